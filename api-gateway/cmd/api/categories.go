@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"time"
+)
+
+// categoryView is the JSON form of a category.
+type categoryView struct {
+	ID        int64     `json:"id"`
+	ParentID  int64     `json:"parent_id,omitempty"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	SortOrder int32     `json:"sort_order"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int32     `json:"version"`
+}
+
+func newCategoryView(category *productServiceProto.Category) categoryView {
+	return categoryView{
+		ID:        category.GetId(),
+		ParentID:  category.GetParentId(),
+		Name:      category.GetName(),
+		Slug:      category.GetSlug(),
+		SortOrder: category.GetSortOrder(),
+		CreatedAt: category.GetCreatedAt().AsTime(),
+		Version:   category.GetVersion(),
+	}
+}
+
+func ValidateCategory(v *validator.Validator, category *productServiceProto.Category) {
+	v.Check(category.Name != "", "name", "must be provided")
+	v.Check(len(category.Name) <= 50, "name", "must not be more than 50 bytes long")
+	v.Check(category.ParentId >= 0, "parent_id", "must not be negative")
+}
+
+// categoryErrorResponse writes the response for a failed category RPC.
+func (app *application) categoryErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	errorStatus, _ := status.FromError(err)
+	switch {
+	case errorStatus.Code() == codes.DeadlineExceeded:
+		app.deadlineExceededResponse(w, r, err)
+	case errorStatus.Code() == codes.Unavailable:
+		app.serviceUnavailableResponse(w, r, err)
+	case errorStatus.Code() == codes.NotFound:
+		app.notFoundResponse(w, r)
+	case errorStatus.Code() == codes.InvalidArgument:
+		app.invalidArgumentResponse(w, r, errorStatus)
+	case errorStatus.Code() == codes.FailedPrecondition:
+		app.failedPreconditionResponse(w, r, errorStatus)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ParentID  int64  `json:"parent_id"`
+		Name      string `json:"name"`
+		Slug      string `json:"slug"`
+		SortOrder int32  `json:"sort_order"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	category := &productServiceProto.Category{
+		ParentId:  input.ParentID,
+		Name:      input.Name,
+		Slug:      input.Slug,
+		SortOrder: input.SortOrder,
+	}
+
+	v := validator.New()
+	if ValidateCategory(v, category); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.AddCategory(ctx, &productServiceProto.AddCategoryRequest{
+		Category: category,
+	})
+	if err != nil {
+		app.categoryErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"category": newCategoryView(response.GetCategory())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.ShowCategory(ctx, &productServiceProto.ShowCategoryRequest{
+		Id: id,
+	})
+	if err != nil {
+		app.categoryErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"category": newCategoryView(response.GetCategory())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listCategoriesHandler returns the category tree flattened depth first, or
+// only the subtree under root_id when it is given.
+func (app *application) listCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	rootID := int64(app.readInt(r.URL.Query(), "root_id", 0))
+
+	v := validator.New()
+	if v.Check(rootID >= 0, "root_id", "must not be negative"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.ListCategories(ctx, &productServiceProto.ListCategoriesRequest{
+		RootId: rootID,
+	})
+	if err != nil {
+		app.categoryErrorResponse(w, r, err)
+		return
+	}
+
+	categories := make([]categoryView, 0, len(response.GetCategories()))
+	for _, category := range response.GetCategories() {
+		categories = append(categories, newCategoryView(category))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"categories": categories}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	current, err := app.productServiceClient.ShowCategory(withPrimaryReads(ctx), &productServiceProto.ShowCategoryRequest{
+		Id: id,
+	})
+	if err != nil {
+		app.categoryErrorResponse(w, r, err)
+		return
+	}
+	category := current.GetCategory()
+
+	var input struct {
+		ParentID  *int64  `json:"parent_id"`
+		Name      *string `json:"name"`
+		Slug      *string `json:"slug"`
+		SortOrder *int32  `json:"sort_order"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// A parent_id of 0 moves the category to the top level.
+	if input.ParentID != nil {
+		category.ParentId = *input.ParentID
+	}
+	if input.Name != nil {
+		category.Name = *input.Name
+	}
+	if input.Slug != nil {
+		category.Slug = *input.Slug
+	}
+	if input.SortOrder != nil {
+		category.SortOrder = *input.SortOrder
+	}
+
+	v := validator.New()
+	if ValidateCategory(v, category); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	response, err := app.productServiceClient.UpdateCategory(ctx, &productServiceProto.UpdateCategoryRequest{
+		Category: category,
+	})
+	if err != nil {
+		app.categoryErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"category": newCategoryView(response.GetCategory())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.DeleteCategory(ctx, &productServiceProto.DeleteCategoryRequest{
+		Id: id,
+	})
+	if err != nil {
+		app.categoryErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": response.GetMessage()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"testing"
+)
+
+func TestTableDrivenValidateCategory(t *testing.T) {
+	var tests = []struct {
+		name     string
+		input    *productServiceProto.Category
+		expected bool
+	}{
+		{
+			"ValidateCategory(noNameCategory) must return false",
+			&productServiceProto.Category{Name: ""},
+			false,
+		},
+		{
+			"ValidateCategory(longNameCategory) must return false",
+			&productServiceProto.Category{Name: "This Category Name Is Far Too Long To Fit In Fifty Bytes"},
+			false,
+		},
+		{
+			"ValidateCategory(badParentCategory) must return false",
+			&productServiceProto.Category{Name: "Fruit", ParentId: -1},
+			false,
+		},
+		{
+			"ValidateCategory(perfectCategory) must return true",
+			&productServiceProto.Category{Name: "Citrus", ParentId: 1},
+			true,
+		},
+	}
+
+	for _, tst := range tests {
+		v := validator.New()
+		t.Run(tst.name, func(t *testing.T) {
+			ValidateCategory(v, tst.input)
+			if result := v.Valid(); result != tst.expected {
+				t.Errorf("%s: got %v", tst.name, result)
+			}
+		})
+	}
+}
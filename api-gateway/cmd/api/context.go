@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// user is the caller identified by the access token on a request. The
+// anonymous user has no ID.
+type user struct {
+	ID   string
+	Role string
+}
+
+// adminRole is the user-service role allowed to moderate reviews.
+const adminRole = "ADMIN"
+
+var anonymousUser = &user{}
+
+func (u *user) IsAnonymous() bool {
+	return u.ID == ""
+}
+
+func (u *user) IsAdmin() bool {
+	return !u.IsAnonymous() && u.Role == adminRole
+}
+
+type contextKey string
+
+const userContextKey = contextKey("user")
+
+func (app *application) contextSetUser(r *http.Request, u *user) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, u)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser returns the user authenticate stored on r, or the anonymous
+// user for requests that did not pass through it.
+func (app *application) contextGetUser(r *http.Request) *user {
+	u, ok := r.Context().Value(userContextKey).(*user)
+	if !ok {
+		return anonymousUser
+	}
+	return u
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"net/http"
 )
 
@@ -59,6 +63,82 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) payloadTooLargeResponse(w http.ResponseWriter, r *http.Request, limit int64) {
+	message := fmt.Sprintf("the request body must not be larger than %d bytes", limit)
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, message)
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
+
+// invalidArgumentResponse reports an InvalidArgument status from an upstream
+// service as a failed validation, using its BadRequest field violations when
+// the service attached any.
+func (app *application) invalidArgumentResponse(w http.ResponseWriter, r *http.Request, st *status.Status) {
+	errors := make(map[string]string)
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.GetFieldViolations() {
+				errors[violation.GetField()] = violation.GetDescription()
+			}
+		}
+	}
+
+	if len(errors) == 0 {
+		app.errorResponse(w, r, http.StatusBadRequest, st.Message())
+		return
+	}
+	app.failedValidationResponse(w, r, errors)
+}
+
+// failedPreconditionResponse reports a request that is valid but conflicts
+// with the current state of the resource, such as deleting a category that
+// still has products.
+func (app *application) failedPreconditionResponse(w http.ResponseWriter, r *http.Request, st *status.Status) {
+	app.errorResponse(w, r, http.StatusConflict, st.Message())
+}
+
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must be signed in to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you are not permitted to change this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// upstreamErrorResponse writes the response for a failed product-service RPC.
+func (app *application) upstreamErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	errorStatus, _ := status.FromError(err)
+	switch {
+	case errorStatus.Code() == codes.DeadlineExceeded:
+		app.deadlineExceededResponse(w, r, err)
+	case errorStatus.Code() == codes.Unavailable:
+		app.serviceUnavailableResponse(w, r, err)
+	case errorStatus.Code() == codes.NotFound:
+		app.notFoundResponse(w, r)
+	case errorStatus.Code() == codes.InvalidArgument:
+		app.invalidArgumentResponse(w, r, errorStatus)
+	case errorStatus.Code() == codes.FailedPrecondition, errorStatus.Code() == codes.AlreadyExists:
+		app.failedPreconditionResponse(w, r, errorStatus)
+	case errorStatus.Code() == codes.Unauthenticated:
+		app.authenticationRequiredResponse(w, r)
+	case errorStatus.Code() == codes.PermissionDenied:
+		app.notPermittedResponse(w, r)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
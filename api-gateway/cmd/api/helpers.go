@@ -1,30 +1,88 @@
 package main
 
 import (
-	"api-gateway/internal/validator"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/money"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
 	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
 	"github.com/julienschmidt/httprouter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type envelope map[string]any
 
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readNamedIDParam(r, "id")
+}
+
+func (app *application) readNamedIDParam(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 	return id, nil
 }
 
+// readTokenHeader carries product-service's read-your-writes token between
+// the gateway and its clients. A write returns it, and a client that sends it
+// back with its next requests reads what it wrote, whichever product-service
+// instance serves them.
+const readTokenHeader = "X-Read-Primary-Until"
+
+type responseHeaderKey struct{}
+
+// withCaller returns ctx carrying what product-service needs to know about
+// the client making r: the user authenticate verified, so that changes are
+// attributed in the audit history and reviews are checked against their
+// author and role, and its read-your-writes token. A token returned by the
+// call is passed on in w's headers by readYourWritesInterceptor.
+func withCaller(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if u, ok := r.Context().Value(userContextKey).(*user); ok && !u.IsAnonymous() {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-user-id", u.ID, "x-user-role", u.Role)
+	}
+	if token := r.Header.Get(readTokenHeader); token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-read-primary-until", token)
+	}
+	return context.WithValue(ctx, responseHeaderKey{}, w.Header())
+}
+
+// withPrimaryReads sends the call's reads to product-service's primary
+// database, for the read half of a read-modify-write that must not start from
+// a lagging replica.
+func withPrimaryReads(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "x-read-primary", "true")
+}
+
+// readYourWritesInterceptor passes the read-your-writes token a
+// product-service call returns on to the client, in the response headers of
+// the request the call was made for.
+func readYourWritesInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	header, ok := ctx.Value(responseHeaderKey{}).(http.Header)
+	if !ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	var md metadata.MD
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&md))...)
+	if tokens := md.Get("x-read-primary-until"); len(tokens) > 0 {
+		header.Set(readTokenHeader, tokens[0])
+	}
+	return err
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, status int, data any, headers http.Header) error {
 	js, err := json.Marshal(data)
 	if err != nil {
@@ -81,12 +139,31 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 func ValidateProduct(v *validator.Validator, product *productServiceProto.Product) {
 	v.Check(product.Name != "", "name", "must be provided")
 	v.Check(len(product.Name) <= 20, "name", "must not be more than 20 bytes long")
-	v.Check(product.Price >= 0, "price", "can not be negative")
+	v.Check(product.PriceMinor >= 0, "price", "can not be negative")
+	ValidateCurrency(v, product.Currency)
 	v.Check(product.Description != "", "description", "must be provided")
-	v.Check(product.Category != "", "category", "must be provided")
+	v.Check(product.CategoryId > 0 || product.Category != "", "category", "must be provided")
 	v.Check(product.Quantity >= 0, "quantity", "can not be negative")
 }
 
+// ValidateCurrency accepts an empty currency, which leaves the choice to
+// product-service.
+func ValidateCurrency(v *validator.Validator, currency string) {
+	if currency == "" {
+		return
+	}
+	_, ok := money.Exponent(currency)
+	v.Check(ok, "currency", "must be a supported ISO 4217 code")
+}
+
+func ValidateFilters(v *validator.Validator, filters *productServiceProto.Filters) {
+	v.Check(filters.Page > 0, "page", "must be greater than zero")
+	v.Check(filters.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	v.Check(filters.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(filters.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.Check(validator.PermittedValue(filters.Sort, filters.SortSafeList...), "sort", "invalid sort value")
+}
+
 func SetStatus(productQuantity int32, p *productServiceProto.Product) {
 	if productQuantity > 0 {
 		p.IsAvailable = true
@@ -110,6 +187,76 @@ func (app *application) readString(qs url.Values, key string, defaultValue strin
 	return s
 }
 
+// readBool returns nil when key is absent, and records a validation error
+// when it is not a boolean.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+	return &b
+}
+
+// readTime accepts RFC 3339 timestamps and plain dates, which are taken as
+// midnight UTC.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *timestamppb.Timestamp {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return timestamppb.New(t)
+		}
+	}
+	v.AddError(key, "must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	return nil
+}
+
+// readIDList reads a comma-separated list of IDs.
+func (app *application) readIDList(qs url.Values, key string, v *validator.Validator) []int64 {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	var ids []int64
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || id < 1 {
+			v.AddError(key, "must be a comma-separated list of positive integers")
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// readPrice reads a decimal amount in currency as minor units.
+func (app *application) readPrice(qs url.Values, key string, currency string, v *validator.Validator) *int64 {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	minor, err := money.Parse(s, currency)
+	if err != nil {
+		if errors.Is(err, money.ErrInvalidAmount) {
+			v.AddError(key, "must be a decimal amount in "+currency)
+		}
+		return nil
+	}
+	v.Check(minor >= 0, key, "must not be negative")
+	return &minor
+}
+
 func (app *application) readInt(qs url.Values, key string, defaultValue int) int {
 	s := qs.Get(key)
 	if s == "" {
@@ -1,9 +1,17 @@
 package main
 
 import (
-	"api-gateway/internal/validator"
+	"context"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
 	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestValidateProduct(t *testing.T) {
@@ -11,7 +19,8 @@ func TestValidateProduct(t *testing.T) {
 
 	noNameProduct := &productServiceProto.Product{
 		Name:        "",
-		Price:       100.0,
+		PriceMinor:  10000,
+		Currency:    "KZT",
 		Description: "SomeDescription",
 		Category:    "Category",
 		Quantity:    5,
@@ -29,7 +38,8 @@ func TestValidateProduct(t *testing.T) {
 func TestTableDrivenValidateProduct(t *testing.T) {
 	noNameProduct := &productServiceProto.Product{
 		Name:        "",
-		Price:       100.0,
+		PriceMinor:  10000,
+		Currency:    "KZT",
 		Description: "SomeDescription",
 		Category:    "Category",
 		Quantity:    5,
@@ -37,7 +47,8 @@ func TestTableDrivenValidateProduct(t *testing.T) {
 
 	longNameProduct := &productServiceProto.Product{
 		Name:        "This A Very Long Name That Has More Than Twenty Bytes In It",
-		Price:       100.0,
+		PriceMinor:  10000,
+		Currency:    "KZT",
 		Description: "SomeDescription",
 		Category:    "Category",
 		Quantity:    5,
@@ -45,7 +56,8 @@ func TestTableDrivenValidateProduct(t *testing.T) {
 
 	badPriceProduct := &productServiceProto.Product{
 		Name:        "GoodName",
-		Price:       -100.0,
+		PriceMinor:  -10000,
+		Currency:    "KZT",
 		Description: "SomeDescription",
 		Category:    "Category",
 		Quantity:    5,
@@ -53,7 +65,8 @@ func TestTableDrivenValidateProduct(t *testing.T) {
 
 	emptyDescriptionProduct := &productServiceProto.Product{
 		Name:        "GoodName",
-		Price:       100.0,
+		PriceMinor:  10000,
+		Currency:    "KZT",
 		Description: "",
 		Category:    "Category",
 		Quantity:    5,
@@ -61,7 +74,8 @@ func TestTableDrivenValidateProduct(t *testing.T) {
 
 	emptyCategoryProduct := &productServiceProto.Product{
 		Name:        "GoodName",
-		Price:       100.0,
+		PriceMinor:  10000,
+		Currency:    "KZT",
 		Description: "Descrpition",
 		Category:    "",
 		Quantity:    5,
@@ -69,15 +83,26 @@ func TestTableDrivenValidateProduct(t *testing.T) {
 
 	badQuantityProduct := &productServiceProto.Product{
 		Name:        "GoodName",
-		Price:       100.0,
+		PriceMinor:  10000,
+		Currency:    "KZT",
 		Description: "",
 		Category:    "Category",
 		Quantity:    -1,
 	}
 
+	badCurrencyProduct := &productServiceProto.Product{
+		Name:        "GoodName",
+		PriceMinor:  10000,
+		Currency:    "XYZ",
+		Description: "SomeDescription",
+		Category:    "Category",
+		Quantity:    5,
+	}
+
 	perfectProduct := &productServiceProto.Product{
 		Name:        "GoodName",
-		Price:       100.0,
+		PriceMinor:  10000,
+		Currency:    "KZT",
 		Description: "SomeDescription",
 		Category:    "Category",
 		Quantity:    5,
@@ -118,6 +143,11 @@ func TestTableDrivenValidateProduct(t *testing.T) {
 			badQuantityProduct,
 			false,
 		},
+		{
+			"ValidateProduct(badCurrencyProduct) must return false",
+			badCurrencyProduct,
+			false,
+		},
 		{
 			"ValidateProduct(perfectProduct) must return true",
 			perfectProduct,
@@ -140,7 +170,8 @@ func TestTableDrivenValidateProduct(t *testing.T) {
 func TestSetCurrentStatus(t *testing.T) {
 	someProduct := &productServiceProto.Product{
 		Name:        "Hello",
-		Price:       100.0,
+		PriceMinor:  10000,
+		Currency:    "KZT",
 		Description: "SomeDescription",
 		Category:    "Category",
 		Quantity:    5,
@@ -158,7 +189,8 @@ func TestSetCurrentStatus(t *testing.T) {
 func TestSetNewStatus(t *testing.T) {
 	someProduct := &productServiceProto.Product{
 		Name:        "Product",
-		Price:       100.0,
+		PriceMinor:  10000,
+		Currency:    "KZT",
 		Description: "SomeDescription",
 		Category:    "Category",
 		Quantity:    5,
@@ -172,3 +204,146 @@ func TestSetNewStatus(t *testing.T) {
 		t.Errorf("SetStatus(noNameProduct.Quantity) returned unexpected value: got %v, expected %s", expected, "true")
 	}
 }
+
+func TestTableDrivenValidateFilters(t *testing.T) {
+	safeList := []string{"id", "-id", "name", "-name"}
+
+	var tests = []struct {
+		name     string
+		input    *productServiceProto.Filters
+		expected bool
+	}{
+		{
+			"ValidateFilters(zeroPage) must return false",
+			&productServiceProto.Filters{Page: 0, PageSize: 20, Sort: "id", SortSafeList: safeList},
+			false,
+		},
+		{
+			"ValidateFilters(hugePageSize) must return false",
+			&productServiceProto.Filters{Page: 1, PageSize: 101, Sort: "id", SortSafeList: safeList},
+			false,
+		},
+		{
+			"ValidateFilters(unsafeSort) must return false",
+			&productServiceProto.Filters{Page: 1, PageSize: 20, Sort: "quantity", SortSafeList: safeList},
+			false,
+		},
+		{
+			"ValidateFilters(perfectFilters) must return true",
+			&productServiceProto.Filters{Page: 1, PageSize: 20, Sort: "-name", SortSafeList: safeList},
+			true,
+		},
+	}
+
+	for _, tst := range tests {
+		v := validator.New()
+		t.Run(tst.name, func(t *testing.T) {
+			ValidateFilters(v, tst.input)
+			result := v.Valid()
+			if result != tst.expected {
+				t.Errorf("Expected %v got %v", tst.expected, result)
+			}
+		})
+	}
+}
+
+func TestReadListFilters(t *testing.T) {
+	app := &application{}
+	qs := url.Values{
+		"is_available":   {"true"},
+		"created_after":  {"2024-01-02"},
+		"created_before": {"2024-02-01T10:00:00Z"},
+		"category_ids":   {"3, 7"},
+		"price_min":      {"10.5"},
+	}
+
+	v := validator.New()
+	available := app.readBool(qs, "is_available", v)
+	after := app.readTime(qs, "created_after", v)
+	before := app.readTime(qs, "created_before", v)
+	ids := app.readIDList(qs, "category_ids", v)
+	priceMin := app.readPrice(qs, "price_min", "KZT", v)
+	priceMax := app.readPrice(qs, "price_max", "KZT", v)
+
+	if !v.Valid() {
+		t.Fatalf("unexpected errors: %v", v.Errors)
+	}
+	if available == nil || !*available {
+		t.Errorf("is_available = %v, expected true", available)
+	}
+	if got := after.AsTime(); !got.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("created_after = %v", got)
+	}
+	if got := before.AsTime(); !got.Equal(time.Date(2024, 2, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("created_before = %v", got)
+	}
+	if !reflect.DeepEqual(ids, []int64{3, 7}) {
+		t.Errorf("category_ids = %v, expected [3 7]", ids)
+	}
+	if priceMin == nil || *priceMin != 1050 {
+		t.Errorf("price_min = %v, expected 1050", priceMin)
+	}
+	if priceMax != nil {
+		t.Errorf("price_max = %v, expected nil", *priceMax)
+	}
+
+	invalid := url.Values{
+		"is_available":  {"maybe"},
+		"created_after": {"yesterday"},
+		"category_ids":  {"1,x"},
+		"price_min":     {"10.005"},
+		"price_max":     {"-1"},
+	}
+	v = validator.New()
+	app.readBool(invalid, "is_available", v)
+	app.readTime(invalid, "created_after", v)
+	app.readIDList(invalid, "category_ids", v)
+	app.readPrice(invalid, "price_min", "KZT", v)
+	app.readPrice(invalid, "price_max", "KZT", v)
+	for _, key := range []string{"is_available", "created_after", "category_ids", "price_min", "price_max"} {
+		if _, ok := v.Errors[key]; !ok {
+			t.Errorf("expected an error for %s", key)
+		}
+	}
+}
+
+func TestReadYourWritesInterceptor(t *testing.T) {
+	// invoke stands in for a product-service write: it records the outgoing
+	// metadata and returns a token in the response headers.
+	var sent metadata.MD
+	invoke := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		sent, _ = metadata.FromOutgoingContext(ctx)
+		for _, opt := range opts {
+			if header, ok := opt.(grpc.HeaderCallOption); ok {
+				*header.HeaderAddr = metadata.Pairs("x-read-primary-until", "1700000000000")
+			}
+		}
+		return nil
+	}
+
+	r := httptest.NewRequest(http.MethodPatch, "/v1/products/1", nil)
+	r = testingApplication.contextSetUser(r, &user{ID: "7", Role: "USER"})
+	r.Header.Set(readTokenHeader, "1600000000000")
+	w := httptest.NewRecorder()
+
+	ctx := withPrimaryReads(withCaller(context.Background(), w, r))
+	if err := readYourWritesInterceptor(ctx, "/ProductService/UpdateProduct", nil, nil, nil, invoke); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := sent.Get("x-user-id"); len(got) != 1 || got[0] != "7" {
+		t.Errorf("forwarded user %v, expected 7", got)
+	}
+	if got := sent.Get("x-user-role"); len(got) != 1 || got[0] != "USER" {
+		t.Errorf("forwarded role %v, expected USER", got)
+	}
+	if got := sent.Get("x-read-primary-until"); len(got) != 1 || got[0] != "1600000000000" {
+		t.Errorf("forwarded token %v, expected the client's", got)
+	}
+	if got := sent.Get("x-read-primary"); len(got) != 1 || got[0] != "true" {
+		t.Errorf("forwarded x-read-primary %v, expected true", got)
+	}
+	if got := w.Header().Get(readTokenHeader); got != "1700000000000" {
+		t.Errorf("returned token %q, expected the one product-service returned", got)
+	}
+}
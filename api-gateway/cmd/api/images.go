@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/grpc"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// imageContentTypes are the sniffed content types accepted for uploads.
+var imageContentTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+var (
+	errImageTooLarge   = errors.New("image too large")
+	errUnsupportedType = errors.New("unsupported image type")
+)
+
+type imageView struct {
+	ID          int64             `json:"id"`
+	URL         string            `json:"url"`
+	Thumbnails  map[string]string `json:"thumbnails"`
+	ContentType string            `json:"content_type"`
+	Width       int32             `json:"width"`
+	Height      int32             `json:"height"`
+	Position    int32             `json:"position"`
+	IsPrimary   bool              `json:"is_primary"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+func newImageView(image *productServiceProto.ProductImage) imageView {
+	return imageView{
+		ID:          image.GetId(),
+		URL:         image.GetUrl(),
+		Thumbnails:  image.GetThumbnails(),
+		ContentType: image.GetContentType(),
+		Width:       image.GetWidth(),
+		Height:      image.GetHeight(),
+		Position:    image.GetPosition(),
+		IsPrimary:   image.GetIsPrimary(),
+		CreatedAt:   image.GetCreatedAt().AsTime(),
+	}
+}
+
+func newImageViews(images []*productServiceProto.ProductImage) []imageView {
+	views := make([]imageView, 0, len(images))
+	for _, image := range images {
+		views = append(views, newImageView(image))
+	}
+	return views
+}
+
+// imageUpload is the content of a multipart upload: the file in the "image"
+// part and the optional "primary" field.
+type imageUpload struct {
+	Data        []byte
+	ContentType string
+	Primary     bool
+}
+
+// readImageUpload streams a multipart/form-data body, stopping as soon as the
+// image exceeds maxSize so that oversized uploads are never held in memory.
+// The content type is sniffed from the data rather than trusted from the
+// client.
+func readImageUpload(w http.ResponseWriter, r *http.Request, maxSize int64) (*imageUpload, error) {
+	// The body limit leaves room for multipart headers and the other fields.
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+64<<10)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.New("body must be multipart/form-data")
+	}
+
+	var upload imageUpload
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				return nil, errImageTooLarge
+			}
+			return nil, fmt.Errorf("body contains badly-formed multipart data: %w", err)
+		}
+
+		switch part.FormName() {
+		case "image":
+			upload.Data, err = io.ReadAll(io.LimitReader(part, maxSize+1))
+			if err != nil {
+				var maxBytesError *http.MaxBytesError
+				if errors.As(err, &maxBytesError) {
+					return nil, errImageTooLarge
+				}
+				return nil, err
+			}
+			if int64(len(upload.Data)) > maxSize {
+				return nil, errImageTooLarge
+			}
+		case "primary":
+			value, err := io.ReadAll(io.LimitReader(part, 16))
+			if err != nil {
+				return nil, err
+			}
+			upload.Primary, err = strconv.ParseBool(string(value))
+			if err != nil {
+				return nil, errors.New("primary must be true or false")
+			}
+		}
+		part.Close()
+	}
+
+	if len(upload.Data) > 0 {
+		upload.ContentType = http.DetectContentType(upload.Data)
+		if !validator.PermittedValue(upload.ContentType, imageContentTypes...) {
+			return nil, errUnsupportedType
+		}
+	}
+	return &upload, nil
+}
+
+func (app *application) uploadProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	cfg := app.config.Load()
+	upload, err := readImageUpload(w, r, cfg.Uploads.MaxImageSize)
+	if err != nil {
+		switch {
+		case errors.Is(err, errImageTooLarge):
+			app.payloadTooLargeResponse(w, r, cfg.Uploads.MaxImageSize)
+		case errors.Is(err, errUnsupportedType):
+			app.unsupportedMediaTypeResponse(w, r, "the image must be a JPEG, PNG or WebP file")
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+	if v.Check(len(upload.Data) > 0, "image", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Thumbnailing happens upstream, so uploads get more time than the usual
+	// upstream call.
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), 3*cfg.Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.UploadProductImage(ctx, &productServiceProto.UploadProductImageRequest{
+		ProductId: id,
+		Data:      upload.Data,
+		Primary:   upload.Primary,
+	}, grpc.MaxCallSendMsgSize(int(cfg.Uploads.MaxImageSize)+1<<20))
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"image": newImageView(response.GetImage())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	imageID, err := app.readNamedIDParam(r, "image_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Position *int32 `json:"position"`
+		Primary  *bool  `json:"primary"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Position != nil || input.Primary != nil, "image", "must change position or primary")
+	if input.Position != nil {
+		v.Check(*input.Position > 0, "position", "must be greater than zero")
+	}
+	if input.Primary != nil {
+		v.Check(*input.Primary, "primary", "can only be set to true; make another image primary instead")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	request := &productServiceProto.UpdateProductImageRequest{
+		ProductId: id,
+		ImageId:   imageID,
+	}
+	if input.Position != nil {
+		request.Position = *input.Position
+	}
+	if input.Primary != nil {
+		request.Primary = *input.Primary
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.UpdateProductImage(ctx, request)
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"images": newImageViews(response.GetImages())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	imageID, err := app.readNamedIDParam(r, "image_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.DeleteProductImage(ctx, &productServiceProto.DeleteProductImageRequest{
+		ProductId: id,
+		ImageId:   imageID,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": response.GetMessage()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func multipartBody(t *testing.T, fields map[string]string, file []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if file != nil {
+		part, err := writer.CreateFormFile("image", "upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(file)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body, writer.FormDataContentType()
+}
+
+func TestReadImageUpload(t *testing.T) {
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name        string
+		fields      map[string]string
+		file        []byte
+		maxSize     int64
+		expectedErr error
+		primary     bool
+	}{
+		{"PNG upload is accepted", map[string]string{"primary": "true"}, pngData.Bytes(), 1 << 20, nil, true},
+		{"Oversized upload is rejected", nil, pngData.Bytes(), 16, errImageTooLarge, false},
+		{"Text upload is rejected", nil, []byte("just some text"), 1 << 20, errUnsupportedType, false},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, tst.fields, tst.file)
+			r := httptest.NewRequest(http.MethodPost, "/v1/products/1/images", body)
+			r.Header.Set("Content-Type", contentType)
+
+			upload, err := readImageUpload(httptest.NewRecorder(), r, tst.maxSize)
+			if !errors.Is(err, tst.expectedErr) {
+				t.Fatalf("%s: got error %v, expected %v", tst.name, err, tst.expectedErr)
+			}
+			if err != nil {
+				return
+			}
+			if upload.ContentType != "image/png" || upload.Primary != tst.primary {
+				t.Errorf("%s: got %s primary=%v", tst.name, upload.ContentType, upload.Primary)
+			}
+		})
+	}
+}
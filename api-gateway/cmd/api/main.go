@@ -3,107 +3,109 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/config"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/discovery"
 	"github.com/Skaifai/gophers-microservice/api-gateway/internal/jsonlog"
 	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
-	"github.com/joho/godotenv"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"log"
 	"os"
-	"strconv"
+	"reflect"
 	"sync"
+	"sync/atomic"
 )
 
 const version = "1.0"
 
-type config struct {
-	port    int
-	env     string
-	limiter struct {
-		enabled bool
-		rps     float64
-		burst   int
-	}
-	productService struct {
-		port int
-	}
-	rmq struct {
-		port     int
-		username string
-		password string
-	}
-}
-
 type application struct {
-	config               config
+	// config is swapped as a whole on reload, so handlers should Load() it
+	// once per request and read from that snapshot.
+	config               atomic.Pointer[config.Config]
+	configPath           string
 	logger               *jsonlog.Logger
 	wg                   sync.WaitGroup
 	productServiceClient productServiceProto.ProductServiceClient
 }
 
 var productServiceConnection *grpc.ClientConn
-var rmqDSN string
-
-func getEnvVarString(key string) string {
-	err := godotenv.Load(".env")
-	failOnError(err, "Could not load .env file.")
-	return os.Getenv(key)
-}
 
 func main() {
-	var cfg config
-	port := getEnvVarString("PORT")
-	if port == "" {
-		fmt.Println("Empty")
-		port = "7000"
-	}
-	portInt, err := strconv.Atoi(port)
-	failOnError(err, "Could not convert port sting to integer")
-	flag.IntVar(&cfg.port, "port", portInt, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
-
-	limiterRPS, err := strconv.ParseFloat(getEnvVarString("LIMITER_RPS"), 64)
-	failOnError(err, "Could not parse LIMITER_RPS string into float64")
-	limiterBurst, err := strconv.Atoi(getEnvVarString("LIMITER_BURST"))
-	failOnError(err, "Could not parse LIMITER_BURST string into float64")
-	limiterEnabled, err := strconv.ParseBool(getEnvVarString("LIMITER_ENABLED"))
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", limiterRPS, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", limiterBurst, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", limiterEnabled, "Enable rate limiter")
-
-	productServicePort, err := strconv.Atoi(getEnvVarString("PRODUCT_SERVICE_PORT"))
-	flag.IntVar(&cfg.productService.port, "product-service-port", productServicePort, "Product service port")
-
-	rabbitMQPort, err := strconv.Atoi(getEnvVarString("RMQ_PORT"))
-	failOnError(err, "Could not parse RMQ_PORT to int")
-	flag.IntVar(&cfg.rmq.port, "rabbitMQPort", rabbitMQPort, "Message broker port")
-	flag.StringVar(&cfg.rmq.username, "rmq-username", getEnvVarString("RMQ_USERNAME"), "Message broker username")
-	flag.StringVar(&cfg.rmq.password, "rmq-password", getEnvVarString("RMQ_PASSWORD"), "Message broker password")
-
+	var configPath string
+	flag.StringVar(&configPath, "config", "config.yaml", "Path to the gateway configuration file")
 	flag.Parse()
 
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatalf("could not load configuration: %v", err)
+	}
+
 	// RabbitMQ
-	rmqDSN = fmt.Sprintf("amqp://%s:%s@localhost:%d/", cfg.rmq.username, cfg.rmq.password, cfg.rmq.port)
-	conn, err := amqp.Dial(rmqDSN)
+	dsn := rmqDSN(cfg)
+	conn, err := amqp.Dial(dsn)
 	failOnError(err, "Could not set up a connection to the message broker")
 	defer conn.Close()
 
 	// Logger
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo, rmqDSN)
+	logLevel, err := jsonlog.ParseLevel(cfg.LogLevel)
+	failOnError(err, "Could not parse log level")
+	logger := jsonlog.New(os.Stdout, logLevel, dsn)
 
 	// Product service
-	productServiceConnection, err = grpc.Dial(fmt.Sprintf(":%d", cfg.productService.port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	productServiceConnection, err = discovery.Dial("product-service", cfg.Upstreams.ProductService,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(readYourWritesInterceptor),
+	)
 	failOnError(err, "Could not set up a connection to the Product service")
 	defer productServiceConnection.Close()
 
 	app := &application{
-		config:               cfg,
+		configPath:           configPath,
 		logger:               logger,
 		productServiceClient: productServiceProto.NewProductServiceClient(productServiceConnection),
 	}
+	app.config.Store(cfg)
 
 	err = app.serve()
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 }
+
+func rmqDSN(cfg *config.Config) string {
+	return fmt.Sprintf("amqp://%s:%s@%s/", cfg.RMQ.Username, cfg.RMQ.Password, cfg.RMQ.Addr)
+}
+
+// reloadConfig re-reads the configuration file and applies the settings that
+// can change at runtime: the rate limiter and the upstream timeout. Everything
+// else needs a restart, so changes to it are reported and ignored.
+func (app *application) reloadConfig() {
+	fresh, err := config.Load(app.configPath)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"action": "reload configuration",
+		})
+		return
+	}
+
+	current := app.config.Load()
+	next := *current
+	next.Limiter = fresh.Limiter
+	next.Timeouts.Upstream = fresh.Timeouts.Upstream
+
+	if fresh.ListenAddr != current.ListenAddr || !reflect.DeepEqual(fresh.Upstreams, current.Upstreams) ||
+		fresh.RMQ != current.RMQ || fresh.LogLevel != current.LogLevel || fresh.Env != current.Env ||
+		fresh.Timeouts.Read != current.Timeouts.Read || fresh.Timeouts.Write != current.Timeouts.Write ||
+		fresh.Timeouts.Idle != current.Timeouts.Idle || fresh.Timeouts.Shutdown != current.Timeouts.Shutdown {
+		app.logger.PrintInfo("some changed settings require a restart and were not applied", nil)
+	}
+
+	app.config.Store(&next)
+	app.logger.PrintInfo("reloaded configuration", map[string]string{
+		"limiter_enabled":  fmt.Sprint(next.Limiter.Enabled),
+		"limiter_rps":      fmt.Sprint(next.Limiter.RPS),
+		"limiter_burst":    fmt.Sprint(next.Limiter.Burst),
+		"upstream_timeout": next.Timeouts.Upstream.String(),
+	})
+}
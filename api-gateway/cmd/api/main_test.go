@@ -1,111 +1,122 @@
 package main
 
 import (
-	"api-gateway/internal/jsonlog"
-	"flag"
-	"fmt"
+	"context"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/config"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/jsonlog"
 	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
 	"github.com/joho/godotenv"
-	amqp "github.com/rabbitmq/amqp091-go"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"io"
 	"os"
-	"strconv"
+	"path/filepath"
 	"testing"
 )
 
 var testingApplication *application
 
+// TestMain builds the application from the default configuration with a fake
+// product-service client and a logger that sends nothing, so the tests need
+// neither a broker nor a running product-service.
 func TestMain(m *testing.M) {
-	var cfg = SetupConfig()
+	cfg := config.Default()
+	cfg.Limiter.Enabled = false
+	cfg.Auth.AccessSecret = testAccessSecret
 
-	// RabbitMQ
-	rmqDSN = fmt.Sprintf("amqp://%s:%s@localhost:%d/", cfg.rmq.username, cfg.rmq.password, cfg.rmq.port)
-	conn, err := amqp.Dial(rmqDSN)
-	failOnError(err, "Could not set up a connection to the message broker")
-	defer conn.Close()
+	logger := jsonlog.New(io.Discard, jsonlog.LevelOff, "")
 
-	// Logger
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo, rmqDSN)
+	testingApplication = SetupApplication(cfg, logger, &fakeProductServiceClient{})
 
-	// Product service
-	productServiceConnection, err = grpc.Dial(fmt.Sprintf(":%d", cfg.productService.port), grpc.WithTransportCredentials(insecure.NewCredentials()))
-	failOnError(err, "Could not set up a connection to the Product service")
-	defer productServiceConnection.Close()
-	productServiceClient := productServiceProto.NewProductServiceClient(productServiceConnection)
-
-	testingApplication = SetupApplication(cfg, logger, productServiceClient)
-
-	exitVal := m.Run()
-
-	os.Exit(exitVal)
+	os.Exit(m.Run())
 }
 
-func SetupApplication(cfg config, logger *jsonlog.Logger, productServiceClient productServiceProto.ProductServiceClient) *application {
+func SetupApplication(cfg *config.Config, logger *jsonlog.Logger, productServiceClient productServiceProto.ProductServiceClient) *application {
 	app := &application{
-		config:               cfg,
 		logger:               logger,
 		productServiceClient: productServiceClient,
 	}
+	app.config.Store(cfg)
 
 	return app
 }
 
-func SetupConfig() config {
-	var cfg config
-	port := getEnvVarStringForTest("PORT")
-	if port == "" {
-		fmt.Println("Empty")
-		port = "7000"
-	}
-	portInt, err := strconv.Atoi(port)
-	failOnError(err, "Could not convert port sting to integer")
-	flag.IntVar(&cfg.port, "port", portInt, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
-
-	limiterRPS, err := strconv.ParseFloat(getEnvVarStringForTest("LIMITER_RPS"), 64)
-	failOnError(err, "Could not parse LIMITER_RPS string into float64")
-	limiterBurst, err := strconv.Atoi(getEnvVarStringForTest("LIMITER_BURST"))
-	failOnError(err, "Could not parse LIMITER_BURST string into float64")
-	limiterEnabled, err := strconv.ParseBool(getEnvVarStringForTest("LIMITER_ENABLED"))
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", limiterRPS, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", limiterBurst, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", limiterEnabled, "Enable rate limiter")
-
-	productServicePort, err := strconv.Atoi(getEnvVarStringForTest("PRODUCT_SERVICE_PORT"))
-	flag.IntVar(&cfg.productService.port, "product-service-port", productServicePort, "Product service port")
-
-	rabbitMQPort, err := strconv.Atoi(getEnvVarStringForTest("RMQ_PORT"))
-	failOnError(err, "Could not parse RMQ_PORT to int")
-	flag.IntVar(&cfg.rmq.port, "rabbitMQPort", rabbitMQPort, "Message broker port")
-	flag.StringVar(&cfg.rmq.username, "rmq-username", getEnvVarStringForTest("RMQ_USERNAME"), "Message broker username")
-	flag.StringVar(&cfg.rmq.password, "rmq-password", getEnvVarStringForTest("RMQ_PASSWORD"), "Message broker password")
-
-	return cfg
+// testAccessSecret signs the access tokens handler tests send.
+const testAccessSecret = "test-secret"
+
+// fakeProductServiceClient answers the calls the handler tests make. Calling
+// any other method panics on the nil embedded client.
+type fakeProductServiceClient struct {
+	productServiceProto.ProductServiceClient
+}
+
+func (c *fakeProductServiceClient) ListProducts(ctx context.Context, in *productServiceProto.ListProductsRequest, opts ...grpc.CallOption) (*productServiceProto.ListProductsResponse, error) {
+	return &productServiceProto.ListProductsResponse{
+		Metadata: &productServiceProto.Metadata{},
+		Products: []*productServiceProto.Product{
+			{Id: 1, Name: "Football", PriceMinor: 400000, Currency: "KZT", CategoryId: 1, Category: "Sports"},
+		},
+	}, nil
+}
+
+func (c *fakeProductServiceClient) AddProduct(ctx context.Context, in *productServiceProto.AddProductRequest, opts ...grpc.CallOption) (*productServiceProto.AddProductResponse, error) {
+	product := in.GetProduct()
+	product.Id = 1
+	return &productServiceProto.AddProductResponse{
+		Product: product,
+	}, nil
 }
 
-//var testingApplication = func() *application {
-//	var cfg = SetupConfig()
-//
-//	// RabbitMQ
-//	rmqDSN = fmt.Sprintf("amqp://%s:%s@localhost:%d/", cfg.rmq.username, cfg.rmq.password, cfg.rmq.port)
-//	conn, err := amqp.Dial(rmqDSN)
-//	failOnError(err, "Could not set up a connection to the message broker")
-//	defer conn.Close()
-//
-//	return SetupApplication(cfg, jsonlog.New(os.Stdout, jsonlog.LevelInfo, rmqDSN))
-//}()
-
-func getEnvVarStringForTest(key string) string {
-	err := godotenv.Load("..\\..\\.env")
+func (c *fakeProductServiceClient) ShowProduct(ctx context.Context, in *productServiceProto.ShowProductRequest, opts ...grpc.CallOption) (*productServiceProto.ShowProductResponse, error) {
+	return &productServiceProto.ShowProductResponse{
+		Product: &productServiceProto.Product{
+			Id: in.GetId(), Name: "Football", PriceMinor: 400000, Currency: "KZT", Description: "Size 5 ball", CategoryId: 1, Category: "Sports", Quantity: 5,
+			Options:  []*productServiceProto.ProductOption{{Name: "size", Values: []string{"S", "M"}}},
+			Variants: []*productServiceProto.ProductVariant{{Id: 1, ProductId: in.GetId(), Sku: "FB-M", Options: map[string]string{"size": "M"}, Quantity: 2}},
+		},
+	}, nil
+}
+
+func (c *fakeProductServiceClient) UpdateProduct(ctx context.Context, in *productServiceProto.UpdateProductRequest, opts ...grpc.CallOption) (*productServiceProto.UpdateProductResponse, error) {
+	return &productServiceProto.UpdateProductResponse{Product: in.GetProduct()}, nil
+}
+
+func (c *fakeProductServiceClient) UpdateProductVariant(ctx context.Context, in *productServiceProto.UpdateProductVariantRequest, opts ...grpc.CallOption) (*productServiceProto.UpdateProductVariantResponse, error) {
+	return &productServiceProto.UpdateProductVariantResponse{Variant: in.GetVariant()}, nil
+}
+
+func (c *fakeProductServiceClient) AdjustStock(ctx context.Context, in *productServiceProto.AdjustStockRequest, opts ...grpc.CallOption) (*productServiceProto.AdjustStockResponse, error) {
+	return &productServiceProto.AdjustStockResponse{
+		Movement: &productServiceProto.StockMovement{Id: 1, ProductId: in.GetId(), VariantId: in.GetVariantId(), Delta: in.GetDelta(), Reason: in.GetReason(), Balance: 5 + in.GetDelta()},
+	}, nil
+}
+
+func getEnvVarStringForTest(path, key string) string {
+	env, err := godotenv.Read(path)
 	failOnError(err, "Could not load .env file.")
-	return os.Getenv(key)
+	return env[key]
 }
 
 func TestGetEnvVarString(t *testing.T) {
-	result := getEnvVarStringForTest("PORT")
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("PORT=7001\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	result := getEnvVarStringForTest(path, "PORT")
 
 	if result != "7001" {
 		t.Errorf("getEnvVarStringForTest() returned unexpected value: got %v, expected %s", result, "7001")
 	}
 }
+
+func (c *fakeProductServiceClient) ModerateReview(ctx context.Context, in *productServiceProto.ModerateReviewRequest, opts ...grpc.CallOption) (*productServiceProto.ModerateReviewResponse, error) {
+	return &productServiceProto.ModerateReviewResponse{
+		Review: &productServiceProto.Review{Id: in.GetReviewId(), ProductId: in.GetProductId(), Rating: 5, Status: in.GetStatus()},
+	}, nil
+}
+
+func (c *fakeProductServiceClient) RestoreProduct(ctx context.Context, in *productServiceProto.RestoreProductRequest, opts ...grpc.CallOption) (*productServiceProto.RestoreProductResponse, error) {
+	return &productServiceProto.RestoreProductResponse{
+		Product: &productServiceProto.Product{Id: in.GetId(), Name: "Football", PriceMinor: 400000, Currency: "KZT", CategoryId: 1, Category: "Sports"},
+	}, nil
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/time/rate" // New import
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -66,6 +69,14 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		}
 	}()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the limiter settings on every request so that a configuration
+		// reload takes effect without restarting the server.
+		cfg := app.config.Load().Limiter
+		if !cfg.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		ip, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
@@ -74,7 +85,14 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		mu.Lock()
 		if _, found := clients[ip]; !found {
 			// Create and add a new client struct to the map if it doesn't already exist.
-			clients[ip] = &client{limiter: rate.NewLimiter(2, 4)}
+			clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(cfg.RPS), cfg.Burst)}
+		}
+		// Bring limiters created under a previous configuration up to date.
+		if clients[ip].limiter.Limit() != rate.Limit(cfg.RPS) {
+			clients[ip].limiter.SetLimit(rate.Limit(cfg.RPS))
+		}
+		if clients[ip].limiter.Burst() != cfg.Burst {
+			clients[ip].limiter.SetBurst(cfg.Burst)
 		}
 		// Update the last seen time for the client.
 		clients[ip].lastSeen = time.Now()
@@ -87,3 +105,83 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// accessClaims are the claims of a user-service access token.
+type accessClaims struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// authenticate identifies the caller from the bearer access token issued by
+// user-service. Requests without a token are anonymous; requests with a token
+// that does not verify are refused, rather than served as anonymous, so that
+// a client notices its token has expired.
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		authorizationHeader := r.Header.Get("Authorization")
+		if authorizationHeader == "" {
+			next.ServeHTTP(w, app.contextSetUser(r, anonymousUser))
+			return
+		}
+
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		claims, err := app.parseAccessToken(headerParts[1])
+		if err != nil {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, app.contextSetUser(r, &user{ID: claims.UserID, Role: claims.Role}))
+	})
+}
+
+func (app *application) parseAccessToken(token string) (*accessClaims, error) {
+	secret := app.config.Load().Auth.AccessSecret
+	if secret == "" {
+		return nil, errors.New("no access token secret is configured")
+	}
+
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	if claims.UserID == "" {
+		return nil, errors.New("access token has no user")
+	}
+	return &claims, nil
+}
+
+// requireAdmin only lets admins through to next.
+func (app *application) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.checkAdmin(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// checkAdmin reports whether the caller is an admin, writing the error
+// response when they are not.
+func (app *application) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	u := app.contextGetUser(r)
+	if u.IsAnonymous() {
+		app.authenticationRequiredResponse(w, r)
+		return false
+	}
+	if !u.IsAdmin() {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signAccessToken returns an access token like those user-service issues.
+func signAccessToken(t *testing.T, secret, userID, role string, expiresAt time.Time) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &accessClaims{
+		UserID:           userID,
+		Role:             role,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(expiresAt)},
+	})
+	signed, err := token.SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestAuthenticate(t *testing.T) {
+	var seen *user
+	handler := testingApplication.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = testingApplication.contextGetUser(r)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		expected      int
+		user          user
+	}{
+		{"no token", "", http.StatusOK, user{}},
+		{"valid token", "Bearer " + signAccessToken(t, testAccessSecret, "7", "USER", time.Now().Add(time.Hour)), http.StatusOK, user{ID: "7", Role: "USER"}},
+		{"expired token", "Bearer " + signAccessToken(t, testAccessSecret, "7", "USER", time.Now().Add(-time.Hour)), http.StatusUnauthorized, user{}},
+		{"wrong secret", "Bearer " + signAccessToken(t, "other", "7", "ADMIN", time.Now().Add(time.Hour)), http.StatusUnauthorized, user{}},
+		{"not bearer", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, user{}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			seen = nil
+			r := httptest.NewRequest(http.MethodGet, "/v1/products", nil)
+			// A client cannot name itself by header any more.
+			r.Header.Set("X-User-Id", "1")
+			if tst.authorization != "" {
+				r.Header.Set("Authorization", tst.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tst.expected {
+				t.Fatalf("got %d, expected %d", w.Code, tst.expected)
+			}
+			if tst.expected == http.StatusOK && *seen != tst.user {
+				t.Errorf("user is %+v, expected %+v", *seen, tst.user)
+			}
+		})
+	}
+}
+
+func TestAdminOnlyRequests(t *testing.T) {
+	server := httptest.NewServer(testingApplication.routes())
+	defer server.Close()
+
+	requests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"moderation", http.MethodPost, "/v1/products/1/reviews/2/moderation", `{"status": "approved"}`},
+		{"restore", http.MethodPost, "/v1/products/1/restore", ""},
+		{"show deleted", http.MethodGet, "/v1/products/1?include_deleted=true", ""},
+		{"list deleted", http.MethodGet, "/v1/products?include_deleted=true", ""},
+	}
+	roles := []struct {
+		role     string
+		expected int
+	}{
+		{"", http.StatusUnauthorized},
+		{"USER", http.StatusForbidden},
+		{"ADMIN", http.StatusOK},
+	}
+
+	for _, rq := range requests {
+		for _, tst := range roles {
+			t.Run(rq.name+" as "+tst.role, func(t *testing.T) {
+				req, err := http.NewRequest(rq.method, server.URL+rq.path, strings.NewReader(rq.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tst.role != "" {
+					req.Header.Set("Authorization", "Bearer "+signAccessToken(t, testAccessSecret, "7", tst.role, time.Now().Add(time.Hour)))
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tst.expected {
+					t.Errorf("got %d, expected %d", resp.StatusCode, tst.expected)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/money"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net/http"
+	"time"
+)
+
+// pricingRuleView is the JSON form of a pricing rule. Fixed discounts are
+// rendered as decimal strings in the rule's currency, like product prices.
+type pricingRuleView struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	TargetID   int64      `json:"target_id,omitempty"`
+	Kind       string     `json:"kind"`
+	PercentBps int32      `json:"percent_bps,omitempty"`
+	Amount     string     `json:"amount,omitempty"`
+	Currency   string     `json:"currency,omitempty"`
+	StartsAt   time.Time  `json:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at"`
+	Priority   int32      `json:"priority"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Version    int32      `json:"version"`
+}
+
+func newPricingRuleView(rule *productServiceProto.PricingRule) pricingRuleView {
+	view := pricingRuleView{
+		ID:         rule.GetId(),
+		Name:       rule.GetName(),
+		Scope:      rule.GetScope(),
+		TargetID:   rule.GetTargetId(),
+		Kind:       rule.GetKind(),
+		PercentBps: rule.GetPercentBps(),
+		Currency:   rule.GetCurrency(),
+		StartsAt:   rule.GetStartsAt().AsTime(),
+		Priority:   rule.GetPriority(),
+		CreatedAt:  rule.GetCreatedAt().AsTime(),
+		Version:    rule.GetVersion(),
+	}
+	if rule.GetAmountMinor() != 0 {
+		view.Amount = money.Format(rule.GetAmountMinor(), rule.GetCurrency())
+	}
+	if rule.GetEndsAt() != nil {
+		endsAt := rule.GetEndsAt().AsTime()
+		view.EndsAt = &endsAt
+	}
+	return view
+}
+
+func ValidatePricingRule(v *validator.Validator, rule *productServiceProto.PricingRule) {
+	v.Check(rule.Name != "", "name", "must be provided")
+	v.Check(len(rule.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.PermittedValue(rule.Scope, "product", "category", "catalog"), "scope", "must be product, category or catalog")
+	if rule.Scope == "catalog" {
+		v.Check(rule.TargetId == 0, "target_id", "must not be set for catalog rules")
+	} else {
+		v.Check(rule.TargetId > 0, "target_id", "must be provided")
+	}
+	v.Check(validator.PermittedValue(rule.Kind, "percent", "fixed"), "kind", "must be percent or fixed")
+	switch rule.Kind {
+	case "percent":
+		v.Check(rule.PercentBps >= 1 && rule.PercentBps <= 10000, "percent_bps", "must be between 1 and 10000")
+	case "fixed":
+		v.Check(rule.AmountMinor > 0, "amount", "must be greater than zero")
+	}
+	if rule.EndsAt != nil {
+		v.Check(rule.EndsAt.AsTime().After(rule.StartsAt.AsTime()), "ends_at", "must be after starts_at")
+	}
+}
+
+// pricingRuleInput is the body of pricing rule requests. Fields left out keep
+// their current value, and a null ends_at makes the rule open-ended.
+type pricingRuleInput struct {
+	Name       *string         `json:"name"`
+	Scope      *string         `json:"scope"`
+	TargetID   *int64          `json:"target_id"`
+	Kind       *string         `json:"kind"`
+	PercentBps *int32          `json:"percent_bps"`
+	Amount     *money.Decimal  `json:"amount"`
+	Currency   *string         `json:"currency"`
+	StartsAt   *time.Time      `json:"starts_at"`
+	EndsAt     json.RawMessage `json:"ends_at"`
+	Priority   *int32          `json:"priority"`
+}
+
+// apply copies the fields the client sent onto rule.
+func (input pricingRuleInput) apply(v *validator.Validator, rule *productServiceProto.PricingRule) {
+	if input.Name != nil {
+		rule.Name = *input.Name
+	}
+	if input.Scope != nil {
+		rule.Scope = *input.Scope
+	}
+	if input.TargetID != nil {
+		rule.TargetId = *input.TargetID
+	}
+	if input.Kind != nil {
+		rule.Kind = *input.Kind
+	}
+	if input.PercentBps != nil {
+		rule.PercentBps = *input.PercentBps
+	}
+	if input.Currency != nil {
+		rule.Currency = *input.Currency
+	}
+	if input.StartsAt != nil {
+		rule.StartsAt = timestamppb.New(*input.StartsAt)
+	}
+	if input.Priority != nil {
+		rule.Priority = *input.Priority
+	}
+
+	switch {
+	case len(input.EndsAt) == 0:
+	case string(input.EndsAt) == "null":
+		rule.EndsAt = nil
+	default:
+		var endsAt time.Time
+		if err := json.Unmarshal(input.EndsAt, &endsAt); err != nil {
+			v.AddError("ends_at", "must be an RFC 3339 timestamp or null")
+			break
+		}
+		rule.EndsAt = timestamppb.New(endsAt)
+	}
+
+	if input.Amount != nil {
+		exponent, ok := money.Exponent(rule.Currency)
+		if !ok {
+			v.AddError("currency", "must be a supported ISO 4217 code")
+			return
+		}
+		minor, err := money.Parse(string(*input.Amount), rule.Currency)
+		if err != nil {
+			v.AddError("amount", fmt.Sprintf("must be a decimal amount with at most %d fractional digits", exponent))
+			return
+		}
+		rule.AmountMinor = minor
+	}
+}
+
+// addPricingRuleHandler creates a pricing rule. Rules start right away unless
+// starts_at says otherwise.
+func (app *application) addPricingRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var input pricingRuleInput
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	rule := &productServiceProto.PricingRule{
+		StartsAt: timestamppb.Now(),
+	}
+
+	v := validator.New()
+	input.apply(v, rule)
+	if ValidatePricingRule(v, rule); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.AddPricingRule(ctx, &productServiceProto.AddPricingRuleRequest{
+		Rule: rule,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"rule": newPricingRuleView(response.GetRule())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listPricingRulesHandler lists the pricing rules, or with active_at only
+// those in effect at that time.
+func (app *application) listPricingRulesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	filters := &productServiceProto.Filters{
+		Page:         int32(app.readInt(qs, "page", 1)),
+		PageSize:     int32(app.readInt(qs, "page_size", 20)),
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafeList: []string{"id", "priority", "starts_at", "-id", "-priority", "-starts_at"},
+	}
+	activeAt := app.readTime(qs, "active_at", v)
+	if ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.ListPricingRules(ctx, &productServiceProto.ListPricingRulesRequest{
+		Filters:  filters,
+		ActiveAt: activeAt,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	rules := make([]pricingRuleView, 0, len(response.GetRules()))
+	for _, rule := range response.GetRules() {
+		rules = append(rules, newPricingRuleView(rule))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"rules": rules, "metadata": response.GetMetadata()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showPricingRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.ShowPricingRule(ctx, &productServiceProto.ShowPricingRuleRequest{
+		Id: id,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"rule": newPricingRuleView(response.GetRule())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updatePricingRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	shown, err := app.productServiceClient.ShowPricingRule(withPrimaryReads(ctx), &productServiceProto.ShowPricingRuleRequest{
+		Id: id,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+	rule := shown.GetRule()
+
+	var input pricingRuleInput
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	input.apply(v, rule)
+	if ValidatePricingRule(v, rule); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	response, err := app.productServiceClient.UpdatePricingRule(ctx, &productServiceProto.UpdatePricingRuleRequest{
+		Rule: rule,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"rule": newPricingRuleView(response.GetRule())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deletePricingRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.DeletePricingRule(ctx, &productServiceProto.DeletePricingRuleRequest{
+		Id: id,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": response.GetMessage()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// previewPricesHandler prices the products in the ids query parameter with
+// the rules in effect at the time in at, or now.
+func (app *application) previewPricesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	ids := app.readIDList(qs, "ids", v)
+	at := app.readTime(qs, "at", v)
+	currency := app.readString(qs, "currency", "")
+	v.Check(qs.Get("ids") != "", "ids", "must not be empty")
+	ValidateCurrency(v, currency)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.PreviewPrices(ctx, &productServiceProto.PreviewPricesRequest{
+		Ids:      ids,
+		At:       at,
+		Currency: currency,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	missing := response.GetMissingIds()
+	if missing == nil {
+		missing = []int64{}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"products": newProductViews(response.GetProducts()), "missing_ids": missing}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
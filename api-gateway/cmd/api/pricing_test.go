@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+func TestTableDrivenValidatePricingRule(t *testing.T) {
+	start := timestamppb.New(time.Date(2026, 10, 24, 0, 0, 0, 0, time.UTC))
+	end := timestamppb.New(time.Date(2026, 10, 26, 0, 0, 0, 0, time.UTC))
+
+	var tests = []struct {
+		name     string
+		input    *productServiceProto.PricingRule
+		expected bool
+	}{
+		{
+			"ValidatePricingRule(noNameRule) must return false",
+			&productServiceProto.PricingRule{Scope: "catalog", Kind: "percent", PercentBps: 2000, StartsAt: start},
+			false,
+		},
+		{
+			"ValidatePricingRule(categoryRuleWithoutTarget) must return false",
+			&productServiceProto.PricingRule{Name: "Fruit weekend", Scope: "category", Kind: "percent", PercentBps: 2000, StartsAt: start},
+			false,
+		},
+		{
+			"ValidatePricingRule(tooLargePercentRule) must return false",
+			&productServiceProto.PricingRule{Name: "Fruit weekend", Scope: "category", TargetId: 1, Kind: "percent", PercentBps: 10001, StartsAt: start},
+			false,
+		},
+		{
+			"ValidatePricingRule(endsBeforeStartRule) must return false",
+			&productServiceProto.PricingRule{Name: "Fruit weekend", Scope: "category", TargetId: 1, Kind: "percent", PercentBps: 2000, StartsAt: end, EndsAt: start},
+			false,
+		},
+		{
+			"ValidatePricingRule(perfectRule) must return true",
+			&productServiceProto.PricingRule{Name: "Fruit weekend", Scope: "category", TargetId: 1, Kind: "percent", PercentBps: 2000, StartsAt: start, EndsAt: end},
+			true,
+		},
+	}
+
+	for _, tst := range tests {
+		v := validator.New()
+		t.Run(tst.name, func(t *testing.T) {
+			ValidatePricingRule(v, tst.input)
+			if result := v.Valid(); result != tst.expected {
+				t.Errorf("%s: got %v", tst.name, result)
+			}
+		})
+	}
+}
+
+func TestPricingRuleInputApply(t *testing.T) {
+	rule := &productServiceProto.PricingRule{
+		Kind:     "percent",
+		StartsAt: timestamppb.Now(),
+		EndsAt:   timestamppb.Now(),
+	}
+
+	var input pricingRuleInput
+	err := json.Unmarshal([]byte(`{"kind": "fixed", "amount": "12.50", "currency": "USD", "ends_at": null}`), &input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := validator.New()
+	input.apply(v, rule)
+	if !v.Valid() {
+		t.Fatalf("apply() recorded errors: %v", v.Errors)
+	}
+	if rule.Kind != "fixed" || rule.AmountMinor != 1250 || rule.Currency != "USD" {
+		t.Errorf("rule is %s %d %s, expected fixed 1250 USD", rule.Kind, rule.AmountMinor, rule.Currency)
+	}
+	if rule.EndsAt != nil {
+		t.Errorf("null ends_at left the end at %v", rule.EndsAt.AsTime())
+	}
+}
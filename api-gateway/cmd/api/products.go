@@ -2,22 +2,113 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/money"
 	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
 	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"math"
 	"net/http"
 	"time"
 )
 
+// productView is the JSON form of a product. Prices are rendered as decimal
+// strings in the product's currency so that clients never see float rounding.
+type productView struct {
+	ID   int64  `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Price is the list price, also in ListPrice. EffectivePrice is what the
+	// product sells for once the pricing rule in PricingRuleID is applied.
+	Price          string                 `json:"price"`
+	ListPrice      string                 `json:"list_price"`
+	EffectivePrice string                 `json:"effective_price"`
+	PricingRuleID  int64                  `json:"pricing_rule_id,omitempty"`
+	Currency       string                 `json:"currency"`
+	Description    string                 `json:"description,omitempty"`
+	CategoryID     int64                  `json:"category_id"`
+	Category       string                 `json:"category,omitempty"`
+	Quantity       int32                  `json:"quantity"`
+	IsAvailable    bool                   `json:"is_available"`
+	CreationDate   *timestamppb.Timestamp `json:"creation_date,omitempty"`
+	Version        int32                  `json:"version,omitempty"`
+	Images         []imageView            `json:"images"`
+	Options        []optionView           `json:"options"`
+	Variants       []variantView          `json:"variants"`
+	Snippet        string                 `json:"snippet,omitempty"`
+	DeletedAt      *timestamppb.Timestamp `json:"deleted_at,omitempty"`
+	// AverageRating is the mean of the approved reviews' ratings, 0 without
+	// any.
+	AverageRating float64 `json:"average_rating"`
+	ReviewCount   int32   `json:"review_count"`
+}
+
+func newProductView(product *productServiceProto.Product) productView {
+	return productView{
+		ID:             product.GetId(),
+		Name:           product.GetName(),
+		Price:          money.Format(product.GetPriceMinor(), product.GetCurrency()),
+		ListPrice:      money.Format(product.GetPriceMinor(), product.GetCurrency()),
+		EffectivePrice: money.Format(product.GetEffectivePriceMinor(), product.GetCurrency()),
+		PricingRuleID:  product.GetPricingRuleId(),
+		Currency:       product.GetCurrency(),
+		Description:    product.GetDescription(),
+		CategoryID:     product.GetCategoryId(),
+		Category:       product.GetCategory(),
+		Quantity:       product.GetQuantity(),
+		IsAvailable:    product.GetIsAvailable(),
+		CreationDate:   product.GetCreationDate(),
+		Version:        product.GetVersion(),
+		Images:         newImageViews(product.GetImages()),
+		Options:        newOptionViews(product.GetOptions()),
+		Variants:       newVariantViews(product),
+		Snippet:        product.GetSnippet(),
+		DeletedAt:      product.GetDeletedAt(),
+		AverageRating:  math.Round(product.GetAverageRating()*100) / 100,
+		ReviewCount:    product.GetReviewCount(),
+	}
+}
+
+func newProductViews(products []*productServiceProto.Product) []productView {
+	views := make([]productView, 0, len(products))
+	for _, product := range products {
+		views = append(views, newProductView(product))
+	}
+	return views
+}
+
+// setPrice parses amount in currency and stores it on product. The deprecated
+// float price is cleared so product-service uses the exact value.
+func setPrice(v *validator.Validator, product *productServiceProto.Product, amount money.Decimal, currency string) {
+	exponent, ok := money.Exponent(currency)
+	if !ok {
+		v.AddError("currency", "must be a supported ISO 4217 code")
+		return
+	}
+
+	minor, err := money.Parse(string(amount), currency)
+	if err != nil {
+		v.AddError("price", fmt.Sprintf("must be a decimal amount with at most %d fractional digits", exponent))
+		return
+	}
+
+	product.PriceMinor = minor
+	product.Currency = currency
+	product.Price = 0
+}
+
 func (app *application) addProductHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Name        string  `json:"name"`
-		Price       float32 `json:"price"`
-		Description string  `json:"description"`
-		Category    string  `json:"category"`
-		Quantity    int32   `json:"quantity"`
+		Name        string        `json:"name"`
+		Price       money.Decimal `json:"price"`
+		Currency    string        `json:"currency"`
+		Description string        `json:"description"`
+		CategoryID  int64         `json:"category_id"`
+		Category    string        `json:"category"`
+		Quantity    int32         `json:"quantity"`
+		Options     []optionView  `json:"options"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -26,26 +117,40 @@ func (app *application) addProductHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if input.Currency == "" {
+		input.Currency = money.DefaultCurrency
+	}
+
 	product := &productServiceProto.Product{
 		Name:        input.Name,
-		Price:       input.Price,
 		Description: input.Description,
+		CategoryId:  input.CategoryID,
 		Category:    input.Category,
 		Quantity:    input.Quantity,
+		Options:     optionsFromViews(input.Options),
 	}
 	SetStatus(product.Quantity, product)
 
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
 	v := validator.New()
-	if ValidateProduct(v, product); !v.Valid() {
+	v.Check(input.Price != "", "price", "must be provided")
+	if input.Price != "" {
+		setPrice(v, product, input.Price, input.Currency)
+	}
+	ValidateProduct(v, product)
+	v.Check(len(idempotencyKey) <= 255, "idempotency_key", "must not be more than 255 bytes long")
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
 	defer cancel()
 
 	response, err := app.productServiceClient.AddProduct(ctx, &productServiceProto.AddProductRequest{
-		Product: product,
+		Product:        product,
+		IdempotencyKey: idempotencyKey,
 	})
 	if err != nil {
 		errorStatus, _ := status.FromError(err)
@@ -54,13 +159,20 @@ func (app *application) addProductHandler(w http.ResponseWriter, r *http.Request
 			app.deadlineExceededResponse(w, r, err)
 		case errorStatus.Code() == codes.Unavailable:
 			app.serviceUnavailableResponse(w, r, err)
+		case errorStatus.Code() == codes.InvalidArgument:
+			app.invalidArgumentResponse(w, r, errorStatus)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"product": response.Product}, nil)
+	headers := make(http.Header)
+	if response.GetReplayed() {
+		headers.Set("Idempotent-Replayed", "true")
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"product": newProductView(response.Product)}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -72,13 +184,29 @@ func (app *application) showProductHandler(w http.ResponseWriter, r *http.Reques
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
+		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	qs := r.URL.Query()
+	currency := app.readString(qs, "currency", "")
+	v := validator.New()
+	includeDeleted := app.readBool(qs, "include_deleted", v)
+	if ValidateCurrency(v, currency); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Deleted products are only for admins.
+	if includeDeleted != nil && *includeDeleted && !app.checkAdmin(w, r) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
 	defer cancel()
 
-	product, err := app.productServiceClient.ShowProduct(ctx, &productServiceProto.ShowProductRequest{
-		Id: id,
+	response, err := app.productServiceClient.ShowProduct(ctx, &productServiceProto.ShowProductRequest{
+		Id:             id,
+		Currency:       currency,
+		IncludeDeleted: includeDeleted != nil && *includeDeleted,
 	})
 	if err != nil {
 		errorStatus, _ := status.FromError(err)
@@ -89,52 +217,155 @@ func (app *application) showProductHandler(w http.ResponseWriter, r *http.Reques
 			app.serviceUnavailableResponse(w, r, err)
 		case errorStatus.Code() == codes.NotFound:
 			app.notFoundResponse(w, r)
+		case errorStatus.Code() == codes.InvalidArgument:
+			app.invalidArgumentResponse(w, r, errorStatus)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	// Encode the struct to JSON and send it as the HTTP response.
-	// using envelope
-	err = app.writeJSON(w, http.StatusOK, product, nil)
+	// The product is sent as a productView, whose decimal string prices
+	// differ from the numbers clients used to get; see the README.
+	err = app.writeJSON(w, http.StatusOK, envelope{"product": newProductView(response.Product)}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// facetsView is the JSON form of the facet counts of a product list.
+type facetsView struct {
+	Categories   []*productServiceProto.CategoryFacet `json:"categories"`
+	Available    int32                                `json:"available"`
+	Unavailable  int32                                `json:"unavailable"`
+	PriceBuckets []priceBucketView                    `json:"price_buckets"`
+	Currency     string                               `json:"currency"`
+}
+
+// priceBucketView covers prices from Min up to but not including Max.
+type priceBucketView struct {
+	Min   string `json:"min"`
+	Max   string `json:"max"`
+	Count int32  `json:"count"`
+}
+
+func newFacetsView(facets *productServiceProto.Facets) *facetsView {
+	if facets == nil {
+		return nil
+	}
+
+	view := &facetsView{
+		Categories:   facets.Categories,
+		Available:    facets.Available,
+		Unavailable:  facets.Unavailable,
+		PriceBuckets: []priceBucketView{},
+		Currency:     facets.Currency,
+	}
+	if view.Categories == nil {
+		view.Categories = []*productServiceProto.CategoryFacet{}
+	}
+	for _, bucket := range facets.PriceBuckets {
+		view.PriceBuckets = append(view.PriceBuckets, priceBucketView{
+			Min:   money.Format(bucket.MinMinor, facets.Currency),
+			Max:   money.Format(bucket.MaxMinor, facets.Currency),
+			Count: bucket.Count,
+		})
+	}
+	return view
+}
+
 func (app *application) listProductsHandler(w http.ResponseWriter, r *http.Request) {
+	// A list of ids fetches exactly those products, e.g. for a cart.
+	if r.URL.Query().Has("ids") {
+		app.batchGetProductsHandler(w, r)
+		return
+	}
+
 	var input struct {
-		Name     string
-		Category string
+		Name           string
+		Category       string
+		Search         string
+		Currency       string
+		CategoryID     int64
+		CategoryIDs    []int64
+		PriceMin       *int64
+		PriceMax       *int64
+		IsAvailable    *bool
+		CreatedAfter   *timestamppb.Timestamp
+		CreatedBefore  *timestamppb.Timestamp
+		Facets         bool
+		IncludeDeleted bool
 		productServiceProto.Filters
 	}
-	// v := validator.New()
+	v := validator.New()
 	qs := r.URL.Query()
 	input.Name = app.readString(qs, "name", "")
-	fmt.Println(input.Name)
 	input.Category = app.readString(qs, "category", "")
+	input.Search = app.readString(qs, "search", "")
+	input.Currency = app.readString(qs, "currency", "")
+	input.CategoryID = int64(app.readInt(qs, "category_id", 0))
+	input.CategoryIDs = app.readIDList(qs, "category_ids", v)
+	input.IsAvailable = app.readBool(qs, "is_available", v)
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+	if facets := app.readBool(qs, "facets", v); facets != nil {
+		input.Facets = *facets
+	}
+	if includeDeleted := app.readBool(qs, "include_deleted", v); includeDeleted != nil {
+		input.IncludeDeleted = *includeDeleted
+	}
+
+	// Price bounds are given in the currency prices are listed in.
+	priceCurrency := input.Currency
+	if priceCurrency == "" {
+		priceCurrency = money.DefaultCurrency
+	}
+	input.PriceMin = app.readPrice(qs, "price_min", priceCurrency, v)
+	input.PriceMax = app.readPrice(qs, "price_max", priceCurrency, v)
 	input.Filters.Page = int32(app.readInt(qs, "page", 1))
 	input.Filters.PageSize = int32(app.readInt(qs, "page_size", 20))
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafeList = []string{"id", "name", "category", "price", "is_available", "creation_date",
-		"-id", "-name", "-category", "-price", "-is_available", "-creation_date"}
-
-	// if data.ValidateFilters(v, input.Filters); !v.Valid() {
-	// 	app.failedValidationResponse(w, r, v.Errors)
-	// 	return
-	// }
-	// Call the GetAll() method to retrieve the movies, passing in the various filter
-	// parameters.
-	// Accept the metadata struct as a return value.
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Searches list the best matches first unless asked otherwise.
+	defaultSort := "id"
+	if input.Search != "" {
+		defaultSort = "relevance"
+	}
+	input.Filters.Sort = app.readString(qs, "sort", defaultSort)
+	input.Filters.SortSafeList = []string{"id", "name", "category", "price", "is_available", "creation_date", "relevance", "rating",
+		"-id", "-name", "-category", "-price", "-is_available", "-creation_date", "-rating"}
+
+	ValidateFilters(v, &input.Filters)
+	ValidateCurrency(v, input.Currency)
+	v.Check(input.CategoryID >= 0, "category_id", "must not be negative")
+	v.Check(input.PriceMin == nil || input.PriceMax == nil || *input.PriceMin <= *input.PriceMax, "price_max", "must not be less than price_min")
+	v.Check(input.CreatedAfter == nil || input.CreatedBefore == nil ||
+		input.CreatedAfter.AsTime().Before(input.CreatedBefore.AsTime()), "created_before", "must be later than created_after")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Deleted products are only for admins.
+	if input.IncludeDeleted && !app.checkAdmin(w, r) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
 	defer cancel()
 
 	response, err := app.productServiceClient.ListProducts(ctx, &productServiceProto.ListProductsRequest{
-		Name:     input.Name,
-		Category: input.Category,
-		Filters:  &input.Filters,
+		Name:           input.Name,
+		Category:       input.Category,
+		Search:         input.Search,
+		Filters:        &input.Filters,
+		Currency:       input.Currency,
+		CategoryId:     input.CategoryID,
+		CategoryIds:    input.CategoryIDs,
+		PriceMin:       input.PriceMin,
+		PriceMax:       input.PriceMax,
+		IsAvailable:    input.IsAvailable,
+		CreatedAfter:   input.CreatedAfter,
+		CreatedBefore:  input.CreatedBefore,
+		Facets:         input.Facets,
+		IncludeDeleted: input.IncludeDeleted,
 	})
 	if err != nil {
 		errorStatus, _ := status.FromError(err)
@@ -145,13 +376,22 @@ func (app *application) listProductsHandler(w http.ResponseWriter, r *http.Reque
 			app.serviceUnavailableResponse(w, r, err)
 		case errorStatus.Code() == codes.NotFound:
 			app.notFoundResponse(w, r)
+		case errorStatus.Code() == codes.InvalidArgument:
+			app.invalidArgumentResponse(w, r, errorStatus)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 	// Include the metadata in the response envelope.
-	err = app.writeJSON(w, http.StatusOK, envelope{"products": response.Products, "metadata": response.Metadata}, nil)
+	env := envelope{"products": newProductViews(response.Products), "metadata": response.Metadata}
+	if input.Facets {
+		env["facets"] = newFacetsView(response.Facets)
+	}
+	if input.Search != "" {
+		env["fuzzy"] = response.Fuzzy
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -172,10 +412,10 @@ func (app *application) updateProductHandler(w http.ResponseWriter, r *http.Requ
 	//	return
 	//}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
 	defer cancel()
 
-	productFromDB, err := app.productServiceClient.ShowProduct(ctx, &productServiceProto.ShowProductRequest{
+	productFromDB, err := app.productServiceClient.ShowProduct(withPrimaryReads(ctx), &productServiceProto.ShowProductRequest{
 		Id: id,
 	})
 	if err != nil {
@@ -195,11 +435,14 @@ func (app *application) updateProductHandler(w http.ResponseWriter, r *http.Requ
 	product := productFromDB.Product
 
 	var input struct {
-		Name        *string  `json:"name"`
-		Price       *float32 `json:"price"`
-		Description *string  `json:"description"`
-		Category    *string  `json:"category"`
-		Quantity    *int32   `json:"quantity"`
+		Name        *string        `json:"name"`
+		Price       *money.Decimal `json:"price"`
+		Currency    *string        `json:"currency"`
+		Description *string        `json:"description"`
+		CategoryID  *int64         `json:"category_id"`
+		Category    *string        `json:"category"`
+		Quantity    *int32         `json:"quantity"`
+		Options     []optionView   `json:"options"`
 	}
 
 	err = app.readJSON(w, r, &input)
@@ -212,24 +455,44 @@ func (app *application) updateProductHandler(w http.ResponseWriter, r *http.Requ
 		product.Name = *input.Name
 	}
 
-	if input.Price != nil {
-		product.Price = *input.Price
+	v := validator.New()
+
+	// A price is only meaningful in its currency, so switching currency
+	// without restating the price is rejected instead of silently
+	// reinterpreting the stored amount.
+	switch {
+	case input.Price != nil && input.Currency != nil:
+		setPrice(v, product, *input.Price, *input.Currency)
+	case input.Price != nil:
+		setPrice(v, product, *input.Price, product.Currency)
+	case input.Currency != nil && *input.Currency != product.Currency:
+		v.AddError("price", "must be provided when currency changes")
 	}
 
 	if input.Description != nil {
 		product.Description = *input.Description
 	}
 
-	if input.Category != nil {
+	// category_id wins over a category name; a name alone is resolved by
+	// product-service, so the current ID has to be cleared for it to apply.
+	switch {
+	case input.CategoryID != nil:
+		product.CategoryId = *input.CategoryID
+	case input.Category != nil:
+		product.CategoryId = 0
 		product.Category = *input.Category
 	}
 
-	if input.Quantity != nil {
-		product.Quantity = *input.Quantity
-		SetStatus(product.Quantity, product)
+	// Stock changes as a delta through POST /v1/products/:id/stock-movements,
+	// so that writing back the quantity read above cannot undo reservations
+	// made in between.
+	v.Check(input.Quantity == nil, "quantity", "must be changed through stock movements")
+
+	// Options are replaced as a whole; an empty list removes them.
+	if input.Options != nil {
+		product.Options = optionsFromViews(input.Options)
 	}
 
-	v := validator.New()
 	if ValidateProduct(v, product); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -247,6 +510,10 @@ func (app *application) updateProductHandler(w http.ResponseWriter, r *http.Requ
 			app.serviceUnavailableResponse(w, r, err)
 		case errorStatus.Code() == codes.NotFound:
 			app.notFoundResponse(w, r)
+		case errorStatus.Code() == codes.InvalidArgument:
+			app.invalidArgumentResponse(w, r, errorStatus)
+		case errorStatus.Code() == codes.FailedPrecondition:
+			app.failedPreconditionResponse(w, r, errorStatus)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -257,7 +524,11 @@ func (app *application) updateProductHandler(w http.ResponseWriter, r *http.Requ
 		"method": "updateProductHandler",
 	})
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": response.GetMessage(), "product": product}, nil)
+	if response.GetProduct() != nil {
+		product = response.GetProduct()
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": response.GetMessage(), "product": newProductView(product)}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -278,7 +549,7 @@ func (app *application) deleteProductHandler(w http.ResponseWriter, r *http.Requ
 	//	return
 	//}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
 	defer cancel()
 
 	response, err := app.productServiceClient.DeleteProduct(ctx, &productServiceProto.DeleteProductRequest{
@@ -308,3 +579,264 @@ func (app *application) deleteProductHandler(w http.ResponseWriter, r *http.Requ
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) showProductHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+	filters := &productServiceProto.Filters{
+		Page:         int32(app.readInt(qs, "page", 1)),
+		PageSize:     int32(app.readInt(qs, "page_size", 20)),
+		Sort:         app.readString(qs, "sort", "-id"),
+		SortSafeList: []string{"id", "-id"},
+	}
+	if ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.GetProductHistory(ctx, &productServiceProto.GetProductHistoryRequest{
+		Id:      id,
+		Filters: filters,
+	})
+	if err != nil {
+		errorStatus, _ := status.FromError(err)
+		switch {
+		case errorStatus.Code() == codes.DeadlineExceeded:
+			app.deadlineExceededResponse(w, r, err)
+		case errorStatus.Code() == codes.Unavailable:
+			app.serviceUnavailableResponse(w, r, err)
+		case errorStatus.Code() == codes.InvalidArgument:
+			app.invalidArgumentResponse(w, r, errorStatus)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Changes arrive as a JSON string; embed them as raw JSON so clients get
+	// an object rather than an escaped string.
+	type historyEntry struct {
+		ID        int64           `json:"id"`
+		Action    string          `json:"action"`
+		Actor     string          `json:"actor,omitempty"`
+		Version   int32           `json:"version"`
+		Changes   json.RawMessage `json:"changes"`
+		ChangedAt time.Time       `json:"changed_at"`
+	}
+
+	history := make([]historyEntry, 0, len(response.GetEntries()))
+	for _, entry := range response.GetEntries() {
+		history = append(history, historyEntry{
+			ID:        entry.GetId(),
+			Action:    entry.GetAction(),
+			Actor:     entry.GetActor(),
+			Version:   entry.GetVersion(),
+			Changes:   json.RawMessage(entry.GetChanges()),
+			ChangedAt: entry.GetChangedAt().AsTime(),
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"history": history, "metadata": response.GetMetadata()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type stockMovementView struct {
+	ID        int64     `json:"id"`
+	VariantID int64     `json:"variant_id,omitempty"`
+	Delta     int32     `json:"delta"`
+	Reason    string    `json:"reason"`
+	Actor     string    `json:"actor,omitempty"`
+	Balance   int32     `json:"balance"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newStockMovementView(movement *productServiceProto.StockMovement) stockMovementView {
+	return stockMovementView{
+		ID:        movement.GetId(),
+		VariantID: movement.GetVariantId(),
+		Delta:     movement.GetDelta(),
+		Reason:    movement.GetReason(),
+		Actor:     movement.GetActor(),
+		Balance:   movement.GetBalance(),
+		CreatedAt: movement.GetCreatedAt().AsTime(),
+	}
+}
+
+func (app *application) listStockMovementsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+	filters := &productServiceProto.Filters{
+		Page:         int32(app.readInt(qs, "page", 1)),
+		PageSize:     int32(app.readInt(qs, "page_size", 20)),
+		Sort:         app.readString(qs, "sort", "-id"),
+		SortSafeList: []string{"id", "-id"},
+	}
+	if ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.ListStockMovements(ctx, &productServiceProto.ListStockMovementsRequest{
+		Id:      id,
+		Filters: filters,
+	})
+	if err != nil {
+		errorStatus, _ := status.FromError(err)
+		switch {
+		case errorStatus.Code() == codes.DeadlineExceeded:
+			app.deadlineExceededResponse(w, r, err)
+		case errorStatus.Code() == codes.Unavailable:
+			app.serviceUnavailableResponse(w, r, err)
+		case errorStatus.Code() == codes.InvalidArgument:
+			app.invalidArgumentResponse(w, r, errorStatus)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movements := make([]stockMovementView, 0, len(response.GetMovements()))
+	for _, movement := range response.GetMovements() {
+		movements = append(movements, newStockMovementView(movement))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"stock_movements": movements, "metadata": response.GetMetadata()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adjustStockHandler adds or removes stock as a delta, which product-service
+// applies to the current quantity however it changed since the client last
+// read it.
+func (app *application) adjustStockHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Delta     int32  `json:"delta"`
+		Reason    string `json:"reason"`
+		VariantID int64  `json:"variant_id"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if ValidateStockAdjustment(v, input.Delta, input.Reason); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.AdjustStock(ctx, &productServiceProto.AdjustStockRequest{
+		Id:        id,
+		Delta:     input.Delta,
+		Reason:    input.Reason,
+		VariantId: input.VariantID,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"stock_movement": newStockMovementView(response.GetMovement())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func ValidateStockAdjustment(v *validator.Validator, delta int32, reason string) {
+	v.Check(delta != 0, "delta", "must not be zero")
+	v.Check(reason != "", "reason", "must be provided")
+	v.Check(len(reason) <= 200, "reason", "must not be more than 200 bytes long")
+}
+
+func (app *application) restoreProductHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.RestoreProduct(ctx, &productServiceProto.RestoreProductRequest{
+		Id: id,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"product": newProductView(response.Product)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// batchGetProductsHandler returns the products in the order of the ids query
+// parameter. Ids without a product are listed under missing_ids instead of
+// failing the request.
+func (app *application) batchGetProductsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	v := validator.New()
+	ids := app.readIDList(qs, "ids", v)
+	currency := app.readString(qs, "currency", "")
+	v.Check(qs.Get("ids") != "", "ids", "must not be empty")
+	ValidateCurrency(v, currency)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.BatchGetProducts(ctx, &productServiceProto.BatchGetProductsRequest{
+		Ids:      ids,
+		Currency: currency,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	missing := response.GetMissingIds()
+	if missing == nil {
+		missing = []int64{}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"products": newProductViews(response.Products), "missing_ids": missing}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
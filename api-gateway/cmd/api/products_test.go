@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -45,3 +46,66 @@ func TestAddProductHandler(t *testing.T) {
 		t.Errorf("Expected 200, got %d", resp.StatusCode)
 	}
 }
+
+func TestUpdateProductHandlerRejectsQuantity(t *testing.T) {
+	server := httptest.NewServer(testingApplication.routes())
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		body     string
+		expected int
+	}{
+		{"/v1/products/1", `{"name": "Ball"}`, http.StatusOK},
+		{"/v1/products/1", `{"name": "Ball", "quantity": 3}`, http.StatusUnprocessableEntity},
+		{"/v1/products/1/variants/1", `{"sku": "FB-M2"}`, http.StatusOK},
+		{"/v1/products/1/variants/1", `{"quantity": 3}`, http.StatusUnprocessableEntity},
+	}
+	for _, tst := range tests {
+		req, err := http.NewRequest(http.MethodPatch, server.URL+tst.path, strings.NewReader(tst.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tst.expected {
+			t.Errorf("PATCH %s %s returned %d, expected %d", tst.path, tst.body, resp.StatusCode, tst.expected)
+		}
+	}
+}
+
+func TestAdjustStockHandler(t *testing.T) {
+	server := httptest.NewServer(testingApplication.routes())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1/products/1/stock-movements", "application/json", strings.NewReader(`{"delta": -2, "reason": "damaged"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Movement stockMovementView `json:"stock_movement"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Movement.Delta != -2 || body.Movement.Balance != 3 {
+		t.Errorf("movement is %+v, expected delta -2 and balance 3", body.Movement)
+	}
+
+	resp, err = http.Post(server.URL+"/v1/products/1/stock-movements", "application/json", strings.NewReader(`{"delta": 0, "reason": ""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a zero delta without a reason, got %d", resp.StatusCode)
+	}
+}
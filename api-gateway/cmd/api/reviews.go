@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"net/http"
+	"time"
+)
+
+// reviewView is the JSON form of a review.
+type reviewView struct {
+	ID        int64     `json:"id"`
+	ProductID int64     `json:"product_id"`
+	UserID    int64     `json:"user_id"`
+	Rating    int32     `json:"rating"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Verified  bool      `json:"verified"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int32     `json:"version"`
+}
+
+func newReviewView(review *productServiceProto.Review) reviewView {
+	return reviewView{
+		ID:        review.GetId(),
+		ProductID: review.GetProductId(),
+		UserID:    review.GetUserId(),
+		Rating:    review.GetRating(),
+		Title:     review.GetTitle(),
+		Body:      review.GetBody(),
+		Verified:  review.GetVerified(),
+		Status:    review.GetStatus(),
+		CreatedAt: review.GetCreatedAt().AsTime(),
+		UpdatedAt: review.GetUpdatedAt().AsTime(),
+		Version:   review.GetVersion(),
+	}
+}
+
+func ValidateReview(v *validator.Validator, review *productServiceProto.Review) {
+	v.Check(review.Rating >= 1 && review.Rating <= 5, "rating", "must be between 1 and 5")
+	v.Check(len(review.Title) <= 100, "title", "must not be more than 100 bytes long")
+	v.Check(len(review.Body) <= 5000, "body", "must not be more than 5000 bytes long")
+}
+
+func (app *application) addReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Rating int32  `json:"rating"`
+		Title  string `json:"title"`
+		Body   string `json:"body"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	review := &productServiceProto.Review{
+		ProductId: id,
+		Rating:    input.Rating,
+		Title:     input.Title,
+		Body:      input.Body,
+	}
+
+	v := validator.New()
+	if ValidateReview(v, review); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.AddReview(ctx, &productServiceProto.AddReviewRequest{
+		Review: review,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"review": newReviewView(response.GetReview())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listReviewsHandler lists a product's reviews, the approved ones unless the
+// status parameter asks for others.
+func (app *application) listReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	app.listReviews(w, r, id)
+}
+
+// listAllReviewsHandler lists the reviews of every product, for moderators
+// working through the pending ones.
+func (app *application) listAllReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listReviews(w, r, 0)
+}
+
+func (app *application) listReviews(w http.ResponseWriter, r *http.Request, productID int64) {
+	v := validator.New()
+	qs := r.URL.Query()
+	status := app.readString(qs, "status", "approved")
+	filters := &productServiceProto.Filters{
+		Page:         int32(app.readInt(qs, "page", 1)),
+		PageSize:     int32(app.readInt(qs, "page_size", 20)),
+		Sort:         app.readString(qs, "sort", "-created_at"),
+		SortSafeList: []string{"id", "rating", "created_at", "-id", "-rating", "-created_at"},
+	}
+	ValidateFilters(v, filters)
+	v.Check(validator.PermittedValue(status, "pending", "approved", "rejected"), "status", "must be pending, approved or rejected")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Reviews waiting for moderation, or turned down, are only for admins.
+	if status != "approved" && !app.checkAdmin(w, r) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.ListReviews(ctx, &productServiceProto.ListReviewsRequest{
+		ProductId: productID,
+		Status:    status,
+		Filters:   filters,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	reviews := make([]reviewView, 0, len(response.GetReviews()))
+	for _, review := range response.GetReviews() {
+		reviews = append(reviews, newReviewView(review))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reviews": reviews, "metadata": response.GetMetadata()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readReviewParams reads the product and review IDs of a review URL.
+func (app *application) readReviewParams(r *http.Request) (int64, int64, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return 0, 0, false
+	}
+	reviewID, err := app.readNamedIDParam(r, "review_id")
+	if err != nil {
+		return 0, 0, false
+	}
+	return id, reviewID, true
+}
+
+func (app *application) showReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, reviewID, ok := app.readReviewParams(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.ShowReview(ctx, &productServiceProto.ShowReviewRequest{
+		ProductId: id,
+		ReviewId:  reviewID,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"review": newReviewView(response.GetReview())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, reviewID, ok := app.readReviewParams(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	shown, err := app.productServiceClient.ShowReview(withPrimaryReads(ctx), &productServiceProto.ShowReviewRequest{
+		ProductId: id,
+		ReviewId:  reviewID,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+	review := shown.GetReview()
+
+	var input struct {
+		Rating *int32  `json:"rating"`
+		Title  *string `json:"title"`
+		Body   *string `json:"body"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Rating != nil {
+		review.Rating = *input.Rating
+	}
+	if input.Title != nil {
+		review.Title = *input.Title
+	}
+	if input.Body != nil {
+		review.Body = *input.Body
+	}
+
+	v := validator.New()
+	if ValidateReview(v, review); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	response, err := app.productServiceClient.UpdateReview(ctx, &productServiceProto.UpdateReviewRequest{
+		Review: review,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"review": newReviewView(response.GetReview())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, reviewID, ok := app.readReviewParams(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.DeleteReview(ctx, &productServiceProto.DeleteReviewRequest{
+		ProductId: id,
+		ReviewId:  reviewID,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": response.GetMessage()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) moderateReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, reviewID, ok := app.readReviewParams(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Status   string `json:"status"`
+		Verified *bool  `json:"verified"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(validator.PermittedValue(input.Status, "approved", "rejected"), "status", "must be approved or rejected"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.ModerateReview(ctx, &productServiceProto.ModerateReviewRequest{
+		ProductId: id,
+		ReviewId:  reviewID,
+		Status:    input.Status,
+		Verified:  input.Verified,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"review": newReviewView(response.GetReview())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"strings"
+	"testing"
+)
+
+func TestTableDrivenValidateReview(t *testing.T) {
+	var tests = []struct {
+		name     string
+		input    *productServiceProto.Review
+		expected bool
+	}{
+		{
+			"ValidateReview(noRatingReview) must return false",
+			&productServiceProto.Review{Title: "Great"},
+			false,
+		},
+		{
+			"ValidateReview(tooHighRatingReview) must return false",
+			&productServiceProto.Review{Rating: 6},
+			false,
+		},
+		{
+			"ValidateReview(longTitleReview) must return false",
+			&productServiceProto.Review{Rating: 4, Title: strings.Repeat("a", 101)},
+			false,
+		},
+		{
+			"ValidateReview(longBodyReview) must return false",
+			&productServiceProto.Review{Rating: 4, Body: strings.Repeat("a", 5001)},
+			false,
+		},
+		{
+			"ValidateReview(perfectReview) must return true",
+			&productServiceProto.Review{Rating: 5, Title: "Great", Body: "Fits well."},
+			true,
+		},
+	}
+
+	for _, tst := range tests {
+		v := validator.New()
+		t.Run(tst.name, func(t *testing.T) {
+			ValidateReview(v, tst.input)
+			if result := v.Valid(); result != tst.expected {
+				t.Errorf("%s: got %v", tst.name, result)
+			}
+		})
+	}
+}
@@ -15,6 +15,36 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/products/:id", app.showProductHandler)
 	router.HandlerFunc(http.MethodPatch, "/v1/products/:id", app.updateProductHandler)
 	router.HandlerFunc(http.MethodDelete, "/v1/products/:id", app.deleteProductHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/restore", app.requireAdmin(app.restoreProductHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/products/:id/history", app.showProductHistoryHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/products/:id/stock-movements", app.listStockMovementsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/stock-movements", app.adjustStockHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/images", app.uploadProductImageHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/products/:id/images/:image_id", app.updateProductImageHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/products/:id/images/:image_id", app.deleteProductImageHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/variants", app.addProductVariantHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/products/:id/variants/:variant_id", app.updateProductVariantHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/products/:id/variants/:variant_id", app.deleteProductVariantHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/products/:id/reviews", app.listReviewsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/reviews", app.addReviewHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/products/:id/reviews/:review_id", app.showReviewHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/products/:id/reviews/:review_id", app.updateReviewHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/products/:id/reviews/:review_id", app.deleteReviewHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/products/:id/reviews/:review_id/moderation", app.requireAdmin(app.moderateReviewHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/reviews", app.listAllReviewsHandler)
 
-	return app.recoverPanic(app.rateLimit(router))
+	router.HandlerFunc(http.MethodPost, "/v1/pricing-rules", app.addPricingRuleHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/pricing-rules", app.listPricingRulesHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/pricing-rules/:id", app.showPricingRuleHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/pricing-rules/:id", app.updatePricingRuleHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/pricing-rules/:id", app.deletePricingRuleHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/prices", app.previewPricesHandler)
+
+	router.HandlerFunc(http.MethodPost, "/v1/categories", app.addCategoryHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/categories", app.listCategoriesHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/categories/:id", app.showCategoryHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/categories/:id", app.updateCategoryHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/categories/:id", app.deleteCategoryHandler)
+
+	return app.recoverPanic(app.rateLimit(app.authenticate(router)))
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/money"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"net/http"
+	"time"
+)
+
+type optionView struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+func newOptionViews(options []*productServiceProto.ProductOption) []optionView {
+	views := make([]optionView, 0, len(options))
+	for _, option := range options {
+		views = append(views, optionView{Name: option.GetName(), Values: option.GetValues()})
+	}
+	return views
+}
+
+func optionsFromViews(views []optionView) []*productServiceProto.ProductOption {
+	options := make([]*productServiceProto.ProductOption, 0, len(views))
+	for _, view := range views {
+		options = append(options, &productServiceProto.ProductOption{Name: view.Name, Values: view.Values})
+	}
+	return options
+}
+
+// variantView is the JSON form of a variant. Price is what the variant sells
+// for: its own price when it has one, otherwise the product's.
+type variantView struct {
+	ID      int64             `json:"id"`
+	SKU     string            `json:"sku"`
+	Options map[string]string `json:"options"`
+	Price   string            `json:"price"`
+	// EffectivePrice is Price after the product's pricing rule.
+	EffectivePrice string    `json:"effective_price"`
+	Currency       string    `json:"currency"`
+	PriceOverride  bool      `json:"price_override"`
+	Quantity       int32     `json:"quantity"`
+	IsAvailable    bool      `json:"is_available"`
+	CreatedAt      time.Time `json:"created_at"`
+	Version        int32     `json:"version"`
+}
+
+func newVariantView(variant *productServiceProto.ProductVariant, product *productServiceProto.Product) variantView {
+	price, effective := product.GetPriceMinor(), product.GetEffectivePriceMinor()
+	if variant.PriceMinor != nil {
+		price, effective = variant.GetPriceMinor(), variant.GetEffectivePriceMinor()
+	}
+
+	return variantView{
+		ID:             variant.GetId(),
+		SKU:            variant.GetSku(),
+		Options:        variant.GetOptions(),
+		Price:          money.Format(price, product.GetCurrency()),
+		EffectivePrice: money.Format(effective, product.GetCurrency()),
+		Currency:       product.GetCurrency(),
+		PriceOverride:  variant.PriceMinor != nil,
+		Quantity:       variant.GetQuantity(),
+		IsAvailable:    variant.GetIsAvailable(),
+		CreatedAt:      variant.GetCreatedAt().AsTime(),
+		Version:        variant.GetVersion(),
+	}
+}
+
+func newVariantViews(product *productServiceProto.Product) []variantView {
+	views := make([]variantView, 0, len(product.GetVariants()))
+	for _, variant := range product.GetVariants() {
+		views = append(views, newVariantView(variant, product))
+	}
+	return views
+}
+
+func ValidateVariant(v *validator.Validator, variant *productServiceProto.ProductVariant) {
+	v.Check(variant.Sku != "", "sku", "must be provided")
+	v.Check(len(variant.Sku) <= 64, "sku", "must not be more than 64 bytes long")
+	v.Check(len(variant.Options) > 0, "options", "must be provided")
+	v.Check(variant.Quantity >= 0, "quantity", "can not be negative")
+}
+
+// setVariantPrice reads a variant price from raw JSON: a missing price leaves
+// the variant alone, null makes it inherit the product's price, and anything
+// else is parsed as an amount in the product's currency.
+func setVariantPrice(v *validator.Validator, variant *productServiceProto.ProductVariant, raw json.RawMessage, currency string) {
+	if len(raw) == 0 {
+		return
+	}
+	if string(raw) == "null" {
+		variant.PriceMinor = nil
+		return
+	}
+
+	var amount money.Decimal
+	if err := json.Unmarshal(raw, &amount); err != nil {
+		v.AddError("price", "must be a decimal amount or null")
+		return
+	}
+	exponent, _ := money.Exponent(currency)
+	minor, err := money.Parse(string(amount), currency)
+	if err != nil {
+		v.AddError("price", fmt.Sprintf("must be a decimal amount with at most %d fractional digits", exponent))
+		return
+	}
+	variant.PriceMinor = &minor
+}
+
+// showProductForVariant loads the product a variant request refers to, which
+// the handlers need for its currency and existing variants. It reads from the
+// primary, since the handlers write on the strength of what it returns.
+func (app *application) showProductForVariant(ctx context.Context, w http.ResponseWriter, r *http.Request, id int64) (*productServiceProto.Product, bool) {
+	response, err := app.productServiceClient.ShowProduct(withPrimaryReads(ctx), &productServiceProto.ShowProductRequest{
+		Id: id,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return nil, false
+	}
+	return response.GetProduct(), true
+}
+
+func (app *application) addProductVariantHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		SKU      string            `json:"sku"`
+		Options  map[string]string `json:"options"`
+		Price    json.RawMessage   `json:"price"`
+		Quantity int32             `json:"quantity"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	product, ok := app.showProductForVariant(ctx, w, r, id)
+	if !ok {
+		return
+	}
+
+	variant := &productServiceProto.ProductVariant{
+		ProductId: id,
+		Sku:       input.SKU,
+		Options:   input.Options,
+		Quantity:  input.Quantity,
+	}
+
+	v := validator.New()
+	setVariantPrice(v, variant, input.Price, product.GetCurrency())
+	if ValidateVariant(v, variant); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	response, err := app.productServiceClient.AddProductVariant(ctx, &productServiceProto.AddProductVariantRequest{
+		Variant: variant,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"variant": newVariantView(response.GetVariant(), product)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateProductVariantHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	variantID, err := app.readNamedIDParam(r, "variant_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	product, ok := app.showProductForVariant(ctx, w, r, id)
+	if !ok {
+		return
+	}
+
+	var variant *productServiceProto.ProductVariant
+	for _, candidate := range product.GetVariants() {
+		if candidate.GetId() == variantID {
+			variant = candidate
+		}
+	}
+	if variant == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		SKU      *string           `json:"sku"`
+		Options  map[string]string `json:"options"`
+		Price    json.RawMessage   `json:"price"`
+		Quantity *int32            `json:"quantity"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.SKU != nil {
+		variant.Sku = *input.SKU
+	}
+	if input.Options != nil {
+		variant.Options = input.Options
+	}
+
+	v := validator.New()
+	// As with products, stock changes through stock movements so that this
+	// snapshot's quantity cannot overwrite reservations made since.
+	v.Check(input.Quantity == nil, "quantity", "must be changed through stock movements")
+	setVariantPrice(v, variant, input.Price, product.GetCurrency())
+	if ValidateVariant(v, variant); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	response, err := app.productServiceClient.UpdateProductVariant(ctx, &productServiceProto.UpdateProductVariantRequest{
+		Variant: variant,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"variant": newVariantView(response.GetVariant(), product)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteProductVariantHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	variantID, err := app.readNamedIDParam(r, "variant_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), w, r), app.config.Load().Timeouts.Upstream)
+	defer cancel()
+
+	response, err := app.productServiceClient.DeleteProductVariant(ctx, &productServiceProto.DeleteProductVariantRequest{
+		ProductId: id,
+		VariantId: variantID,
+	})
+	if err != nil {
+		app.upstreamErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": response.GetMessage()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	productServiceProto "github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"testing"
+)
+
+func TestTableDrivenValidateVariant(t *testing.T) {
+	var tests = []struct {
+		name     string
+		input    *productServiceProto.ProductVariant
+		expected bool
+	}{
+		{
+			"ValidateVariant(noSKUVariant) must return false",
+			&productServiceProto.ProductVariant{Options: map[string]string{"size": "M"}},
+			false,
+		},
+		{
+			"ValidateVariant(noOptionsVariant) must return false",
+			&productServiceProto.ProductVariant{Sku: "TS-M"},
+			false,
+		},
+		{
+			"ValidateVariant(negativeQuantityVariant) must return false",
+			&productServiceProto.ProductVariant{Sku: "TS-M", Options: map[string]string{"size": "M"}, Quantity: -1},
+			false,
+		},
+		{
+			"ValidateVariant(perfectVariant) must return true",
+			&productServiceProto.ProductVariant{Sku: "TS-M", Options: map[string]string{"size": "M"}, Quantity: 3},
+			true,
+		},
+	}
+
+	for _, tst := range tests {
+		v := validator.New()
+		t.Run(tst.name, func(t *testing.T) {
+			ValidateVariant(v, tst.input)
+			if result := v.Valid(); result != tst.expected {
+				t.Errorf("%s: got %v", tst.name, result)
+			}
+		})
+	}
+}
+
+func TestSetVariantPrice(t *testing.T) {
+	existing := int64(500)
+
+	var tests = []struct {
+		name     string
+		raw      string
+		expected *int64
+		valid    bool
+	}{
+		{"Missing price keeps the override", "", &existing, true},
+		{"Null price clears the override", "null", nil, true},
+		{"String price is parsed", `"12.50"`, func() *int64 { p := int64(1250); return &p }(), true},
+		{"Too many digits", `"1.234"`, &existing, false},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			price := existing
+			variant := &productServiceProto.ProductVariant{PriceMinor: &price}
+			v := validator.New()
+			setVariantPrice(v, variant, json.RawMessage(tst.raw), "USD")
+
+			if v.Valid() != tst.valid {
+				t.Fatalf("%s: valid = %v, expected %v", tst.name, v.Valid(), tst.valid)
+			}
+			switch {
+			case tst.expected == nil && variant.PriceMinor != nil:
+				t.Errorf("%s: price = %d, expected none", tst.name, *variant.PriceMinor)
+			case tst.expected != nil && (variant.PriceMinor == nil || *variant.PriceMinor != *tst.expected):
+				t.Errorf("%s: price = %v, expected %d", tst.name, variant.PriceMinor, *tst.expected)
+			}
+		})
+	}
+}
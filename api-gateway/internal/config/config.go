@@ -0,0 +1,310 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/validator"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Env        string    `yaml:"env"`
+	ListenAddr string    `yaml:"listen_addr"`
+	LogLevel   string    `yaml:"log_level"`
+	Upstreams  Upstreams `yaml:"upstreams"`
+	RMQ        RMQ       `yaml:"rmq"`
+	Limiter    Limiter   `yaml:"limiter"`
+	Timeouts   Timeouts  `yaml:"timeouts"`
+	Uploads    Uploads   `yaml:"uploads"`
+	Auth       Auth      `yaml:"auth"`
+}
+
+type Upstreams struct {
+	ProductService Upstream `yaml:"product_service"`
+}
+
+// Upstream lists the replicas of a backend service, either inline as
+// host:port or dns:///host:port addresses, or in an endpoints file that is
+// re-read every RefreshInterval so replicas can be added or removed at runtime.
+type Upstream struct {
+	Addresses       []string      `yaml:"addresses"`
+	EndpointsFile   string        `yaml:"endpoints_file"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	HealthCheck     bool          `yaml:"health_check"`
+}
+
+type RMQ struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type Limiter struct {
+	Enabled bool    `yaml:"enabled"`
+	RPS     float64 `yaml:"rps"`
+	Burst   int     `yaml:"burst"`
+}
+
+// Timeouts holds the HTTP server timeouts, which are fixed once the server is
+// listening, and the upstream call timeout, which is reloadable.
+type Timeouts struct {
+	Read     time.Duration `yaml:"read"`
+	Write    time.Duration `yaml:"write"`
+	Idle     time.Duration `yaml:"idle"`
+	Shutdown time.Duration `yaml:"shutdown"`
+	Upstream time.Duration `yaml:"upstream"`
+}
+
+// Uploads limits the request bodies accepted by upload endpoints.
+type Uploads struct {
+	MaxImageSize int64 `yaml:"max_image_size"`
+}
+
+// Auth holds the secret that verifies the HS256 access tokens issued by
+// user-service; it must match user-service's JWT_ACCESS_SECRET. Without it
+// no token is accepted and every request is anonymous.
+type Auth struct {
+	AccessSecret string `yaml:"access_secret"`
+}
+
+// ValidationError lists every invalid setting found in a configuration.
+type ValidationError struct {
+	Errors map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	keys := make([]string, 0, len(e.Errors))
+	for key := range e.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	messages := make([]string, 0, len(keys))
+	for _, key := range keys {
+		messages = append(messages, fmt.Sprintf("%s %s", key, e.Errors[key]))
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+func Default() *Config {
+	return &Config{
+		Env:        "development",
+		ListenAddr: ":7000",
+		LogLevel:   "info",
+		Upstreams: Upstreams{
+			ProductService: Upstream{
+				RefreshInterval: 5 * time.Second,
+				HealthCheck:     true,
+			},
+		},
+		RMQ: RMQ{
+			Addr: "localhost:5672",
+		},
+		Limiter: Limiter{
+			Enabled: true,
+			RPS:     2,
+			Burst:   4,
+		},
+		Timeouts: Timeouts{
+			Read:     10 * time.Second,
+			Write:    30 * time.Second,
+			Idle:     time.Minute,
+			Shutdown: 5 * time.Second,
+			Upstream: 5 * time.Second,
+		},
+		Uploads: Uploads{
+			MaxImageSize: 5 << 20,
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the YAML file at path (if
+// path is not empty and the file exists) and finally the environment, which
+// also picks up a .env file when one is present. Unknown keys in the file are
+// rejected.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	raw, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	_ = godotenv.Load(".env")
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
+	}
+
+	// Upstream addresses are only defaulted once the file and environment
+	// have been applied, so that setting endpoints_file alone is enough.
+	if len(cfg.Upstreams.ProductService.Addresses) == 0 && cfg.Upstreams.ProductService.EndpointsFile == "" {
+		cfg.Upstreams.ProductService.Addresses = []string{"localhost:7001"}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile returns the contents of the configuration file, or nil when there
+// is none, so that a gateway configured only through the environment can
+// start without one.
+func readFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return raw, err
+}
+
+func (c *Config) Validate() error {
+	v := validator.New()
+
+	v.Check(validator.PermittedValue(c.Env, "development", "staging", "production"), "env", "must be development, staging or production")
+	v.Check(validAddr(c.ListenAddr), "listen_addr", "must be a host:port address")
+	v.Check(validator.PermittedValue(c.LogLevel, "info", "error", "fatal", "off"), "log_level", "must be info, error, fatal or off")
+	validateUpstream(v, "upstreams.product_service", c.Upstreams.ProductService)
+	v.Check(validAddr(c.RMQ.Addr), "rmq.addr", "must be a host:port address")
+
+	if c.Limiter.Enabled {
+		v.Check(c.Limiter.RPS > 0, "limiter.rps", "must be greater than zero")
+		v.Check(c.Limiter.Burst > 0, "limiter.burst", "must be greater than zero")
+	}
+
+	v.Check(c.Timeouts.Read > 0, "timeouts.read", "must be greater than zero")
+	v.Check(c.Timeouts.Write > 0, "timeouts.write", "must be greater than zero")
+	v.Check(c.Timeouts.Idle > 0, "timeouts.idle", "must be greater than zero")
+	v.Check(c.Timeouts.Shutdown > 0, "timeouts.shutdown", "must be greater than zero")
+	v.Check(c.Timeouts.Upstream > 0, "timeouts.upstream", "must be greater than zero")
+	v.Check(c.Uploads.MaxImageSize > 0, "uploads.max_image_size", "must be greater than zero")
+
+	if !v.Valid() {
+		return &ValidationError{Errors: v.Errors}
+	}
+	return nil
+}
+
+func validateUpstream(v *validator.Validator, key string, upstream Upstream) {
+	if upstream.EndpointsFile != "" {
+		v.Check(len(upstream.Addresses) == 0, key, "must not set both addresses and endpoints_file")
+		v.Check(upstream.RefreshInterval > 0, key+".refresh_interval", "must be greater than zero")
+		return
+	}
+
+	v.Check(len(upstream.Addresses) > 0, key, "must set addresses or endpoints_file")
+	for _, addr := range upstream.Addresses {
+		if strings.HasPrefix(addr, "dns:///") {
+			v.Check(len(upstream.Addresses) == 1, key+".addresses", "must contain a single entry when using dns:///")
+			v.Check(validAddr(strings.TrimPrefix(addr, "dns:///")), key+".addresses", "must be host:port addresses")
+			continue
+		}
+		v.Check(validAddr(addr), key+".addresses", "must be host:port addresses")
+	}
+}
+
+func validAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port != ""
+}
+
+// applyEnv overrides file settings with any of the environment variables
+// below that are set.
+func applyEnv(cfg *Config) error {
+	stringVars := map[string]*string{
+		"ENV":          &cfg.Env,
+		"LISTEN_ADDR":  &cfg.ListenAddr,
+		"LOG_LEVEL":    &cfg.LogLevel,
+		"RMQ_ADDR":     &cfg.RMQ.Addr,
+		"RMQ_USERNAME": &cfg.RMQ.Username,
+		"RMQ_PASSWORD": &cfg.RMQ.Password,
+
+		"JWT_ACCESS_SECRET": &cfg.Auth.AccessSecret,
+	}
+	for key, dst := range stringVars {
+		if value, ok := os.LookupEnv(key); ok {
+			*dst = value
+		}
+	}
+
+	// PRODUCT_SERVICE_ADDR takes a comma separated list of addresses and
+	// replaces an endpoints file configured in the file.
+	if value, ok := os.LookupEnv("PRODUCT_SERVICE_ADDR"); ok {
+		cfg.Upstreams.ProductService.Addresses = strings.Split(value, ",")
+		cfg.Upstreams.ProductService.EndpointsFile = ""
+	}
+	if value, ok := os.LookupEnv("PRODUCT_SERVICE_ENDPOINTS_FILE"); ok {
+		cfg.Upstreams.ProductService.EndpointsFile = value
+		cfg.Upstreams.ProductService.Addresses = nil
+	}
+
+	if value, ok := os.LookupEnv("LIMITER_ENABLED"); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("LIMITER_ENABLED: %w", err)
+		}
+		cfg.Limiter.Enabled = enabled
+	}
+	if value, ok := os.LookupEnv("LIMITER_RPS"); ok {
+		rps, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("LIMITER_RPS: %w", err)
+		}
+		cfg.Limiter.RPS = rps
+	}
+	if value, ok := os.LookupEnv("LIMITER_BURST"); ok {
+		burst, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("LIMITER_BURST: %w", err)
+		}
+		cfg.Limiter.Burst = burst
+	}
+
+	durationVars := map[string]*time.Duration{
+		"READ_TIMEOUT":     &cfg.Timeouts.Read,
+		"WRITE_TIMEOUT":    &cfg.Timeouts.Write,
+		"IDLE_TIMEOUT":     &cfg.Timeouts.Idle,
+		"SHUTDOWN_TIMEOUT": &cfg.Timeouts.Shutdown,
+		"UPSTREAM_TIMEOUT": &cfg.Timeouts.Upstream,
+	}
+	for key, dst := range durationVars {
+		if value, ok := os.LookupEnv(key); ok {
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = timeout
+		}
+	}
+
+	if value, ok := os.LookupEnv("MAX_IMAGE_SIZE"); ok {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("MAX_IMAGE_SIZE: %w", err)
+		}
+		cfg.Uploads.MaxImageSize = size
+	}
+
+	return nil
+}
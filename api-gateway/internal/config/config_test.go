@@ -0,0 +1,165 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+listen_addr: ":8000"
+upstreams:
+  product_service:
+    addresses: ["products-1:7001", "products-2:7001"]
+limiter:
+  rps: 10
+timeouts:
+  upstream: 2s
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	if cfg.ListenAddr != ":8000" {
+		t.Errorf("ListenAddr = %q, expected %q", cfg.ListenAddr, ":8000")
+	}
+	if addresses := cfg.Upstreams.ProductService.Addresses; len(addresses) != 2 || addresses[1] != "products-2:7001" {
+		t.Errorf("Upstreams.ProductService.Addresses = %v, expected two products replicas", addresses)
+	}
+	if cfg.Limiter.RPS != 10 || cfg.Limiter.Burst != 4 {
+		t.Errorf("Limiter = %+v, expected rps 10 and default burst 4", cfg.Limiter)
+	}
+	if cfg.Timeouts.Upstream != 2*time.Second || cfg.Timeouts.Read != 10*time.Second {
+		t.Errorf("Timeouts = %+v, expected upstream 2s and default read 10s", cfg.Timeouts)
+	}
+}
+
+func TestLoadEnvOverride(t *testing.T) {
+	path := writeConfig(t, `limiter:
+  burst: 4
+`)
+	t.Setenv("LIMITER_BURST", "12")
+	t.Setenv("PRODUCT_SERVICE_ADDR", "10.0.0.5:7001,10.0.0.6:7001")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	if cfg.Limiter.Burst != 12 {
+		t.Errorf("Limiter.Burst = %d, expected 12", cfg.Limiter.Burst)
+	}
+	if addresses := cfg.Upstreams.ProductService.Addresses; len(addresses) != 2 || addresses[0] != "10.0.0.5:7001" {
+		t.Errorf("Upstreams.ProductService.Addresses = %v, expected the two addresses from the environment", addresses)
+	}
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	t.Setenv("READ_TIMEOUT", "3s")
+	t.Setenv("SHUTDOWN_TIMEOUT", "20s")
+
+	cfg, err := Load(filepath.Join(t.TempDir(), "config.yaml"))
+	if err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	if cfg.ListenAddr != Default().ListenAddr {
+		t.Errorf("ListenAddr = %q, expected the default %q", cfg.ListenAddr, Default().ListenAddr)
+	}
+	if cfg.Timeouts.Read != 3*time.Second || cfg.Timeouts.Shutdown != 20*time.Second || cfg.Timeouts.Write != 30*time.Second {
+		t.Errorf("Timeouts = %+v, expected read 3s and shutdown 20s from the environment and default write 30s", cfg.Timeouts)
+	}
+
+	t.Setenv("IDLE_TIMEOUT", "soon")
+	if _, err := Load(""); err == nil {
+		t.Error("Load() accepted IDLE_TIMEOUT=soon")
+	}
+}
+
+func TestLoadEndpointsFile(t *testing.T) {
+	path := writeConfig(t, `upstreams:
+  product_service:
+    endpoints_file: /etc/gateway/products.txt
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+	if len(cfg.Upstreams.ProductService.Addresses) != 0 {
+		t.Errorf("Upstreams.ProductService.Addresses = %v, expected none alongside an endpoints file", cfg.Upstreams.ProductService.Addresses)
+	}
+}
+
+func TestLoadRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		field    string
+	}{
+		{
+			name:     "Unknown key",
+			contents: "listen_port: 7000\n",
+		},
+		{
+			name:     "Bad listen address",
+			contents: "listen_addr: \"7000\"\n",
+			field:    "listen_addr",
+		},
+		{
+			name:     "Addresses and endpoints file",
+			contents: "upstreams:\n  product_service:\n    addresses: [\"a:1\"]\n    endpoints_file: endpoints.txt\n",
+			field:    "upstreams.product_service",
+		},
+		{
+			name:     "DNS target mixed with addresses",
+			contents: "upstreams:\n  product_service:\n    addresses: [\"dns:///products:7001\", \"a:1\"]\n",
+			field:    "upstreams.product_service.addresses",
+		},
+		{
+			name:     "Zero limiter rps",
+			contents: "limiter:\n  enabled: true\n  rps: 0\n",
+			field:    "limiter.rps",
+		},
+		{
+			name:     "Zero max image size",
+			contents: "uploads:\n  max_image_size: 0\n",
+			field:    "uploads.max_image_size",
+		},
+		{
+			name:     "Unknown log level",
+			contents: "log_level: debug\n",
+			field:    "log_level",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.contents))
+			if err == nil {
+				t.Fatal("Load() returned no error")
+			}
+			if tt.field == "" {
+				return
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Load() returned %v, expected a ValidationError", err)
+			}
+			if _, ok := validationErr.Errors[tt.field]; !ok {
+				t.Errorf("Load() did not report %s: %v", tt.field, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/config"
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/health"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+const (
+	staticScheme = "static"
+	fileScheme   = "file"
+	dnsPrefix    = "dns:///"
+)
+
+// serviceConfig spreads calls across every ready backend and enables client
+// side health checking, so a backend whose grpc.health.v1 service stops
+// reporting SERVING is taken out of rotation until it recovers.
+const serviceConfig = `{
+	"loadBalancingConfig": [{"round_robin": {}}],
+	"healthCheckConfig": {"serviceName": ""}
+}`
+
+// Dial connects to an upstream described in the configuration. Static address
+// lists and endpoints files are resolved by this package, while a single
+// dns:/// address is handed to gRPC's DNS resolver.
+func Dial(name string, upstream config.Upstream, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	var target string
+
+	switch {
+	case upstream.EndpointsFile != "":
+		target = fmt.Sprintf("%s:///%s", fileScheme, name)
+		opts = append(opts, grpc.WithResolvers(&fileBuilder{
+			path:     upstream.EndpointsFile,
+			interval: upstream.RefreshInterval,
+		}))
+	case len(upstream.Addresses) == 1 && strings.HasPrefix(upstream.Addresses[0], dnsPrefix):
+		target = upstream.Addresses[0]
+	default:
+		builder := manual.NewBuilderWithScheme(staticScheme)
+		builder.InitialState(resolver.State{Addresses: toAddresses(upstream.Addresses)})
+		target = fmt.Sprintf("%s:///%s", staticScheme, name)
+		opts = append(opts, grpc.WithResolvers(builder))
+	}
+
+	if upstream.HealthCheck {
+		opts = append(opts, grpc.WithDefaultServiceConfig(serviceConfig))
+	} else {
+		opts = append(opts, grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin": {}}]}`))
+	}
+
+	return grpc.Dial(target, opts...)
+}
+
+// ParseEndpoints reads one host:port per line. Blank lines and lines starting
+// with # are ignored.
+func ParseEndpoints(raw []byte) ([]string, error) {
+	var endpoints []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(text); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		endpoints = append(endpoints, text)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+func toAddresses(endpoints []string) []resolver.Address {
+	addresses := make([]resolver.Address, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		addresses = append(addresses, resolver.Address{Addr: endpoint})
+	}
+	return addresses
+}
+
+type fileBuilder struct {
+	path     string
+	interval time.Duration
+}
+
+func (b *fileBuilder) Build(_ resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	r := &fileResolver{
+		path:     b.path,
+		interval: b.interval,
+		cc:       cc,
+		refresh:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if r.interval <= 0 {
+		r.interval = 5 * time.Second
+	}
+
+	r.update()
+
+	r.wg.Add(1)
+	go r.watch()
+
+	return r, nil
+}
+
+func (b *fileBuilder) Scheme() string {
+	return fileScheme
+}
+
+// fileResolver polls an endpoints file and pushes its contents to the client
+// connection whenever they change. An unreadable or invalid file keeps the
+// last good set of endpoints.
+type fileResolver struct {
+	path     string
+	interval time.Duration
+	cc       resolver.ClientConn
+	last     []byte
+	refresh  chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func (r *fileResolver) watch() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		case <-r.refresh:
+		}
+		r.update()
+	}
+}
+
+func (r *fileResolver) update() {
+	raw, err := os.ReadFile(r.path)
+	if err != nil {
+		r.cc.ReportError(err)
+		return
+	}
+	if r.last != nil && bytes.Equal(raw, r.last) {
+		return
+	}
+
+	endpoints, err := ParseEndpoints(raw)
+	if err != nil {
+		r.cc.ReportError(fmt.Errorf("%s: %w", r.path, err))
+		return
+	}
+	if len(endpoints) == 0 {
+		r.cc.ReportError(fmt.Errorf("%s: no endpoints", r.path))
+		return
+	}
+
+	if err := r.cc.UpdateState(resolver.State{Addresses: toAddresses(endpoints)}); err != nil {
+		return
+	}
+	r.last = raw
+}
+
+func (r *fileResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *fileResolver) Close() {
+	close(r.done)
+	r.wg.Wait()
+}
@@ -0,0 +1,86 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/api-gateway/internal/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	endpoints, err := ParseEndpoints([]byte(`
+# product-service replicas
+10.0.0.1:7001
+
+10.0.0.2:7001
+`))
+	if err != nil {
+		t.Fatalf("ParseEndpoints() returned error: %v", err)
+	}
+	if len(endpoints) != 2 || endpoints[0] != "10.0.0.1:7001" || endpoints[1] != "10.0.0.2:7001" {
+		t.Errorf("ParseEndpoints() returned %v", endpoints)
+	}
+
+	if _, err := ParseEndpoints([]byte("10.0.0.1\n")); err == nil {
+		t.Error("ParseEndpoints() accepted an address without a port")
+	}
+}
+
+// startBackend runs a gRPC server exposing only the health service and
+// returns its address and health server.
+func startBackend(t *testing.T) (string, *health.Server) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(srv, healthServer)
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	return listener.Addr().String(), healthServer
+}
+
+func TestDialEndpointsFile(t *testing.T) {
+	addr, _ := startBackend(t)
+
+	path := filepath.Join(t.TempDir(), "endpoints.txt")
+	if err := os.WriteFile(path, []byte("127.0.0.1:1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := Dial("test", config.Upstream{
+		EndpointsFile:   path,
+		RefreshInterval: 20 * time.Millisecond,
+		HealthCheck:     true,
+	}, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial() returned error: %v", err)
+	}
+	defer conn.Close()
+
+	// Point the file at the live backend; the resolver should pick it up
+	// without redialing.
+	if err := os.WriteFile(path, []byte(addr+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("Check() through the endpoints file failed: %v", err)
+	}
+}
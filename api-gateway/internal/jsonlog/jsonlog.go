@@ -3,6 +3,7 @@ package jsonlog
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"io"
 	"os"
@@ -33,6 +34,21 @@ func (l Level) String() string {
 	}
 }
 
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	case "fatal":
+		return LevelFatal, nil
+	case "off":
+		return LevelOff, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
 type Logger struct {
 	out      io.Writer
 	minLevel Level
@@ -0,0 +1,110 @@
+// Package money converts between the decimal amounts clients read and write
+// and the integer minor units product-service stores.
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/currency"
+)
+
+// DefaultCurrency matches product-service's default for products created
+// without a currency.
+const DefaultCurrency = currency.Default
+
+var (
+	ErrUnknownCurrency = errors.New("unknown currency")
+	ErrInvalidAmount   = errors.New("invalid amount")
+)
+
+// Exponent reports how many minor-unit digits code uses. The table is
+// product-service's, so both sides always agree on it.
+func Exponent(code string) (int, bool) {
+	return currency.Exponent(code)
+}
+
+// Format renders an amount in minor units as a decimal string, e.g. 85000 KZT
+// as "850.00".
+func Format(minor int64, code string) string {
+	exponent, ok := currency.Exponent(code)
+	if !ok || exponent == 0 {
+		return strconv.FormatInt(minor, 10)
+	}
+
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	digits := fmt.Sprintf("%0*d", exponent+1, minor)
+	split := len(digits) - exponent
+	return sign + digits[:split] + "." + digits[split:]
+}
+
+// Parse converts a decimal string into minor units of code. Amounts with
+// more fractional digits than the currency uses are rejected rather than
+// rounded.
+func Parse(amount string, code string) (int64, error) {
+	exponent, ok := currency.Exponent(code)
+	if !ok {
+		return 0, ErrUnknownCurrency
+	}
+
+	negative := strings.HasPrefix(amount, "-")
+	amount = strings.TrimPrefix(amount, "-")
+
+	whole, fraction, _ := strings.Cut(amount, ".")
+	if whole == "" || len(fraction) > exponent || !isDigits(whole) || !isDigits(fraction) {
+		return 0, ErrInvalidAmount
+	}
+	if strings.Contains(amount, ".") && fraction == "" {
+		return 0, ErrInvalidAmount
+	}
+
+	fraction += strings.Repeat("0", exponent-len(fraction))
+	minor, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidAmount
+	}
+	if negative {
+		minor = -minor
+	}
+	return minor, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decimal holds an amount exactly as the client wrote it. It accepts both a
+// JSON string ("12.50") and a JSON number (12.50), so the literal is never
+// rounded through a float.
+type Decimal string
+
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*d = Decimal(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*d = Decimal(n.String())
+	return nil
+}
@@ -0,0 +1,74 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		minor    int64
+		currency string
+		expected string
+	}{
+		{85000, "KZT", "850.00"},
+		{5, "USD", "0.05"},
+		{-1234, "EUR", "-12.34"},
+		{1500, "JPY", "1500"},
+		{1, "KWD", "0.001"},
+	}
+
+	for _, tt := range tests {
+		if result := Format(tt.minor, tt.currency); result != tt.expected {
+			t.Errorf("Format(%d, %s) = %q, expected %q", tt.minor, tt.currency, result, tt.expected)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		expected int64
+		wantErr  bool
+	}{
+		{amount: "850", currency: "KZT", expected: 85000},
+		{amount: "850.5", currency: "KZT", expected: 85050},
+		{amount: "0.01", currency: "USD", expected: 1},
+		{amount: "-12.34", currency: "EUR", expected: -1234},
+		{amount: "1500", currency: "JPY", expected: 1500},
+		{amount: "1.5", currency: "JPY", wantErr: true},
+		{amount: "0.001", currency: "USD", wantErr: true},
+		{amount: "1.", currency: "USD", wantErr: true},
+		{amount: ".5", currency: "USD", wantErr: true},
+		{amount: "1e3", currency: "USD", wantErr: true},
+		{amount: "", currency: "USD", wantErr: true},
+		{amount: "1", currency: "XXX", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		result, err := Parse(tt.amount, tt.currency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q, %s) error = %v, wantErr %v", tt.amount, tt.currency, err, tt.wantErr)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("Parse(%q, %s) = %d, expected %d", tt.amount, tt.currency, result, tt.expected)
+		}
+	}
+}
+
+func TestDecimalUnmarshalJSON(t *testing.T) {
+	var input struct {
+		Number Decimal `json:"number"`
+		String Decimal `json:"string"`
+	}
+
+	err := json.Unmarshal([]byte(`{"number": 19.99, "string": "0.10"}`), &input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if input.Number != "19.99" || input.String != "0.10" {
+		t.Errorf("got %q and %q, expected \"19.99\" and \"0.10\"", input.Number, input.String)
+	}
+}
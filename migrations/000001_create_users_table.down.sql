@@ -1,3 +0,0 @@
-DROP EXTENSION IF EXISTS citext;
-
-DROP TABLE IF EXISTS users;
\ No newline at end of file
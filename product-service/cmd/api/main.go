@@ -1,17 +1,30 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/Skaifai/gophers-microservice/product-service/cmd/utils"
 	"github.com/Skaifai/gophers-microservice/product-service/config"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/cache"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
 	"github.com/Skaifai/gophers-microservice/product-service/internal/logger"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/outbox"
 	"github.com/Skaifai/gophers-microservice/product-service/internal/server"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/server/closer"
 	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
 	_ "github.com/lib/pq"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -19,35 +32,358 @@ func main() {
 
 	flag.IntVar(&cfg.Port, "port", cfg.Port, "API server port")
 	flag.StringVar(&cfg.Env, "env", cfg.Env, "Environment (development|staging|production)")
+	flag.DurationVar(&cfg.IdempotencyWindow, "idempotency-window", cfg.IdempotencyWindow, "How long AddProduct idempotency keys are kept")
+	flag.DurationVar(&cfg.ReservationTTL, "reservation-ttl", cfg.ReservationTTL, "How long reserved stock is held before it is released")
+	flag.DurationVar(&cfg.ReservationSweepInterval, "reservation-sweep-interval", cfg.ReservationSweepInterval, "How often expired reservations are released")
+	flag.DurationVar(&cfg.DeletedRetention, "deleted-retention", cfg.DeletedRetention, "How long deleted products can be restored before they are purged (0 keeps them)")
+	flag.DurationVar(&cfg.PurgeInterval, "purge-interval", cfg.PurgeInterval, "How often deleted products past their retention are purged")
+	flag.DurationVar(&cfg.OutboxInterval, "outbox-interval", cfg.OutboxInterval, "How often pending outbox messages are published")
+	flag.IntVar(&cfg.OutboxBatchSize, "outbox-batch-size", cfg.OutboxBatchSize, "Most outbox messages published per transaction")
+	flag.StringVar(&cfg.EventEncoding, "event-encoding", cfg.EventEncoding, "How product events are published (protobuf|json)")
+	flag.IntVar(&cfg.MetricsPort, "metrics-port", cfg.MetricsPort, "Port serving expvar metrics (0 disables them)")
+	flag.DurationVar(&cfg.GracefulStopTimeout, "graceful-stop-timeout", cfg.GracefulStopTimeout, "How long in-flight RPCs may run after a shutdown signal")
+	flag.IntVar(&cfg.MaxBatchSize, "max-batch-size", cfg.MaxBatchSize, "Most products one BatchGetProducts call may ask for")
+	flag.IntVar(&cfg.MaxImageSize, "max-image-size", cfg.MaxImageSize, "Largest image upload accepted, in bytes")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "How long the whole shutdown sequence may take")
+	flag.DurationVar(&cfg.QueryTimeouts.Read, "db-read-timeout", cfg.QueryTimeouts.Read, "How long a product read may take")
+	flag.DurationVar(&cfg.QueryTimeouts.Write, "db-write-timeout", cfg.QueryTimeouts.Write, "How long a product write may take")
+	flag.DurationVar(&cfg.QueryTimeouts.Sweep, "db-sweep-timeout", cfg.QueryTimeouts.Sweep, "How long one batch of a background sweep may take")
+	flag.DurationVar(&cfg.SlowQueryThreshold, "slow-query-threshold", cfg.SlowQueryThreshold, "Product queries at least this slow are logged (0 disables it)")
+
+	flag.StringVar(&cfg.Cache.Backend, "cache-backend", cfg.Cache.Backend, "Where product reads are cached (lru|redis|none)")
+	flag.IntVar(&cfg.Cache.Size, "cache-size", cfg.Cache.Size, "Most products the lru cache holds")
+	flag.DurationVar(&cfg.Cache.TTL, "cache-ttl", cfg.Cache.TTL, "How long a cached product is served before it is read again")
+	flag.StringVar(&cfg.Cache.RedisAddr, "redis-addr", cfg.Cache.RedisAddr, "Address of the redis cache")
 
 	flag.StringVar(&cfg.DB.DSN, "db-dsn", cfg.DB.DSN, "PostgreSQL DSN")
 	flag.IntVar(&cfg.DB.MaxOpenConns, "db-max-open-conns", cfg.DB.MaxOpenConns, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.DB.MaxIdleConns, "db-max-idle-conns", cfg.DB.MaxIdleConns, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.DB.MaxIdleTime, "db-max-idle-time", cfg.DB.MaxIdleTime, "PostgreSQL max idle time")
+	flag.BoolVar(&cfg.DB.AutoMigrate, "auto-migrate", cfg.DB.AutoMigrate, "Apply pending migrations on startup")
+	flag.DurationVar(&cfg.DB.ReadYourWritesWindow, "db-read-your-writes-window", cfg.DB.ReadYourWritesWindow, "How long a caller reads from the primary after writing")
+	flag.DurationVar(&cfg.DB.ReplicaCheckInterval, "db-replica-check-interval", cfg.DB.ReplicaCheckInterval, "How often read replicas are health-checked")
 
 	flag.Parse()
 
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(cfg, flag.Args()[1:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
+	if cfg.EventEncoding != outbox.EncodingProtobuf && cfg.EventEncoding != outbox.EncodingJSON {
+		log.Fatalf("unknown event encoding %q", cfg.EventEncoding)
+	}
+
+	if cfg.DB.AutoMigrate {
+		if err := autoMigrate(cfg); err != nil {
+			log.Fatalf("failed to migrate: %v", err)
+		}
+	}
+
 	db, err := utils.OpenDB(cfg)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	defer db.Close()
+
+	replicaDBs, err := utils.OpenReplicas(cfg)
+	if err != nil {
+		log.Fatalf("failed to open read replicas: %v", err)
+	}
+	var replicas *data.Replicas
+	if len(replicaDBs) > 0 {
+		replicas = data.NewReplicas(replicaDBs)
+		replicas.Check(context.Background())
+	}
 
 	publisher, err := logger.NewPublisher()
 	if err != nil {
 		log.Fatalf("failed to create publisher: %v", err)
 	}
-	defer publisher.Close()
 
-	srv := grpc.NewServer()
-	proto.RegisterProductServiceServer(srv, server.NewServer(db, publisher))
+	store, err := utils.OpenStorage(cfg)
+	if err != nil {
+		log.Fatalf("failed to open storage: %v", err)
+	}
+
+	cacheStore, err := openCache(cfg)
+	if err != nil {
+		log.Fatalf("failed to open cache: %v", err)
+	}
+
+	timeouts := data.Timeouts{
+		Read:  cfg.QueryTimeouts.Read,
+		Write: cfg.QueryTimeouts.Write,
+		Sweep: cfg.QueryTimeouts.Sweep,
+	}
+	slowQueries := &data.SlowQueryLog{Threshold: cfg.SlowQueryThreshold, Logger: publisher}
+	models := data.NewModels(db, replicas, timeouts, slowQueries)
+
+	// Each replica caches on its own or shares a Redis with the others;
+	// either way, writes are announced on the broker so that every replica
+	// drops what it holds of the products they changed.
+	var productCache *cache.Cache
+	if cacheStore != nil {
+		productCache = cache.New(cacheStore, cfg.Cache.TTL)
+		productCache.Notifier = publisher
+		models = cache.Wrap(models, productCache)
+	}
+
+	// Leave room for the rest of the message around an upload of the
+	// largest allowed image.
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(server.UnaryInterceptors(cfg.DB.ReadYourWritesWindow)...),
+		grpc.MaxRecvMsgSize(cfg.MaxImageSize+1<<20),
+	)
+	productServer := server.NewServer(models, publisher, store, cfg)
+	healthServer := health.NewServer()
+
+	proto.RegisterProductServiceServer(srv, productServer)
+	healthpb.RegisterHealthServer(srv, healthServer)
 	listen, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
+	// Images kept on local disk are served from here; with S3 the bucket or
+	// its CDN serves them instead.
+	var media *http.Server
+	if cfg.Storage.Backend == "local" && cfg.Storage.MediaPort > 0 {
+		media = &http.Server{
+			Addr:        fmt.Sprintf(":%d", cfg.Storage.MediaPort),
+			Handler:     http.StripPrefix("/media/", http.FileServer(http.Dir(cfg.Storage.Root))),
+			IdleTimeout: time.Minute,
+			ReadTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Printf("Serving media on port :%d", cfg.Storage.MediaPort)
+			if err := media.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("media server failed: %v", err)
+			}
+		}()
+	}
+
+	var metrics *http.Server
+	if cfg.MetricsPort > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		metrics = &http.Server{
+			Addr:        fmt.Sprintf(":%d", cfg.MetricsPort),
+			Handler:     mux,
+			IdleTimeout: time.Minute,
+			ReadTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Printf("Serving metrics on port :%d", cfg.MetricsPort)
+			if err := metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	relay := &outbox.Relay{
+		Outbox:    productServer.Outbox,
+		Publisher: publisher,
+		Interval:  cfg.OutboxInterval,
+		BatchSize: cfg.OutboxBatchSize,
+		Encoding:  cfg.EventEncoding,
+	}
+
+	background, stopBackground := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		relay.Run(background)
+		close(relayDone)
+	}()
+	go purgeIdempotencyKeys(background, productServer)
+	go sweepReservations(background, productServer, cfg.ReservationSweepInterval)
+	if cfg.DeletedRetention > 0 {
+		go purgeDeletedProducts(background, productServer, cfg.PurgeInterval)
+	}
+	if replicas != nil {
+		go replicas.Run(background, cfg.DB.ReplicaCheckInterval)
+	}
+	if productCache != nil {
+		go productCache.Listen(background, config.GetEnvironmentVar("RMQ_DSN"))
+	}
+
+	// Shutdown runs in the order the handlers are added: stop taking traffic,
+	// wait for the relay to put down its batch, let in-flight RPCs finish,
+	// then release the publisher and the database they were using.
+	c := closer.New()
+	c.Add(func(ctx context.Context) error {
+		healthServer.Shutdown()
+		stopBackground()
+		select {
+		case <-relayDone:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("outbox relay did not stop: %w", ctx.Err())
+		}
+	})
+	c.Add(func(ctx context.Context) error {
+		return gracefulStop(ctx, srv, cfg.GracefulStopTimeout)
+	})
+	if media != nil {
+		c.Add(media.Shutdown)
+	}
+	if metrics != nil {
+		c.Add(metrics.Shutdown)
+	}
+	c.Add(publisher.Close)
+	if redis, ok := cacheStore.(*cache.Redis); ok {
+		c.Add(redis.Close)
+	}
+	c.Add(func(ctx context.Context) error {
+		return db.Close()
+	})
+	if replicas != nil {
+		c.Add(func(ctx context.Context) error {
+			return replicas.Close()
+		})
+	}
+
+	shutdownError := make(chan error)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+		log.Printf("caught signal %s, shutting down", s)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+
+		shutdownError <- c.Close(ctx)
+	}()
+
 	log.Printf("Server is running on port :%d", cfg.Port)
 	if err := srv.Serve(listen); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
+
+	if err := <-shutdownError; err != nil {
+		log.Fatalf("failed to shut down cleanly: %v", err)
+	}
+	log.Printf("Server stopped")
+}
+
+// openCache returns the store product reads are cached in, or nil when
+// caching is turned off.
+func openCache(cfg *config.Config) (cache.Store, error) {
+	switch cfg.Cache.Backend {
+	case "none":
+		return nil, nil
+	case "lru":
+		if cfg.Cache.Size <= 0 {
+			return nil, fmt.Errorf("lru cache needs a positive size")
+		}
+		return cache.NewLRU(cfg.Cache.Size), nil
+	case "redis":
+		if cfg.Cache.RedisAddr == "" {
+			return nil, fmt.Errorf("redis cache needs an address")
+		}
+		return cache.NewRedis(cfg.Cache.RedisAddr, cfg.Cache.RedisPassword, cfg.Cache.RedisDB), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.Cache.Backend)
+	}
+}
+
+// gracefulStop waits up to timeout for in-flight RPCs to finish and then
+// cancels whatever is still running.
+func gracefulStop(ctx context.Context, srv *grpc.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		return fmt.Errorf("in-flight RPCs cancelled: %v", ctx.Err())
+	}
+}
+
+func purgeIdempotencyKeys(ctx context.Context, s *server.Server) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := s.Products.DeleteExpiredIdempotencyKeys(ctx)
+		if err != nil {
+			log.Printf("failed to purge idempotency keys: %v", err)
+			continue
+		}
+		log.Printf("purged %d expired idempotency keys", deleted)
+	}
+}
+
+// sweepReservations returns the stock held by expired reservations. Each pass
+// works in batches until nothing expired is left.
+func sweepReservations(ctx context.Context, s *server.Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			expired, _, err := s.Products.ExpireReservations(ctx, 100)
+			if err != nil {
+				log.Printf("failed to expire reservations: %v", err)
+				break
+			}
+			if expired > 0 {
+				log.Printf("released %d expired reservations", expired)
+			}
+			if expired < 100 || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+}
+
+// purgeDeletedProducts removes deleted products once their retention period
+// is over. Like sweepReservations, each pass works in batches.
+func purgeDeletedProducts(ctx context.Context, s *server.Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			purged, err := s.PurgeDeletedProducts(ctx, 100)
+			if err != nil {
+				log.Printf("failed to purge deleted products: %v", err)
+				break
+			}
+			if purged > 0 {
+				log.Printf("purged %d deleted products", purged)
+			}
+			if purged < 100 || ctx.Err() != nil {
+				break
+			}
+		}
+	}
 }
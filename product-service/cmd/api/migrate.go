@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/product-service/cmd/utils"
+	"github.com/Skaifai/gophers-microservice/product-service/config"
+	"github.com/golang-migrate/migrate/v4"
+	"log"
+	"strconv"
+)
+
+var errMigrateUsage = errors.New("usage: migrate up [N] | down [N|all] | version | force VERSION")
+
+// runMigrate carries out the arguments left after "migrate" once the flags
+// are parsed, so -db-dsn and the environment choose the database as they do
+// for the server. up applies everything pending or the next N migrations,
+// down rolls back the last one, the last N or all of them, and force records
+// a version without running anything, to recover a dirty schema.
+func runMigrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errMigrateUsage
+	}
+	var arg string
+	if len(args) == 2 {
+		arg = args[1]
+	}
+	n, convErr := strconv.Atoi(arg)
+
+	var run func(m *migrate.Migrate) error
+	switch {
+	case args[0] == "up" && arg == "":
+		run = (*migrate.Migrate).Up
+	case args[0] == "up" && convErr == nil && n > 0:
+		run = func(m *migrate.Migrate) error { return m.Steps(n) }
+	case args[0] == "down" && arg == "":
+		run = func(m *migrate.Migrate) error { return m.Steps(-1) }
+	case args[0] == "down" && arg == "all":
+		run = (*migrate.Migrate).Down
+	case args[0] == "down" && convErr == nil && n > 0:
+		run = func(m *migrate.Migrate) error { return m.Steps(-n) }
+	case args[0] == "version" && arg == "":
+		run = func(m *migrate.Migrate) error { return nil }
+	case args[0] == "force" && convErr == nil:
+		run = func(m *migrate.Migrate) error { return m.Force(n) }
+	default:
+		return errMigrateUsage
+	}
+
+	m, err := utils.OpenMigrations(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open migrations: %v", err)
+	}
+	defer m.Close()
+
+	err = run(m)
+	if errors.Is(err, migrate.ErrNoChange) {
+		log.Printf("no migrations to apply")
+	} else if err != nil {
+		return err
+	}
+	return logVersion(m)
+}
+
+// autoMigrate applies every pending migration before the server starts. The
+// postgres driver holds an advisory lock while it migrates, so replicas
+// started together wait for each other and apply each migration once.
+func autoMigrate(cfg *config.Config) error {
+	m, err := utils.OpenMigrations(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open migrations: %v", err)
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return logVersion(m)
+}
+
+func logVersion(m *migrate.Migrate) error {
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		log.Printf("schema has no migrations applied")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dirty {
+		log.Printf("schema is at version %d and dirty: fix it by hand, then run migrate force %d", version, version)
+		return nil
+	}
+	log.Printf("schema is at version %d", version)
+	return nil
+}
@@ -3,25 +3,58 @@ package utils
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"github.com/Skaifai/gophers-microservice/product-service/config"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/storage"
+	"github.com/Skaifai/gophers-microservice/product-service/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"time"
 )
 
 func OpenDB(cfg *config.Config) (*sql.DB, error) {
-	db, err := sql.Open("postgres", cfg.DB.DSN)
+	return openPool(cfg.DB.DSN, cfg.DB.MaxOpenConns, cfg.DB.MaxIdleConns, cfg.DB.MaxIdleTime, true)
+}
+
+// OpenReplicas opens a pool for each read replica. They are not pinged: a
+// replica that is down is taken out of rotation by its health checks rather
+// than stopping the server from starting.
+func OpenReplicas(cfg *config.Config) ([]*sql.DB, error) {
+	var dbs []*sql.DB
+	for i, replica := range cfg.DB.Replicas {
+		db, err := openPool(replica.DSN, replica.MaxOpenConns, replica.MaxIdleConns, replica.MaxIdleTime, false)
+		if err != nil {
+			for _, db := range dbs {
+				db.Close()
+			}
+			return nil, fmt.Errorf("replica %d: %v", i+1, err)
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+func openPool(dsn string, maxOpenConns, maxIdleConns int, maxIdleTime string, ping bool) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	db.SetMaxIdleConns(cfg.DB.MaxIdleConns)
-	db.SetMaxOpenConns(cfg.DB.MaxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetMaxOpenConns(maxOpenConns)
 
-	duration, err := time.ParseDuration(cfg.DB.MaxIdleTime)
+	duration, err := time.ParseDuration(maxIdleTime)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 	db.SetConnMaxIdleTime(duration)
 
+	if !ping {
+		return db, nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	err = db.PingContext(ctx)
@@ -32,3 +65,60 @@ func OpenDB(cfg *config.Config) (*sql.DB, error) {
 
 	return db, nil
 }
+
+func OpenStorage(cfg *config.Config) (storage.Storage, error) {
+	switch cfg.Storage.Backend {
+	case "local":
+		return storage.Local{
+			Root:    cfg.Storage.Root,
+			BaseURL: cfg.Storage.BaseURL,
+		}, nil
+	case "s3":
+		if cfg.Storage.S3.Endpoint == "" || cfg.Storage.S3.Bucket == "" {
+			return nil, fmt.Errorf("s3 storage needs an endpoint and a bucket")
+		}
+		s3, err := storage.NewS3(storage.S3Options{
+			Endpoint:  cfg.Storage.S3.Endpoint,
+			Region:    cfg.Storage.S3.Region,
+			Bucket:    cfg.Storage.S3.Bucket,
+			AccessKey: cfg.Storage.S3.AccessKey,
+			SecretKey: cfg.Storage.S3.SecretKey,
+			PublicURL: cfg.Storage.S3.PublicURL,
+			PathStyle: cfg.Storage.S3.PathStyle,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s3, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+}
+
+// OpenMigrations opens the embedded migrations against the database on a
+// connection of their own, so closing them leaves the server's pool alone.
+func OpenMigrations(cfg *config.Config) (*migrate.Migrate, error) {
+	db, err := sql.Open("postgres", cfg.DB.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	source, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		driver.Close()
+		return nil, err
+	}
+
+	m, err := migrate.NewWithInstance("iofs", source, "postgres", driver)
+	if err != nil {
+		driver.Close()
+		return nil, err
+	}
+	return m, nil
+}
@@ -1,42 +1,250 @@
 package config
 
 import (
+	"fmt"
 	"github.com/joho/godotenv"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	Port int
 	Env  string
-	DB   struct {
+	// IdempotencyWindow is how long an AddProduct idempotency key is kept.
+	IdempotencyWindow time.Duration
+	// ReservationTTL is how long reserved stock is held before the sweeper,
+	// which runs every ReservationSweepInterval, returns it.
+	ReservationTTL           time.Duration
+	ReservationSweepInterval time.Duration
+	// DeletedRetention is how long deleted products can still be restored
+	// before the purge, which runs every PurgeInterval, removes them. Zero
+	// keeps them forever.
+	DeletedRetention time.Duration
+	PurgeInterval    time.Duration
+	// OutboxInterval is how often the relay looks for outbox messages to
+	// publish, up to OutboxBatchSize per transaction.
+	OutboxInterval  time.Duration
+	OutboxBatchSize int
+	// EventEncoding is how product events are published: "protobuf" or
+	// "json".
+	EventEncoding string
+	// MetricsPort serves expvar metrics on /debug/vars. Zero disables it.
+	MetricsPort int
+	// GracefulStopTimeout bounds how long in-flight RPCs may run after a
+	// shutdown signal; ShutdownTimeout bounds the whole shutdown sequence.
+	GracefulStopTimeout time.Duration
+	ShutdownTimeout     time.Duration
+	// MaxImageSize is the largest image upload accepted, in bytes.
+	MaxImageSize int
+	// MaxBatchSize is how many products one BatchGetProducts call may ask for.
+	MaxBatchSize int
+	// QueryTimeouts bound product queries by kind. Queries that take
+	// SlowQueryThreshold or longer are published to the logs; zero turns
+	// that off.
+	QueryTimeouts      QueryTimeouts
+	SlowQueryThreshold time.Duration
+	Storage            Storage
+	Cache              Cache
+	DB                 struct {
 		DSN          string
 		MaxOpenConns int
 		MaxIdleConns int
 		MaxIdleTime  string
+		// AutoMigrate applies pending migrations on startup.
+		AutoMigrate bool
+		// Replicas serve product reads. A caller that writes gets a token
+		// that sends its reads to the primary for ReadYourWritesWindow
+		// afterwards, and replicas are health-checked every
+		// ReplicaCheckInterval.
+		Replicas             []Replica
+		ReadYourWritesWindow time.Duration
+		ReplicaCheckInterval time.Duration
 	}
 }
 
+// QueryTimeouts bound reads, writes and the background sweeps that expire
+// reservations and purge deleted products and idempotency keys.
+type QueryTimeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Sweep time.Duration
+}
+
+// Replica is a read replica of the database with a pool of its own.
+type Replica struct {
+	DSN          string
+	MaxOpenConns int
+	MaxIdleConns int
+	MaxIdleTime  string
+}
+
+// Storage selects where product images are kept. With the local backend the
+// files under Root are also served over HTTP on MediaPort, which BaseURL
+// should point at.
+type Storage struct {
+	Backend   string
+	Root      string
+	BaseURL   string
+	MediaPort int
+	S3        S3
+}
+
+// Cache sits in front of product reads. The "lru" backend keeps up to Size
+// products in each replica, "redis" keeps them in the server at RedisAddr
+// and "none" reads every product from the database. Entries expire after
+// TTL in case an invalidation is lost.
+type Cache struct {
+	Backend       string
+	Size          int
+	TTL           time.Duration
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+}
+
+type S3 struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PublicURL string
+	PathStyle bool
+}
+
 func GetEnvironmentVar(key string) string {
 	godotenv.Load(".env")
 	return os.Getenv(key)
 }
 
+func getEnvironmentVarOr(key, fallback string) string {
+	if value := GetEnvironmentVar(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// loadReplicas reads the comma-separated DSNs in DB_REPLICA_DSNS. The pool
+// of the nth replica, counting from 1, is sized by DB_REPLICA_<n>_MAX_OPEN_CONNS,
+// DB_REPLICA_<n>_MAX_IDLE_CONNS and DB_REPLICA_<n>_MAX_IDLE_TIME.
+func loadReplicas() []Replica {
+	var replicas []Replica
+	for i, dsn := range strings.Split(GetEnvironmentVar("DB_REPLICA_DSNS"), ",") {
+		dsn = strings.TrimSpace(dsn)
+		if dsn == "" {
+			continue
+		}
+		prefix := fmt.Sprintf("DB_REPLICA_%d_", i+1)
+		maxOpenConns, err := strconv.Atoi(GetEnvironmentVar(prefix + "MAX_OPEN_CONNS"))
+		if err != nil {
+			maxOpenConns = 25
+		}
+		maxIdleConns, err := strconv.Atoi(GetEnvironmentVar(prefix + "MAX_IDLE_CONNS"))
+		if err != nil {
+			maxIdleConns = 25
+		}
+		replicas = append(replicas, Replica{
+			DSN:          dsn,
+			MaxOpenConns: maxOpenConns,
+			MaxIdleConns: maxIdleConns,
+			MaxIdleTime:  getEnvironmentVarOr(prefix+"MAX_IDLE_TIME", "15m"),
+		})
+	}
+	return replicas
+}
+
+// getDurationOr reads a duration such as "3s" from the environment.
+func getDurationOr(key string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(GetEnvironmentVar(key))
+	if err != nil {
+		return fallback
+	}
+	return duration
+}
+
 func LoadConfiguration() *Config {
 	port, _ := strconv.Atoi(GetEnvironmentVar("PORT"))
+	mediaPort, err := strconv.Atoi(GetEnvironmentVar("MEDIA_PORT"))
+	if err != nil {
+		mediaPort = 7002
+	}
+	metricsPort, err := strconv.Atoi(GetEnvironmentVar("METRICS_PORT"))
+	if err != nil {
+		metricsPort = 7003
+	}
+	pathStyle, _ := strconv.ParseBool(GetEnvironmentVar("S3_PATH_STYLE"))
+	autoMigrate, _ := strconv.ParseBool(GetEnvironmentVar("AUTO_MIGRATE"))
+	cacheSize, err := strconv.Atoi(GetEnvironmentVar("CACHE_SIZE"))
+	if err != nil {
+		cacheSize = 10000
+	}
+	redisDB, _ := strconv.Atoi(GetEnvironmentVar("REDIS_DB"))
+
 	return &Config{
-		Port: port,
-		Env:  "development",
+		Port:                     port,
+		Env:                      "development",
+		IdempotencyWindow:        24 * time.Hour,
+		ReservationTTL:           15 * time.Minute,
+		ReservationSweepInterval: time.Minute,
+		DeletedRetention:         30 * 24 * time.Hour,
+		PurgeInterval:            time.Hour,
+		OutboxInterval:           time.Second,
+		OutboxBatchSize:          100,
+		EventEncoding:            getEnvironmentVarOr("EVENT_ENCODING", "protobuf"),
+		MetricsPort:              metricsPort,
+		GracefulStopTimeout:      10 * time.Second,
+		ShutdownTimeout:          15 * time.Second,
+		MaxImageSize:             5 << 20,
+		MaxBatchSize:             100,
+		QueryTimeouts: QueryTimeouts{
+			Read:  getDurationOr("DB_READ_TIMEOUT", 3*time.Second),
+			Write: getDurationOr("DB_WRITE_TIMEOUT", 3*time.Second),
+			Sweep: getDurationOr("DB_SWEEP_TIMEOUT", 10*time.Second),
+		},
+		SlowQueryThreshold: getDurationOr("SLOW_QUERY_THRESHOLD", 500*time.Millisecond),
+		Storage: Storage{
+			Backend:   getEnvironmentVarOr("STORAGE_BACKEND", "local"),
+			Root:      getEnvironmentVarOr("STORAGE_ROOT", "media"),
+			BaseURL:   getEnvironmentVarOr("STORAGE_BASE_URL", "http://localhost:7002/media"),
+			MediaPort: mediaPort,
+			S3: S3{
+				Endpoint:  GetEnvironmentVar("S3_ENDPOINT"),
+				Region:    getEnvironmentVarOr("S3_REGION", "us-east-1"),
+				Bucket:    GetEnvironmentVar("S3_BUCKET"),
+				AccessKey: GetEnvironmentVar("S3_ACCESS_KEY"),
+				SecretKey: GetEnvironmentVar("S3_SECRET_KEY"),
+				PublicURL: GetEnvironmentVar("S3_PUBLIC_URL"),
+				PathStyle: pathStyle,
+			},
+		},
+		Cache: Cache{
+			Backend:       getEnvironmentVarOr("CACHE_BACKEND", "lru"),
+			Size:          cacheSize,
+			TTL:           getDurationOr("CACHE_TTL", 5*time.Minute),
+			RedisAddr:     getEnvironmentVarOr("REDIS_ADDR", "localhost:6379"),
+			RedisPassword: GetEnvironmentVar("REDIS_PASSWORD"),
+			RedisDB:       redisDB,
+		},
 		DB: struct {
-			DSN          string
-			MaxOpenConns int
-			MaxIdleConns int
-			MaxIdleTime  string
+			DSN                  string
+			MaxOpenConns         int
+			MaxIdleConns         int
+			MaxIdleTime          string
+			AutoMigrate          bool
+			Replicas             []Replica
+			ReadYourWritesWindow time.Duration
+			ReplicaCheckInterval time.Duration
 		}{
-			DSN:          GetEnvironmentVar("DB_DSN"),
-			MaxOpenConns: 25,
-			MaxIdleConns: 25,
-			MaxIdleTime:  "15m",
+			DSN:                  GetEnvironmentVar("DB_DSN"),
+			MaxOpenConns:         25,
+			MaxIdleConns:         25,
+			MaxIdleTime:          "15m",
+			AutoMigrate:          autoMigrate,
+			Replicas:             loadReplicas(),
+			ReadYourWritesWindow: getDurationOr("DB_READ_YOUR_WRITES_WINDOW", 5*time.Second),
+			ReplicaCheckInterval: 5 * time.Second,
 		},
 	}
 }
@@ -0,0 +1,342 @@
+// Package cache keeps recently read products in front of the database.
+//
+// Products are stored marshalled, so every read hands out a fresh copy that
+// the server is free to change. Writes that change a product invalidate it
+// here and, through the broker, on every other replica; entries also expire
+// after a TTL in case an invalidation is lost.
+package cache
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"golang.org/x/sync/singleflight"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Metrics are published under "product_cache" in expvar. Hits and misses
+// count products looked up; loads count database reads, so a miss that
+// joined a load already in flight shows up in shared rather than loads.
+var (
+	metrics       = expvar.NewMap("product_cache")
+	hitsTotal     = new(expvar.Int)
+	missesTotal   = new(expvar.Int)
+	loadsTotal    = new(expvar.Int)
+	sharedTotal   = new(expvar.Int)
+	invalidations = new(expvar.Int)
+	errorsTotal   = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("hits_total", hitsTotal)
+	metrics.Set("misses_total", missesTotal)
+	metrics.Set("loads_total", loadsTotal)
+	metrics.Set("shared_loads_total", sharedTotal)
+	metrics.Set("invalidations_total", invalidations)
+	metrics.Set("errors_total", errorsTotal)
+}
+
+// ErrNotFound is returned by Store.Get for keys it does not hold.
+var ErrNotFound = errors.New("cache: key not found")
+
+// Store holds marshalled products by key. LRU keeps them in process and Redis
+// in a server shared by every replica.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	// Flush removes every product the store holds.
+	Flush(ctx context.Context) error
+}
+
+// Notifier publishes invalidations to the other replicas.
+type Notifier interface {
+	Publish(ctx context.Context, exchange, routingKey, contentType string, body []byte) error
+}
+
+// Cache reads products through a Store. The zero value is not usable; use
+// New.
+type Cache struct {
+	store Store
+	ttl   time.Duration
+	// Notifier, when set, fans invalidations out over the broker.
+	Notifier Notifier
+
+	group singleflight.Group
+
+	// loads tracks reads from the database that are in flight, so that an
+	// invalidation arriving while one runs keeps its result out of the store.
+	mu    sync.Mutex
+	loads map[*load]struct{}
+}
+
+type load struct {
+	ids   map[int64]bool
+	stale bool
+}
+
+func New(store Store, ttl time.Duration) *Cache {
+	return &Cache{
+		store: store,
+		ttl:   ttl,
+		loads: make(map[*load]struct{}),
+	}
+}
+
+// Get returns the product with the given id, reading it with fetch on a miss.
+// Concurrent misses for one product share a single fetch.
+func (c *Cache) Get(id int64, fetch func(id int64) (*proto.Product, error)) (*proto.Product, error) {
+	if product, ok := c.lookup(id); ok {
+		hitsTotal.Add(1)
+		return product, nil
+	}
+	missesTotal.Add(1)
+
+	value, err, shared := c.group.Do(key(id), func() (interface{}, error) {
+		loadsTotal.Add(1)
+		l := c.begin([]int64{id})
+		defer c.end(l)
+
+		product, err := fetch(id)
+		if err != nil {
+			return nil, err
+		}
+		return c.fill(l, []*proto.Product{product})
+	})
+	if shared {
+		sharedTotal.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decode(value.([][]byte)[0])
+}
+
+// GetMany returns the products with the given ids that exist, reading the
+// ones it does not hold with a single call to fetch. Like the repository it
+// stands in front of, it returns them in no particular order.
+func (c *Cache) GetMany(ids []int64, fetch func(ids []int64) ([]*proto.Product, error)) ([]*proto.Product, error) {
+	products := make([]*proto.Product, 0, len(ids))
+	seen := make(map[int64]bool, len(ids))
+	var missing []int64
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if product, ok := c.lookup(id); ok {
+			products = append(products, product)
+			continue
+		}
+		missing = append(missing, id)
+	}
+	hitsTotal.Add(int64(len(products)))
+	if len(missing) == 0 {
+		return products, nil
+	}
+	missesTotal.Add(int64(len(missing)))
+
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	keys := make([]string, len(missing))
+	for i, id := range missing {
+		keys[i] = strconv.FormatInt(id, 10)
+	}
+
+	value, err, shared := c.group.Do("many:"+strings.Join(keys, ","), func() (interface{}, error) {
+		loadsTotal.Add(1)
+		l := c.begin(missing)
+		defer c.end(l)
+
+		loaded, err := fetch(missing)
+		if err != nil {
+			return nil, err
+		}
+		return c.fill(l, loaded)
+	})
+	if shared {
+		sharedTotal.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, encoded := range value.([][]byte) {
+		product, err := decode(encoded)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	return products, nil
+}
+
+// Invalidate drops products from this replica's store and tells the other
+// replicas to do the same.
+func (c *Cache) Invalidate(ids ...int64) {
+	if len(ids) == 0 {
+		return
+	}
+	c.Drop(ids...)
+	c.notify(invalidation{IDs: ids})
+}
+
+// InvalidateAll drops every product, here and on the other replicas. It is
+// for changes, like renaming a category, that touch more products than are
+// worth listing.
+func (c *Cache) InvalidateAll() {
+	c.DropAll()
+	c.notify(invalidation{All: true})
+}
+
+// Drop removes products from the store without telling the other replicas.
+func (c *Cache) Drop(ids ...int64) {
+	invalidations.Add(int64(len(ids)))
+
+	c.mu.Lock()
+	for l := range c.loads {
+		for _, id := range ids {
+			if l.ids[id] {
+				l.stale = true
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = key(id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := c.store.Delete(ctx, keys...); err != nil {
+		errorsTotal.Add(1)
+		log.Printf("failed to invalidate cached products %v: %v", ids, err)
+	}
+}
+
+// DropAll removes every product from the store without telling the other
+// replicas.
+func (c *Cache) DropAll() {
+	invalidations.Add(1)
+
+	c.mu.Lock()
+	for l := range c.loads {
+		l.stale = true
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.store.Flush(ctx); err != nil {
+		errorsTotal.Add(1)
+		log.Printf("failed to flush cached products: %v", err)
+	}
+}
+
+// lookup reads a product from the store. Store errors are counted and treated
+// as misses, so an unreachable Redis slows reads down rather than failing them.
+func (c *Cache) lookup(id int64) (*proto.Product, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	encoded, err := c.store.Get(ctx, key(id))
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			errorsTotal.Add(1)
+			log.Printf("failed to read cached product %d: %v", id, err)
+		}
+		return nil, false
+	}
+
+	product, err := decode(encoded)
+	if err != nil {
+		errorsTotal.Add(1)
+		log.Printf("failed to decode cached product %d: %v", id, err)
+		return nil, false
+	}
+	return product, true
+}
+
+func (c *Cache) begin(ids []int64) *load {
+	l := &load{ids: make(map[int64]bool, len(ids))}
+	for _, id := range ids {
+		l.ids[id] = true
+	}
+
+	c.mu.Lock()
+	c.loads[l] = struct{}{}
+	c.mu.Unlock()
+	return l
+}
+
+func (c *Cache) end(l *load) {
+	c.mu.Lock()
+	delete(c.loads, l)
+	c.mu.Unlock()
+}
+
+// fill marshals loaded products and stores them, unless an invalidation
+// arrived while they were read and they may already be out of date. One that
+// arrives while they are being stored is caught by looking again afterwards.
+func (c *Cache) fill(l *load, products []*proto.Product) ([][]byte, error) {
+	encoded := make([][]byte, len(products))
+	for i, product := range products {
+		var err error
+		if encoded[i], err = protobuf.Marshal(product); err != nil {
+			return nil, err
+		}
+	}
+	if c.stale(l) {
+		return encoded, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	keys := make([]string, 0, len(products))
+	for i, product := range products {
+		if err := c.store.Set(ctx, key(product.Id), encoded[i], c.ttl); err != nil {
+			errorsTotal.Add(1)
+			log.Printf("failed to cache product %d: %v", product.Id, err)
+			break
+		}
+		keys = append(keys, key(product.Id))
+	}
+
+	if len(keys) > 0 && c.stale(l) {
+		if err := c.store.Delete(ctx, keys...); err != nil {
+			errorsTotal.Add(1)
+			log.Printf("failed to drop products cached during an invalidation: %v", err)
+		}
+	}
+	return encoded, nil
+}
+
+func (c *Cache) stale(l *load) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return l.stale
+}
+
+func key(id int64) string {
+	return "product:" + strconv.FormatInt(id, 10)
+}
+
+func decode(encoded []byte) (*proto.Product, error) {
+	product := new(proto.Product)
+	if err := protobuf.Unmarshal(encoded, product); err != nil {
+		return nil, err
+	}
+	return product, nil
+}
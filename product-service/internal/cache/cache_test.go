@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+)
+
+type recordingNotifier struct {
+	mu       sync.Mutex
+	messages []invalidation
+}
+
+func (n *recordingNotifier) Publish(ctx context.Context, exchange, routingKey, contentType string, body []byte) error {
+	var message invalidation
+	if err := json.Unmarshal(body, &message); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+func TestCacheGet(t *testing.T) {
+	c := New(NewLRU(10), time.Minute)
+
+	var fetches int32
+	fetch := func(id int64) (*proto.Product, error) {
+		atomic.AddInt32(&fetches, 1)
+		return &proto.Product{Id: id, Name: "Apple", Quantity: 3}, nil
+	}
+
+	first, err := c.Get(1, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Quantity = 0
+
+	second, err := c.Get(1, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 {
+		t.Errorf("fetched %d times, expected 1", fetches)
+	}
+	if second.Quantity != 3 {
+		t.Errorf("changing a returned product changed the cached one: quantity %d", second.Quantity)
+	}
+
+	c.Invalidate(1)
+	if _, err = c.Get(1, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 2 {
+		t.Errorf("fetched %d times after invalidating, expected 2", fetches)
+	}
+}
+
+func TestCacheGetErrorsAreNotCached(t *testing.T) {
+	c := New(NewLRU(10), time.Minute)
+
+	fetch := func(id int64) (*proto.Product, error) {
+		return nil, data.ErrRecordNotFound
+	}
+	if _, err := c.Get(1, fetch); err != data.ErrRecordNotFound {
+		t.Fatalf("Get returned %v, expected ErrRecordNotFound", err)
+	}
+
+	fetch = func(id int64) (*proto.Product, error) {
+		return &proto.Product{Id: id}, nil
+	}
+	if _, err := c.Get(1, fetch); err != nil {
+		t.Errorf("Get after the product was added returned %v", err)
+	}
+}
+
+func TestCacheGetSharesConcurrentFetches(t *testing.T) {
+	c := New(NewLRU(10), time.Minute)
+
+	release := make(chan struct{})
+	var fetches int32
+	fetch := func(id int64) (*proto.Product, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return &proto.Product{Id: id}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get(1, fetch); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// Give the readers time to pile up behind the first fetch.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("fetched %d times, expected 1", fetches)
+	}
+}
+
+func TestCacheInvalidationDuringFetch(t *testing.T) {
+	c := New(NewLRU(10), time.Minute)
+
+	fetch := func(id int64) (*proto.Product, error) {
+		// The product changes after it was read but before the read is
+		// cached.
+		c.Invalidate(id)
+		return &proto.Product{Id: id, Quantity: 3}, nil
+	}
+	if _, err := c.Get(1, fetch); err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := false
+	fetch = func(id int64) (*proto.Product, error) {
+		fetched = true
+		return &proto.Product{Id: id, Quantity: 2}, nil
+	}
+	product, err := c.Get(1, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fetched || product.Quantity != 2 {
+		t.Errorf("read %v from a fetch that raced an invalidation", product)
+	}
+}
+
+func TestCacheGetMany(t *testing.T) {
+	c := New(NewLRU(10), time.Minute)
+
+	var fetched [][]int64
+	fetch := func(ids []int64) ([]*proto.Product, error) {
+		fetched = append(fetched, ids)
+		var products []*proto.Product
+		for _, id := range ids {
+			if id != 3 {
+				products = append(products, &proto.Product{Id: id})
+			}
+		}
+		return products, nil
+	}
+
+	products, err := c.GetMany([]int64{2, 1, 3, 2}, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 {
+		t.Errorf("got %d products, expected 2", len(products))
+	}
+
+	products, err = c.GetMany([]int64{1, 2, 3, 4}, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 3 {
+		t.Errorf("got %d products, expected 3", len(products))
+	}
+
+	if len(fetched) != 2 || len(fetched[0]) != 3 || len(fetched[1]) != 2 || fetched[1][0] != 3 || fetched[1][1] != 4 {
+		t.Errorf("fetched %v, expected [[1 2 3] [3 4]]", fetched)
+	}
+}
+
+func TestCacheNotifiesOtherReplicas(t *testing.T) {
+	notifier := &recordingNotifier{}
+	c := New(NewLRU(10), time.Minute)
+	c.Notifier = notifier
+
+	c.Invalidate(1, 2)
+	c.InvalidateAll()
+	c.Drop(3)
+	c.DropAll()
+
+	if len(notifier.messages) != 2 {
+		t.Fatalf("published %v, expected two invalidations", notifier.messages)
+	}
+	if ids := notifier.messages[0].IDs; len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("first invalidation is %v, expected products 1 and 2", notifier.messages[0])
+	}
+	if !notifier.messages[1].All {
+		t.Errorf("second invalidation is %v, expected all products", notifier.messages[1])
+	}
+}
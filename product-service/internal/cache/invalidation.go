@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Exchange is the fanout exchange invalidations are published on. Every
+// replica binds a queue of its own to it.
+const Exchange = "product-cache"
+
+type invalidation struct {
+	IDs []int64 `json:"ids,omitempty"`
+	All bool    `json:"all,omitempty"`
+}
+
+// notify publishes an invalidation for the other replicas. A failure is only
+// logged: the write it follows has already happened, and the TTL bounds how
+// long the other replicas can serve what they hold.
+func (c *Cache) notify(message invalidation) {
+	if c.Notifier == nil {
+		return
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		errorsTotal.Add(1)
+		log.Printf("failed to encode cache invalidation: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = c.Notifier.Publish(ctx, Exchange, "", "application/json", body); err != nil {
+		errorsTotal.Add(1)
+		log.Printf("failed to publish cache invalidation: %v", err)
+	}
+}
+
+// Listen applies the invalidations other replicas publish until ctx is done.
+// It reconnects when the broker goes away and drops every product each time it
+// does, since invalidations may have been missed in between.
+func (c *Cache) Listen(ctx context.Context, dsn string) {
+	backoff := time.Second
+	for {
+		connected, err := c.listen(ctx, dsn)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = time.Second
+		}
+		log.Printf("cache invalidations interrupted, reconnecting in %s: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// listen consumes invalidations over one connection and reports whether it
+// got as far as consuming before it failed.
+func (c *Cache) listen(ctx context.Context, dsn string) (bool, error) {
+	conn, err := amqp.Dial(dsn)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+
+	err = ch.ExchangeDeclare(Exchange, "fanout", true, false, false, false, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// The queue belongs to this replica alone and goes away with it.
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return false, err
+	}
+	if err = ch.QueueBind(queue.Name, "", Exchange, false, nil); err != nil {
+		return false, err
+	}
+
+	deliveries, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return false, err
+	}
+
+	c.DropAll()
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	for {
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case err := <-closed:
+			return true, err
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return true, amqp.ErrClosed
+			}
+
+			var message invalidation
+			if err := json.Unmarshal(delivery.Body, &message); err != nil {
+				errorsTotal.Add(1)
+				log.Printf("failed to decode cache invalidation: %v", err)
+				continue
+			}
+			if message.All {
+				c.DropAll()
+			} else {
+				c.Drop(message.IDs...)
+			}
+		}
+	}
+}
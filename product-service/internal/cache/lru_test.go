@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	c := NewLRU(2)
+	c.now = func() time.Time { return now }
+
+	c.Set(ctx, "a", []byte("1"), 0)
+	c.Set(ctx, "b", []byte("2"), 0)
+	if _, err := c.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// b is now the least recently used.
+	c.Set(ctx, "c", []byte("3"), 0)
+	if _, err := c.Get(ctx, "b"); err != ErrNotFound {
+		t.Errorf("Get(b) after eviction returned %v, expected ErrNotFound", err)
+	}
+	if value, err := c.Get(ctx, "a"); err != nil || string(value) != "1" {
+		t.Errorf("Get(a) = %q, %v", value, err)
+	}
+
+	c.Delete(ctx, "a")
+	if _, err := c.Get(ctx, "a"); err != ErrNotFound {
+		t.Errorf("Get(a) after Delete returned %v, expected ErrNotFound", err)
+	}
+
+	c.Set(ctx, "d", []byte("4"), time.Minute)
+	now = now.Add(time.Minute)
+	if _, err := c.Get(ctx, "d"); err != ErrNotFound {
+		t.Errorf("Get(d) after its TTL returned %v, expected ErrNotFound", err)
+	}
+
+	c.Flush(ctx)
+	if c.Len() != 0 {
+		t.Errorf("Len() after Flush = %d, expected 0", c.Len())
+	}
+}
@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+)
+
+// Wrap returns models that read products through c. Every write that changes
+// what ProductRepository.Get returns - stock, variants, ratings and category
+// names included - invalidates the products it touched once it succeeds.
+func Wrap(models data.Models, c *Cache) data.Models {
+	models.Products = products{models.Products, c}
+	models.Variants = variants{models.Variants, c}
+	models.Reviews = reviews{models.Reviews, c}
+	models.Categories = categories{models.Categories, c}
+	return models
+}
+
+type products struct {
+	data.ProductRepository
+	c *Cache
+}
+
+// Misses are read from the primary: a fill from a lagging replica right
+// after an invalidation would be served until it expired. A fill may be
+// shared by several callers, so it does not run under any one caller's
+// context. Reads pinned to the primary skip the cache altogether, since an
+// entry can outlive a write whose invalidation has not arrived yet.
+func (p products) Get(ctx context.Context, id int64) (*proto.Product, error) {
+	if data.ReadsFromPrimary(ctx) {
+		return p.ProductRepository.Get(ctx, id)
+	}
+	return p.c.Get(id, func(id int64) (*proto.Product, error) {
+		return p.ProductRepository.Get(data.WithPrimary(context.Background()), id)
+	})
+}
+
+func (p products) GetMany(ctx context.Context, ids []int64) ([]*proto.Product, error) {
+	if data.ReadsFromPrimary(ctx) {
+		return p.ProductRepository.GetMany(ctx, ids)
+	}
+	return p.c.GetMany(ids, func(ids []int64) ([]*proto.Product, error) {
+		return p.ProductRepository.GetMany(data.WithPrimary(context.Background()), ids)
+	})
+}
+
+func (p products) Update(ctx context.Context, product *proto.Product, actor string) error {
+	err := p.ProductRepository.Update(ctx, product, actor)
+	if err == nil {
+		p.c.Invalidate(product.Id)
+	}
+	return err
+}
+
+func (p products) Delete(ctx context.Context, id int64, actor string) error {
+	err := p.ProductRepository.Delete(ctx, id, actor)
+	if err == nil {
+		p.c.Invalidate(id)
+	}
+	return err
+}
+
+func (p products) Restore(ctx context.Context, id int64, actor string) error {
+	err := p.ProductRepository.Restore(ctx, id, actor)
+	if err == nil {
+		p.c.Invalidate(id)
+	}
+	return err
+}
+
+func (p products) Reserve(ctx context.Context, productID, variantID int64, quantity int32, ttl time.Duration, actor string) (*proto.StockReservation, error) {
+	reservation, err := p.ProductRepository.Reserve(ctx, productID, variantID, quantity, ttl, actor)
+	if err == nil {
+		p.c.Invalidate(productID)
+	}
+	return reservation, err
+}
+
+func (p products) Release(ctx context.Context, id int64, actor string) (*proto.StockReservation, error) {
+	reservation, err := p.ProductRepository.Release(ctx, id, actor)
+	if err == nil {
+		p.c.Invalidate(reservation.ProductId)
+	}
+	return reservation, err
+}
+
+func (p products) ExpireReservations(ctx context.Context, limit int) (int, []int64, error) {
+	expired, productIDs, err := p.ProductRepository.ExpireReservations(ctx, limit)
+	if err == nil {
+		p.c.Invalidate(productIDs...)
+	}
+	return expired, productIDs, err
+}
+
+func (p products) AdjustStock(ctx context.Context, productID, variantID int64, delta int32, reason, actor string) (*proto.StockMovement, error) {
+	movement, err := p.ProductRepository.AdjustStock(ctx, productID, variantID, delta, reason, actor)
+	if err == nil {
+		p.c.Invalidate(productID)
+	}
+	return movement, err
+}
+
+// Variants change the version and availability of their product.
+type variants struct {
+	data.VariantRepository
+	c *Cache
+}
+
+func (v variants) Insert(variant *proto.ProductVariant, actor string) (*proto.ProductVariant, error) {
+	inserted, err := v.VariantRepository.Insert(variant, actor)
+	if err == nil {
+		v.c.Invalidate(variant.ProductId)
+	}
+	return inserted, err
+}
+
+func (v variants) Update(variant *proto.ProductVariant, actor string) error {
+	err := v.VariantRepository.Update(variant, actor)
+	if err == nil {
+		v.c.Invalidate(variant.ProductId)
+	}
+	return err
+}
+
+func (v variants) Delete(productID, variantID int64, actor string) error {
+	err := v.VariantRepository.Delete(productID, variantID, actor)
+	if err == nil {
+		v.c.Invalidate(productID)
+	}
+	return err
+}
+
+// Reviews change the rating of their product once they are approved, or when
+// an approved one is edited or deleted. New reviews wait for moderation.
+type reviews struct {
+	data.ReviewRepository
+	c *Cache
+}
+
+func (r reviews) Update(review *proto.Review) error {
+	err := r.ReviewRepository.Update(review)
+	if err == nil {
+		r.c.Invalidate(review.ProductId)
+	}
+	return err
+}
+
+func (r reviews) Moderate(productID, id int64, status string, verified *bool) (*proto.Review, error) {
+	review, err := r.ReviewRepository.Moderate(productID, id, status, verified)
+	if err == nil {
+		r.c.Invalidate(productID)
+	}
+	return review, err
+}
+
+func (r reviews) Delete(productID, id int64) error {
+	err := r.ReviewRepository.Delete(productID, id)
+	if err == nil {
+		r.c.Invalidate(productID)
+	}
+	return err
+}
+
+// Products carry the name of their category, so renaming one drops them all.
+type categories struct {
+	data.CategoryRepository
+	c *Cache
+}
+
+func (c categories) Update(category *proto.Category) error {
+	err := c.CategoryRepository.Update(category)
+	if err == nil {
+		c.c.InvalidateAll()
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+)
+
+func TestWrap(t *testing.T) {
+	models := data.NewMemoryModels()
+	category, err := models.Categories.Insert(&proto.Category{Name: "Fruit", Slug: "fruit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	product, err := models.Products.Insert(context.Background(), &proto.Product{Name: "Apple", PriceMinor: 300, Currency: "KZT", CategoryId: category.Id, Quantity: 5}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifier := &recordingNotifier{}
+	c := New(NewLRU(10), time.Minute)
+	c.Notifier = notifier
+	models = Wrap(models, c)
+
+	get := func() *proto.Product {
+		t.Helper()
+		product, err := models.Products.Get(context.Background(), product.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return product
+	}
+
+	get()
+	if _, err = models.Products.Reserve(context.Background(), product.Id, 0, 2, time.Minute, ""); err != nil {
+		t.Fatal(err)
+	}
+	if stored := get(); stored.Quantity != 3 {
+		t.Errorf("quantity after reserving is %d, expected 3", stored.Quantity)
+	}
+
+	stored := get()
+	stored.Name = "Green apple"
+	if err = models.Products.Update(context.Background(), stored, ""); err != nil {
+		t.Fatal(err)
+	}
+	if stored = get(); stored.Name != "Green apple" {
+		t.Errorf("name after updating is %q", stored.Name)
+	}
+
+	category.Name = "Fresh fruit"
+	if err = models.Categories.Update(category); err != nil {
+		t.Fatal(err)
+	}
+	if stored = get(); stored.Category != "Fresh fruit" {
+		t.Errorf("category after renaming it is %q", stored.Category)
+	}
+
+	if err = models.Products.Delete(context.Background(), product.Id, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = models.Products.Get(context.Background(), product.Id); err != data.ErrRecordNotFound {
+		t.Errorf("Get after deleting returned %v, expected ErrRecordNotFound", err)
+	}
+
+	if len(notifier.messages) != 4 {
+		t.Errorf("published %d invalidations, expected 4", len(notifier.messages))
+	}
+}
+
+func TestWrapSkipsCacheForPrimaryReads(t *testing.T) {
+	models := data.NewMemoryModels()
+	category, err := models.Categories.Insert(&proto.Category{Name: "Fruit", Slug: "fruit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	product, err := models.Products.Insert(context.Background(), &proto.Product{Name: "Apple", PriceMinor: 300, Currency: "KZT", CategoryId: category.Id, Quantity: 5}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped := Wrap(models, New(NewLRU(10), time.Minute))
+	if _, err = wrapped.Products.Get(context.Background(), product.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write whose invalidation has not reached this instance yet.
+	product.Name = "Green apple"
+	if err = models.Products.Update(context.Background(), product, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := data.WithPrimary(context.Background())
+	stored, err := wrapped.Products.Get(primary, product.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "Green apple" {
+		t.Errorf("primary read returned %q, expected the latest write", stored.Name)
+	}
+	many, err := wrapped.Products.GetMany(primary, []int64{product.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(many) != 1 || many[0].Name != "Green apple" {
+		t.Errorf("primary read returned %v, expected the latest write", many)
+	}
+}
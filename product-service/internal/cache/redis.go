@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is a Store kept in a Redis server, so that every replica shares one
+// cache. Keys are prefixed with Prefix, which also bounds what Flush removes.
+type Redis struct {
+	Prefix string
+
+	client *redis.Client
+}
+
+// NewRedis returns a Redis store. Commands are bounded by the context's
+// deadline, or by a second when it has none; connections are pooled and
+// opened on first use.
+func NewRedis(addr, password string, db int) *Redis {
+	return &Redis{
+		Prefix: "product-service:",
+		client: redis.NewClient(&redis.Options{
+			Addr:                  addr,
+			Password:              password,
+			DB:                    db,
+			DialTimeout:           time.Second,
+			ReadTimeout:           time.Second,
+			WriteTimeout:          time.Second,
+			ContextTimeoutEnabled: true,
+		}),
+	}
+}
+
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := r.client.Get(ctx, r.Prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, r.Prefix+key, value, ttl).Err()
+}
+
+func (r *Redis) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = r.Prefix + key
+	}
+	return r.client.Del(ctx, prefixed...).Err()
+}
+
+// Flush deletes every key under Prefix. It scans rather than using FLUSHDB,
+// so that other data kept in the same database is left alone.
+func (r *Redis) Flush(ctx context.Context) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(ctx, cursor, r.Prefix+"*", 1000).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err = r.client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// Close closes the pooled connections.
+func (r *Redis) Close(ctx context.Context) error {
+	return r.client.Close()
+}
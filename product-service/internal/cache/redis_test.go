@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers the commands Redis sends from a map, enough to check
+// what goes over the wire. Commands it does not know, such as the HELLO the
+// client opens with, get an error reply, as from an older server.
+type fakeRedis struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &fakeRedis{data: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		fmt.Fprint(conn, s.handle(args))
+	}
+}
+
+// readCommand reads one command, which clients send as an array of bulk
+// strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err = io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func (s *fakeRedis) handle(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		value, ok := s.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		s.data[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := s.data[key]; ok {
+				delete(s.data, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "SCAN":
+		prefix := strings.TrimSuffix(args[3], "*")
+		var keys []string
+		for key := range s.data {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, fmt.Sprintf("$%d\r\n%s\r\n", len(key), key))
+			}
+		}
+		return fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", len(keys), strings.Join(keys, ""))
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestRedis(t *testing.T) {
+	server, addr := startFakeRedis(t)
+	server.data["other"] = "kept"
+
+	ctx := context.Background()
+	c := NewRedis(addr, "", 0)
+	defer c.Close(ctx)
+
+	if _, err := c.Get(ctx, "product:1"); err != ErrNotFound {
+		t.Errorf("Get of a missing key returned %v, expected ErrNotFound", err)
+	}
+
+	value := []byte("binary\r\n\x00value")
+	if err := c.Set(ctx, "product:1", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "product:2", []byte("2"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, "product:1"); err != nil || string(got) != string(value) {
+		t.Errorf("Get = %q, %v, expected %q", got, err, value)
+	}
+
+	if err := c.Delete(ctx, "product:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "product:1"); err != ErrNotFound {
+		t.Errorf("Get after Delete returned %v, expected ErrNotFound", err)
+	}
+
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "product:2"); err != ErrNotFound {
+		t.Errorf("Get after Flush returned %v, expected ErrNotFound", err)
+	}
+	if server.data["other"] != "kept" {
+		t.Error("Flush removed a key outside the prefix")
+	}
+
+	if err := c.Set(ctx, "product:3", []byte("3"), 0); err != nil {
+		t.Errorf("Set without a TTL returned %v", err)
+	}
+}
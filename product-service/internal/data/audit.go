@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	AuditActionInsert  = "insert"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+
+	AuditActionReserve = "reserve"
+	AuditActionRelease = "release"
+	AuditActionExpire  = "expire"
+	AuditActionAdjust  = "adjust"
+
+	AuditActionAddVariant    = "add_variant"
+	AuditActionUpdateVariant = "update_variant"
+	AuditActionDeleteVariant = "delete_variant"
+)
+
+var AuditSortSafeList = []string{"id", "-id"}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// FieldChange is the old and new value of a single product field. Old is nil
+// for inserts and New is nil for deletes.
+type FieldChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// productFields returns the fields a client can set on a product, keyed by
+// their column name. Derived fields such as is_available are left out.
+func productFields(product *proto.Product) map[string]any {
+	if product == nil {
+		return map[string]any{}
+	}
+	// Options are recorded as their stored JSON, since slices cannot be
+	// compared.
+	options, _ := encodeOptions(product.Options)
+	return map[string]any{
+		"name":        product.Name,
+		"price_minor": product.PriceMinor,
+		"currency":    product.Currency,
+		"description": product.Description,
+		"category_id": product.CategoryId,
+		"quantity":    product.Quantity,
+		"options":     string(options),
+	}
+}
+
+func diffProducts(before, after *proto.Product) map[string]FieldChange {
+	return diffFields(productFields(before), productFields(after))
+}
+
+// diffFields compares two sets of comparable field values.
+func diffFields(oldFields, newFields map[string]any) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	for field, newValue := range newFields {
+		oldValue, ok := oldFields[field]
+		if !ok {
+			changes[field] = FieldChange{New: newValue}
+			continue
+		}
+		if oldValue != newValue {
+			changes[field] = FieldChange{Old: oldValue, New: newValue}
+		}
+	}
+	for field, oldValue := range oldFields {
+		if _, ok := newFields[field]; !ok {
+			changes[field] = FieldChange{Old: oldValue}
+		}
+	}
+	return changes
+}
+
+func insertAudit(ctx context.Context, q querier, productID int64, action, actor string, version int32, changes map[string]FieldChange) error {
+	js, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO product_audit (product_id, action, actor, version, changes)
+			  VALUES ($1, $2, $3, $4, $5)`
+
+	_, err = q.ExecContext(ctx, query, productID, action, actor, version, js)
+	return err
+}
+
+func (a AuditModel) GetForProduct(ctx context.Context, productID int64, filters *proto.Filters) ([]*proto.ProductAuditEntry, *proto.Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, product_id, action, actor, version, changes, changed_at
+		FROM product_audit
+		WHERE product_id = $1
+		ORDER BY %s %s
+		LIMIT $2 OFFSET $3`, sortColumn(filters), sortDirection(filters))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := a.DB.QueryContext(ctx, query, productID, limit(filters), offset(filters))
+	if err != nil {
+		return nil, &proto.Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int32 = 0
+	var entries []*proto.ProductAuditEntry
+
+	for rows.Next() {
+		var entry proto.ProductAuditEntry
+		var changes []byte
+		var changedAt time.Time
+		err := rows.Scan(
+			&totalRecords,
+			&entry.Id,
+			&entry.ProductId,
+			&entry.Action,
+			&entry.Actor,
+			&entry.Version,
+			&changes,
+			&changedAt,
+		)
+		if err != nil {
+			return nil, &proto.Metadata{}, err
+		}
+		entry.Changes = string(changes)
+		entry.ChangedAt = timestamppb.New(changedAt)
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, &proto.Metadata{}, err
+	}
+	return entries, calculateMetadata(totalRecords, filters), nil
+}
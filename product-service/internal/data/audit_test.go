@@ -0,0 +1,92 @@
+package data
+
+import (
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"testing"
+)
+
+func TestDiffProducts(t *testing.T) {
+	before := &proto.Product{
+		Name:        "Apple",
+		PriceMinor:  85000,
+		Currency:    "KZT",
+		Description: "Apple from Almaty city",
+		CategoryId:  1,
+		Quantity:    5,
+	}
+	after := &proto.Product{
+		Name:        "Apple",
+		PriceMinor:  120000,
+		Currency:    "KZT",
+		Description: "Apple from Almaty city",
+		CategoryId:  1,
+		Quantity:    3,
+	}
+
+	tests := []struct {
+		name     string
+		before   *proto.Product
+		after    *proto.Product
+		expected map[string]FieldChange
+	}{
+		{
+			name:   "Update",
+			before: before,
+			after:  after,
+			expected: map[string]FieldChange{
+				"price_minor": {Old: int64(85000), New: int64(120000)},
+				"quantity":    {Old: int32(5), New: int32(3)},
+			},
+		},
+		{
+			name:   "Options",
+			before: before,
+			after: &proto.Product{
+				Name:        "Apple",
+				PriceMinor:  85000,
+				Currency:    "KZT",
+				Description: "Apple from Almaty city",
+				CategoryId:  1,
+				Quantity:    5,
+				Options:     []*proto.ProductOption{{Name: "size", Values: []string{"S", "M"}}},
+			},
+			expected: map[string]FieldChange{
+				"options": {Old: "[]", New: `[{"name":"size","values":["S","M"]}]`},
+			},
+		},
+		{
+			name:     "No changes",
+			before:   before,
+			after:    before,
+			expected: map[string]FieldChange{},
+		},
+		{
+			name:   "Delete",
+			before: before,
+			after:  nil,
+			expected: map[string]FieldChange{
+				"name":        {Old: "Apple"},
+				"price_minor": {Old: int64(85000)},
+				"currency":    {Old: "KZT"},
+				"description": {Old: "Apple from Almaty city"},
+				"category_id": {Old: int64(1)},
+				"quantity":    {Old: int32(5)},
+				"options":     {Old: "[]"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := diffProducts(tt.before, tt.after)
+			if len(changes) != len(tt.expected) {
+				t.Fatalf("diffProducts() returned %v, expected %v", changes, tt.expected)
+			}
+			for field, change := range tt.expected {
+				if changes[field] != change {
+					t.Errorf("diffProducts()[%s] = %v, expected %v", field, changes[field], change)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"github.com/lib/pq"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	ErrDuplicateSlug   = errors.New("duplicate slug")
+	ErrParentNotFound  = errors.New("parent category not found")
+	ErrCategoryCycle   = errors.New("category cannot be moved below itself")
+	ErrCategoryInUse   = errors.New("category still has subcategories or products")
+	ErrUnknownCategory = errors.New("category does not exist")
+)
+
+type CategoryModel struct {
+	DB *sql.DB
+}
+
+// Slugify lower-cases value and joins its runs of letters and digits with
+// hyphens. It matches the slugify function the categories migration used to
+// map the old free-text categories.
+func Slugify(value string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(strings.TrimSpace(value)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+			continue
+		}
+		hyphen = true
+	}
+	return b.String()
+}
+
+func ValidateCategory(v *validator.Validator, category *proto.Category) {
+	v.Check(category.Name != "", "name", "must be provided")
+	v.Check(len(category.Name) <= 50, "name", "must not be more than 50 bytes long")
+	v.Check(category.Slug != "", "slug", "must be provided")
+	v.Check(Slugify(category.Slug) == category.Slug, "slug", "must be lower-case letters and digits separated by single hyphens")
+	v.Check(category.ParentId >= 0, "parent_id", "must not be negative")
+	v.Check(category.Id == 0 || category.ParentId != category.Id, "parent_id", "must not be the category itself")
+}
+
+func (c CategoryModel) Insert(category *proto.Category) (*proto.Category, error) {
+	query := `INSERT INTO categories (parent_id, name, slug, sort_order)
+			  VALUES ($1, $2, $3, $4)
+			  RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{
+		nullableID(category.ParentId),
+		category.Name,
+		category.Slug,
+		category.SortOrder,
+	}
+
+	var createdAt time.Time
+	err := c.DB.QueryRowContext(ctx, query, args...).Scan(&category.Id, &createdAt, &category.Version)
+	if err != nil {
+		return nil, categoryWriteError(err)
+	}
+	category.CreatedAt = timestamppb.New(createdAt)
+
+	return category, nil
+}
+
+func (c CategoryModel) Get(id int64) (*proto.Category, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, parent_id, name, slug, sort_order, created_at, version
+			  FROM categories
+			  WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanCategory(c.DB.QueryRowContext(ctx, query, id))
+}
+
+func (c CategoryModel) GetBySlug(slug string) (*proto.Category, error) {
+	query := `SELECT id, parent_id, name, slug, sort_order, created_at, version
+			  FROM categories
+			  WHERE slug = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanCategory(c.DB.QueryRowContext(ctx, query, slug))
+}
+
+// GetAll returns the subtree under rootID, including the root, or every
+// category when rootID is zero. Categories are ordered depth first, siblings
+// by sort order and then name.
+func (c CategoryModel) GetAll(rootID int64) ([]*proto.Category, error) {
+	query := `WITH RECURSIVE subtree AS (
+				  SELECT id FROM categories WHERE id = $1 OR ($1 = 0 AND parent_id IS NULL)
+				  UNION ALL
+				  SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+			  )
+			  SELECT id, parent_id, name, slug, sort_order, created_at, version
+			  FROM categories
+			  WHERE id IN (SELECT id FROM subtree)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, query, rootID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []*proto.Category
+	for rows.Next() {
+		category, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if rootID != 0 && len(categories) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return orderTree(categories), nil
+}
+
+func (c CategoryModel) Update(category *proto.Category) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Moves are rare, so they are serialised on the whole table rather than
+	// risking two concurrent moves that each look fine on their own but
+	// together form a cycle.
+	_, err = tx.ExecContext(ctx, `LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		return err
+	}
+
+	if category.ParentId != 0 {
+		var cycle bool
+		err = tx.QueryRowContext(ctx, `
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM categories WHERE id = $1
+				UNION ALL
+				SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+			)
+			SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)`, category.Id, category.ParentId).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrCategoryCycle
+		}
+	}
+
+	query := `UPDATE categories
+			  SET parent_id = $1, name = $2, slug = $3, sort_order = $4, version = version + 1
+			  WHERE id = $5
+			  RETURNING version`
+
+	args := []any{
+		nullableID(category.ParentId),
+		category.Name,
+		category.Slug,
+		category.SortOrder,
+		category.Id,
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&category.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return categoryWriteError(err)
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a category. Categories that still have subcategories or
+// products are kept and ErrCategoryInUse is returned.
+func (c CategoryModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := c.DB.ExecContext(ctx, `DELETE FROM categories WHERE id = $1`, id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Name() == "foreign_key_violation" {
+			return ErrCategoryInUse
+		}
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanCategory(row rowScanner) (*proto.Category, error) {
+	var category proto.Category
+	var parentID sql.NullInt64
+	var createdAt time.Time
+	err := row.Scan(
+		&category.Id,
+		&parentID,
+		&category.Name,
+		&category.Slug,
+		&category.SortOrder,
+		&createdAt,
+		&category.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	category.ParentId = parentID.Int64
+	category.CreatedAt = timestamppb.New(createdAt)
+
+	return &category, nil
+}
+
+// orderTree sorts categories depth first so that each one follows its parent.
+// Categories whose parent is not in the list are treated as roots.
+func orderTree(categories []*proto.Category) []*proto.Category {
+	present := make(map[int64]bool, len(categories))
+	for _, category := range categories {
+		present[category.Id] = true
+	}
+
+	children := make(map[int64][]*proto.Category)
+	for _, category := range categories {
+		parent := category.ParentId
+		if !present[parent] {
+			parent = 0
+		}
+		children[parent] = append(children[parent], category)
+	}
+	for _, siblings := range children {
+		sort.Slice(siblings, func(i, j int) bool {
+			if siblings[i].SortOrder != siblings[j].SortOrder {
+				return siblings[i].SortOrder < siblings[j].SortOrder
+			}
+			if siblings[i].Name != siblings[j].Name {
+				return siblings[i].Name < siblings[j].Name
+			}
+			return siblings[i].Id < siblings[j].Id
+		})
+	}
+
+	ordered := make([]*proto.Category, 0, len(categories))
+	var walk func(parent int64)
+	walk = func(parent int64) {
+		for _, category := range children[parent] {
+			ordered = append(ordered, category)
+			walk(category.Id)
+		}
+	}
+	walk(0)
+
+	return ordered
+}
+
+func nullableID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+func categoryWriteError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "unique_violation":
+			return ErrDuplicateSlug
+		case "foreign_key_violation":
+			return ErrParentNotFound
+		}
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"Fruit", "fruit"},
+		{"  fruit ", "fruit"},
+		{"Home & Garden", "home-garden"},
+		{"--Kids' toys--", "kids-toys"},
+		{"Фрукты и овощи", "фрукты-и-овощи"},
+		{"!!!", ""},
+	}
+
+	for _, tt := range tests {
+		if result := Slugify(tt.input); result != tt.expected {
+			t.Errorf("Slugify(%q) = %q, expected %q", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestOrderTree(t *testing.T) {
+	categories := []*proto.Category{
+		{Id: 4, ParentId: 1, Name: "Citrus", SortOrder: 2},
+		{Id: 2, Name: "Vegetables", SortOrder: 1},
+		{Id: 3, ParentId: 1, Name: "Apples", SortOrder: 1},
+		{Id: 1, Name: "Fruit", SortOrder: 0},
+		{Id: 5, ParentId: 4, Name: "Lemons"},
+	}
+
+	expected := []int64{1, 3, 4, 5, 2}
+
+	ordered := orderTree(categories)
+	if len(ordered) != len(expected) {
+		t.Fatalf("orderTree() returned %d categories, expected %d", len(ordered), len(expected))
+	}
+	for i, category := range ordered {
+		if category.Id != expected[i] {
+			t.Errorf("orderTree()[%d] = %d, expected %d", i, category.Id, expected[i])
+		}
+	}
+
+	// A subtree's root keeps its parent_id but still comes first.
+	subtree := orderTree([]*proto.Category{
+		{Id: 5, ParentId: 4, Name: "Lemons"},
+		{Id: 4, ParentId: 1, Name: "Citrus"},
+	})
+	if subtree[0].Id != 4 || subtree[1].Id != 5 {
+		t.Errorf("orderTree() = [%d %d], expected [4 5]", subtree[0].Id, subtree[1].Id)
+	}
+}
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// EventSchemaVersion is carried by every ProductEvent.
+const EventSchemaVersion = 1
+
+const (
+	EventExchange = "products"
+	// EventContentType is how events are stored in the outbox. The relay may
+	// re-encode them as JSON.
+	EventContentType = "application/x-protobuf"
+)
+
+// Event names, used in routing keys.
+const (
+	EventCreated      = "created"
+	EventUpdated      = "updated"
+	EventDeleted      = "deleted"
+	EventStockChanged = "stock_changed"
+)
+
+// newEventID returns a random (version 4) UUID.
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// EventRoutingKey is product.<name>.<category slug>, so that consumers can
+// bind to all events of a kind or all events of a category.
+func EventRoutingKey(name, categorySlug string) string {
+	return "product." + name + "." + categorySlug
+}
+
+// eventState reads the full state of a product for an event, variants
+// included, and locks it. Deleted products are found too.
+func eventState(ctx context.Context, q querier, productID int64) (*proto.Product, error) {
+	product, err := lockedProduct(ctx, q, productID, true)
+	if err != nil {
+		return nil, err
+	}
+	if err = withVariants(ctx, q, product); err != nil {
+		return nil, err
+	}
+	return product, nil
+}
+
+// withVariants loads the variants of a product read with lockedProduct.
+func withVariants(ctx context.Context, q querier, product *proto.Product) error {
+	rows, err := q.QueryContext(ctx, `SELECT `+variantColumns+` FROM product_variants WHERE product_id = $1 ORDER BY id`, product.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	product.Variants = nil
+	for rows.Next() {
+		variant, err := scanVariant(rows)
+		if err != nil {
+			return err
+		}
+		product.Variants = append(product.Variants, variant)
+	}
+	return rows.Err()
+}
+
+// insertEvent queues event in the outbox of q, routed by the category of
+// product. Like insertAudit, q should be the transaction making the change.
+func insertEvent(ctx context.Context, q querier, name string, product *proto.Product, actor string, event *proto.ProductEvent) error {
+	id, err := newEventID()
+	if err != nil {
+		return err
+	}
+	event.SchemaVersion = EventSchemaVersion
+	event.EventId = id
+	event.OccurredAt = timestamppb.New(time.Now())
+	event.Actor = actor
+
+	payload, err := protobuf.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	var slug string
+	err = q.QueryRowContext(ctx, `SELECT slug FROM categories WHERE id = $1`, product.CategoryId).Scan(&slug)
+	if err != nil {
+		return err
+	}
+
+	return insertOutbox(ctx, q, &OutboxMessage{
+		AggregateID: product.Id,
+		Exchange:    EventExchange,
+		RoutingKey:  EventRoutingKey(name, slug),
+		ContentType: EventContentType,
+		Payload:     payload,
+	})
+}
+
+func productCreated(ctx context.Context, q querier, after *proto.Product, actor string) error {
+	return insertEvent(ctx, q, EventCreated, after, actor, &proto.ProductEvent{
+		Event: &proto.ProductEvent_ProductCreated{ProductCreated: &proto.ProductCreated{After: after}},
+	})
+}
+
+func productUpdated(ctx context.Context, q querier, before, after *proto.Product, actor string) error {
+	return insertEvent(ctx, q, EventUpdated, after, actor, &proto.ProductEvent{
+		Event: &proto.ProductEvent_ProductUpdated{ProductUpdated: &proto.ProductUpdated{Before: before, After: after}},
+	})
+}
+
+func productDeleted(ctx context.Context, q querier, before *proto.Product, actor string) error {
+	return insertEvent(ctx, q, EventDeleted, before, actor, &proto.ProductEvent{
+		Event: &proto.ProductEvent_ProductDeleted{ProductDeleted: &proto.ProductDeleted{Before: before}},
+	})
+}
+
+func stockChanged(ctx context.Context, q querier, movement *proto.StockMovement, before, after *proto.Product, actor string) error {
+	return insertEvent(ctx, q, EventStockChanged, after, actor, &proto.ProductEvent{
+		Event: &proto.ProductEvent_StockChanged{StockChanged: &proto.StockChanged{Movement: movement, Before: before, After: after}},
+	})
+}
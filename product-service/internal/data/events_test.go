@@ -0,0 +1,30 @@
+package data
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNewEventID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := newEventID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !uuid.MatchString(id) {
+			t.Errorf("event id %q is not a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Errorf("event id %q was generated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestEventRoutingKey(t *testing.T) {
+	if key := EventRoutingKey(EventStockChanged, "fruit"); key != "product.stock_changed.fruit" {
+		t.Errorf("routing key is %q, expected product.stock_changed.fruit", key)
+	}
+}
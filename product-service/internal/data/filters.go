@@ -1,11 +1,25 @@
 package data
 
 import (
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
 	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
 	"math"
 	"strings"
 )
 
+const (
+	MaxPage     = 10_000_000
+	MaxPageSize = 100
+)
+
+func ValidateFilters(v *validator.Validator, filters *proto.Filters) {
+	v.Check(filters.GetPage() > 0, "page", "must be greater than zero")
+	v.Check(filters.GetPage() <= MaxPage, "page", "must be a maximum of 10 million")
+	v.Check(filters.GetPageSize() > 0, "page_size", "must be greater than zero")
+	v.Check(filters.GetPageSize() <= MaxPageSize, "page_size", "must be a maximum of 100")
+	v.Check(validator.PermittedValue(filters.GetSort(), filters.GetSortSafeList()...), "sort", "invalid sort value")
+}
+
 func sortColumn(filters *proto.Filters) string {
 	for _, safeValue := range filters.SortSafeList {
 		if filters.Sort == safeValue {
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
 	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
 	"testing"
 )
@@ -130,3 +131,48 @@ func TestOffSet(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateFilters(t *testing.T) {
+	safeList := []string{"id", "-id", "name", "-name"}
+	tests := []struct {
+		name     string
+		filter   *proto.Filters
+		expected []string
+	}{
+		{
+			name:     "Valid filters",
+			filter:   testcaseFilterByNameDesc,
+			expected: nil,
+		},
+		{
+			name:     "Zero page",
+			filter:   &proto.Filters{Page: 0, PageSize: 10, Sort: "id", SortSafeList: safeList},
+			expected: []string{"page"},
+		},
+		{
+			name:     "Page size above maximum",
+			filter:   &proto.Filters{Page: 1, PageSize: MaxPageSize + 1, Sort: "id", SortSafeList: safeList},
+			expected: []string{"page_size"},
+		},
+		{
+			name:     "Unsafe sort value",
+			filter:   &proto.Filters{Page: 1, PageSize: 10, Sort: "id; DROP TABLE products", SortSafeList: safeList},
+			expected: []string{"sort"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateFilters(v, tt.filter)
+			if len(v.Errors) != len(tt.expected) {
+				t.Fatalf("ValidateFilters() returned %v, expected errors for %v", v.Errors, tt.expected)
+			}
+			for _, key := range tt.expected {
+				if _, ok := v.Errors[key]; !ok {
+					t.Errorf("ValidateFilters() did not report %s", key)
+				}
+			}
+		})
+	}
+}
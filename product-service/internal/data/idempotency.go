@@ -0,0 +1,110 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used with a different request")
+
+// InsertIdempotent inserts the product unless the key has already been used
+// within its window, in which case the product stored with the key is
+// returned and replayed is true. Keys are scoped to the actor, so the same key
+// from another user is a different key. Claiming the key and inserting the
+// product happen in one transaction, so a concurrent retry with the same key
+// waits for the first attempt and then replays its result.
+func (p ProductModel) InsertIdempotent(ctx context.Context, product *proto.Product, actor, key string, fingerprint []byte, window time.Duration) (_ *proto.Product, replayed bool, err error) {
+	ctx, op := p.begin(ctx, "ProductModel.InsertIdempotent", p.Timeouts.Write)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// An expired key is reclaimed as if it had never been used.
+	claim := `INSERT INTO idempotency_keys (scope, key, fingerprint, expires_at)
+			  VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+			  ON CONFLICT (scope, key) DO UPDATE
+			  SET fingerprint = EXCLUDED.fingerprint, response = NULL, created_at = NOW(), expires_at = EXCLUDED.expires_at
+			  WHERE idempotency_keys.expires_at < NOW()
+			  RETURNING key`
+
+	var claimed string
+	err = tx.QueryRowContext(ctx, claim, actor, key, fingerprint, window.Seconds()).Scan(&claimed)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		product, err := replay(ctx, tx, actor, key, fingerprint)
+		if err == nil {
+			op.rows = 1
+		}
+		return product, err == nil, err
+	case err != nil:
+		return nil, false, err
+	}
+
+	product, err = p.insert(ctx, tx, product, actor)
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, err := protobuf.Marshal(product)
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE idempotency_keys SET response = $3 WHERE scope = $1 AND key = $2`, actor, key, response)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	op.rows = 1
+	return product, false, nil
+}
+
+func replay(ctx context.Context, tx *sql.Tx, scope, key string, fingerprint []byte) (*proto.Product, error) {
+	var storedFingerprint, response []byte
+	err := tx.QueryRowContext(ctx, `SELECT fingerprint, response FROM idempotency_keys WHERE scope = $1 AND key = $2`, scope, key).
+		Scan(&storedFingerprint, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(storedFingerprint, fingerprint) {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if response == nil {
+		return nil, errors.New("idempotency key has no stored response")
+	}
+
+	var product proto.Product
+	if err := protobuf.Unmarshal(response, &product); err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// DeleteExpiredIdempotencyKeys removes keys whose window has passed and
+// returns how many were deleted.
+func (p ProductModel) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	ctx, op := p.begin(ctx, "ProductModel.DeleteExpiredIdempotencyKeys", p.Timeouts.Sweep)
+	defer op.end()
+
+	result, err := p.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	op.rows = int(deleted)
+	return deleted, err
+}
@@ -0,0 +1,320 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ProductImage is a stored image. Key and Thumbnails are storage keys, which
+// the server turns into URLs.
+type ProductImage struct {
+	ID          int64
+	ProductID   int64
+	Key         string
+	Thumbnails  map[string]string
+	ContentType string
+	Width       int32
+	Height      int32
+	Position    int32
+	IsPrimary   bool
+	CreatedAt   time.Time
+}
+
+type ImageModel struct {
+	DB *sql.DB
+}
+
+// Insert adds an image after the product's existing ones. The first image a
+// product gets is its primary image, as is any image inserted with primary.
+func (m ImageModel) Insert(image *ProductImage, primary bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = lockProduct(ctx, tx, image.ProductID); err != nil {
+		return err
+	}
+
+	var count int32
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM product_images WHERE product_id = $1`, image.ProductID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	image.Position = count + 1
+	image.IsPrimary = primary || count == 0
+
+	if image.IsPrimary {
+		_, err = tx.ExecContext(ctx, `UPDATE product_images SET is_primary = false WHERE product_id = $1 AND is_primary`, image.ProductID)
+		if err != nil {
+			return err
+		}
+	}
+
+	thumbnails, err := json.Marshal(image.Thumbnails)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO product_images (product_id, storage_key, thumbnails, content_type, width, height, position, is_primary)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			  RETURNING id, created_at`
+
+	args := []any{
+		image.ProductID,
+		image.Key,
+		thumbnails,
+		image.ContentType,
+		image.Width,
+		image.Height,
+		image.Position,
+		image.IsPrimary,
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&image.ID, &image.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m ImageModel) GetForProduct(productID int64) ([]*ProductImage, error) {
+	images, err := m.GetForProducts([]int64{productID})
+	if err != nil {
+		return nil, err
+	}
+	return images[productID], nil
+}
+
+// GetForProducts loads the images of several products at once, each list
+// ordered by position.
+func (m ImageModel) GetForProducts(productIDs []int64) (map[int64][]*ProductImage, error) {
+	images := make(map[int64][]*ProductImage)
+	if len(productIDs) == 0 {
+		return images, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + imageColumns + `
+			  FROM product_images
+			  WHERE product_id = ANY($1)
+			  ORDER BY product_id, position`
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images[image.ProductID] = append(images[image.ProductID], image)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// Update moves an image to position, shifting the images in between, and
+// makes it the primary image when primary is set. A zero position leaves the
+// order alone. It returns all of the product's images in their new order.
+func (m ImageModel) Update(productID, imageID int64, position int32, primary bool) ([]*ProductImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return nil, err
+	}
+
+	images, err := imagesForProduct(ctx, tx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	index := -1
+	for i, image := range images {
+		if image.ID == imageID {
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil, ErrRecordNotFound
+	}
+
+	if position > 0 {
+		target := int(position) - 1
+		if target >= len(images) {
+			target = len(images) - 1
+		}
+		images = move(images, index, target)
+
+		for i, image := range images {
+			if image.Position == int32(i+1) {
+				continue
+			}
+			image.Position = int32(i + 1)
+			_, err = tx.ExecContext(ctx, `UPDATE product_images SET position = $2 WHERE id = $1`, image.ID, image.Position)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if primary {
+		// Two statements, since the unique index on the primary flag is
+		// checked row by row.
+		_, err = tx.ExecContext(ctx, `UPDATE product_images SET is_primary = false WHERE product_id = $1 AND is_primary`, productID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE product_images SET is_primary = true WHERE id = $1`, imageID)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			image.IsPrimary = image.ID == imageID
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// Delete removes an image and closes the gap it leaves in the order. When the
+// primary image is deleted, the first remaining image takes its place. The
+// deleted image is returned so that its files can be removed from storage.
+func (m ImageModel) Delete(productID, imageID int64) (*ProductImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return nil, err
+	}
+
+	query := `DELETE FROM product_images
+			  WHERE id = $1 AND product_id = $2
+			  RETURNING ` + imageColumns
+
+	image, err := scanImage(tx.QueryRowContext(ctx, query, imageID, productID))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE product_images SET position = position - 1 WHERE product_id = $1 AND position > $2`, productID, image.Position)
+	if err != nil {
+		return nil, err
+	}
+
+	if image.IsPrimary {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE product_images SET is_primary = true
+			WHERE id = (SELECT id FROM product_images WHERE product_id = $1 ORDER BY position LIMIT 1)`, productID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+const imageColumns = `id, product_id, storage_key, thumbnails, content_type, width, height, position, is_primary, created_at`
+
+func scanImage(row rowScanner) (*ProductImage, error) {
+	var image ProductImage
+	var thumbnails []byte
+	err := row.Scan(
+		&image.ID,
+		&image.ProductID,
+		&image.Key,
+		&thumbnails,
+		&image.ContentType,
+		&image.Width,
+		&image.Height,
+		&image.Position,
+		&image.IsPrimary,
+		&image.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if err = json.Unmarshal(thumbnails, &image.Thumbnails); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func imagesForProduct(ctx context.Context, q querier, productID int64) ([]*ProductImage, error) {
+	rows, err := q.QueryContext(ctx, `SELECT `+imageColumns+` FROM product_images WHERE product_id = $1 ORDER BY position`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []*ProductImage
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// lockProduct serialises changes to a product's images and reports a missing
+// or deleted product as ErrRecordNotFound.
+func lockProduct(ctx context.Context, q querier, productID int64) error {
+	var id int64
+	err := q.QueryRowContext(ctx, `SELECT id FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, productID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+// move returns images with the element at from moved to index to.
+func move(images []*ProductImage, from, to int) []*ProductImage {
+	image := images[from]
+	images = append(images[:from], images[from+1:]...)
+	images = append(images[:to], append([]*ProductImage{image}, images[to:]...)...)
+	return images
+}
@@ -0,0 +1,31 @@
+package data
+
+import "testing"
+
+func TestMove(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int
+		expected []int64
+	}{
+		{"Forward", 0, 2, []int64{2, 3, 1, 4}},
+		{"Backward", 3, 1, []int64{1, 4, 2, 3}},
+		{"In place", 1, 1, []int64{1, 2, 3, 4}},
+		{"To end", 0, 3, []int64{2, 3, 4, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images := []*ProductImage{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+			result := move(images, tt.from, tt.to)
+			if len(result) != len(tt.expected) {
+				t.Fatalf("move() returned %d images, expected %d", len(result), len(tt.expected))
+			}
+			for i, image := range result {
+				if image.ID != tt.expected[i] {
+					t.Errorf("move()[%d] = %d, expected %d", i, image.ID, tt.expected[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,570 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// memoryStore holds everything the memory repositories keep. One mutex
+// guards all of it, which stands in for the row locks and transactions of
+// the PostgreSQL models.
+type memoryStore struct {
+	mu  sync.Mutex
+	now func() time.Time
+	ids map[string]int64
+
+	categories      map[int64]*proto.Category
+	products        map[int64]*proto.Product
+	variants        map[int64]*proto.ProductVariant
+	images          map[int64]*ProductImage
+	reviews         map[int64]*proto.Review
+	pricingRules    map[int64]*proto.PricingRule
+	movements       []*proto.StockMovement
+	reservations    map[int64]*proto.StockReservation
+	idempotencyKeys map[idempotencyScope]*memoryIdempotencyKey
+}
+
+// idempotencyScope is a key as the client sent it and the actor it belongs to.
+type idempotencyScope struct {
+	actor, key string
+}
+
+type memoryIdempotencyKey struct {
+	fingerprint []byte
+	product     *proto.Product
+	expiresAt   time.Time
+}
+
+// NewMemoryModels returns models that keep their data in memory, for tests
+// that should not need a database. They follow the PostgreSQL models closely
+// but leave out what only the database does: the audit history, currency
+// conversion and the outbox are not available, and prices are only compared
+// with filter bounds in the filter's own currency.
+func NewMemoryModels() Models {
+	s := &memoryStore{
+		now:             time.Now,
+		ids:             make(map[string]int64),
+		categories:      make(map[int64]*proto.Category),
+		products:        make(map[int64]*proto.Product),
+		variants:        make(map[int64]*proto.ProductVariant),
+		images:          make(map[int64]*ProductImage),
+		reviews:         make(map[int64]*proto.Review),
+		pricingRules:    make(map[int64]*proto.PricingRule),
+		reservations:    make(map[int64]*proto.StockReservation),
+		idempotencyKeys: make(map[idempotencyScope]*memoryIdempotencyKey),
+	}
+	return Models{
+		Products:   memoryProducts{s},
+		Movements:  memoryMovements{s},
+		Categories: memoryCategories{s},
+		Images:     memoryImages{s},
+		Variants:   memoryVariants{s},
+		Reviews:    memoryReviews{s},
+		Pricing:    memoryPricingRules{s},
+	}
+}
+
+func (s *memoryStore) nextID(table string) int64 {
+	s.ids[table]++
+	return s.ids[table]
+}
+
+// product returns the stored product, or ErrRecordNotFound when there is none
+// or it is deleted and includeDeleted is not set.
+func (s *memoryStore) product(id int64, includeDeleted bool) (*proto.Product, error) {
+	product, ok := s.products[id]
+	if !ok || (!includeDeleted && product.DeletedAt != nil) {
+		return nil, ErrRecordNotFound
+	}
+	return product, nil
+}
+
+// output copies a stored product the way scanProduct reads it.
+func (s *memoryStore) output(product *proto.Product) *proto.Product {
+	out := protobuf.Clone(product).(*proto.Product)
+	if category, ok := s.categories[product.CategoryId]; ok {
+		out.Category = category.Name
+	}
+	SetLegacyPrice(out)
+	return out
+}
+
+// touch bumps a product's version and recomputes its availability, as
+// touchProduct does.
+func (s *memoryStore) touch(product *proto.Product) {
+	product.Version++
+	product.IsAvailable = product.Quantity > 0
+	for _, variant := range s.variants {
+		if variant.ProductId == product.Id && variant.Quantity > 0 {
+			product.IsAvailable = true
+		}
+	}
+}
+
+func (s *memoryStore) insertMovement(movement *proto.StockMovement) {
+	movement.Id = s.nextID("stock_movements")
+	movement.CreatedAt = timestamppb.New(s.now())
+	s.movements = append(s.movements, protobuf.Clone(movement).(*proto.StockMovement))
+}
+
+// adjustQuantity is the memory version of adjustQuantity.
+func (s *memoryStore) adjustQuantity(product *proto.Product, delta int32, reason, actor string) (*proto.StockMovement, error) {
+	if product.Quantity+delta < 0 {
+		return nil, ErrInsufficientStock
+	}
+	product.Quantity += delta
+	s.touch(product)
+
+	movement := &proto.StockMovement{
+		ProductId: product.Id,
+		Delta:     delta,
+		Reason:    reason,
+		Actor:     actor,
+		Balance:   product.Quantity,
+	}
+	s.insertMovement(movement)
+	return movement, nil
+}
+
+// adjustVariantQuantity is the memory version of adjustVariantQuantity.
+func (s *memoryStore) adjustVariantQuantity(product *proto.Product, variantID int64, delta int32, reason, actor string) (*proto.StockMovement, error) {
+	variant, ok := s.variants[variantID]
+	if !ok || variant.ProductId != product.Id {
+		return nil, ErrRecordNotFound
+	}
+	if variant.Quantity+delta < 0 {
+		return nil, ErrInsufficientStock
+	}
+	variant.Quantity += delta
+	variant.Version++
+	s.touch(product)
+
+	movement := &proto.StockMovement{
+		ProductId: product.Id,
+		VariantId: variantID,
+		Delta:     delta,
+		Reason:    reason,
+		Actor:     actor,
+		Balance:   variant.Quantity,
+	}
+	s.insertMovement(movement)
+	return movement, nil
+}
+
+// restock is the memory version of restock.
+func (s *memoryStore) restock(product *proto.Product, reservation *proto.StockReservation, reason, actor string) error {
+	var err error
+	if reservation.VariantId != 0 {
+		_, err = s.adjustVariantQuantity(product, reservation.VariantId, reservation.Quantity, reason, actor)
+	} else {
+		_, err = s.adjustQuantity(product, reservation.Quantity, reason, actor)
+	}
+	return err
+}
+
+func (s *memoryStore) hasVariants(productID int64) bool {
+	for _, variant := range s.variants {
+		if variant.ProductId == productID {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryProducts struct {
+	s *memoryStore
+}
+
+func (m memoryProducts) Insert(ctx context.Context, product *proto.Product, actor string) (*proto.Product, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	return m.insert(product, actor)
+}
+
+func (m memoryProducts) insert(product *proto.Product, actor string) (*proto.Product, error) {
+	category, ok := m.s.categories[product.CategoryId]
+	if !ok {
+		return nil, ErrUnknownCategory
+	}
+
+	product.Id = m.s.nextID("products")
+	product.CreationDate = timestamppb.New(m.s.now())
+	product.Version = 1
+	product.IsAvailable = product.Quantity > 0
+	product.Category = category.Name
+	product.AverageRating, product.ReviewCount = 0, 0
+
+	stored := protobuf.Clone(product).(*proto.Product)
+	stored.Variants, stored.Images, stored.Snippet = nil, nil, ""
+	m.s.products[product.Id] = stored
+
+	if product.Quantity != 0 {
+		m.s.insertMovement(&proto.StockMovement{
+			ProductId: product.Id,
+			Delta:     product.Quantity,
+			Reason:    MovementReasonInitial,
+			Actor:     actor,
+			Balance:   product.Quantity,
+		})
+	}
+	return product, nil
+}
+
+func (m memoryProducts) InsertIdempotent(ctx context.Context, product *proto.Product, actor, key string, fingerprint []byte, window time.Duration) (*proto.Product, bool, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	scoped := idempotencyScope{actor: actor, key: key}
+	if stored, ok := m.s.idempotencyKeys[scoped]; ok && !stored.expiresAt.Before(m.s.now()) {
+		if !bytes.Equal(stored.fingerprint, fingerprint) {
+			return nil, false, ErrIdempotencyKeyReused
+		}
+		return protobuf.Clone(stored.product).(*proto.Product), true, nil
+	}
+
+	product, err := m.insert(product, actor)
+	if err != nil {
+		return nil, false, err
+	}
+	m.s.idempotencyKeys[scoped] = &memoryIdempotencyKey{
+		fingerprint: fingerprint,
+		product:     protobuf.Clone(product).(*proto.Product),
+		expiresAt:   m.s.now().Add(window),
+	}
+	return product, false, nil
+}
+
+func (m memoryProducts) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var deleted int64
+	for key, stored := range m.s.idempotencyKeys {
+		if stored.expiresAt.Before(m.s.now()) {
+			delete(m.s.idempotencyKeys, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m memoryProducts) Get(ctx context.Context, id int64) (*proto.Product, error) {
+	return m.get(id, false)
+}
+
+func (m memoryProducts) GetIncludingDeleted(ctx context.Context, id int64) (*proto.Product, error) {
+	return m.get(id, true)
+}
+
+func (m memoryProducts) get(id int64, includeDeleted bool) (*proto.Product, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	product, err := m.s.product(id, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	return m.s.output(product), nil
+}
+
+func (m memoryProducts) GetMany(ctx context.Context, ids []int64) ([]*proto.Product, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var products []*proto.Product
+	for _, id := range ids {
+		if product, err := m.s.product(id, false); err == nil {
+			products = append(products, m.s.output(product))
+		}
+	}
+	return products, nil
+}
+
+func (m memoryProducts) Update(ctx context.Context, product *proto.Product, actor string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, err := m.s.product(product.Id, false)
+	if err != nil {
+		return err
+	}
+	category, ok := m.s.categories[product.CategoryId]
+	if !ok {
+		return ErrUnknownCategory
+	}
+	for _, variant := range m.s.variants {
+		if variant.ProductId != product.Id {
+			continue
+		}
+		if optionsMismatch(variant.Options, product.Options) != "" {
+			return ErrOptionsInUse
+		}
+		if variant.PriceMinor != nil && stored.Currency != product.Currency {
+			return ErrCurrencyInUse
+		}
+	}
+
+	stored.Name = product.Name
+	stored.PriceMinor = product.PriceMinor
+	stored.Currency = product.Currency
+	stored.Description = product.Description
+	stored.CategoryId = product.CategoryId
+	stored.Options = product.Options
+	m.s.touch(stored)
+
+	product.Quantity = stored.Quantity
+	product.Version = stored.Version
+	product.IsAvailable = stored.IsAvailable
+	product.Category = category.Name
+	product.AverageRating = stored.AverageRating
+	product.ReviewCount = stored.ReviewCount
+	return nil
+}
+
+func (m memoryProducts) Delete(ctx context.Context, id int64, actor string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	product, err := m.s.product(id, false)
+	if err != nil {
+		return err
+	}
+	product.DeletedAt = timestamppb.New(m.s.now())
+	product.Version++
+	return nil
+}
+
+func (m memoryProducts) Restore(ctx context.Context, id int64, actor string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	product, err := m.s.product(id, true)
+	if err != nil {
+		return err
+	}
+	if product.DeletedAt == nil {
+		return ErrNotDeleted
+	}
+	product.DeletedAt = nil
+	product.Version++
+	return nil
+}
+
+func (m memoryProducts) PurgeDeleted(ctx context.Context, retention time.Duration, limit int) (int, []*ProductImage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	cutoff := m.s.now().Add(-retention)
+	var expired []*proto.Product
+	for _, product := range m.s.products {
+		if product.DeletedAt != nil && product.DeletedAt.AsTime().Before(cutoff) {
+			expired = append(expired, product)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].DeletedAt.AsTime().Before(expired[j].DeletedAt.AsTime())
+	})
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+
+	var images []*ProductImage
+	for _, product := range expired {
+		images = append(images, m.s.imagesFor(product.Id)...)
+		for id, image := range m.s.images {
+			if image.ProductID == product.Id {
+				delete(m.s.images, id)
+			}
+		}
+		for id, variant := range m.s.variants {
+			if variant.ProductId == product.Id {
+				delete(m.s.variants, id)
+			}
+		}
+		for id, reservation := range m.s.reservations {
+			if reservation.ProductId == product.Id {
+				delete(m.s.reservations, id)
+			}
+		}
+		for id, review := range m.s.reviews {
+			if review.ProductId == product.Id {
+				delete(m.s.reviews, id)
+			}
+		}
+		for id, rule := range m.s.pricingRules {
+			if rule.Scope == PricingScopeProduct && rule.TargetId == product.Id {
+				delete(m.s.pricingRules, id)
+			}
+		}
+		delete(m.s.products, product.Id)
+	}
+	return len(expired), images, nil
+}
+
+func (m memoryProducts) Reserve(ctx context.Context, productID, variantID int64, quantity int32, ttl time.Duration, actor string) (*proto.StockReservation, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	product, err := m.s.product(productID, false)
+	if err != nil {
+		return nil, err
+	}
+	if variantID != 0 {
+		_, err = m.s.adjustVariantQuantity(product, variantID, -quantity, MovementReasonReserve, actor)
+	} else {
+		_, err = m.s.adjustQuantity(product, -quantity, MovementReasonReserve, actor)
+		if errors.Is(err, ErrInsufficientStock) && m.s.hasVariants(productID) {
+			err = ErrVariantRequired
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.s.now()
+	reservation := &proto.StockReservation{
+		Id:        m.s.nextID("stock_reservations"),
+		ProductId: productID,
+		VariantId: variantID,
+		Quantity:  quantity,
+		Status:    ReservationPending,
+		CreatedAt: timestamppb.New(now),
+		ExpiresAt: timestamppb.New(now.Add(ttl)),
+	}
+	m.s.reservations[reservation.Id] = reservation
+	return protobuf.Clone(reservation).(*proto.StockReservation), nil
+}
+
+func (m memoryProducts) Release(ctx context.Context, id int64, actor string) (*proto.StockReservation, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	reservation, err := m.closeReservation(id, ReservationReleased, false)
+	if err != nil {
+		return nil, err
+	}
+	// Deleted products still get their stock back.
+	if product, err := m.s.product(reservation.ProductId, true); err == nil {
+		if err = m.s.restock(product, reservation, MovementReasonRelease, actor); err != nil {
+			return nil, err
+		}
+	}
+	return reservation, nil
+}
+
+func (m memoryProducts) Commit(ctx context.Context, id int64) (*proto.StockReservation, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	return m.closeReservation(id, ReservationCommitted, true)
+}
+
+func (m memoryProducts) ExpireReservations(ctx context.Context, limit int) (int, []int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var expired []*proto.StockReservation
+	for _, reservation := range m.s.reservations {
+		if reservation.Status == ReservationPending && !reservation.ExpiresAt.AsTime().After(m.s.now()) {
+			expired = append(expired, reservation)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Id < expired[j].Id })
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+
+	var productIDs []int64
+	for _, reservation := range expired {
+		reservation.Status = ReservationExpired
+		if product, err := m.s.product(reservation.ProductId, true); err == nil {
+			if err = m.s.restock(product, reservation, MovementReasonExpire, ""); err != nil {
+				return 0, nil, err
+			}
+			productIDs = append(productIDs, product.Id)
+		}
+	}
+	return len(expired), productIDs, nil
+}
+
+// closeReservation is the memory version of closeReservation.
+func (m memoryProducts) closeReservation(id int64, status string, unexpired bool) (*proto.StockReservation, error) {
+	reservation, ok := m.s.reservations[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	expired := !reservation.ExpiresAt.AsTime().After(m.s.now())
+	if reservation.Status != ReservationPending || (unexpired && expired) {
+		current := reservation.Status
+		if current == ReservationPending && expired {
+			current = ReservationExpired
+		}
+		return nil, fmt.Errorf("%w: %s", ErrReservationClosed, current)
+	}
+
+	reservation.Status = status
+	return protobuf.Clone(reservation).(*proto.StockReservation), nil
+}
+
+func (m memoryProducts) AdjustStock(ctx context.Context, productID, variantID int64, delta int32, reason, actor string) (*proto.StockMovement, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	product, err := m.s.product(productID, false)
+	if err != nil {
+		return nil, err
+	}
+	if variantID == 0 {
+		return m.s.adjustQuantity(product, delta, reason, actor)
+	}
+	return m.s.adjustVariantQuantity(product, variantID, delta, reason, actor)
+}
+
+type memoryMovements struct {
+	s *memoryStore
+}
+
+func (m memoryMovements) GetForProduct(ctx context.Context, productID int64, filters *proto.Filters) ([]*proto.StockMovement, *proto.Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var movements []*proto.StockMovement
+	for _, movement := range m.s.movements {
+		if movement.ProductId == productID {
+			movements = append(movements, protobuf.Clone(movement).(*proto.StockMovement))
+		}
+	}
+	// The only sort column is the id, in which order movements are kept.
+	sortColumn(filters)
+	if sortDirection(filters) == "DESC" {
+		for i, j := 0, len(movements)-1; i < j; i, j = i+1, j-1 {
+			movements[i], movements[j] = movements[j], movements[i]
+		}
+	}
+
+	return paginate(movements, filters), calculateMetadata(int32(len(movements)), filters), nil
+}
+
+// paginate returns the page of items that filters asks for.
+func paginate[T any](items []T, filters *proto.Filters) []T {
+	start := int(offset(filters))
+	if start >= len(items) {
+		return nil
+	}
+	end := start + int(limit(filters))
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end]
+}
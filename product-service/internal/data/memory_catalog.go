@@ -0,0 +1,396 @@
+package data
+
+import (
+	"sort"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type memoryCategories struct {
+	s *memoryStore
+}
+
+func (m memoryCategories) Insert(category *proto.Category) (*proto.Category, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if err := m.check(category); err != nil {
+		return nil, err
+	}
+
+	category.Id = m.s.nextID("categories")
+	category.CreatedAt = timestamppb.New(m.s.now())
+	category.Version = 1
+	m.s.categories[category.Id] = protobuf.Clone(category).(*proto.Category)
+	return category, nil
+}
+
+// check enforces the constraints of the categories table: a unique slug and
+// an existing parent.
+func (m memoryCategories) check(category *proto.Category) error {
+	for _, other := range m.s.categories {
+		if other.Slug == category.Slug && other.Id != category.Id {
+			return ErrDuplicateSlug
+		}
+	}
+	if _, ok := m.s.categories[category.ParentId]; category.ParentId != 0 && !ok {
+		return ErrParentNotFound
+	}
+	return nil
+}
+
+func (m memoryCategories) Get(id int64) (*proto.Category, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	category, ok := m.s.categories[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return protobuf.Clone(category).(*proto.Category), nil
+}
+
+func (m memoryCategories) GetBySlug(slug string) (*proto.Category, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, category := range m.s.categories {
+		if category.Slug == slug {
+			return protobuf.Clone(category).(*proto.Category), nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryCategories) GetAll(rootID int64) ([]*proto.Category, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var categories []*proto.Category
+	if rootID == 0 {
+		for _, category := range m.s.categories {
+			categories = append(categories, protobuf.Clone(category).(*proto.Category))
+		}
+	} else {
+		for id := range m.s.subtree([]int64{rootID}) {
+			categories = append(categories, protobuf.Clone(m.s.categories[id]).(*proto.Category))
+		}
+		if len(categories) == 0 {
+			return nil, ErrRecordNotFound
+		}
+	}
+	return orderTree(categories), nil
+}
+
+func (m memoryCategories) Update(category *proto.Category) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.categories[category.Id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	if category.ParentId != 0 && m.s.subtree([]int64{category.Id})[category.ParentId] {
+		return ErrCategoryCycle
+	}
+	if err := m.check(category); err != nil {
+		return err
+	}
+
+	stored.ParentId = category.ParentId
+	stored.Name = category.Name
+	stored.Slug = category.Slug
+	stored.SortOrder = category.SortOrder
+	stored.Version++
+	category.Version = stored.Version
+	return nil
+}
+
+func (m memoryCategories) Delete(id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.categories[id]; !ok {
+		return ErrRecordNotFound
+	}
+	for _, category := range m.s.categories {
+		if category.ParentId == id {
+			return ErrCategoryInUse
+		}
+	}
+	for _, product := range m.s.products {
+		if product.CategoryId == id {
+			return ErrCategoryInUse
+		}
+	}
+	for ruleID, rule := range m.s.pricingRules {
+		if rule.Scope == PricingScopeCategory && rule.TargetId == id {
+			delete(m.s.pricingRules, ruleID)
+		}
+	}
+	delete(m.s.categories, id)
+	return nil
+}
+
+type memoryVariants struct {
+	s *memoryStore
+}
+
+// check enforces what checkVariantOptions and the constraints of the
+// product_variants table do.
+func (m memoryVariants) check(variant *proto.ProductVariant) (*proto.Product, error) {
+	product, err := m.s.product(variant.ProductId, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(product.Options) == 0 || optionsMismatch(variant.Options, product.Options) != "" {
+		return nil, ErrVariantOptions
+	}
+
+	for _, other := range m.s.variants {
+		if other.Id == variant.Id {
+			continue
+		}
+		if other.Sku == variant.Sku {
+			return nil, ErrDuplicateSKU
+		}
+		if other.ProductId == variant.ProductId && sameOptions(other.Options, variant.Options) {
+			return nil, ErrDuplicateVariant
+		}
+	}
+	return product, nil
+}
+
+func sameOptions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if b[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (m memoryVariants) Insert(variant *proto.ProductVariant, actor string) (*proto.ProductVariant, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	product, err := m.check(variant)
+	if err != nil {
+		return nil, err
+	}
+
+	variant.Id = m.s.nextID("product_variants")
+	variant.CreatedAt = timestamppb.New(m.s.now())
+	variant.Version = 1
+	variant.IsAvailable = variant.Quantity > 0
+	m.s.variants[variant.Id] = protobuf.Clone(variant).(*proto.ProductVariant)
+
+	if variant.Quantity != 0 {
+		m.s.insertMovement(&proto.StockMovement{
+			ProductId: variant.ProductId,
+			VariantId: variant.Id,
+			Delta:     variant.Quantity,
+			Reason:    MovementReasonInitial,
+			Actor:     actor,
+			Balance:   variant.Quantity,
+		})
+	}
+	m.s.touch(product)
+	return variant, nil
+}
+
+func (m memoryVariants) Update(variant *proto.ProductVariant, actor string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	product, err := m.check(variant)
+	if err != nil {
+		return err
+	}
+	stored, ok := m.s.variants[variant.Id]
+	if !ok || stored.ProductId != variant.ProductId {
+		return ErrRecordNotFound
+	}
+
+	stored.Sku = variant.Sku
+	stored.Options = variant.Options
+	stored.PriceMinor = variant.PriceMinor
+	stored.Version++
+
+	variant.Quantity = stored.Quantity
+	variant.CreatedAt = stored.CreatedAt
+	variant.Version = stored.Version
+	variant.IsAvailable = stored.IsAvailable
+	m.s.touch(product)
+	return nil
+}
+
+func (m memoryVariants) Delete(productID, variantID int64, actor string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	product, err := m.s.product(productID, false)
+	if err != nil {
+		return err
+	}
+	stored, ok := m.s.variants[variantID]
+	if !ok || stored.ProductId != productID {
+		return ErrRecordNotFound
+	}
+
+	delete(m.s.variants, variantID)
+	for id, reservation := range m.s.reservations {
+		if reservation.VariantId == variantID {
+			delete(m.s.reservations, id)
+		}
+	}
+	m.s.touch(product)
+	return nil
+}
+
+func (m memoryVariants) GetForProducts(productIDs []int64) (map[int64][]*proto.ProductVariant, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	wanted := make(map[int64]bool, len(productIDs))
+	for _, id := range productIDs {
+		wanted[id] = true
+	}
+
+	variants := make(map[int64][]*proto.ProductVariant)
+	for _, variant := range m.s.variants {
+		if wanted[variant.ProductId] {
+			variants[variant.ProductId] = append(variants[variant.ProductId], protobuf.Clone(variant).(*proto.ProductVariant))
+		}
+	}
+	for _, list := range variants {
+		sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	}
+	return variants, nil
+}
+
+type memoryImages struct {
+	s *memoryStore
+}
+
+// imagesFor returns copies of a product's images ordered by position.
+func (s *memoryStore) imagesFor(productID int64) []*ProductImage {
+	var images []*ProductImage
+	for _, image := range s.images {
+		if image.ProductID == productID {
+			copied := *image
+			images = append(images, &copied)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Position < images[j].Position })
+	return images
+}
+
+func (m memoryImages) Insert(image *ProductImage, primary bool) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, err := m.s.product(image.ProductID, false); err != nil {
+		return err
+	}
+
+	existing := m.s.imagesFor(image.ProductID)
+	image.Position = int32(len(existing)) + 1
+	image.IsPrimary = primary || len(existing) == 0
+	if image.IsPrimary {
+		for _, other := range existing {
+			m.s.images[other.ID].IsPrimary = false
+		}
+	}
+
+	image.ID = m.s.nextID("product_images")
+	image.CreatedAt = m.s.now()
+	stored := *image
+	m.s.images[image.ID] = &stored
+	return nil
+}
+
+func (m memoryImages) Update(productID, imageID int64, position int32, primary bool) ([]*ProductImage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, err := m.s.product(productID, false); err != nil {
+		return nil, err
+	}
+
+	images := m.s.imagesFor(productID)
+	index := -1
+	for i, image := range images {
+		if image.ID == imageID {
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil, ErrRecordNotFound
+	}
+
+	if position > 0 {
+		target := int(position) - 1
+		if target >= len(images) {
+			target = len(images) - 1
+		}
+		images = move(images, index, target)
+		for i, image := range images {
+			image.Position = int32(i + 1)
+		}
+	}
+	if primary {
+		for _, image := range images {
+			image.IsPrimary = image.ID == imageID
+		}
+	}
+
+	for _, image := range images {
+		stored := *image
+		m.s.images[image.ID] = &stored
+	}
+	return images, nil
+}
+
+func (m memoryImages) Delete(productID, imageID int64) (*ProductImage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, err := m.s.product(productID, false); err != nil {
+		return nil, err
+	}
+	image, ok := m.s.images[imageID]
+	if !ok || image.ProductID != productID {
+		return nil, ErrRecordNotFound
+	}
+	delete(m.s.images, imageID)
+
+	remaining := m.s.imagesFor(productID)
+	for _, other := range remaining {
+		if other.Position > image.Position {
+			m.s.images[other.ID].Position--
+		}
+	}
+	if image.IsPrimary && len(remaining) > 0 {
+		m.s.images[remaining[0].ID].IsPrimary = true
+	}
+	return image, nil
+}
+
+func (m memoryImages) GetForProducts(productIDs []int64) (map[int64][]*ProductImage, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	images := make(map[int64][]*ProductImage)
+	for _, id := range productIDs {
+		if list := m.s.imagesFor(id); len(list) > 0 {
+			images[id] = list
+		}
+	}
+	return images, nil
+}
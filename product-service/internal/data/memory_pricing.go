@@ -0,0 +1,133 @@
+package data
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type memoryPricingRules struct {
+	s *memoryStore
+}
+
+// check enforces the foreign keys of the pricing_rules table.
+func (m memoryPricingRules) check(rule *proto.PricingRule) error {
+	switch rule.Scope {
+	case PricingScopeProduct:
+		if _, ok := m.s.products[rule.TargetId]; !ok {
+			return ErrUnknownPricingTarget
+		}
+	case PricingScopeCategory:
+		if _, ok := m.s.categories[rule.TargetId]; !ok {
+			return ErrUnknownPricingTarget
+		}
+	}
+	return nil
+}
+
+func (m memoryPricingRules) Insert(rule *proto.PricingRule) (*proto.PricingRule, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if err := m.check(rule); err != nil {
+		return nil, err
+	}
+
+	rule.Id = m.s.nextID("pricing_rules")
+	rule.CreatedAt = timestamppb.New(m.s.now())
+	rule.Version = 1
+	m.s.pricingRules[rule.Id] = protobuf.Clone(rule).(*proto.PricingRule)
+	return rule, nil
+}
+
+func (m memoryPricingRules) Get(id int64) (*proto.PricingRule, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	rule, ok := m.s.pricingRules[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return protobuf.Clone(rule).(*proto.PricingRule), nil
+}
+
+func (m memoryPricingRules) GetAll(activeAt *time.Time, filters *proto.Filters) ([]*proto.PricingRule, *proto.Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var rules []*proto.PricingRule
+	for _, rule := range m.s.pricingRules {
+		if activeAt == nil || activeRule(rule, *activeAt) {
+			rules = append(rules, protobuf.Clone(rule).(*proto.PricingRule))
+		}
+	}
+
+	column := sortColumn(filters)
+	descending := sortDirection(filters) == "DESC"
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		var cmp int
+		switch column {
+		case "priority":
+			cmp = compare(int64(a.Priority), int64(b.Priority))
+		case "starts_at":
+			cmp = compare(a.StartsAt.AsTime().UnixNano(), b.StartsAt.AsTime().UnixNano())
+		case "id":
+			cmp = compare(a.Id, b.Id)
+		}
+		if descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+		return a.Id < b.Id
+	})
+
+	return paginate(rules, filters), calculateMetadata(int32(len(rules)), filters), nil
+}
+
+func (m memoryPricingRules) Active(at time.Time) ([]*proto.PricingRule, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var rules []*proto.PricingRule
+	for _, rule := range m.s.pricingRules {
+		if activeRule(rule, at) {
+			rules = append(rules, protobuf.Clone(rule).(*proto.PricingRule))
+		}
+	}
+	return rules, nil
+}
+
+func (m memoryPricingRules) Update(rule *proto.PricingRule) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.pricingRules[rule.Id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	if err := m.check(rule); err != nil {
+		return err
+	}
+
+	rule.CreatedAt = stored.CreatedAt
+	rule.Version = stored.Version + 1
+	m.s.pricingRules[rule.Id] = protobuf.Clone(rule).(*proto.PricingRule)
+	return nil
+}
+
+func (m memoryPricingRules) Delete(id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.pricingRules[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.pricingRules, id)
+	return nil
+}
@@ -0,0 +1,177 @@
+package data
+
+import (
+	"sort"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type memoryReviews struct {
+	s *memoryStore
+}
+
+func (m memoryReviews) Insert(review *proto.Review) (*proto.Review, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, err := m.s.product(review.ProductId, false); err != nil {
+		return nil, err
+	}
+	for _, other := range m.s.reviews {
+		if other.ProductId == review.ProductId && other.UserId == review.UserId {
+			return nil, ErrDuplicateReview
+		}
+	}
+
+	now := timestamppb.New(m.s.now())
+	review.Id = m.s.nextID("reviews")
+	review.Verified = false
+	review.Status = ReviewPending
+	review.CreatedAt = now
+	review.UpdatedAt = now
+	review.Version = 1
+	m.s.reviews[review.Id] = protobuf.Clone(review).(*proto.Review)
+	return review, nil
+}
+
+// review returns a stored review of a product that is not deleted.
+func (m memoryReviews) review(productID, id int64) (*proto.Review, error) {
+	if _, err := m.s.product(productID, false); err != nil {
+		return nil, err
+	}
+	review, ok := m.s.reviews[id]
+	if !ok || review.ProductId != productID {
+		return nil, ErrRecordNotFound
+	}
+	return review, nil
+}
+
+func (m memoryReviews) Get(productID, id int64) (*proto.Review, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	review, ok := m.s.reviews[id]
+	if !ok || review.ProductId != productID {
+		return nil, ErrRecordNotFound
+	}
+	return protobuf.Clone(review).(*proto.Review), nil
+}
+
+func (m memoryReviews) GetAll(filter ReviewFilter, filters *proto.Filters) ([]*proto.Review, *proto.Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var reviews []*proto.Review
+	for _, review := range m.s.reviews {
+		if (filter.ProductID == 0 || review.ProductId == filter.ProductID) && review.Status == filter.Status {
+			reviews = append(reviews, protobuf.Clone(review).(*proto.Review))
+		}
+	}
+
+	column := sortColumn(filters)
+	descending := sortDirection(filters) == "DESC"
+	sort.Slice(reviews, func(i, j int) bool {
+		a, b := reviews[i], reviews[j]
+		var cmp int
+		switch column {
+		case "rating":
+			cmp = compare(int64(a.Rating), int64(b.Rating))
+		case "created_at":
+			cmp = compare(a.CreatedAt.AsTime().UnixNano(), b.CreatedAt.AsTime().UnixNano())
+		case "id":
+			cmp = compare(a.Id, b.Id)
+		}
+		if descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+		return a.Id < b.Id
+	})
+
+	return paginate(reviews, filters), calculateMetadata(int32(len(reviews)), filters), nil
+}
+
+func (m memoryReviews) Update(review *proto.Review) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, err := m.review(review.ProductId, review.Id)
+	if err != nil {
+		return err
+	}
+
+	stored.Rating = review.Rating
+	stored.Title = review.Title
+	stored.Body = review.Body
+	stored.Status = ReviewPending
+	stored.UpdatedAt = timestamppb.New(m.s.now())
+	stored.Version++
+	m.s.rate(review.ProductId)
+
+	review.UserId = stored.UserId
+	review.Verified = stored.Verified
+	review.Status = stored.Status
+	review.CreatedAt = stored.CreatedAt
+	review.UpdatedAt = stored.UpdatedAt
+	review.Version = stored.Version
+	return nil
+}
+
+func (m memoryReviews) Moderate(productID, id int64, status string, verified *bool) (*proto.Review, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, err := m.review(productID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	stored.Status = status
+	if verified != nil {
+		stored.Verified = *verified
+	}
+	stored.UpdatedAt = timestamppb.New(m.s.now())
+	stored.Version++
+	m.s.rate(productID)
+
+	return protobuf.Clone(stored).(*proto.Review), nil
+}
+
+func (m memoryReviews) Delete(productID, id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, err := m.review(productID, id); err != nil {
+		return err
+	}
+	delete(m.s.reviews, id)
+	m.s.rate(productID)
+	return nil
+}
+
+// rate recomputes a product's rating from its approved reviews, which
+// rateProduct keeps up to date one change at a time.
+func (s *memoryStore) rate(productID int64) {
+	product, ok := s.products[productID]
+	if !ok {
+		return
+	}
+
+	var sum int64
+	var count int32
+	for _, review := range s.reviews {
+		if review.ProductId == productID && review.Status == ReviewApproved {
+			sum += int64(review.Rating)
+			count++
+		}
+	}
+	product.ReviewCount = count
+	product.AverageRating = 0
+	if count > 0 {
+		product.AverageRating = float64(sum) / float64(count)
+	}
+}
@@ -0,0 +1,410 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/currency"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+)
+
+// The memory store filters and ranks products in Go. Word matching follows
+// the 'simple' text search configuration the queries use; ranking and
+// similarity approximate ts_rank and word_similarity closely enough to order
+// results the same way in tests.
+
+// similarityThreshold is pg_trgm's default word_similarity_threshold, which
+// the <% operator uses.
+const similarityThreshold = 0.6
+
+func (m memoryProducts) GetAll(ctx context.Context, filter ProductFilter, filters *proto.Filters) ([]*proto.Product, *proto.Metadata, error) {
+	if err := checkFilterCurrency(filter, filter.hasPriceBounds()); err != nil {
+		return nil, &proto.Metadata{}, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	matches := m.matching(filter, facetNone)
+
+	column := sortColumn(filters)
+	descending := sortDirection(filters) == "DESC"
+	ranks := make(map[int64]float64, len(matches))
+	if column == "relevance" {
+		for _, product := range matches {
+			ranks[product.Id] = rank(filter, product)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		var cmp int
+		switch column {
+		case "relevance":
+			cmp = compare(ranks[b.Id], ranks[a.Id])
+		case "name":
+			cmp = strings.Compare(a.Name, b.Name)
+		case "category":
+			cmp = strings.Compare(m.s.categories[a.CategoryId].GetName(), m.s.categories[b.CategoryId].GetName())
+		case "price":
+			cmp = compare(a.PriceMinor, b.PriceMinor)
+		case "is_available":
+			cmp = compareBool(a.IsAvailable, b.IsAvailable)
+		case "rating":
+			cmp = compare(a.AverageRating, b.AverageRating)
+		case "creation_date":
+			cmp = compare(a.CreationDate.AsTime().UnixNano(), b.CreationDate.AsTime().UnixNano())
+		}
+		if descending && column != "relevance" {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+		return a.Id < b.Id
+	})
+
+	total := int32(len(matches))
+	var products []*proto.Product
+	for _, product := range paginate(matches, filters) {
+		out := m.s.output(product)
+		out.Snippet = snippet(filter, product.Description)
+		products = append(products, out)
+	}
+	return products, calculateMetadata(total, filters), nil
+}
+
+func (m memoryProducts) HasMatches(ctx context.Context, filter ProductFilter) (bool, error) {
+	if err := checkFilterCurrency(filter, filter.hasPriceBounds()); err != nil {
+		return false, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	return len(m.matching(filter, facetNone)) > 0, nil
+}
+
+func (m memoryProducts) Facets(ctx context.Context, filter ProductFilter) (*proto.Facets, error) {
+	if err := checkFilterCurrency(filter, true); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	facets := &proto.Facets{Currency: filter.Currency}
+
+	counts := make(map[int64]int32)
+	for _, product := range m.matching(filter, facetCategory) {
+		counts[product.CategoryId]++
+	}
+	for id, count := range counts {
+		facets.Categories = append(facets.Categories, &proto.CategoryFacet{
+			CategoryId: id,
+			Name:       m.s.categories[id].GetName(),
+			Count:      count,
+		})
+	}
+	sort.Slice(facets.Categories, func(i, j int) bool {
+		a, b := facets.Categories[i], facets.Categories[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.CategoryId < b.CategoryId
+	})
+
+	for _, product := range m.matching(filter, facetAvailable) {
+		if product.IsAvailable {
+			facets.Available++
+		} else {
+			facets.Unavailable++
+		}
+	}
+
+	var prices []int64
+	for _, product := range m.matching(filter, facetPrice) {
+		if price, ok := filterPrice(filter, product); ok {
+			prices = append(prices, price)
+		}
+	}
+	if len(prices) == 0 {
+		return facets, nil
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+	lowest, highest := prices[0], prices[len(prices)-1]
+
+	step := priceStep(lowest, highest, MaxPriceBuckets)
+	start := lowest - lowest%step
+	for i := int64(0); start+i*step <= highest; i++ {
+		facets.PriceBuckets = append(facets.PriceBuckets, &proto.PriceBucket{
+			MinMinor: start + i*step,
+			MaxMinor: start + (i+1)*step,
+		})
+	}
+	for _, price := range prices {
+		facets.PriceBuckets[(price-start)/step].Count++
+	}
+	return facets, nil
+}
+
+// checkFilterCurrency fails like priceFactors does when prices are compared
+// in an unknown currency.
+func checkFilterCurrency(filter ProductFilter, withPrice bool) error {
+	if _, ok := currency.Exponent(filter.Currency); withPrice && !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCurrency, filter.Currency)
+	}
+	return nil
+}
+
+// matching returns the stored products that filter selects, leaving out the
+// condition of the facet skip.
+func (m memoryProducts) matching(filter ProductFilter, skip string) []*proto.Product {
+	var subtree map[int64]bool
+	if len(filter.CategoryIDs) > 0 && skip != facetCategory {
+		subtree = m.s.subtree(filter.CategoryIDs)
+	}
+
+	var matches []*proto.Product
+	for _, product := range m.s.products {
+		if !filter.IncludeDeleted && product.DeletedAt != nil {
+			continue
+		}
+		if filter.Name != "" && !hasWords(words(product.Name), words(filter.Name), false) {
+			continue
+		}
+		if filter.Search != "" && filter.Fuzzy && wordSimilarity(filter.Search, product.Name) < similarityThreshold {
+			continue
+		}
+		if filter.Search != "" && !filter.Fuzzy && !hasWords(append(words(product.Name), words(product.Description)...), words(filter.Search), true) {
+			continue
+		}
+		if filter.Category != "" && skip != facetCategory && !hasWords(words(m.s.categories[product.CategoryId].GetName()), words(filter.Category), false) {
+			continue
+		}
+		if subtree != nil && !subtree[product.CategoryId] {
+			continue
+		}
+		if filter.hasPriceBounds() && skip != facetPrice {
+			price, ok := filterPrice(filter, product)
+			if !ok || (filter.PriceMin != nil && price < *filter.PriceMin) || (filter.PriceMax != nil && price > *filter.PriceMax) {
+				continue
+			}
+		}
+		if filter.IsAvailable != nil && skip != facetAvailable && product.IsAvailable != *filter.IsAvailable {
+			continue
+		}
+		created := product.CreationDate.AsTime()
+		if filter.CreatedAfter != nil && created.Before(*filter.CreatedAfter) {
+			continue
+		}
+		if filter.CreatedBefore != nil && !created.Before(*filter.CreatedBefore) {
+			continue
+		}
+		matches = append(matches, product)
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Id < matches[j].Id })
+	return matches
+}
+
+// filterPrice is a product's price in the filter currency. Without exchange
+// rates only prices already in that currency are known.
+func filterPrice(filter ProductFilter, product *proto.Product) (int64, bool) {
+	return product.PriceMinor, product.Currency == filter.Currency
+}
+
+// subtree returns the given categories and all categories below them.
+func (s *memoryStore) subtree(roots []int64) map[int64]bool {
+	ids := make(map[int64]bool)
+	for _, id := range roots {
+		if _, ok := s.categories[id]; ok {
+			ids[id] = true
+		}
+	}
+	for grew := true; grew; {
+		grew = false
+		for _, category := range s.categories {
+			if ids[category.ParentId] && !ids[category.Id] {
+				ids[category.Id] = true
+				grew = true
+			}
+		}
+	}
+	return ids
+}
+
+// words splits text the way SearchQuery does, lower-cased like the 'simple'
+// configuration.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// hasWords reports whether text contains every query word. With prefix, the
+// last query word only has to start a word of text, as in SearchQuery.
+func hasWords(text, query []string, prefix bool) bool {
+	for i, q := range query {
+		found := false
+		for _, word := range text {
+			if matchesWord(word, q, prefix && i == len(query)-1) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(query) > 0
+}
+
+// matchesQuery reports whether word matches any of the query words, the
+// last one as a prefix.
+func matchesQuery(word string, query []string) bool {
+	for i, q := range query {
+		if matchesWord(word, q, i == len(query)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesWord(word, query string, prefix bool) bool {
+	if prefix {
+		return strings.HasPrefix(word, query)
+	}
+	return word == query
+}
+
+// rank scores a product against the filter's search. Words found in the name
+// count more than words found in the description, as the weights of the
+// search column do.
+func rank(filter ProductFilter, product *proto.Product) float64 {
+	if filter.Search == "" {
+		return 0
+	}
+	if filter.Fuzzy {
+		return wordSimilarity(filter.Search, product.Name)
+	}
+
+	query := words(filter.Search)
+	score := 0.0
+	for _, word := range words(product.Name) {
+		if matchesQuery(word, query) {
+			score += 1
+		}
+	}
+	for _, word := range words(product.Description) {
+		if matchesQuery(word, query) {
+			score += 0.4
+		}
+	}
+	return score
+}
+
+// snippet marks the searched words in the HTML-escaped description, as
+// ts_headline does for the queries.
+func snippet(filter ProductFilter, description string) string {
+	if filter.Search == "" || filter.Fuzzy {
+		return ""
+	}
+	query := words(filter.Search)
+
+	var b strings.Builder
+	rest := description
+	for rest != "" {
+		start := strings.IndexFunc(rest, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) })
+		if start == -1 {
+			b.WriteString(html.EscapeString(rest))
+			break
+		}
+		end := strings.IndexFunc(rest[start:], func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+		if end == -1 {
+			end = len(rest)
+		} else {
+			end += start
+		}
+
+		word := rest[start:end]
+		b.WriteString(html.EscapeString(rest[:start]))
+		if matchesQuery(strings.ToLower(word), query) {
+			b.WriteString("<mark>" + word + "</mark>")
+		} else {
+			b.WriteString(word)
+		}
+		rest = rest[end:]
+	}
+	return b.String()
+}
+
+// wordSimilarity is the greatest similarity between the trigrams of term and
+// those of any run of consecutive trigrams in text, as pg_trgm computes it.
+func wordSimilarity(term, text string) float64 {
+	query := make(map[string]bool)
+	for _, trigram := range trigrams(words(term)) {
+		query[trigram] = true
+	}
+	if len(query) == 0 {
+		return 0
+	}
+
+	sequence := trigrams(words(text))
+	best := 0.0
+	for i := range sequence {
+		extent := make(map[string]bool)
+		common := 0
+		for _, trigram := range sequence[i:] {
+			if !extent[trigram] {
+				extent[trigram] = true
+				if query[trigram] {
+					common++
+				}
+			}
+			similarity := float64(common) / float64(len(query)+len(extent)-common)
+			if similarity > best {
+				best = similarity
+			}
+		}
+	}
+	return best
+}
+
+// trigrams returns the trigrams of words in order, as pg_trgm makes them:
+// each word padded with two spaces in front and one behind.
+func trigrams(words []string) []string {
+	var list []string
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			list = append(list, string(padded[i:i+3]))
+		}
+	}
+	return list
+}
+
+func compare[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,214 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+)
+
+// newTestMemoryModels returns memory models with a Fruit category, a Berries
+// category below it and a Vegetables category, and the store behind them.
+func newTestMemoryModels(t *testing.T) (Models, *memoryStore) {
+	t.Helper()
+
+	models := NewMemoryModels()
+	for _, category := range []*proto.Category{
+		{Name: "Fruit", Slug: "fruit"},
+		{Name: "Berries", Slug: "berries", ParentId: 1},
+		{Name: "Vegetables", Slug: "vegetables"},
+	} {
+		if _, err := models.Categories.Insert(category); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return models, models.Products.(memoryProducts).s
+}
+
+func TestMemoryGetAll(t *testing.T) {
+	models, _ := newTestMemoryModels(t)
+	for _, product := range []*proto.Product{
+		{Name: "Apple", PriceMinor: 300, CategoryId: 1, Quantity: 1, Description: "Red apples"},
+		{Name: "Strawberry", PriceMinor: 500, CategoryId: 2, Description: "Sweet red berries"},
+		{Name: "Carrot", PriceMinor: 100, CategoryId: 3, Quantity: 3},
+		{Name: "Blueberry", PriceMinor: 900, CategoryId: 2, Quantity: 2, Description: "Wild berries"},
+		{Name: "Mango", PriceMinor: 700, Currency: "USD", CategoryId: 1, Quantity: 1},
+	} {
+		if product.Currency == "" {
+			product.Currency = "KZT"
+		}
+		if _, err := models.Products.Insert(context.Background(), product, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := models.Products.Delete(context.Background(), 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	min := int64(200)
+	available := true
+	tests := []struct {
+		name     string
+		filter   ProductFilter
+		filters  *proto.Filters
+		expected []int64
+		total    int32
+	}{
+		{"sorted by price", ProductFilter{}, &proto.Filters{Page: 1, PageSize: 10, Sort: "-price"}, []int64{4, 5, 2, 3}, 4},
+		{"second page", ProductFilter{}, &proto.Filters{Page: 2, PageSize: 3, Sort: "id"}, []int64{5}, 4},
+		{"deleted included", ProductFilter{IncludeDeleted: true}, &proto.Filters{Page: 1, PageSize: 10, Sort: "id"}, []int64{1, 2, 3, 4, 5}, 5},
+		{"category subtree", ProductFilter{CategoryIDs: []int64{1}}, &proto.Filters{Page: 1, PageSize: 10, Sort: "name"}, []int64{4, 5, 2}, 3},
+		{"price in currency", ProductFilter{PriceMin: &min, Currency: "KZT"}, &proto.Filters{Page: 1, PageSize: 10, Sort: "price"}, []int64{2, 4}, 2},
+		{"available", ProductFilter{IsAvailable: &available}, &proto.Filters{Page: 1, PageSize: 10, Sort: "id"}, []int64{3, 4, 5}, 3},
+		{"search by prefix", ProductFilter{Search: "berr"}, &proto.Filters{Page: 1, PageSize: 10, Sort: "relevance"}, []int64{2, 4}, 2},
+		{"search ranks names first", ProductFilter{Search: "blueberry"}, &proto.Filters{Page: 1, PageSize: 10, Sort: "relevance"}, []int64{4}, 1},
+		{"fuzzy", ProductFilter{Search: "strawbery", Fuzzy: true}, &proto.Filters{Page: 1, PageSize: 10, Sort: "relevance"}, []int64{2}, 1},
+		{"nothing", ProductFilter{Name: "kiwi"}, &proto.Filters{Page: 1, PageSize: 10, Sort: "id"}, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filters.SortSafeList = ProductSortSafeList
+			list, metadata, err := models.Products.GetAll(context.Background(), tt.filter, tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, product := range list {
+				ids = append(ids, product.Id)
+			}
+			if len(ids) != len(tt.expected) {
+				t.Fatalf("got products %v, expected %v", ids, tt.expected)
+			}
+			for i := range ids {
+				if ids[i] != tt.expected[i] {
+					t.Fatalf("got products %v, expected %v", ids, tt.expected)
+				}
+			}
+			if metadata.TotalRecords != tt.total {
+				t.Errorf("total is %d, expected %d", metadata.TotalRecords, tt.total)
+			}
+		})
+	}
+}
+
+func TestMemoryFacets(t *testing.T) {
+	models, _ := newTestMemoryModels(t)
+	for _, product := range []*proto.Product{
+		{Name: "Apple", PriceMinor: 120, Currency: "KZT", CategoryId: 1, Quantity: 1},
+		{Name: "Strawberry", PriceMinor: 480, Currency: "KZT", CategoryId: 2},
+		{Name: "Carrot", PriceMinor: 150, Currency: "KZT", CategoryId: 3, Quantity: 3},
+	} {
+		if _, err := models.Products.Insert(context.Background(), product, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	available := true
+	facets, err := models.Products.Facets(context.Background(), ProductFilter{CategoryIDs: []int64{1}, IsAvailable: &available, Currency: "KZT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The category facet ignores the category filter, the availability
+	// facet the availability filter.
+	if len(facets.Categories) != 2 || facets.Categories[0].Name != "Fruit" || facets.Categories[1].Name != "Vegetables" {
+		t.Errorf("category facets are %v, expected Fruit and Vegetables", facets.Categories)
+	}
+	if facets.Available != 1 || facets.Unavailable != 1 {
+		t.Errorf("availability facets are %d/%d, expected 1/1", facets.Available, facets.Unavailable)
+	}
+	if len(facets.PriceBuckets) != 1 || facets.PriceBuckets[0].Count != 1 {
+		t.Errorf("price buckets are %v, expected the one available fruit", facets.PriceBuckets)
+	}
+
+	if _, err = models.Products.Facets(context.Background(), ProductFilter{Currency: "XXX"}); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("unknown currency returned %v, expected ErrUnknownCurrency", err)
+	}
+}
+
+func TestMemoryReservations(t *testing.T) {
+	models, store := newTestMemoryModels(t)
+	product, err := models.Products.Insert(context.Background(), &proto.Product{Name: "Apple", Currency: "KZT", CategoryId: 1, Quantity: 3}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = models.Products.Reserve(context.Background(), product.Id, 0, 4, time.Minute, ""); !errors.Is(err, ErrInsufficientStock) {
+		t.Errorf("reserving more than the stock returned %v, expected ErrInsufficientStock", err)
+	}
+	reservation, err := models.Products.Reserve(context.Background(), product.Id, 0, 3, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := models.Products.Get(context.Background(), product.Id); stored.Quantity != 0 || stored.IsAvailable {
+		t.Errorf("product after reserving all stock is %v", stored)
+	}
+
+	now := time.Now()
+	store.now = func() time.Time { return now.Add(2 * time.Minute) }
+	if _, err = models.Products.Commit(context.Background(), reservation.Id); !errors.Is(err, ErrReservationClosed) {
+		t.Errorf("committing an expired reservation returned %v, expected ErrReservationClosed", err)
+	}
+	expired, restocked, err := models.Products.ExpireReservations(context.Background(), 100)
+	if err != nil || expired != 1 {
+		t.Fatalf("expired %d reservations (%v), expected 1", expired, err)
+	}
+	if len(restocked) != 1 || restocked[0] != product.Id {
+		t.Errorf("restocked products %v, expected [%d]", restocked, product.Id)
+	}
+	if stored, _ := models.Products.Get(context.Background(), product.Id); stored.Quantity != 3 || !stored.IsAvailable {
+		t.Errorf("product after the reservation expired is %v", stored)
+	}
+
+	movements, metadata, err := models.Movements.GetForProduct(context.Background(), product.Id, &proto.Filters{Page: 1, PageSize: 10, Sort: "-id", SortSafeList: MovementSortSafeList})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.TotalRecords != 3 || movements[0].Reason != MovementReasonExpire {
+		t.Errorf("movements are %v, expected the expiry after the reservation and the initial stock", movements)
+	}
+}
+
+func TestMemoryVariants(t *testing.T) {
+	models, _ := newTestMemoryModels(t)
+	product, err := models.Products.Insert(context.Background(), &proto.Product{
+		Name:       "T-shirt",
+		Currency:   "KZT",
+		CategoryId: 1,
+		Options:    []*proto.ProductOption{{Name: "size", Values: []string{"S", "M"}}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	variant, err := models.Variants.Insert(&proto.ProductVariant{ProductId: product.Id, Sku: "TS-S", Options: map[string]string{"size": "S"}, Quantity: 2}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := models.Products.Get(context.Background(), product.Id); !stored.IsAvailable {
+		t.Error("product with a stocked variant is not available")
+	}
+
+	_, err = models.Variants.Insert(&proto.ProductVariant{ProductId: product.Id, Sku: "TS-S", Options: map[string]string{"size": "M"}}, "")
+	if !errors.Is(err, ErrDuplicateSKU) {
+		t.Errorf("duplicate sku returned %v, expected ErrDuplicateSKU", err)
+	}
+	_, err = models.Variants.Insert(&proto.ProductVariant{ProductId: product.Id, Sku: "TS-S2", Options: map[string]string{"size": "S"}}, "")
+	if !errors.Is(err, ErrDuplicateVariant) {
+		t.Errorf("duplicate options returned %v, expected ErrDuplicateVariant", err)
+	}
+
+	product.Options = []*proto.ProductOption{{Name: "colour", Values: []string{"red"}}}
+	if err = models.Products.Update(context.Background(), product, ""); !errors.Is(err, ErrOptionsInUse) {
+		t.Errorf("removing an option in use returned %v, expected ErrOptionsInUse", err)
+	}
+
+	if _, err = models.Products.AdjustStock(context.Background(), product.Id, variant.Id, -2, "sold", ""); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := models.Products.Get(context.Background(), product.Id); stored.IsAvailable {
+		t.Error("product without stock is still available")
+	}
+}
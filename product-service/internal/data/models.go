@@ -4,12 +4,40 @@ import (
 	"database/sql"
 )
 
+// Models are the stores the server works with. The audit history, currency
+// rates and the outbox are only kept in PostgreSQL.
 type Models struct {
-	Products ProductModel
+	Products   ProductRepository
+	Audit      AuditModel
+	Currencies CurrencyModel
+	Movements  MovementRepository
+	Categories CategoryRepository
+	Images     ImageRepository
+	Variants   VariantRepository
+	Reviews    ReviewRepository
+	Pricing    PricingRuleRepository
+	Outbox     OutboxModel
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels returns the models kept in db. Product reads go to replicas when
+// it is not nil, and product queries run under timeouts and are reported to
+// slowQueries when they are slow.
+func NewModels(db *sql.DB, replicas *Replicas, timeouts Timeouts, slowQueries *SlowQueryLog) Models {
 	return Models{
-		Products: ProductModel{DB: db},
+		Products: ProductModel{
+			DB:          db,
+			Replicas:    replicas,
+			Timeouts:    timeouts,
+			SlowQueries: slowQueries,
+		},
+		Audit:      AuditModel{DB: db},
+		Currencies: CurrencyModel{DB: db},
+		Movements:  MovementModel{DB: db},
+		Categories: CategoryModel{DB: db},
+		Images:     ImageModel{DB: db},
+		Variants:   VariantModel{DB: db},
+		Reviews:    ReviewModel{DB: db},
+		Pricing:    PricingRuleModel{DB: db},
+		Outbox:     OutboxModel{DB: db},
 	}
 }
@@ -0,0 +1,203 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/currency"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"math"
+	"math/big"
+	"time"
+)
+
+// DefaultCurrency is used for products created without a currency, matching
+// the column default.
+const DefaultCurrency = currency.Default
+
+var (
+	ErrUnknownCurrency = errors.New("unknown currency")
+	ErrNoRate          = errors.New("no conversion rate")
+)
+
+// NormalizePrice fills in the default currency and, for clients that still
+// send only the deprecated float price, derives price_minor from it. A
+// product carrying both must state the same amount in each; a price that
+// disagrees with price_minor is reported to v rather than dropped.
+func NormalizePrice(v *validator.Validator, product *proto.Product) {
+	if product.Currency == "" {
+		product.Currency = DefaultCurrency
+	}
+	exponent, ok := currency.Exponent(product.Currency)
+	if !ok {
+		return
+	}
+
+	legacy := int64(math.Round(float64(product.Price) * math.Pow10(exponent)))
+	switch {
+	case product.PriceMinor == 0:
+		product.PriceMinor = legacy
+	case product.Price != 0 && legacy != product.PriceMinor && product.Price != legacyPrice(product.PriceMinor, exponent):
+		v.AddError("price", "must match price_minor")
+	}
+	SetLegacyPrice(product)
+}
+
+func ValidatePrice(v *validator.Validator, product *proto.Product) {
+	_, known := currency.Exponent(product.Currency)
+	v.Check(known, "currency", "must be a supported ISO 4217 code")
+	v.Check(product.PriceMinor >= 0, "price", "must not be negative")
+}
+
+// SetLegacyPrice keeps the deprecated float price populated for clients that
+// have not moved to price_minor yet.
+func SetLegacyPrice(product *proto.Product) {
+	exponent, ok := currency.Exponent(product.Currency)
+	if !ok {
+		return
+	}
+	product.Price = legacyPrice(product.PriceMinor, exponent)
+}
+
+// legacyPrice is the float price SetLegacyPrice derives from minor. Large
+// amounts lose precision in a float32, so a client sending back the price it
+// was given may not round to the same price_minor.
+func legacyPrice(minor int64, exponent int) float32 {
+	return float32(float64(minor) / math.Pow10(exponent))
+}
+
+// ConvertMinor converts an amount in from's minor units to to's minor units
+// using rate (units of to per unit of from), rounding half away from zero.
+func ConvertMinor(amount int64, from, to string, rate *big.Rat) (int64, error) {
+	fromExponent, ok := currency.Exponent(from)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownCurrency, from)
+	}
+	toExponent, ok := currency.Exponent(to)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownCurrency, to)
+	}
+
+	value := new(big.Rat).SetInt64(amount)
+	value.Mul(value, rate)
+	value.Mul(value, new(big.Rat).SetFrac(pow10(toExponent), pow10(fromExponent)))
+
+	return roundRat(value), nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func roundRat(r *big.Rat) int64 {
+	num := new(big.Int).Abs(r.Num())
+	quotient, remainder := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	if remainder.Mul(remainder, big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	if r.Sign() < 0 {
+		quotient.Neg(quotient)
+	}
+	return quotient.Int64()
+}
+
+type CurrencyModel struct {
+	DB *sql.DB
+}
+
+// RatesTo returns the rate from every currency that can be converted into
+// quote, using the inverse of a stored quote->base rate when no base->quote
+// rate exists. The query runs under ctx, so callers that are already inside
+// an operation share its deadline.
+func (c CurrencyModel) RatesTo(ctx context.Context, quote string) (map[string]*big.Rat, error) {
+	query := `SELECT base, quote, rate::text
+			  FROM currency_rates
+			  WHERE base = $1 OR quote = $1`
+
+	rows, err := c.DB.QueryContext(ctx, query, quote)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := map[string]*big.Rat{quote: big.NewRat(1, 1)}
+	inverse := map[string]*big.Rat{}
+
+	for rows.Next() {
+		var base, to, text string
+		if err := rows.Scan(&base, &to, &text); err != nil {
+			return nil, err
+		}
+		rate, ok := new(big.Rat).SetString(text)
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid rate %s for %s/%s", text, base, to)
+		}
+		if to == quote {
+			rates[base] = rate
+		} else {
+			inverse[to] = new(big.Rat).Inv(rate)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for currency, rate := range inverse {
+		if _, ok := rates[currency]; !ok {
+			rates[currency] = rate
+		}
+	}
+	return rates, nil
+}
+
+// Convert rewrites the prices of products into the target currency.
+func (c CurrencyModel) Convert(ctx context.Context, products []*proto.Product, target string) error {
+	if _, ok := currency.Exponent(target); !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCurrency, target)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rates, err := c.RatesTo(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	for _, product := range products {
+		rate, ok := rates[product.Currency]
+		if !ok {
+			return fmt.Errorf("%w from %s to %s", ErrNoRate, product.Currency, target)
+		}
+		from := product.Currency
+		amount, err := ConvertMinor(product.PriceMinor, from, target, rate)
+		if err != nil {
+			return err
+		}
+		effective, err := ConvertMinor(product.EffectivePriceMinor, from, target, rate)
+		if err != nil {
+			return err
+		}
+		product.PriceMinor = amount
+		product.EffectivePriceMinor = effective
+		product.Currency = target
+		SetLegacyPrice(product)
+
+		// Variant prices are in the product's currency, so they move with it.
+		for _, variant := range product.Variants {
+			for _, price := range []*int64{variant.PriceMinor, variant.EffectivePriceMinor} {
+				if price == nil {
+					continue
+				}
+				converted, err := ConvertMinor(*price, from, target, rate)
+				if err != nil {
+					return err
+				}
+				*price = converted
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package data
+
+import (
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"math/big"
+	"testing"
+)
+
+func TestConvertMinor(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   int64
+		from     string
+		to       string
+		rate     *big.Rat
+		expected int64
+	}{
+		{name: "Same currency", amount: 85000, from: "KZT", to: "KZT", rate: big.NewRat(1, 1), expected: 85000},
+		{name: "KZT to USD", amount: 85000, from: "KZT", to: "USD", rate: big.NewRat(1, 500), expected: 170},
+		{name: "Rounds half up", amount: 250, from: "KZT", to: "USD", rate: big.NewRat(1, 500), expected: 1},
+		{name: "Rounds down", amount: 249, from: "KZT", to: "USD", rate: big.NewRat(1, 500), expected: 0},
+		{name: "To zero-digit currency", amount: 1999, from: "USD", to: "JPY", rate: big.NewRat(150, 1), expected: 2999},
+		{name: "To three-digit currency", amount: 1000, from: "USD", to: "KWD", rate: big.NewRat(307, 1000), expected: 3070},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ConvertMinor(tt.amount, tt.from, tt.to, tt.rate)
+			if err != nil {
+				t.Fatalf("ConvertMinor() returned error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("ConvertMinor() = %d, expected %d", result, tt.expected)
+			}
+		})
+	}
+
+	if _, err := ConvertMinor(100, "XXX", "USD", big.NewRat(1, 1)); err == nil {
+		t.Error("ConvertMinor() should reject unknown currencies")
+	}
+}
+
+func TestNormalizePrice(t *testing.T) {
+	tests := []struct {
+		name     string
+		product  *proto.Product
+		expected int64
+		valid    bool
+	}{
+		{"Legacy price only", &proto.Product{Price: 12.34}, 1234, true},
+		{"Minor units only", &proto.Product{PriceMinor: 500, Currency: "JPY"}, 500, true},
+		{"Both agree", &proto.Product{PriceMinor: 1234, Price: 12.34}, 1234, true},
+		{"Legacy price as returned", &proto.Product{PriceMinor: 123456789, Price: float32(1234567.89)}, 123456789, true},
+		{"Both disagree", &proto.Product{PriceMinor: 500, Currency: "JPY", Price: 1}, 500, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			NormalizePrice(v, tt.product)
+			if v.Valid() != tt.valid {
+				t.Fatalf("NormalizePrice() errors = %v, expected valid %v", v.Errors, tt.valid)
+			}
+			if tt.product.PriceMinor != tt.expected {
+				t.Errorf("NormalizePrice() = %d, expected %d", tt.product.PriceMinor, tt.expected)
+			}
+			if tt.product.Currency == "" {
+				t.Errorf("NormalizePrice() left the currency empty, expected %s", DefaultCurrency)
+			}
+		})
+	}
+}
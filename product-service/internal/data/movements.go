@@ -0,0 +1,136 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Reasons recorded for stock movements the service makes on its own.
+// AdjustStock records whatever reason the caller gives.
+const (
+	MovementReasonInitial = "initial stock"
+	MovementReasonReserve = "reservation"
+	MovementReasonRelease = "reservation released"
+	MovementReasonExpire  = "reservation expired"
+)
+
+var MovementSortSafeList = []string{"id", "-id"}
+
+type MovementModel struct {
+	DB *sql.DB
+}
+
+// AdjustStock adds delta to a product's stock, or to the stock of one of its
+// variants when variantID is not zero, and records the movement.
+func (p ProductModel) AdjustStock(ctx context.Context, productID, variantID int64, delta int32, reason, actor string) (*proto.StockMovement, error) {
+	ctx, op := p.begin(ctx, "ProductModel.AdjustStock", p.Timeouts.Write)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return nil, err
+	}
+
+	var movement *proto.StockMovement
+	if variantID != 0 {
+		movement, err = adjustVariantQuantity(ctx, tx, productID, variantID, delta, AuditActionAdjust, reason, actor)
+	} else {
+		movement, err = adjustQuantity(ctx, tx, productID, delta, AuditActionAdjust, reason, actor)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	message := productLog(productID, "Stock of product with id %d adjusted by %d to %d", productID, delta, movement.Balance)
+	if err = insertOutbox(ctx, tx, message); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	op.rows = 1
+	return movement, nil
+}
+
+// insertMovement appends to the stock ledger using q, which should be the
+// transaction that changed the quantity.
+func insertMovement(ctx context.Context, q querier, movement *proto.StockMovement) error {
+	query := `INSERT INTO stock_movements (product_id, delta, reason, actor, balance, variant_id)
+			  VALUES ($1, $2, $3, $4, $5, $6)
+			  RETURNING id, created_at`
+
+	args := []any{
+		movement.ProductId,
+		movement.Delta,
+		movement.Reason,
+		movement.Actor,
+		movement.Balance,
+		nullableID(movement.VariantId),
+	}
+
+	var createdAt time.Time
+	err := q.QueryRowContext(ctx, query, args...).Scan(&movement.Id, &createdAt)
+	if err != nil {
+		return err
+	}
+	movement.CreatedAt = timestamppb.New(createdAt)
+	return nil
+}
+
+func (m MovementModel) GetForProduct(ctx context.Context, productID int64, filters *proto.Filters) ([]*proto.StockMovement, *proto.Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, product_id, coalesce(variant_id, 0), delta, reason, actor, balance, created_at
+		FROM stock_movements
+		WHERE product_id = $1
+		ORDER BY %s %s
+		LIMIT $2 OFFSET $3`, sortColumn(filters), sortDirection(filters))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, productID, limit(filters), offset(filters))
+	if err != nil {
+		return nil, &proto.Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int32 = 0
+	var movements []*proto.StockMovement
+
+	for rows.Next() {
+		var movement proto.StockMovement
+		var createdAt time.Time
+		err := rows.Scan(
+			&totalRecords,
+			&movement.Id,
+			&movement.ProductId,
+			&movement.VariantId,
+			&movement.Delta,
+			&movement.Reason,
+			&movement.Actor,
+			&movement.Balance,
+			&createdAt,
+		)
+		if err != nil {
+			return nil, &proto.Metadata{}, err
+		}
+		movement.CreatedAt = timestamppb.New(createdAt)
+		movements = append(movements, &movement)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, &proto.Metadata{}, err
+	}
+	return movements, calculateMetadata(totalRecords, filters), nil
+}
@@ -0,0 +1,93 @@
+package data
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Timeouts bound ProductModel calls by kind, on top of whatever deadline the
+// caller's context has. A zero timeout leaves calls of that kind bounded by
+// the context alone.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	// Sweep bounds the batch jobs: expiring reservations and purging deleted
+	// products and expired idempotency keys.
+	Sweep time.Duration
+}
+
+// slowQueryBacklog is how many slow queries may wait to be published. When
+// the broker falls behind, further ones are only logged locally and counted
+// in slow_queries_dropped_total.
+const slowQueryBacklog = 64
+
+var slowQueriesDropped = expvar.NewInt("slow_queries_dropped_total")
+
+// SlowQueryLog publishes the ProductModel calls that take Threshold or
+// longer, with how long they took and how many rows they returned or
+// changed. A nil log, or a zero Threshold, publishes nothing.
+type SlowQueryLog struct {
+	Threshold time.Duration
+	Logger    interface{ SendLog(message string) error }
+
+	once  sync.Once
+	queue chan string
+}
+
+// observe hands slow queries to a single background publisher, so a slow
+// query is not made slower by waiting on the broker and a burst of them
+// cannot start a goroutine each.
+func (l *SlowQueryLog) observe(name string, duration time.Duration, rows int) {
+	if l == nil || l.Threshold <= 0 || duration < l.Threshold {
+		return
+	}
+
+	message := fmt.Sprintf("slow query=%s duration=%s rows=%d", name, duration, rows)
+	log.Print(message)
+
+	l.once.Do(func() {
+		l.queue = make(chan string, slowQueryBacklog)
+		go l.publish()
+	})
+	select {
+	case l.queue <- message:
+	default:
+		slowQueriesDropped.Add(1)
+	}
+}
+
+func (l *SlowQueryLog) publish() {
+	for message := range l.queue {
+		if err := l.Logger.SendLog(message); err != nil {
+			log.Printf("failed to publish slow query: %v", err)
+		}
+	}
+}
+
+// operation is one timed ProductModel call. The call sets rows before it
+// returns successfully.
+type operation struct {
+	name   string
+	start  time.Time
+	rows   int
+	log    *SlowQueryLog
+	cancel context.CancelFunc
+}
+
+// begin starts a call named name under timeout. The call must defer end.
+func (p ProductModel) begin(ctx context.Context, name string, timeout time.Duration) (context.Context, *operation) {
+	op := &operation{name: name, start: time.Now(), log: p.SlowQueries, cancel: func() {}}
+	if timeout > 0 {
+		ctx, op.cancel = context.WithTimeout(ctx, timeout)
+	}
+	return ctx, op
+}
+
+func (op *operation) end() {
+	op.cancel()
+	op.log.observe(op.name, time.Since(op.start), op.rows)
+}
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/logger"
+)
+
+func TestOperationTimeout(t *testing.T) {
+	p := ProductModel{Timeouts: Timeouts{Read: time.Millisecond}}
+
+	ctx, op := p.begin(context.Background(), "ProductModel.Get", p.Timeouts.Read)
+	defer op.end()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Error("a call with a timeout has no deadline")
+	}
+
+	ctx, op = p.begin(context.Background(), "ProductModel.Update", p.Timeouts.Write)
+	defer op.end()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("a call without a timeout has a deadline")
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	recorder := &logger.Recorder{}
+	p := ProductModel{SlowQueries: &SlowQueryLog{Threshold: 10 * time.Millisecond, Logger: recorder}}
+
+	_, op := p.begin(context.Background(), "ProductModel.Get", 0)
+	op.rows = 1
+	op.end()
+
+	_, op = p.begin(context.Background(), "ProductModel.GetAll", 0)
+	op.rows = 20
+	time.Sleep(10 * time.Millisecond)
+	op.end()
+
+	// Slow queries are published in the background.
+	deadline := time.Now().Add(time.Second)
+	for len(recorder.Logs()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	logs := recorder.Logs()
+	if len(logs) != 1 {
+		t.Fatalf("published %q, expected one slow query", logs)
+	}
+	if !strings.HasPrefix(logs[0], "slow query=ProductModel.GetAll duration=") || !strings.HasSuffix(logs[0], " rows=20") {
+		t.Errorf("published %q", logs[0])
+	}
+}
+
+// blockingLogger holds each message until it is released.
+type blockingLogger struct {
+	received chan string
+	release  chan struct{}
+}
+
+func (b blockingLogger) SendLog(message string) error {
+	b.received <- message
+	<-b.release
+	return nil
+}
+
+func TestSlowQueryLogDropsOverflow(t *testing.T) {
+	logger := blockingLogger{received: make(chan string, slowQueryBacklog+2), release: make(chan struct{})}
+	defer close(logger.release)
+	l := &SlowQueryLog{Threshold: time.Millisecond, Logger: logger}
+
+	// The first query occupies the publisher, the next slowQueryBacklog wait
+	// for it, and the one after that has no room.
+	l.observe("ProductModel.Get", time.Second, 1)
+	<-logger.received
+
+	dropped := slowQueriesDropped.Value()
+	for i := 0; i <= slowQueryBacklog; i++ {
+		l.observe("ProductModel.Get", time.Second, 1)
+	}
+	if n := slowQueriesDropped.Value() - dropped; n != 1 {
+		t.Errorf("dropped %d slow queries, expected 1", n)
+	}
+}
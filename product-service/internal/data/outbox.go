@@ -0,0 +1,178 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// outboxLockKey is the advisory lock held while claiming messages, so that
+// relays on different replicas never claim the same product's messages out of
+// order.
+const outboxLockKey = 7_212_001
+
+// OutboxMessage is a broker message waiting to be published. AggregateID is
+// the product it is about; messages for the same product are published in
+// the order they were written.
+type OutboxMessage struct {
+	ID          int64
+	AggregateID int64
+	Exchange    string
+	RoutingKey  string
+	ContentType string
+	Payload     []byte
+	CreatedAt   time.Time
+	Attempts    int32
+}
+
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// productLog is a log line published for a change to a product or to
+// something of it, such as its stock or reviews. It is formatted like
+// fmt.Sprintf.
+func productLog(productID int64, format string, args ...any) *OutboxMessage {
+	return &OutboxMessage{
+		AggregateID: productID,
+		Exchange:    "logs",
+		RoutingKey:  "logger",
+		ContentType: "text/plain",
+		Payload:     []byte(fmt.Sprintf(format, args...)),
+	}
+}
+
+// insertOutbox queues message using q, which should be the transaction that
+// makes the change the message describes.
+func insertOutbox(ctx context.Context, q querier, message *OutboxMessage) error {
+	query := `INSERT INTO outbox (aggregate_id, exchange, routing_key, content_type, payload)
+			  VALUES ($1, $2, $3, $4, $5)`
+
+	_, err := q.ExecContext(ctx, query, message.AggregateID, message.Exchange, message.RoutingKey, message.ContentType, message.Payload)
+	return err
+}
+
+// Claim leases up to limit due messages to the caller for lease, oldest
+// first, and returns them in that order. A product's messages are claimed in
+// order: while one waits for a retry or is claimed by another relay, none
+// after it is. The caller settles each message with Published, Failed or
+// Release; a claim it does not settle runs out and the message is claimed
+// again, so delivery is at least once.
+func (m OutboxModel) Claim(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, outboxLockKey); err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE outbox
+			  SET claimed_until = NOW() + make_interval(secs => $2)
+			  WHERE id IN (
+			      SELECT id FROM outbox o
+			      WHERE NOT EXISTS (
+			          SELECT 1 FROM outbox b
+			          WHERE b.aggregate_id = o.aggregate_id AND b.id <= o.id
+			            AND (b.next_attempt_at > NOW() OR b.claimed_until > NOW())
+			      )
+			      ORDER BY id
+			      LIMIT $1
+			  )
+			  RETURNING id, aggregate_id, exchange, routing_key, content_type, payload, created_at, attempts`
+
+	rows, err := tx.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	var messages []*OutboxMessage
+	for rows.Next() {
+		var message OutboxMessage
+		err := rows.Scan(
+			&message.ID,
+			&message.AggregateID,
+			&message.Exchange,
+			&message.RoutingKey,
+			&message.ContentType,
+			&message.Payload,
+			&message.CreatedAt,
+			&message.Attempts,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, &message)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+// Published removes a claimed message once the broker has taken it.
+func (m OutboxModel) Published(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM outbox WHERE id = $1`, id)
+	return err
+}
+
+// Failed records a failed attempt to publish a claimed message and releases
+// it to be retried after retryIn. The product's later messages wait for it.
+func (m OutboxModel) Failed(id int64, retryIn time.Duration, cause error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE outbox
+			  SET attempts = attempts + 1, next_attempt_at = NOW() + make_interval(secs => $2), last_error = $3, claimed_until = NULL
+			  WHERE id = $1`
+	_, err := m.DB.ExecContext(ctx, query, id, retryIn.Seconds(), cause.Error())
+	return err
+}
+
+// Release gives up the claim on messages that were not tried, so that they
+// can be claimed again straight away.
+func (m OutboxModel) Release(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE outbox SET claimed_until = NULL WHERE id = ANY($1)`, pq.Array(ids))
+	return err
+}
+
+// Backlog returns how many messages are waiting and how long the oldest has
+// been waiting.
+func (m OutboxModel) Backlog() (int64, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var pending int64
+	var age float64
+	query := `SELECT count(*), coalesce(extract(epoch FROM NOW() - min(created_at)), 0) FROM outbox`
+	err := m.DB.QueryRowContext(ctx, query).Scan(&pending, &age)
+	if err != nil {
+		return 0, 0, err
+	}
+	return pending, time.Duration(age * float64(time.Second)), nil
+}
@@ -0,0 +1,432 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/currency"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"github.com/lib/pq"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var ErrUnknownPricingTarget = errors.New("pricing rule target does not exist")
+
+// Pricing rule scopes, from the most to the least specific.
+const (
+	PricingScopeProduct  = "product"
+	PricingScopeCategory = "category"
+	PricingScopeCatalog  = "catalog"
+)
+
+// Pricing rule kinds.
+const (
+	PricingKindPercent = "percent"
+	PricingKindFixed   = "fixed"
+)
+
+var PricingRuleSortSafeList = []string{"id", "priority", "starts_at", "-id", "-priority", "-starts_at"}
+
+type PricingRuleModel struct {
+	DB *sql.DB
+}
+
+// NormalizePricingRule clears the fields the rule's kind does not use, so that
+// a rule switched from one kind to the other keeps no stale amount.
+func NormalizePricingRule(rule *proto.PricingRule) {
+	switch rule.Kind {
+	case PricingKindPercent:
+		rule.AmountMinor = 0
+		rule.Currency = ""
+	case PricingKindFixed:
+		rule.PercentBps = 0
+	}
+}
+
+func ValidatePricingRule(v *validator.Validator, rule *proto.PricingRule) {
+	v.Check(rule.Name != "", "name", "must be provided")
+	v.Check(len(rule.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(validator.PermittedValue(rule.Scope, PricingScopeProduct, PricingScopeCategory, PricingScopeCatalog), "scope", "must be product, category or catalog")
+	if rule.Scope == PricingScopeCatalog {
+		v.Check(rule.TargetId == 0, "target_id", "must not be set for catalog rules")
+	} else {
+		v.Check(rule.TargetId > 0, "target_id", "must be provided")
+	}
+
+	v.Check(validator.PermittedValue(rule.Kind, PricingKindPercent, PricingKindFixed), "kind", "must be percent or fixed")
+	switch rule.Kind {
+	case PricingKindPercent:
+		v.Check(rule.PercentBps >= 1 && rule.PercentBps <= 10000, "percent_bps", "must be between 1 and 10000")
+	case PricingKindFixed:
+		_, known := currency.Exponent(rule.Currency)
+		v.Check(rule.AmountMinor > 0, "amount_minor", "must be greater than zero")
+		v.Check(known, "currency", "must be a supported ISO 4217 code")
+	}
+
+	v.Check(rule.StartsAt != nil, "starts_at", "must be provided")
+	if rule.StartsAt != nil && rule.EndsAt != nil {
+		v.Check(rule.EndsAt.AsTime().After(rule.StartsAt.AsTime()), "ends_at", "must be after starts_at")
+	}
+}
+
+const pricingRuleColumns = `id, name, scope, coalesce(product_id, category_id, 0), kind, percent_bps, amount_minor, currency, starts_at, ends_at, priority, created_at, version`
+
+// activeAtClause matches the rules in effect at the time in the given
+// query parameter.
+func activeAtClause(param string) string {
+	return fmt.Sprintf(`starts_at <= %[1]s AND (ends_at IS NULL OR ends_at > %[1]s)`, param)
+}
+
+func (m PricingRuleModel) Insert(rule *proto.PricingRule) (*proto.PricingRule, error) {
+	productID, categoryID := ruleTargets(rule)
+
+	query := `INSERT INTO pricing_rules (name, scope, product_id, category_id, kind, percent_bps, amount_minor, currency, starts_at, ends_at, priority)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			  RETURNING ` + pricingRuleColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{
+		rule.Name,
+		rule.Scope,
+		productID,
+		categoryID,
+		rule.Kind,
+		rule.PercentBps,
+		rule.AmountMinor,
+		rule.Currency,
+		rule.StartsAt.AsTime(),
+		nullableTime(rule.EndsAt),
+		rule.Priority,
+	}
+
+	rule, err := scanPricingRule(m.DB.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		return nil, pricingRuleWriteError(err)
+	}
+	return rule, nil
+}
+
+func (m PricingRuleModel) Get(id int64) (*proto.PricingRule, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + pricingRuleColumns + `
+			  FROM pricing_rules
+			  WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanPricingRule(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// GetAll lists the pricing rules, or only those in effect at activeAt when it
+// is not nil.
+func (m PricingRuleModel) GetAll(activeAt *time.Time, filters *proto.Filters) ([]*proto.PricingRule, *proto.Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM pricing_rules
+		WHERE $1::timestamptz IS NULL OR (%s)
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, pricingRuleColumns, activeAtClause("$1"), sortColumn(filters), sortDirection(filters))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var at sql.NullTime
+	if activeAt != nil {
+		at = sql.NullTime{Time: *activeAt, Valid: true}
+	}
+
+	rows, err := m.DB.QueryContext(ctx, query, at, limit(filters), offset(filters))
+	if err != nil {
+		return nil, &proto.Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int32 = 0
+	var rules []*proto.PricingRule
+
+	for rows.Next() {
+		rule, err := scanPricingRule(prefixedRow{rows, &totalRecords})
+		if err != nil {
+			return nil, &proto.Metadata{}, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, &proto.Metadata{}, err
+	}
+	return rules, calculateMetadata(totalRecords, filters), nil
+}
+
+// Active returns every rule in effect at the given time.
+func (m PricingRuleModel) Active(at time.Time) ([]*proto.PricingRule, error) {
+	query := `SELECT ` + pricingRuleColumns + `
+			  FROM pricing_rules
+			  WHERE ` + activeAtClause("$1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*proto.PricingRule
+	for rows.Next() {
+		rule, err := scanPricingRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (m PricingRuleModel) Update(rule *proto.PricingRule) error {
+	productID, categoryID := ruleTargets(rule)
+
+	query := `UPDATE pricing_rules
+			  SET name = $1, scope = $2, product_id = $3, category_id = $4, kind = $5, percent_bps = $6,
+				  amount_minor = $7, currency = $8, starts_at = $9, ends_at = $10, priority = $11, version = version + 1
+			  WHERE id = $12
+			  RETURNING created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{
+		rule.Name,
+		rule.Scope,
+		productID,
+		categoryID,
+		rule.Kind,
+		rule.PercentBps,
+		rule.AmountMinor,
+		rule.Currency,
+		rule.StartsAt.AsTime(),
+		nullableTime(rule.EndsAt),
+		rule.Priority,
+		rule.Id,
+	}
+
+	var createdAt time.Time
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&createdAt, &rule.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return pricingRuleWriteError(err)
+	}
+	rule.CreatedAt = timestamppb.New(createdAt)
+	return nil
+}
+
+func (m PricingRuleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM pricing_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// ruleTargets splits a rule's target into the product_id and category_id
+// columns, only one of which is set for product and category rules.
+func ruleTargets(rule *proto.PricingRule) (sql.NullInt64, sql.NullInt64) {
+	switch rule.Scope {
+	case PricingScopeProduct:
+		return nullableID(rule.TargetId), sql.NullInt64{}
+	case PricingScopeCategory:
+		return sql.NullInt64{}, nullableID(rule.TargetId)
+	default:
+		return sql.NullInt64{}, sql.NullInt64{}
+	}
+}
+
+func nullableTime(t *timestamppb.Timestamp) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.AsTime(), Valid: true}
+}
+
+// scanPricingRule reads a row of pricingRuleColumns.
+func scanPricingRule(row rowScanner) (*proto.PricingRule, error) {
+	var rule proto.PricingRule
+	var startsAt, createdAt time.Time
+	var endsAt sql.NullTime
+	err := row.Scan(
+		&rule.Id,
+		&rule.Name,
+		&rule.Scope,
+		&rule.TargetId,
+		&rule.Kind,
+		&rule.PercentBps,
+		&rule.AmountMinor,
+		&rule.Currency,
+		&startsAt,
+		&endsAt,
+		&rule.Priority,
+		&createdAt,
+		&rule.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	rule.StartsAt = timestamppb.New(startsAt)
+	if endsAt.Valid {
+		rule.EndsAt = timestamppb.New(endsAt.Time)
+	}
+	rule.CreatedAt = timestamppb.New(createdAt)
+
+	return &rule, nil
+}
+
+func pricingRuleWriteError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "foreign_key_violation" {
+		return ErrUnknownPricingTarget
+	}
+	return err
+}
+
+// activeRule reports whether rule is in effect at the given time, as
+// activeAtClause does.
+func activeRule(rule *proto.PricingRule, at time.Time) bool {
+	if rule.StartsAt.AsTime().After(at) {
+		return false
+	}
+	return rule.EndsAt == nil || rule.EndsAt.AsTime().After(at)
+}
+
+// ApplyPricing sets the effective prices of products, and of those of their
+// variants that have a price of their own, from the best of rules. Prices
+// must still be in the products' own currencies. parents maps category IDs
+// to their parents' and is only needed when rules has category rules.
+func ApplyPricing(products []*proto.Product, rules []*proto.PricingRule, parents map[int64]int64) {
+	for _, product := range products {
+		rule := bestRule(product, rules, parents)
+
+		product.EffectivePriceMinor = discount(product.PriceMinor, rule)
+		product.PricingRuleId = 0
+		if rule != nil {
+			product.PricingRuleId = rule.Id
+		}
+
+		for _, variant := range product.Variants {
+			variant.EffectivePriceMinor = nil
+			if variant.PriceMinor != nil {
+				price := discount(*variant.PriceMinor, rule)
+				variant.EffectivePriceMinor = &price
+			}
+		}
+	}
+}
+
+// bestRule picks the rule with the highest priority among those that apply
+// to product, preferring the more specific scope and then the older rule.
+func bestRule(product *proto.Product, rules []*proto.PricingRule, parents map[int64]int64) *proto.PricingRule {
+	var best *proto.PricingRule
+	for _, rule := range rules {
+		if !appliesTo(rule, product, parents) {
+			continue
+		}
+		if best == nil || rule.Priority > best.Priority ||
+			rule.Priority == best.Priority && (specificity(rule) > specificity(best) ||
+				specificity(rule) == specificity(best) && rule.Id < best.Id) {
+			best = rule
+		}
+	}
+	return best
+}
+
+func appliesTo(rule *proto.PricingRule, product *proto.Product, parents map[int64]int64) bool {
+	if rule.Kind == PricingKindFixed && rule.Currency != product.Currency {
+		return false
+	}
+
+	switch rule.Scope {
+	case PricingScopeProduct:
+		return rule.TargetId == product.Id
+	case PricingScopeCategory:
+		// The walk is bounded in case the map is stale and has a cycle.
+		id := product.CategoryId
+		for steps := 0; id != 0 && steps <= len(parents); steps++ {
+			if id == rule.TargetId {
+				return true
+			}
+			id = parents[id]
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func specificity(rule *proto.PricingRule) int {
+	switch rule.Scope {
+	case PricingScopeProduct:
+		return 2
+	case PricingScopeCategory:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// discount applies rule to a price in minor units, rounding percentages half
+// away from zero. A nil rule leaves the price as it is.
+func discount(price int64, rule *proto.PricingRule) int64 {
+	if rule == nil {
+		return price
+	}
+
+	var off int64
+	switch rule.Kind {
+	case PricingKindPercent:
+		off = roundRat(new(big.Rat).Mul(new(big.Rat).SetInt64(price), big.NewRat(int64(rule.PercentBps), 10000)))
+	case PricingKindFixed:
+		off = rule.AmountMinor
+	}
+
+	if off > price {
+		return 0
+	}
+	return price - off
+}
@@ -0,0 +1,120 @@
+package data
+
+import (
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+func TestApplyPricing(t *testing.T) {
+	// Berries (2) is a subcategory of Fruit (1).
+	parents := map[int64]int64{1: 0, 2: 1, 3: 0}
+
+	fruitSale := &proto.PricingRule{Id: 1, Scope: PricingScopeCategory, TargetId: 1, Kind: PricingKindPercent, PercentBps: 2000}
+	catalogSale := &proto.PricingRule{Id: 2, Scope: PricingScopeCatalog, Kind: PricingKindPercent, PercentBps: 1000}
+	productSale := &proto.PricingRule{Id: 3, Scope: PricingScopeProduct, TargetId: 7, Kind: PricingKindFixed, AmountMinor: 5000, Currency: "KZT"}
+	urgentSale := &proto.PricingRule{Id: 4, Scope: PricingScopeCatalog, Kind: PricingKindPercent, PercentBps: 500, Priority: 10}
+	dollarOff := &proto.PricingRule{Id: 5, Scope: PricingScopeCatalog, Kind: PricingKindFixed, AmountMinor: 100, Currency: "USD"}
+
+	tests := []struct {
+		name      string
+		product   *proto.Product
+		rules     []*proto.PricingRule
+		effective int64
+		ruleID    int64
+	}{
+		{name: "No rules", product: &proto.Product{Id: 7, PriceMinor: 85000, CategoryId: 1, Currency: "KZT"}, effective: 85000},
+		{name: "Category rule", product: &proto.Product{Id: 8, PriceMinor: 85000, CategoryId: 1, Currency: "KZT"}, rules: []*proto.PricingRule{fruitSale}, effective: 68000, ruleID: 1},
+		{name: "Category rule covers subcategories", product: &proto.Product{Id: 8, PriceMinor: 150000, CategoryId: 2, Currency: "KZT"}, rules: []*proto.PricingRule{fruitSale}, effective: 120000, ruleID: 1},
+		{name: "Category rule skips other categories", product: &proto.Product{Id: 8, PriceMinor: 150000, CategoryId: 3, Currency: "KZT"}, rules: []*proto.PricingRule{fruitSale}, effective: 150000},
+		{name: "More specific scope wins a tie", product: &proto.Product{Id: 7, PriceMinor: 85000, CategoryId: 1, Currency: "KZT"}, rules: []*proto.PricingRule{catalogSale, fruitSale, productSale}, effective: 80000, ruleID: 3},
+		{name: "Higher priority wins", product: &proto.Product{Id: 7, PriceMinor: 85000, CategoryId: 1, Currency: "KZT"}, rules: []*proto.PricingRule{productSale, urgentSale}, effective: 80750, ruleID: 4},
+		{name: "Fixed rule skips other currencies", product: &proto.Product{Id: 8, PriceMinor: 85000, CategoryId: 1, Currency: "KZT"}, rules: []*proto.PricingRule{dollarOff}, effective: 85000},
+		{name: "Discount stops at zero", product: &proto.Product{Id: 8, PriceMinor: 50, CategoryId: 1, Currency: "USD"}, rules: []*proto.PricingRule{dollarOff}, effective: 0, ruleID: 5},
+		{name: "Percentages round half up", product: &proto.Product{Id: 8, PriceMinor: 5, CategoryId: 3, Currency: "KZT"}, rules: []*proto.PricingRule{catalogSale}, effective: 4, ruleID: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ApplyPricing([]*proto.Product{tt.product}, tt.rules, parents)
+			if tt.product.EffectivePriceMinor != tt.effective {
+				t.Errorf("effective price = %d, expected %d", tt.product.EffectivePriceMinor, tt.effective)
+			}
+			if tt.product.PricingRuleId != tt.ruleID {
+				t.Errorf("pricing rule = %d, expected %d", tt.product.PricingRuleId, tt.ruleID)
+			}
+		})
+	}
+}
+
+func TestApplyPricingVariants(t *testing.T) {
+	override := int64(90000)
+	product := &proto.Product{
+		Id:         8,
+		PriceMinor: 85000,
+		CategoryId: 1,
+		Currency:   "KZT",
+		Variants:   []*proto.ProductVariant{{Id: 1}, {Id: 2, PriceMinor: &override}},
+	}
+	rule := &proto.PricingRule{Id: 1, Scope: PricingScopeCatalog, Kind: PricingKindPercent, PercentBps: 2000}
+
+	ApplyPricing([]*proto.Product{product}, []*proto.PricingRule{rule}, nil)
+
+	if product.Variants[0].EffectivePriceMinor != nil {
+		t.Errorf("variant without a price got effective price %d", *product.Variants[0].EffectivePriceMinor)
+	}
+	if got := product.Variants[1].EffectivePriceMinor; got == nil || *got != 72000 {
+		t.Errorf("variant effective price = %v, expected 72000", got)
+	}
+}
+
+func TestValidatePricingRule(t *testing.T) {
+	now := time.Now()
+	valid := func() *proto.PricingRule {
+		return &proto.PricingRule{
+			Name:       "Fruit weekend",
+			Scope:      PricingScopeCategory,
+			TargetId:   1,
+			Kind:       PricingKindPercent,
+			PercentBps: 2000,
+			StartsAt:   timestamppb.New(now),
+			EndsAt:     timestamppb.New(now.Add(48 * time.Hour)),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(rule *proto.PricingRule)
+		valid  bool
+	}{
+		{name: "Valid rule", change: func(rule *proto.PricingRule) {}, valid: true},
+		{name: "Missing name", change: func(rule *proto.PricingRule) { rule.Name = "" }},
+		{name: "Unknown scope", change: func(rule *proto.PricingRule) { rule.Scope = "brand" }},
+		{name: "Catalog rule with target", change: func(rule *proto.PricingRule) { rule.Scope = PricingScopeCatalog }},
+		{name: "Catalog rule", change: func(rule *proto.PricingRule) { rule.Scope, rule.TargetId = PricingScopeCatalog, 0 }, valid: true},
+		{name: "Percent above 100", change: func(rule *proto.PricingRule) { rule.PercentBps = 10001 }},
+		{name: "Fixed rule without currency", change: func(rule *proto.PricingRule) { rule.Kind, rule.AmountMinor = PricingKindFixed, 500 }},
+		{name: "Fixed rule", change: func(rule *proto.PricingRule) {
+			rule.Kind, rule.AmountMinor, rule.Currency = PricingKindFixed, 500, "KZT"
+		}, valid: true},
+		{name: "Missing start", change: func(rule *proto.PricingRule) { rule.StartsAt = nil }},
+		{name: "Ends before it starts", change: func(rule *proto.PricingRule) { rule.EndsAt = timestamppb.New(now.Add(-time.Hour)) }},
+		{name: "Open-ended rule", change: func(rule *proto.PricingRule) { rule.EndsAt = nil }, valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := valid()
+			tt.change(rule)
+			NormalizePricingRule(rule)
+
+			v := validator.New()
+			ValidatePricingRule(v, rule)
+			if v.Valid() != tt.valid {
+				t.Errorf("Valid() = %v, expected %v: %v", v.Valid(), tt.valid, v.Errors)
+			}
+		})
+	}
+}
@@ -6,75 +6,240 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"github.com/lib/pq"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"time"
 )
 
-var ErrRecordNotFound = errors.New("record not found")
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	ErrNotDeleted     = errors.New("product is not deleted")
+)
+
+// ProductSortSafeList is the set of sort values accepted by GetAll. Clients
+// cannot extend it, since the sort column is interpolated into the query.
+// "relevance" orders search results by rank and other lists by id; "rating"
+// orders by average rating.
+var ProductSortSafeList = []string{"id", "name", "category", "price", "is_available", "creation_date", "relevance", "rating",
+	"-id", "-name", "-category", "-price", "-is_available", "-creation_date", "-rating"}
 
+// ProductModel writes to DB, the primary. Get, GetMany and GetAll read from
+// Replicas when there are any. Every call runs under the caller's context
+// and the timeout for its kind, and slow ones are reported to SlowQueries.
 type ProductModel struct {
-	DB *sql.DB
+	DB          *sql.DB
+	Replicas    *Replicas
+	Timeouts    Timeouts
+	SlowQueries *SlowQueryLog
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx, so statements can run
+// either on their own or as part of a larger transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// productSortColumn qualifies the sort column for queries that join products
+// (p) with categories (c), mapping the public "price" sort onto the stored
+// minor-unit column, "category" onto the category name and "rating" onto the
+// average rating.
+func productSortColumn(filters *proto.Filters) string {
+	switch column := sortColumn(filters); column {
+	case "price":
+		return "p.price_minor"
+	case "category":
+		return "c.name"
+	case "rating":
+		return "p.average_rating"
+	default:
+		return "p." + column
+	}
 }
 
-func SetStatus(product *proto.Product) {
-	if product.GetQuantity() > 0 {
-		product.IsAvailable = true
-	} else {
-		product.IsAvailable = false
+// productWriteError reports a product that points at a missing category as
+// ErrUnknownCategory.
+func productWriteError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "foreign_key_violation" {
+		return ErrUnknownCategory
 	}
+	return err
 }
 
-func (p ProductModel) Insert(product *proto.Product) (*proto.Product, error) {
-	query := `INSERT INTO products (name, price, description, category, quantity, is_available)
-			  VALUES ($1, $2, $3, $4, $5, $6)
-	          RETURNING id, creation_date, version`
+func (p ProductModel) Insert(ctx context.Context, product *proto.Product, actor string) (*proto.Product, error) {
+	ctx, op := p.begin(ctx, "ProductModel.Insert", p.Timeouts.Write)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	product, err = p.insert(ctx, tx, product, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	op.rows = 1
+	return product, nil
+}
+
+// insert adds the product, its audit record and its outbox message using q,
+// which should be a transaction so that none is written without the others.
+func (p ProductModel) insert(ctx context.Context, q querier, product *proto.Product, actor string) (*proto.Product, error) {
+	query := `INSERT INTO products (name, price_minor, currency, description, category_id, quantity, is_available, options)
+			  VALUES ($1, $2, $3, $4, $5, $6, $6 > 0, $7)
+	          RETURNING id, creation_date, version, is_available, (SELECT name FROM categories WHERE id = category_id), average_rating, review_count`
+
+	options, err := encodeOptions(product.Options)
+	if err != nil {
+		return nil, err
+	}
 
 	args := []any{
 		product.Name,
-		product.Price,
+		product.PriceMinor,
+		product.Currency,
 		product.Description,
-		product.Category,
+		product.CategoryId,
 		product.Quantity,
-		product.IsAvailable,
+		options,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	var creationDate time.Time
-	err := p.DB.QueryRowContext(ctx, query, args...).Scan(&product.Id, &creationDate, &product.Version)
+	err = q.QueryRowContext(ctx, query, args...).Scan(&product.Id, &creationDate, &product.Version, &product.IsAvailable, &product.Category, &product.AverageRating, &product.ReviewCount)
 	if err != nil {
-		return nil, err
+		return nil, productWriteError(err)
 	}
 	product.CreationDate = timestamppb.New(creationDate)
 
+	err = insertAudit(ctx, q, product.Id, AuditActionInsert, actor, product.Version, diffProducts(nil, product))
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertOutbox(ctx, q, productLog(product.Id, "Product has been successfully created with id: %d", product.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = productCreated(ctx, q, product, actor); err != nil {
+		return nil, err
+	}
+
+	if product.Quantity != 0 {
+		err = insertMovement(ctx, q, &proto.StockMovement{
+			ProductId: product.Id,
+			Delta:     product.Quantity,
+			Reason:    MovementReasonInitial,
+			Actor:     actor,
+			Balance:   product.Quantity,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return product, nil
 }
 
-func (p ProductModel) Get(id int64) (*proto.Product, error) {
+// Get returns a product unless it is deleted.
+func (p ProductModel) Get(ctx context.Context, id int64) (*proto.Product, error) {
+	db := p.Replicas.reader(ctx, p.DB)
+	ctx, op := p.begin(ctx, "ProductModel.Get", p.Timeouts.Read)
+	defer op.end()
+
+	return p.get(ctx, op, db, id, false)
+}
+
+// GetIncludingDeleted returns a product whether or not it is deleted.
+func (p ProductModel) GetIncludingDeleted(ctx context.Context, id int64) (*proto.Product, error) {
+	ctx, op := p.begin(ctx, "ProductModel.GetIncludingDeleted", p.Timeouts.Read)
+	defer op.end()
+
+	return p.get(ctx, op, p.DB, id, true)
+}
+
+func (p ProductModel) get(ctx context.Context, op *operation, q querier, id int64, includeDeleted bool) (*proto.Product, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `SELECT id, name, price, description, category, is_available, creation_date, version
-			  FROM products
-		      WHERE id = $1`
+	query := `SELECT ` + productColumns + `
+			  FROM products p
+			  JOIN categories c ON c.id = p.category_id
+		      WHERE p.id = $1 AND ($2 OR p.deleted_at IS NULL)`
 
+	product, err := scanProduct(q.QueryRowContext(ctx, query, id, includeDeleted))
+	if err != nil {
+		return nil, err
+	}
+	op.rows = 1
+	return product, nil
+}
+
+// GetMany returns the products with the given ids that exist and are not
+// deleted, in no particular order.
+func (p ProductModel) GetMany(ctx context.Context, ids []int64) ([]*proto.Product, error) {
+	db := p.Replicas.reader(ctx, p.DB)
+	ctx, op := p.begin(ctx, "ProductModel.GetMany", p.Timeouts.Read)
+	defer op.end()
+
+	query := `SELECT ` + productColumns + `
+			  FROM products p
+			  JOIN categories c ON c.id = p.category_id
+			  WHERE p.id = ANY($1) AND p.deleted_at IS NULL`
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var products []*proto.Product
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	op.rows = len(products)
+	return products, rows.Err()
+}
+
+const productColumns = `p.id, p.name, p.price_minor, p.currency, p.description, p.category_id, c.name, p.quantity, p.is_available, p.creation_date, p.version, p.options, p.deleted_at, p.average_rating, p.review_count`
+
+// scanProduct reads a row of productColumns.
+func scanProduct(row rowScanner) (*proto.Product, error) {
 	var product proto.Product
 	var creationDate time.Time
-	err := p.DB.QueryRow(query, id).Scan(
+	var options []byte
+	var deletedAt sql.NullTime
+	err := row.Scan(
 		&product.Id,
 		&product.Name,
-		&product.Price,
+		&product.PriceMinor,
+		&product.Currency,
 		&product.Description,
+		&product.CategoryId,
 		&product.Category,
+		&product.Quantity,
 		&product.IsAvailable,
 		&creationDate,
 		&product.Version,
+		&options,
+		&deletedAt,
+		&product.AverageRating,
+		&product.ReviewCount,
 	)
 
-	product.CreationDate = timestamppb.New(creationDate)
-
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -83,26 +248,41 @@ func (p ProductModel) Get(id int64) (*proto.Product, error) {
 			return nil, err
 		}
 	}
+	product.CreationDate = timestamppb.New(creationDate)
+	setDeletedAt(&product, deletedAt)
+	SetLegacyPrice(&product)
+	if product.Options, err = decodeOptions(options); err != nil {
+		return nil, err
+	}
 
 	return &product, nil
 }
 
-func (p ProductModel) GetAll(name string, category string, filters *proto.Filters) ([]*proto.Product, *proto.Metadata, error) {
-	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, name, price, description, category, is_available, creation_date, version
-		FROM products
-		WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (to_tsvector('simple', category) @@ plainto_tsquery('simple', $2) OR $2 = '')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, sortColumn(filters), sortDirection(filters))
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetAll lists the products matching filter.
+func (p ProductModel) GetAll(ctx context.Context, filter ProductFilter, filters *proto.Filters) ([]*proto.Product, *proto.Metadata, error) {
+	db := p.Replicas.reader(ctx, p.DB)
+	ctx, op := p.begin(ctx, "ProductModel.GetAll", p.Timeouts.Read)
+	defer op.end()
 
-	defer cancel()
+	q, err := p.newProductQuery(ctx, filter, filter.hasPriceBounds())
+	if err != nil {
+		return nil, &proto.Metadata{}, err
+	}
 
-	args := []any{name, category, limit(filters), offset(filters)}
+	orderBy := productSortColumn(filters) + " " + sortDirection(filters)
+	if sortColumn(filters) == "relevance" {
+		orderBy = q.rank() + " DESC"
+	}
 
-	rows, err := p.DB.QueryContext(ctx, query, args...)
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), p.id, p.name, p.price_minor, p.currency, p.description, p.category_id, c.name, p.quantity, p.is_available, p.creation_date, p.version, p.options, p.deleted_at, p.average_rating, p.review_count, %s
+		FROM %s
+		WHERE %s
+		ORDER BY %s, p.id ASC
+		LIMIT %s OFFSET %s`, q.snippet(), q.from(filter.hasPriceBounds()), q.where(facetNone), orderBy,
+		q.arg(limit(filters)), q.arg(offset(filters)))
+
+	rows, err := db.QueryContext(ctx, query, q.args...)
 	if err != nil {
 		return nil, &proto.Metadata{}, err
 	}
@@ -116,21 +296,36 @@ func (p ProductModel) GetAll(name string, category string, filters *proto.Filter
 	for rows.Next() {
 		var product proto.Product
 		var creationDate time.Time
+		var options []byte
+		var deletedAt sql.NullTime
 		err := rows.Scan(
 			&totalRecords,
 			&product.Id,
 			&product.Name,
-			&product.Price,
+			&product.PriceMinor,
+			&product.Currency,
 			&product.Description,
+			&product.CategoryId,
 			&product.Category,
+			&product.Quantity,
 			&product.IsAvailable,
 			&creationDate,
 			&product.Version,
+			&options,
+			&deletedAt,
+			&product.AverageRating,
+			&product.ReviewCount,
+			&product.Snippet,
 		)
-		product.CreationDate = timestamppb.New(creationDate)
 		if err != nil {
 			return nil, &proto.Metadata{}, err
 		}
+		product.CreationDate = timestamppb.New(creationDate)
+		setDeletedAt(&product, deletedAt)
+		SetLegacyPrice(&product)
+		if product.Options, err = decodeOptions(options); err != nil {
+			return nil, &proto.Metadata{}, err
+		}
 		products = append(products, &product)
 	}
 
@@ -138,42 +333,265 @@ func (p ProductModel) GetAll(name string, category string, filters *proto.Filter
 		return nil, &proto.Metadata{}, err
 	}
 	metadata := calculateMetadata(totalRecords, filters)
+	op.rows = len(products)
 	return products, metadata, nil
 }
 
-func (p ProductModel) Update(product *proto.Product) error {
+func (p ProductModel) Update(ctx context.Context, product *proto.Product, actor string) error {
+	ctx, op := p.begin(ctx, "ProductModel.Update", p.Timeouts.Write)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getForUpdate(ctx, tx, product.Id)
+	if err != nil {
+		return err
+	}
+	if err = withVariants(ctx, tx, before); err != nil {
+		return err
+	}
+
+	if err = checkProductVariants(ctx, tx, before, product); err != nil {
+		return err
+	}
+
+	options, err := encodeOptions(product.Options)
+	if err != nil {
+		return err
+	}
+
+	// Stock is left alone: it only changes through AdjustStock and
+	// reservations, which would otherwise be undone by an update built from
+	// an earlier read of the product.
 	query := `UPDATE products
-	          SET name = $1, price = $2, description = $3, category = $4, quantity = $5, version = version + 1
+	          SET name = $1, price_minor = $2, currency = $3, description = $4, category_id = $5,
+	              options = $7, version = version + 1
 	          WHERE id = $6
-	          RETURNING version`
+	          RETURNING quantity, version, is_available, (SELECT name FROM categories WHERE id = category_id), average_rating, review_count`
 
 	args := []any{
 		product.Name,
-		product.Price,
+		product.PriceMinor,
+		product.Currency,
 		product.Description,
-		product.Category,
-		product.Quantity,
+		product.CategoryId,
 		product.Id,
+		options,
+	}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&product.Quantity, &product.Version, &product.IsAvailable, &product.Category, &product.AverageRating, &product.ReviewCount)
+	if err != nil {
+		return productWriteError(err)
+	}
+
+	err = insertAudit(ctx, tx, product.Id, AuditActionUpdate, actor, product.Version, diffProducts(before, product))
+	if err != nil {
+		return err
+	}
+
+	err = insertOutbox(ctx, tx, productLog(product.Id, "Product has been successfully updated with id: %d", product.Id))
+	if err != nil {
+		return err
+	}
+
+	after, err := eventState(ctx, tx, product.Id)
+	if err != nil {
+		return err
+	}
+	if err = productUpdated(ctx, tx, before, after, actor); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	op.rows = 1
+	return nil
+}
+
+func (p ProductModel) Delete(ctx context.Context, id int64, actor string) error {
+	ctx, op := p.begin(ctx, "ProductModel.Delete", p.Timeouts.Write)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getForUpdate(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if err = withVariants(ctx, tx, before); err != nil {
+		return err
+	}
+
+	// The row is only marked, so that the product can be restored until
+	// PurgeDeleted removes it.
+	var version int32
+	err = tx.QueryRowContext(ctx, `UPDATE products SET deleted_at = NOW(), version = version + 1 WHERE id = $1 RETURNING version`, id).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	err = insertAudit(ctx, tx, id, AuditActionDelete, actor, version, diffProducts(before, nil))
+	if err != nil {
+		return err
 	}
-	return p.DB.QueryRow(query, args...).Scan(&product.Version)
+
+	err = insertOutbox(ctx, tx, productLog(id, "Product has been successfully deleted with id: %d", id))
+	if err != nil {
+		return err
+	}
+
+	if err = productDeleted(ctx, tx, before, actor); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	op.rows = 1
+	return nil
 }
 
-func (p ProductModel) Delete(id int64) error {
-	query := `DELETE FROM products WHERE id = $1`
+// Restore undoes the deletion of a product. It fails with ErrNotDeleted when
+// the product is not deleted.
+func (p ProductModel) Restore(ctx context.Context, id int64, actor string) error {
+	ctx, op := p.begin(ctx, "ProductModel.Restore", p.Timeouts.Write)
+	defer op.end()
 
-	result, err := p.DB.Exec(query, id)
+	tx, err := p.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	before, err := eventState(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if before.DeletedAt == nil {
+		return ErrNotDeleted
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE products SET deleted_at = NULL, version = version + 1 WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	after, err := eventState(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = insertAudit(ctx, tx, id, AuditActionRestore, actor, after.Version, diffProducts(nil, after))
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	err = insertOutbox(ctx, tx, productLog(id, "Product has been successfully restored with id: %d", id))
+	if err != nil {
+		return err
 	}
 
+	if err = productUpdated(ctx, tx, before, after, actor); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	op.rows = 1
 	return nil
 }
+
+// PurgeDeleted removes up to limit products that were deleted more than
+// retention ago, along with their variants, images and reservations. Their
+// history and stock movements are kept. It returns how many products were
+// removed and their images, whose files the caller still has to remove.
+func (p ProductModel) PurgeDeleted(ctx context.Context, retention time.Duration, limit int) (int, []*ProductImage, error) {
+	ctx, op := p.begin(ctx, "ProductModel.PurgeDeleted", p.Timeouts.Sweep)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id FROM products
+			  WHERE deleted_at < NOW() - make_interval(secs => $1)
+			  ORDER BY deleted_at
+			  LIMIT $2
+			  FOR UPDATE SKIP LOCKED`
+
+	rows, err := tx.QueryContext(ctx, query, retention.Seconds(), limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	var images []*ProductImage
+	for _, id := range ids {
+		productImages, err := imagesForProduct(ctx, tx, id)
+		if err != nil {
+			return 0, nil, err
+		}
+		images = append(images, productImages...)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM products WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	op.rows = len(ids)
+	return len(ids), images, nil
+}
+
+func setDeletedAt(product *proto.Product, deletedAt sql.NullTime) {
+	if deletedAt.Valid {
+		product.DeletedAt = timestamppb.New(deletedAt.Time)
+	}
+}
+
+// getForUpdate reads the current state of a product and locks its row until
+// the surrounding transaction ends. Deleted products are not found.
+func getForUpdate(ctx context.Context, q querier, id int64) (*proto.Product, error) {
+	return lockedProduct(ctx, q, id, false)
+}
+
+// lockedProduct is getForUpdate that can also find deleted products, for
+// changes such as releasing stock that still apply to them.
+func lockedProduct(ctx context.Context, q querier, id int64, includeDeleted bool) (*proto.Product, error) {
+	query := `SELECT ` + productColumns + `
+			  FROM products p
+			  JOIN categories c ON c.id = p.category_id
+			  WHERE p.id = $1 AND ($2 OR p.deleted_at IS NULL)
+			  FOR UPDATE OF p`
+
+	return scanProduct(q.QueryRowContext(ctx, query, id, includeDeleted))
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"errors"
 	"github.com/Skaifai/gophers-microservice/product-service/cmd/utils"
 	"github.com/Skaifai/gophers-microservice/product-service/config"
@@ -8,39 +9,52 @@ import (
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 )
 
 const id = 5
 
-var products = func() ProductModel {
+// products is the repository under test: PostgreSQL when DB_DSN is set, in
+// the environment or in .env, and otherwise the memory repository holding
+// the products the tests expect.
+var products = func() ProductRepository {
 	cfg := loadTestConfiguration()
-	db, _ := utils.OpenDB(cfg)
-	return ProductModel{DB: db}
+	if cfg.DB.DSN != "" {
+		db, _ := utils.OpenDB(cfg)
+		return ProductModel{DB: db}
+	}
+
+	models := NewMemoryModels()
+	category, _ := models.Categories.Insert(&proto.Category{Name: "Fruit", Slug: "fruit"})
+	for _, name := range []string{"Banana", "Cherry", "Grape", "Pear"} {
+		models.Products.Insert(context.Background(), &proto.Product{Name: name, PriceMinor: 50000, Currency: "KZT", CategoryId: category.Id, Quantity: 1}, "")
+	}
+	return models.Products
 }()
 
 func TestAddProduct(t *testing.T) {
 	product := &proto.Product{
 		Name:        "Apple",
-		Price:       850,
+		PriceMinor:  85000,
+		Currency:    "KZT",
 		Description: "Apple from Almaty city",
-		Category:    "Fruit",
+		CategoryId:  1,
 		Quantity:    5,
 	}
-	SetStatus(product)
-	if !product.IsAvailable {
-		t.Error("product should be available")
-	}
-
-	_, err := products.Insert(product)
+	result, err := products.Insert(context.Background(), product, "")
 	if err != nil {
 		t.Fatalf("error acquired while inserting product. %s", err.Error())
 	}
+	if !result.IsAvailable {
+		t.Error("product should be available")
+	}
 }
 
 func TestGetProduct(t *testing.T) {
-	product, err := products.Get(id)
+	product, err := products.Get(context.Background(), id)
 	if err != nil {
 		t.Fatalf("error acquired while accessing table product. %s", err.Error())
 	}
@@ -61,7 +75,7 @@ func TestGetAllProduct(t *testing.T) {
 	input.Filters.SortSafeList = []string{"id", "name", "category", "price", "is_available", "creation_date",
 		"-id", "-name", "-category", "-price", "-is_available", "-creation_date"}
 
-	products, metadata, err := products.GetAll(input.Name, input.Category, &input.Filters)
+	products, metadata, err := products.GetAll(context.Background(), ProductFilter{Name: input.Name, Category: input.Category}, &input.Filters)
 	if err != nil {
 		t.Fatalf("error acquired while accessing table product. %s", err.Error())
 	}
@@ -77,34 +91,59 @@ func TestUpdateProduct(t *testing.T) {
 	product := &proto.Product{
 		Id:          id,
 		Name:        "Apple",
-		Price:       1200,
+		PriceMinor:  120000,
+		Currency:    "KZT",
 		Description: "Apple from Almaty city",
-		Category:    "Fruit",
+		CategoryId:  1,
 		Quantity:    3,
 	}
-	err := products.Update(product)
+	err := products.Update(context.Background(), product, "")
 	if err != nil {
 		t.Fatalf("error acquired while updating product. %s", err.Error())
 	}
-	result, _ := products.Get(product.Id)
-	if result.Name != product.Name && result.Price != product.Price {
+	result, _ := products.Get(context.Background(), product.Id)
+	if result.Name != product.Name && result.PriceMinor != product.PriceMinor {
 		t.Error("returned another product")
 	}
 }
 
 func TestDeleteProduct(t *testing.T) {
-	err := products.Delete(id)
+	err := products.Delete(context.Background(), id, "")
 	if err != nil {
 		t.Fatalf("error acquired while deleting product. %s", err.Error())
 	}
-	_, err = products.Get(id)
+	_, err = products.Get(context.Background(), id)
 	if !errors.Is(err, ErrRecordNotFound) {
 		t.Error("product should be deleted, but it is not")
 	}
+	deleted, err := products.GetIncludingDeleted(context.Background(), id)
+	if err != nil {
+		t.Fatalf("deleted product should still be stored. %s", err.Error())
+	}
+	if deleted.DeletedAt == nil {
+		t.Error("deleted product should have deleted_at set")
+	}
+}
+
+func TestRestoreProduct(t *testing.T) {
+	err := products.Restore(context.Background(), id, "")
+	if err != nil {
+		t.Fatalf("error acquired while restoring product. %s", err.Error())
+	}
+	result, err := products.Get(context.Background(), id)
+	if err != nil {
+		t.Fatalf("product should be restored, but it is not. %s", err.Error())
+	}
+	if result.DeletedAt != nil {
+		t.Error("restored product should not have deleted_at set")
+	}
+	if err = products.Restore(context.Background(), id, ""); !errors.Is(err, ErrNotDeleted) {
+		t.Errorf("restoring a product that is not deleted returned %v", err)
+	}
 }
 
 func getEnvironmentVar(key string) string {
-	godotenv.Load("..\\..\\.env")
+	godotenv.Load(filepath.Join("..", "..", ".env"))
 	return os.Getenv(key)
 }
 
@@ -114,10 +153,14 @@ func loadTestConfiguration() *config.Config {
 		Port: port,
 		Env:  "development",
 		DB: struct {
-			DSN          string
-			MaxOpenConns int
-			MaxIdleConns int
-			MaxIdleTime  string
+			DSN                  string
+			MaxOpenConns         int
+			MaxIdleConns         int
+			MaxIdleTime          string
+			AutoMigrate          bool
+			Replicas             []config.Replica
+			ReadYourWritesWindow time.Duration
+			ReplicaCheckInterval time.Duration
 		}{
 			DSN:          getEnvironmentVar("DB_DSN"),
 			MaxOpenConns: 25,
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Replicas routes product reads to read replicas of the primary database.
+// Reads go round-robin to the replicas that passed their last health check,
+// and to the primary when none did. A nil *Replicas sends every read to the
+// primary.
+//
+// Replicas lag behind the primary, so reads that must see the latest writes
+// run under WithPrimary.
+type Replicas struct {
+	replicas []*replica
+	next     uint32
+}
+
+type replica struct {
+	db *sql.DB
+	// healthy is 1 while the replica passes its health checks.
+	healthy int32
+}
+
+// NewReplicas routes reads to dbs, which are assumed healthy until a check
+// says otherwise.
+func NewReplicas(dbs []*sql.DB) *Replicas {
+	r := &Replicas{}
+	for _, db := range dbs {
+		r.replicas = append(r.replicas, &replica{db: db, healthy: 1})
+	}
+	return r
+}
+
+type primaryKey struct{}
+
+// WithPrimary returns a context whose reads go to the primary, for reads
+// that must see the latest writes.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// ReadsFromPrimary reports whether reads under ctx skip the replicas.
+func ReadsFromPrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryKey{}).(bool)
+	return primary
+}
+
+// reader returns the database a read under ctx should go to.
+func (r *Replicas) reader(ctx context.Context, primary *sql.DB) *sql.DB {
+	if r == nil || len(r.replicas) == 0 {
+		return primary
+	}
+	if ReadsFromPrimary(ctx) {
+		return primary
+	}
+
+	start := atomic.AddUint32(&r.next, 1)
+	for i := range r.replicas {
+		replica := r.replicas[(int(start)+i)%len(r.replicas)]
+		if atomic.LoadInt32(&replica.healthy) == 1 {
+			return replica.db
+		}
+	}
+	return primary
+}
+
+// Check pings every replica and takes the ones that do not answer out of
+// rotation until a later check succeeds.
+func (r *Replicas) Check(ctx context.Context) {
+	for i, replica := range r.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		err := replica.db.PingContext(pingCtx)
+		cancel()
+
+		healthy := int32(1)
+		if err != nil {
+			healthy = 0
+		}
+		if atomic.SwapInt32(&replica.healthy, healthy) != healthy {
+			if err != nil {
+				log.Printf("read replica %d is unhealthy: %v", i, err)
+			} else {
+				log.Printf("read replica %d is healthy again", i)
+			}
+		}
+	}
+}
+
+// Run checks the replicas every interval until ctx is done.
+func (r *Replicas) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Check(ctx)
+		}
+	}
+}
+
+// Close closes the replica pools.
+func (r *Replicas) Close() error {
+	var first error
+	for _, replica := range r.replicas {
+		if err := replica.db.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
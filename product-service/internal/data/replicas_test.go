@@ -0,0 +1,48 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// openUnreachable opens a pool against a port nothing listens on. Opening it
+// does not connect, so it stands in for a replica until it is pinged.
+func openUnreachable(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("postgres", "postgres://127.0.0.1:1/products?sslmode=disable&connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestReplicasReader(t *testing.T) {
+	primary, first, second := openUnreachable(t), openUnreachable(t), openUnreachable(t)
+	ctx := context.Background()
+
+	var none *Replicas
+	if none.reader(ctx, primary) != primary {
+		t.Error("without replicas, reads did not go to the primary")
+	}
+
+	replicas := NewReplicas([]*sql.DB{first, second})
+	seen := map[*sql.DB]int{}
+	for i := 0; i < 4; i++ {
+		seen[replicas.reader(ctx, primary)]++
+	}
+	if seen[first] != 2 || seen[second] != 2 {
+		t.Errorf("reads were not spread evenly over the replicas: %v", seen)
+	}
+
+	if replicas.reader(WithPrimary(ctx), primary) != primary {
+		t.Error("a read under WithPrimary did not go to the primary")
+	}
+
+	replicas.Check(ctx)
+	if replicas.reader(ctx, primary) != primary {
+		t.Error("with every replica unhealthy, reads did not go to the primary")
+	}
+}
@@ -0,0 +1,89 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+)
+
+// ProductRepository stores products, their stock and its reservations.
+// ProductModel keeps them in PostgreSQL; NewMemoryModels returns one that
+// keeps them in memory. Get, GetMany and GetAll may be served by a read
+// replica; WithPrimary sends them to the primary.
+type ProductRepository interface {
+	Insert(ctx context.Context, product *proto.Product, actor string) (*proto.Product, error)
+	InsertIdempotent(ctx context.Context, product *proto.Product, actor, key string, fingerprint []byte, window time.Duration) (*proto.Product, bool, error)
+	Get(ctx context.Context, id int64) (*proto.Product, error)
+	GetIncludingDeleted(ctx context.Context, id int64) (*proto.Product, error)
+	GetMany(ctx context.Context, ids []int64) ([]*proto.Product, error)
+	GetAll(ctx context.Context, filter ProductFilter, filters *proto.Filters) ([]*proto.Product, *proto.Metadata, error)
+	HasMatches(ctx context.Context, filter ProductFilter) (bool, error)
+	Facets(ctx context.Context, filter ProductFilter) (*proto.Facets, error)
+	Update(ctx context.Context, product *proto.Product, actor string) error
+	Delete(ctx context.Context, id int64, actor string) error
+	Restore(ctx context.Context, id int64, actor string) error
+	PurgeDeleted(ctx context.Context, retention time.Duration, limit int) (int, []*ProductImage, error)
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+
+	Reserve(ctx context.Context, productID, variantID int64, quantity int32, ttl time.Duration, actor string) (*proto.StockReservation, error)
+	Release(ctx context.Context, id int64, actor string) (*proto.StockReservation, error)
+	Commit(ctx context.Context, id int64) (*proto.StockReservation, error)
+	ExpireReservations(ctx context.Context, limit int) (int, []int64, error)
+	AdjustStock(ctx context.Context, productID, variantID int64, delta int32, reason, actor string) (*proto.StockMovement, error)
+}
+
+type VariantRepository interface {
+	Insert(variant *proto.ProductVariant, actor string) (*proto.ProductVariant, error)
+	Update(variant *proto.ProductVariant, actor string) error
+	Delete(productID, variantID int64, actor string) error
+	GetForProducts(productIDs []int64) (map[int64][]*proto.ProductVariant, error)
+}
+
+type ImageRepository interface {
+	Insert(image *ProductImage, primary bool) error
+	Update(productID, imageID int64, position int32, primary bool) ([]*ProductImage, error)
+	Delete(productID, imageID int64) (*ProductImage, error)
+	GetForProducts(productIDs []int64) (map[int64][]*ProductImage, error)
+}
+
+type CategoryRepository interface {
+	Insert(category *proto.Category) (*proto.Category, error)
+	Get(id int64) (*proto.Category, error)
+	GetBySlug(slug string) (*proto.Category, error)
+	GetAll(rootID int64) ([]*proto.Category, error)
+	Update(category *proto.Category) error
+	Delete(id int64) error
+}
+
+type ReviewRepository interface {
+	Insert(review *proto.Review) (*proto.Review, error)
+	Get(productID, id int64) (*proto.Review, error)
+	GetAll(filter ReviewFilter, filters *proto.Filters) ([]*proto.Review, *proto.Metadata, error)
+	Update(review *proto.Review) error
+	Moderate(productID, id int64, status string, verified *bool) (*proto.Review, error)
+	Delete(productID, id int64) error
+}
+
+type PricingRuleRepository interface {
+	Insert(rule *proto.PricingRule) (*proto.PricingRule, error)
+	Get(id int64) (*proto.PricingRule, error)
+	GetAll(activeAt *time.Time, filters *proto.Filters) ([]*proto.PricingRule, *proto.Metadata, error)
+	Active(at time.Time) ([]*proto.PricingRule, error)
+	Update(rule *proto.PricingRule) error
+	Delete(id int64) error
+}
+
+type MovementRepository interface {
+	GetForProduct(ctx context.Context, productID int64, filters *proto.Filters) ([]*proto.StockMovement, *proto.Metadata, error)
+}
+
+var (
+	_ ProductRepository     = ProductModel{}
+	_ VariantRepository     = VariantModel{}
+	_ ImageRepository       = ImageModel{}
+	_ CategoryRepository    = CategoryModel{}
+	_ ReviewRepository      = ReviewModel{}
+	_ PricingRuleRepository = PricingRuleModel{}
+	_ MovementRepository    = MovementModel{}
+)
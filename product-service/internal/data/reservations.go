@@ -0,0 +1,364 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	ReservationPending   = "pending"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+)
+
+var (
+	ErrInsufficientStock = errors.New("insufficient stock")
+	ErrReservationClosed = errors.New("reservation is no longer pending")
+	ErrVariantRequired   = errors.New("product stock is held by its variants")
+)
+
+// Reserve takes quantity units of a product, or of one of its variants when
+// variantID is not zero, out of stock and records a pending reservation for
+// them that expires after ttl. The decrement and the stock check are a single
+// statement, so concurrent reservations can never take more units than there
+// are. A product without enough stock of its own fails with
+// ErrVariantRequired when it has variants, since their stock is what the
+// caller meant to reserve.
+func (p ProductModel) Reserve(ctx context.Context, productID, variantID int64, quantity int32, ttl time.Duration, actor string) (*proto.StockReservation, error) {
+	ctx, op := p.begin(ctx, "ProductModel.Reserve", p.Timeouts.Write)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Deleted products cannot be reserved, though reservations made before
+	// the delete can still be released.
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return nil, err
+	}
+
+	if variantID != 0 {
+		_, err = adjustVariantQuantity(ctx, tx, productID, variantID, -quantity, AuditActionReserve, MovementReasonReserve, actor)
+	} else {
+		_, err = adjustQuantity(ctx, tx, productID, -quantity, AuditActionReserve, MovementReasonReserve, actor)
+		if errors.Is(err, ErrInsufficientStock) {
+			err = variantsHoldStock(ctx, tx, productID)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO stock_reservations (product_id, variant_id, quantity, expires_at)
+			  VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+			  RETURNING id, created_at, expires_at`
+
+	reservation := &proto.StockReservation{
+		ProductId: productID,
+		VariantId: variantID,
+		Quantity:  quantity,
+		Status:    ReservationPending,
+	}
+	var createdAt, expiresAt time.Time
+	err = tx.QueryRowContext(ctx, query, productID, nullableID(variantID), quantity, ttl.Seconds()).Scan(&reservation.Id, &createdAt, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	reservation.CreatedAt = timestamppb.New(createdAt)
+	reservation.ExpiresAt = timestamppb.New(expiresAt)
+
+	message := productLog(productID, "Reserved %d units of product with id: %d", quantity, productID)
+	if variantID != 0 {
+		message = productLog(productID, "Reserved %d units of variant %d of product with id: %d", quantity, variantID, productID)
+	}
+	err = insertOutbox(ctx, tx, message)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	op.rows = 1
+	return reservation, nil
+}
+
+// Release returns the units held by a pending reservation to stock.
+func (p ProductModel) Release(ctx context.Context, id int64, actor string) (*proto.StockReservation, error) {
+	ctx, op := p.begin(ctx, "ProductModel.Release", p.Timeouts.Write)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	reservation, err := closeReservation(ctx, tx, id, ReservationReleased, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = restock(ctx, tx, reservation.ProductId, reservation.VariantId, reservation.Quantity, AuditActionRelease, MovementReasonRelease, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertOutbox(ctx, tx, productLog(reservation.ProductId, "Reservation has been released with id: %d", reservation.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	op.rows = 1
+	return reservation, nil
+}
+
+// Commit turns a pending reservation into a sale. The units already left
+// stock when they were reserved, so only the reservation changes. A
+// reservation past its expiry cannot be committed even if the sweeper has not
+// reached it yet.
+func (p ProductModel) Commit(ctx context.Context, id int64) (*proto.StockReservation, error) {
+	ctx, op := p.begin(ctx, "ProductModel.Commit", p.Timeouts.Write)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	reservation, err := closeReservation(ctx, tx, id, ReservationCommitted, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertOutbox(ctx, tx, productLog(reservation.ProductId, "Reservation has been committed with id: %d", reservation.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	op.rows = 1
+	return reservation, nil
+}
+
+// ExpireReservations releases up to limit pending reservations whose expiry
+// has passed and reports how many it released and which products got stock
+// back. Rows locked by another sweeper are skipped, so several instances can
+// sweep at once.
+func (p ProductModel) ExpireReservations(ctx context.Context, limit int) (int, []int64, error) {
+	ctx, op := p.begin(ctx, "ProductModel.ExpireReservations", p.Timeouts.Sweep)
+	defer op.end()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `WITH expired AS (
+				  SELECT id FROM stock_reservations
+				  WHERE status = $1 AND expires_at <= NOW()
+				  ORDER BY id
+				  LIMIT $3
+				  FOR UPDATE SKIP LOCKED
+			  )
+			  UPDATE stock_reservations r
+			  SET status = $2
+			  FROM expired
+			  WHERE r.id = expired.id
+			  RETURNING r.product_id, coalesce(r.variant_id, 0), r.quantity`
+
+	rows, err := tx.QueryContext(ctx, query, ReservationPending, ReservationExpired, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	type stock struct{ productID, variantID int64 }
+
+	expired := 0
+	quantities := make(map[stock]int32)
+	for rows.Next() {
+		var key stock
+		var quantity int32
+		if err := rows.Scan(&key.productID, &key.variantID, &quantity); err != nil {
+			return 0, nil, err
+		}
+		quantities[key] += quantity
+		expired++
+	}
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	// Products are locked in id order so that two sweepers cannot deadlock.
+	keys := make([]stock, 0, len(quantities))
+	for key := range quantities {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].productID != keys[j].productID {
+			return keys[i].productID < keys[j].productID
+		}
+		return keys[i].variantID < keys[j].variantID
+	})
+
+	var productIDs []int64
+	for _, key := range keys {
+		err = restock(ctx, tx, key.productID, key.variantID, quantities[key], AuditActionExpire, MovementReasonExpire, "")
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(productIDs) == 0 || productIDs[len(productIDs)-1] != key.productID {
+			productIDs = append(productIDs, key.productID)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	op.rows = expired
+	return expired, productIDs, nil
+}
+
+// closeReservation moves a pending reservation to status. When unexpired is
+// set, reservations past their expiry are treated as already closed.
+func closeReservation(ctx context.Context, q querier, id int64, status string, unexpired bool) (*proto.StockReservation, error) {
+	query := `UPDATE stock_reservations
+			  SET status = $2
+			  WHERE id = $1 AND status = $3 AND (NOT $4 OR expires_at > NOW())
+			  RETURNING product_id, coalesce(variant_id, 0), quantity, created_at, expires_at`
+
+	reservation := &proto.StockReservation{Id: id, Status: status}
+	var createdAt, expiresAt time.Time
+	err := q.QueryRowContext(ctx, query, id, status, ReservationPending, unexpired).Scan(
+		&reservation.ProductId,
+		&reservation.VariantId,
+		&reservation.Quantity,
+		&createdAt,
+		&expiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, reservationState(ctx, q, id)
+		}
+		return nil, err
+	}
+	reservation.CreatedAt = timestamppb.New(createdAt)
+	reservation.ExpiresAt = timestamppb.New(expiresAt)
+
+	return reservation, nil
+}
+
+// reservationState explains why a reservation could not be closed.
+func reservationState(ctx context.Context, q querier, id int64) error {
+	var status string
+	var expired bool
+	err := q.QueryRowContext(ctx, `SELECT status, expires_at <= NOW() FROM stock_reservations WHERE id = $1`, id).Scan(&status, &expired)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+	if status == ReservationPending && expired {
+		status = ReservationExpired
+	}
+	return fmt.Errorf("%w: %s", ErrReservationClosed, status)
+}
+
+// restock returns the units of a closed reservation to the stock they were
+// taken from.
+func restock(ctx context.Context, q querier, productID, variantID int64, quantity int32, action, reason, actor string) error {
+	var err error
+	if variantID != 0 {
+		_, err = adjustVariantQuantity(ctx, q, productID, variantID, quantity, action, reason, actor)
+	} else {
+		_, err = adjustQuantity(ctx, q, productID, quantity, action, reason, actor)
+	}
+	return err
+}
+
+// variantsHoldStock turns a failed reservation of a product's own stock into
+// ErrVariantRequired when the product has variants.
+func variantsHoldStock(ctx context.Context, q querier, productID int64) error {
+	var exists bool
+	err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM product_variants WHERE product_id = $1)`, productID).Scan(&exists)
+	switch {
+	case err != nil:
+		return err
+	case exists:
+		return ErrVariantRequired
+	default:
+		return ErrInsufficientStock
+	}
+}
+
+// adjustQuantity adds delta to a product's stock, recomputing is_available in
+// the same statement, and records the change in the audit history and the
+// stock ledger. Stock never goes below zero: a decrement larger than the
+// stock fails with ErrInsufficientStock and leaves the row untouched.
+// Deleted products are adjusted too, so that their reservations can still be
+// released.
+func adjustQuantity(ctx context.Context, q querier, productID int64, delta int32, action, reason, actor string) (*proto.StockMovement, error) {
+	before, err := eventState(ctx, q, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE products
+			  SET quantity = quantity + $2, is_available = quantity + $2 > 0 OR ` + variantStockExpr + `, version = version + 1
+			  WHERE id = $1 AND quantity + $2 >= 0
+			  RETURNING quantity, version, is_available`
+
+	after := protobuf.Clone(before).(*proto.Product)
+	err = q.QueryRowContext(ctx, query, productID, delta).Scan(&after.Quantity, &after.Version, &after.IsAvailable)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInsufficientStock
+		}
+		return nil, err
+	}
+	quantity, version := after.Quantity, after.Version
+
+	changes := map[string]FieldChange{
+		"quantity": {Old: quantity - delta, New: quantity},
+	}
+	err = insertAudit(ctx, q, productID, action, actor, version, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	movement := &proto.StockMovement{
+		ProductId: productID,
+		Delta:     delta,
+		Reason:    reason,
+		Actor:     actor,
+		Balance:   quantity,
+	}
+	if err = insertMovement(ctx, q, movement); err != nil {
+		return nil, err
+	}
+	if err = stockChanged(ctx, q, movement, before, after, actor); err != nil {
+		return nil, err
+	}
+	return movement, nil
+}
@@ -0,0 +1,376 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"github.com/lib/pq"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var ErrDuplicateReview = errors.New("user has already reviewed the product")
+
+// Review statuses. Reviews start out pending and go back to pending when
+// their author changes them.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+var ReviewSortSafeList = []string{"id", "rating", "created_at", "-id", "-rating", "-created_at"}
+
+// ReviewFilter selects the reviews GetAll lists. A zero ProductID selects the
+// reviews of every product.
+type ReviewFilter struct {
+	ProductID int64
+	Status    string
+}
+
+type ReviewModel struct {
+	DB *sql.DB
+}
+
+func ValidateReview(v *validator.Validator, review *proto.Review) {
+	v.Check(review.Rating >= 1 && review.Rating <= 5, "rating", "must be between 1 and 5")
+	v.Check(len(review.Title) <= 100, "title", "must not be more than 100 bytes long")
+	v.Check(len(review.Body) <= 5000, "body", "must not be more than 5000 bytes long")
+}
+
+func ValidateReviewStatus(v *validator.Validator, status string) {
+	v.Check(validator.PermittedValue(status, ReviewPending, ReviewApproved, ReviewRejected), "status", "must be pending, approved or rejected")
+}
+
+const reviewColumns = `id, product_id, user_id, rating, title, body, verified, status, created_at, updated_at, version`
+
+// Insert adds a pending review of a product that is not deleted.
+func (m ReviewModel) Insert(review *proto.Review) (*proto.Review, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err = lockProduct(ctx, tx, review.ProductId); err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO reviews (product_id, user_id, rating, title, body)
+			  VALUES ($1, $2, $3, $4, $5)
+			  RETURNING ` + reviewColumns
+
+	args := []any{
+		review.ProductId,
+		review.UserId,
+		review.Rating,
+		review.Title,
+		review.Body,
+	}
+
+	review, err = scanReview(tx.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		return nil, reviewWriteError(err)
+	}
+
+	if err = rateProduct(ctx, tx, nil, review); err != nil {
+		return nil, err
+	}
+
+	err = insertOutbox(ctx, tx, productLog(review.ProductId, "Review has been added to product with id: %d", review.ProductId))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+func (m ReviewModel) Get(productID, id int64) (*proto.Review, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + reviewColumns + `
+			  FROM reviews
+			  WHERE id = $1 AND product_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanReview(m.DB.QueryRowContext(ctx, query, id, productID))
+}
+
+// GetAll lists the reviews matching filter.
+func (m ReviewModel) GetAll(filter ReviewFilter, filters *proto.Filters) ([]*proto.Review, *proto.Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM reviews
+		WHERE ($1::bigint = 0 OR product_id = $1) AND status = $2
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, reviewColumns, sortColumn(filters), sortDirection(filters))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filter.ProductID, filter.Status, limit(filters), offset(filters))
+	if err != nil {
+		return nil, &proto.Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int32 = 0
+	var reviews []*proto.Review
+
+	for rows.Next() {
+		review, err := scanReview(prefixedRow{rows, &totalRecords})
+		if err != nil {
+			return nil, &proto.Metadata{}, err
+		}
+		reviews = append(reviews, review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, &proto.Metadata{}, err
+	}
+	return reviews, calculateMetadata(totalRecords, filters), nil
+}
+
+// Update replaces a review's rating, title and body and puts it back up for
+// moderation.
+func (m ReviewModel) Update(review *proto.Review) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := reviewForUpdate(ctx, tx, review.ProductId, review.Id)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE reviews
+			  SET rating = $1, title = $2, body = $3, status = $4, updated_at = NOW(), version = version + 1
+			  WHERE id = $5
+			  RETURNING ` + reviewColumns
+
+	args := []any{
+		review.Rating,
+		review.Title,
+		review.Body,
+		ReviewPending,
+		review.Id,
+	}
+
+	after, err := scanReview(tx.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		return err
+	}
+
+	if err = rateProduct(ctx, tx, before, after); err != nil {
+		return err
+	}
+
+	err = insertOutbox(ctx, tx, productLog(after.ProductId, "Review %d of product with id %d has been updated", after.Id, after.ProductId))
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	review.UserId = after.UserId
+	review.Verified = after.Verified
+	review.Status = after.Status
+	review.CreatedAt = after.CreatedAt
+	review.UpdatedAt = after.UpdatedAt
+	review.Version = after.Version
+	return nil
+}
+
+// Moderate sets a review's status and, unless verified is nil, whether its
+// author is known to have bought the product.
+func (m ReviewModel) Moderate(productID, id int64, status string, verified *bool) (*proto.Review, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before, err := reviewForUpdate(ctx, tx, productID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE reviews
+			  SET status = $1, verified = coalesce($2, verified), updated_at = NOW(), version = version + 1
+			  WHERE id = $3
+			  RETURNING ` + reviewColumns
+
+	after, err := scanReview(tx.QueryRowContext(ctx, query, status, verified, id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = rateProduct(ctx, tx, before, after); err != nil {
+		return nil, err
+	}
+
+	err = insertOutbox(ctx, tx, productLog(after.ProductId, "Review %d of product with id %d has been %s", after.Id, after.ProductId, after.Status))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+func (m ReviewModel) Delete(productID, id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := reviewForUpdate(ctx, tx, productID, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM reviews WHERE id = $1`, id); err != nil {
+		return err
+	}
+
+	if err = rateProduct(ctx, tx, before, nil); err != nil {
+		return err
+	}
+
+	err = insertOutbox(ctx, tx, productLog(productID, "Review %d has been deleted from product with id: %d", id, productID))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// reviewForUpdate locks a product that is not deleted and then one of its
+// reviews, in the order Insert locks them.
+func reviewForUpdate(ctx context.Context, q querier, productID, id int64) (*proto.Review, error) {
+	if err := lockProduct(ctx, q, productID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + reviewColumns + `
+			  FROM reviews
+			  WHERE id = $1 AND product_id = $2
+			  FOR UPDATE`
+
+	return scanReview(q.QueryRowContext(ctx, query, id, productID))
+}
+
+// rateProduct updates the rating sum and review count of the product a review
+// belongs to for the review changing from before to after. Either may be nil
+// when the review is added or removed. Only approved reviews count.
+func rateProduct(ctx context.Context, q querier, before, after *proto.Review) error {
+	review := after
+	if review == nil {
+		review = before
+	}
+
+	sumBefore, countBefore := ratingOf(before)
+	sumAfter, countAfter := ratingOf(after)
+	if sumAfter == sumBefore && countAfter == countBefore {
+		return nil
+	}
+
+	query := `UPDATE products
+			  SET rating_sum = rating_sum + $1, review_count = review_count + $2
+			  WHERE id = $3`
+
+	_, err := q.ExecContext(ctx, query, sumAfter-sumBefore, countAfter-countBefore, review.ProductId)
+	return err
+}
+
+// ratingOf is what a review adds to its product's rating sum and count.
+func ratingOf(review *proto.Review) (int64, int32) {
+	if review == nil || review.Status != ReviewApproved {
+		return 0, 0
+	}
+	return int64(review.Rating), 1
+}
+
+// prefixedRow reads a leading column into first before the columns scanReview
+// expects, for queries that also select a window count.
+type prefixedRow struct {
+	row   rowScanner
+	first any
+}
+
+func (p prefixedRow) Scan(dest ...any) error {
+	return p.row.Scan(append([]any{p.first}, dest...)...)
+}
+
+// scanReview reads a row of reviewColumns.
+func scanReview(row rowScanner) (*proto.Review, error) {
+	var review proto.Review
+	var createdAt, updatedAt time.Time
+	err := row.Scan(
+		&review.Id,
+		&review.ProductId,
+		&review.UserId,
+		&review.Rating,
+		&review.Title,
+		&review.Body,
+		&review.Verified,
+		&review.Status,
+		&createdAt,
+		&updatedAt,
+		&review.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	review.CreatedAt = timestamppb.New(createdAt)
+	review.UpdatedAt = timestamppb.New(updatedAt)
+
+	return &review, nil
+}
+
+func reviewWriteError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "unique_violation":
+			return ErrDuplicateReview
+		case "foreign_key_violation":
+			return ErrRecordNotFound
+		}
+	}
+	return err
+}
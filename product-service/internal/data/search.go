@@ -0,0 +1,409 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/currency"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"github.com/lib/pq"
+)
+
+// MaxPriceBuckets bounds the number of buckets in the price facet.
+const MaxPriceBuckets = 10
+
+// Facet names, used to leave a facet's own filter out when counting it.
+const (
+	facetNone      = ""
+	facetCategory  = "category"
+	facetAvailable = "is_available"
+	facetPrice     = "price"
+)
+
+// ProductFilter selects the products GetAll and Facets work on. Nil and zero
+// fields do not filter.
+type ProductFilter struct {
+	Name     string
+	Category string
+	// Search matches words in the name and description, see SearchQuery.
+	Search string
+	// Fuzzy matches Search against names by trigram similarity instead, for
+	// when the words themselves find nothing.
+	Fuzzy          bool
+	IncludeDeleted bool
+	// CategoryIDs match products in these categories or below them.
+	CategoryIDs []int64
+	// PriceMin and PriceMax are inclusive bounds in minor units of Currency.
+	PriceMin      *int64
+	PriceMax      *int64
+	Currency      string
+	IsAvailable   *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+// MaxFilterCategories limits how many categories a list can be filtered by.
+const MaxFilterCategories = 50
+
+// MaxSearchLength limits the length of a search term in bytes.
+const MaxSearchLength = 200
+
+// SearchQuery turns a search term into a tsquery matching all of its words,
+// the last one as a prefix so that results narrow while the user types.
+// Anything but letters and digits separates words, so the result is always
+// valid tsquery syntax. It is empty when the term has no words.
+func SearchQuery(term string) string {
+	words := strings.FieldsFunc(term, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	return strings.Join(words, " & ") + ":*"
+}
+
+func ValidateProductFilter(v *validator.Validator, f ProductFilter) {
+	v.Check(f.PriceMin == nil || *f.PriceMin >= 0, "price_min", "must not be negative")
+	v.Check(f.PriceMax == nil || *f.PriceMax >= 0, "price_max", "must not be negative")
+	v.Check(f.PriceMin == nil || f.PriceMax == nil || *f.PriceMin <= *f.PriceMax, "price_max", "must not be less than price_min")
+	v.Check(f.CreatedAfter == nil || f.CreatedBefore == nil || f.CreatedAfter.Before(*f.CreatedBefore), "created_before", "must be later than created_after")
+	v.Check(len(f.Search) <= MaxSearchLength, "search", fmt.Sprintf("must not be more than %d bytes long", MaxSearchLength))
+	v.Check(f.Search == "" || SearchQuery(f.Search) != "", "search", "must contain a letter or digit")
+	v.Check(len(f.CategoryIDs) <= MaxFilterCategories, "category_ids", fmt.Sprintf("must not have more than %d entries", MaxFilterCategories))
+	for _, id := range f.CategoryIDs {
+		v.Check(id > 0, "category_ids", "must be positive")
+	}
+}
+
+func (f ProductFilter) hasPriceBounds() bool {
+	return f.PriceMin != nil || f.PriceMax != nil
+}
+
+// productQuery builds the FROM and WHERE clauses shared by the product list
+// and its facets. Arguments are numbered as they are added, so each query
+// needs its own productQuery.
+type productQuery struct {
+	filter  ProductFilter
+	factors *priceFactors
+	args    []any
+	// Placeholders of the search arguments, added once and shared by the
+	// conditions, the rank and the snippet.
+	tsquery string
+	term    string
+}
+
+func (q *productQuery) arg(value any) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (q *productQuery) searchQuery() string {
+	if q.tsquery == "" {
+		q.tsquery = fmt.Sprintf(`to_tsquery('simple', %s)`, q.arg(SearchQuery(q.filter.Search)))
+	}
+	return q.tsquery
+}
+
+func (q *productQuery) searchTerm() string {
+	if q.term == "" {
+		q.term = q.arg(q.filter.Search)
+	}
+	return q.term
+}
+
+// rank scores how well a product matches the search, higher first.
+func (q *productQuery) rank() string {
+	switch {
+	case q.filter.Search == "":
+		return `0`
+	case q.filter.Fuzzy:
+		return fmt.Sprintf(`word_similarity(%s, p.name)`, q.searchTerm())
+	default:
+		return fmt.Sprintf(`ts_rank(p.search, %s)`, q.searchQuery())
+	}
+}
+
+// escapedDescription is the description escaped as html.EscapeString does,
+// so that the only markup in a snippet is the <mark> tags ts_headline adds.
+const escapedDescription = `replace(replace(replace(replace(replace(p.description, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;')`
+
+// snippet highlights the matched words in the description. Similarity
+// matches have no words to highlight.
+func (q *productQuery) snippet() string {
+	if q.filter.Search == "" || q.filter.Fuzzy {
+		return `''`
+	}
+	return fmt.Sprintf(`ts_headline('simple', %s, %s, 'StartSel=<mark>, StopSel=</mark>, MinWords=10, MaxWords=30')`, escapedDescription, q.searchQuery())
+}
+
+// from joins products (p) with their categories (c) and, when prices have to
+// be compared across currencies, with the conversion factors (f).
+func (q *productQuery) from(withPrice bool) string {
+	from := `products p JOIN categories c ON c.id = p.category_id`
+	if withPrice {
+		from += fmt.Sprintf(`
+		LEFT JOIN unnest(%s::text[], %s::numeric[], %s::numeric[]) AS f(currency, num, den) ON f.currency = p.currency`,
+			q.arg(pq.Array(q.factors.currencies)), q.arg(pq.Array(q.factors.nums)), q.arg(pq.Array(q.factors.dens)))
+	}
+	return from
+}
+
+// where returns the conditions of the filter, leaving out those of the facet
+// skip.
+func (q *productQuery) where(skip string) string {
+	f := q.filter
+	conditions := []string{"true"}
+
+	if !f.IncludeDeleted {
+		conditions = append(conditions, `p.deleted_at IS NULL`)
+	}
+	if f.Name != "" {
+		conditions = append(conditions, fmt.Sprintf(`to_tsvector('simple', p.name) @@ plainto_tsquery('simple', %s)`, q.arg(f.Name)))
+	}
+	if f.Search != "" && f.Fuzzy {
+		conditions = append(conditions, fmt.Sprintf(`%s <%% p.name`, q.searchTerm()))
+	} else if f.Search != "" {
+		conditions = append(conditions, fmt.Sprintf(`p.search @@ %s`, q.searchQuery()))
+	}
+	if f.Category != "" && skip != facetCategory {
+		conditions = append(conditions, fmt.Sprintf(`to_tsvector('simple', c.name) @@ plainto_tsquery('simple', %s)`, q.arg(f.Category)))
+	}
+	if len(f.CategoryIDs) > 0 && skip != facetCategory {
+		conditions = append(conditions, fmt.Sprintf(`p.category_id IN (
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM categories WHERE id = ANY(%s)
+				UNION
+				SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+			)
+			SELECT id FROM subtree)`, q.arg(pq.Array(f.CategoryIDs))))
+	}
+	if f.PriceMin != nil && skip != facetPrice {
+		conditions = append(conditions, fmt.Sprintf(`%s >= %s`, convertedPrice, q.arg(*f.PriceMin)))
+	}
+	if f.PriceMax != nil && skip != facetPrice {
+		conditions = append(conditions, fmt.Sprintf(`%s <= %s`, convertedPrice, q.arg(*f.PriceMax)))
+	}
+	if f.IsAvailable != nil && skip != facetAvailable {
+		conditions = append(conditions, fmt.Sprintf(`p.is_available = %s`, q.arg(*f.IsAvailable)))
+	}
+	if f.CreatedAfter != nil {
+		conditions = append(conditions, fmt.Sprintf(`p.creation_date >= %s`, q.arg(*f.CreatedAfter)))
+	}
+	if f.CreatedBefore != nil {
+		conditions = append(conditions, fmt.Sprintf(`p.creation_date < %s`, q.arg(*f.CreatedBefore)))
+	}
+
+	return strings.Join(conditions, "\n\t\tAND ")
+}
+
+// convertedPrice is a product's price in minor units of the filter currency,
+// or NULL when there is no rate for it.
+const convertedPrice = `round(p.price_minor * f.num / f.den)`
+
+// priceFactors turn minor units of each currency into minor units of the
+// filter currency, as exact fractions so that Postgres does the rounding on
+// numerics.
+type priceFactors struct {
+	currencies []string
+	nums       []string
+	dens       []string
+}
+
+func (p ProductModel) priceFactors(ctx context.Context, target string) (*priceFactors, error) {
+	targetExponent, ok := currency.Exponent(target)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCurrency, target)
+	}
+
+	rates, err := CurrencyModel{DB: p.Replicas.reader(ctx, p.DB)}.RatesTo(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	factors := &priceFactors{}
+	for from, rate := range rates {
+		exponent, ok := currency.Exponent(from)
+		if !ok {
+			continue
+		}
+		factor := new(big.Rat).Mul(rate, new(big.Rat).SetFrac(pow10(targetExponent), pow10(exponent)))
+		factors.currencies = append(factors.currencies, from)
+		factors.nums = append(factors.nums, factor.Num().String())
+		factors.dens = append(factors.dens, factor.Denom().String())
+	}
+	return factors, nil
+}
+
+// newProductQuery loads the conversion factors when the filter compares
+// prices.
+func (p ProductModel) newProductQuery(ctx context.Context, filter ProductFilter, withPrice bool) (*productQuery, error) {
+	q := &productQuery{filter: filter}
+	if withPrice {
+		factors, err := p.priceFactors(ctx, filter.Currency)
+		if err != nil {
+			return nil, err
+		}
+		q.factors = factors
+	}
+	return q, nil
+}
+
+// HasMatches reports whether any product matches filter. It tells whether a
+// search has exact matches before falling back to similarity.
+func (p ProductModel) HasMatches(ctx context.Context, filter ProductFilter) (bool, error) {
+	db := p.Replicas.reader(ctx, p.DB)
+	ctx, op := p.begin(ctx, "ProductModel.HasMatches", p.Timeouts.Read)
+	defer op.end()
+
+	q, err := p.newProductQuery(ctx, filter, filter.hasPriceBounds())
+	if err != nil {
+		return false, err
+	}
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE %s)`, q.from(filter.hasPriceBounds()), q.where(facetNone))
+
+	var exists bool
+	err = db.QueryRowContext(ctx, query, q.args...).Scan(&exists)
+	op.rows = 1
+	return exists, err
+}
+
+// Facets counts the products matching filter per category, per availability
+// and per price bucket, each ignoring the filter's own condition on it.
+func (p ProductModel) Facets(ctx context.Context, filter ProductFilter) (*proto.Facets, error) {
+	db := p.Replicas.reader(ctx, p.DB)
+	ctx, op := p.begin(ctx, "ProductModel.Facets", p.Timeouts.Read)
+	defer op.end()
+
+	facets := &proto.Facets{Currency: filter.Currency}
+
+	q, err := p.newProductQuery(ctx, filter, filter.hasPriceBounds())
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`
+		SELECT c.id, c.name, count(*)
+		FROM %s
+		WHERE %s
+		GROUP BY c.id, c.name
+		ORDER BY c.name, c.id`, q.from(filter.hasPriceBounds()), q.where(facetCategory))
+
+	rows, err := db.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var facet proto.CategoryFacet
+		if err := rows.Scan(&facet.CategoryId, &facet.Name, &facet.Count); err != nil {
+			return nil, err
+		}
+		facets.Categories = append(facets.Categories, &facet)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	q, err = p.newProductQuery(ctx, filter, filter.hasPriceBounds())
+	if err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf(`
+		SELECT count(*) FILTER (WHERE p.is_available), count(*) FILTER (WHERE NOT p.is_available)
+		FROM %s
+		WHERE %s`, q.from(filter.hasPriceBounds()), q.where(facetAvailable))
+
+	err = db.QueryRowContext(ctx, query, q.args...).Scan(&facets.Available, &facets.Unavailable)
+	if err != nil {
+		return nil, err
+	}
+
+	facets.PriceBuckets, err = p.priceBuckets(ctx, db, filter)
+	if err != nil {
+		return nil, err
+	}
+	op.rows = len(facets.Categories) + len(facets.PriceBuckets) + 1
+	return facets, nil
+}
+
+// priceBuckets finds the range of matching prices first, so that the buckets
+// can have a round width that covers it.
+func (p ProductModel) priceBuckets(ctx context.Context, db querier, filter ProductFilter) ([]*proto.PriceBucket, error) {
+	q, err := p.newProductQuery(ctx, filter, true)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`
+		SELECT coalesce(min(%[1]s), 0), coalesce(max(%[1]s), -1)
+		FROM %[2]s
+		WHERE %[3]s AND f.currency IS NOT NULL`, convertedPrice, q.from(true), q.where(facetPrice))
+
+	var lowest, highest int64
+	if err := db.QueryRowContext(ctx, query, q.args...).Scan(&lowest, &highest); err != nil {
+		return nil, err
+	}
+	if highest < lowest {
+		return nil, nil
+	}
+
+	step := priceStep(lowest, highest, MaxPriceBuckets)
+	start := lowest - lowest%step
+
+	q, err = p.newProductQuery(ctx, filter, true)
+	if err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf(`
+		SELECT floor((%[1]s - %[2]s) / %[3]s)::bigint AS bucket, count(*)
+		FROM %[4]s
+		WHERE %[5]s AND f.currency IS NOT NULL
+		GROUP BY bucket`, convertedPrice, q.arg(start), q.arg(step), q.from(true), q.where(facetPrice))
+
+	rows, err := db.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int32)
+	for rows.Next() {
+		var bucket int64
+		var count int32
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, err
+		}
+		counts[bucket] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var buckets []*proto.PriceBucket
+	for i := int64(0); start+i*step <= highest; i++ {
+		buckets = append(buckets, &proto.PriceBucket{
+			MinMinor: start + i*step,
+			MaxMinor: start + (i+1)*step,
+			Count:    counts[i],
+		})
+	}
+	return buckets, nil
+}
+
+// priceStep picks a bucket width of 1, 2 or 5 times a power of ten, the
+// smallest that covers lowest to highest in at most maxBuckets buckets.
+func priceStep(lowest, highest int64, maxBuckets int) int64 {
+	for magnitude := int64(1); ; magnitude *= 10 {
+		for _, multiple := range []int64{1, 2, 5} {
+			step := multiple * magnitude
+			start := lowest - lowest%step
+			if (highest-start)/step < int64(maxBuckets) {
+				return step
+			}
+		}
+	}
+}
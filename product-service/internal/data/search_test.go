@@ -0,0 +1,95 @@
+package data
+
+import (
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"testing"
+	"time"
+)
+
+func TestPriceStep(t *testing.T) {
+	tests := []struct {
+		lowest, highest int64
+		expected        int64
+	}{
+		{0, 0, 1},
+		{0, 9, 1},
+		{0, 10, 2},
+		{150, 980, 100},
+		{120000, 125000, 1000},
+		{99, 101, 1},
+		{0, 1_000_000, 200_000},
+	}
+
+	for _, tt := range tests {
+		step := priceStep(tt.lowest, tt.highest, MaxPriceBuckets)
+		if step != tt.expected {
+			t.Errorf("priceStep(%d, %d) = %d, expected %d", tt.lowest, tt.highest, step, tt.expected)
+		}
+		start := tt.lowest - tt.lowest%step
+		if buckets := (tt.highest-start)/step + 1; buckets > MaxPriceBuckets {
+			t.Errorf("priceStep(%d, %d) needs %d buckets", tt.lowest, tt.highest, buckets)
+		}
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	tests := []struct {
+		term     string
+		expected string
+	}{
+		{"", ""},
+		{"  !? ", ""},
+		{"appl", "appl:*"},
+		{"Red apple", "Red & apple:*"},
+		{"it's 100% (juice)", "it & s & 100 & juice:*"},
+		{"яблоко зел", "яблоко & зел:*"},
+		{"a:* | !b", "a & b:*"},
+	}
+
+	for _, tt := range tests {
+		if query := SearchQuery(tt.term); query != tt.expected {
+			t.Errorf("SearchQuery(%q) = %q, expected %q", tt.term, query, tt.expected)
+		}
+	}
+}
+
+func TestValidateProductFilter(t *testing.T) {
+	low, high := int64(100), int64(50)
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		filter   ProductFilter
+		expected bool
+	}{
+		{"Empty", ProductFilter{}, true},
+		{"Price range", ProductFilter{PriceMin: &high, PriceMax: &low}, true},
+		{"Inverted price range", ProductFilter{PriceMin: &low, PriceMax: &high}, false},
+		{"Date range", ProductFilter{CreatedAfter: &earlier, CreatedBefore: &now}, true},
+		{"Inverted date range", ProductFilter{CreatedAfter: &now, CreatedBefore: &earlier}, false},
+		{"Bad category", ProductFilter{CategoryIDs: []int64{1, 0}}, false},
+		{"Search", ProductFilter{Search: "apple"}, true},
+		{"Search without words", ProductFilter{Search: "%%"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			if ValidateProductFilter(v, tt.filter); v.Valid() != tt.expected {
+				t.Errorf("ValidateProductFilter() valid = %v, expected %v (%v)", v.Valid(), tt.expected, v.Errors)
+			}
+		})
+	}
+}
+
+func TestSnippetEscapesDescription(t *testing.T) {
+	filter := ProductFilter{Search: "fresh"}
+	description := `Fresh <script>alert("x")</script> & 'crisp'`
+
+	got := snippet(filter, description)
+	expected := `<mark>Fresh</mark> &lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; &amp; &#39;crisp&#39;`
+	if got != expected {
+		t.Errorf("snippet(%q) = %q, expected %q", description, got, expected)
+	}
+}
@@ -0,0 +1,576 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"github.com/lib/pq"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	ErrDuplicateSKU     = errors.New("duplicate sku")
+	ErrDuplicateVariant = errors.New("a variant with these options already exists")
+	ErrVariantOptions   = errors.New("variant options do not match the product's options")
+	ErrOptionsInUse     = errors.New("options are still used by variants")
+	ErrCurrencyInUse    = errors.New("variants have prices in the current currency")
+)
+
+// MaxOptions limits how many options a product can vary by.
+const MaxOptions = 5
+
+var skuRX = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+type VariantModel struct {
+	DB *sql.DB
+}
+
+// productOption is the stored form of a proto.ProductOption.
+type productOption struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+func encodeOptions(options []*proto.ProductOption) ([]byte, error) {
+	stored := make([]productOption, 0, len(options))
+	for _, option := range options {
+		stored = append(stored, productOption{Name: option.Name, Values: option.Values})
+	}
+	return json.Marshal(stored)
+}
+
+func decodeOptions(js []byte) ([]*proto.ProductOption, error) {
+	var stored []productOption
+	if err := json.Unmarshal(js, &stored); err != nil {
+		return nil, err
+	}
+	options := make([]*proto.ProductOption, 0, len(stored))
+	for _, option := range stored {
+		options = append(options, &proto.ProductOption{Name: option.Name, Values: option.Values})
+	}
+	return options, nil
+}
+
+func ValidateOptions(v *validator.Validator, options []*proto.ProductOption) {
+	v.Check(len(options) <= MaxOptions, "options", fmt.Sprintf("must not have more than %d options", MaxOptions))
+
+	names := make(map[string]bool, len(options))
+	for _, option := range options {
+		v.Check(option.Name != "", "options", "must all have a name")
+		v.Check(len(option.Name) <= 30, "options", "must have names of at most 30 bytes")
+		v.Check(!names[option.Name], "options", "must have unique names")
+		names[option.Name] = true
+
+		v.Check(len(option.Values) > 0, "options", "must each have at least one value")
+		values := make(map[string]bool, len(option.Values))
+		for _, value := range option.Values {
+			v.Check(value != "", "options", "must not have empty values")
+			v.Check(len(value) <= 30, "options", "must have values of at most 30 bytes")
+			v.Check(!values[value], "options", "must not repeat a value")
+			values[value] = true
+		}
+	}
+}
+
+// ValidateVariant checks a variant against the options of its product.
+func ValidateVariant(v *validator.Validator, variant *proto.ProductVariant, options []*proto.ProductOption) {
+	v.Check(variant.Sku != "", "sku", "must be provided")
+	v.Check(len(variant.Sku) <= 64, "sku", "must not be more than 64 bytes long")
+	v.Check(variant.Sku == "" || skuRX.MatchString(variant.Sku), "sku", "must be letters, digits, dots, hyphens and underscores")
+	v.Check(variant.PriceMinor == nil || *variant.PriceMinor >= 0, "price", "must not be negative")
+	v.Check(variant.Quantity >= 0, "quantity", "must not be negative")
+
+	if len(options) == 0 {
+		v.AddError("options", "the product has no options to vary by")
+		return
+	}
+	if problem := optionsMismatch(variant.Options, options); problem != "" {
+		v.AddError("options", problem)
+	}
+}
+
+// optionsMismatch describes why selection does not pick exactly one allowed
+// value for every option, or returns "" when it does.
+func optionsMismatch(selection map[string]string, options []*proto.ProductOption) string {
+	for _, option := range options {
+		value, ok := selection[option.Name]
+		if !ok {
+			return fmt.Sprintf("must have a value for %s", option.Name)
+		}
+		if !validator.PermittedValue(value, option.Values...) {
+			return fmt.Sprintf("%s must be one of the product's values for it", option.Name)
+		}
+	}
+	if len(selection) != len(options) {
+		return "must only use the product's options"
+	}
+	return ""
+}
+
+// variantFields returns the fields of a variant recorded in the product's
+// audit history, keyed so that changes to different variants stay apart.
+func variantFields(variant *proto.ProductVariant) map[string]any {
+	if variant == nil {
+		return map[string]any{}
+	}
+	options, _ := json.Marshal(variant.Options)
+	prefix := fmt.Sprintf("variants.%d.", variant.Id)
+
+	fields := map[string]any{
+		prefix + "sku":      variant.Sku,
+		prefix + "options":  string(options),
+		prefix + "quantity": variant.Quantity,
+	}
+	if variant.PriceMinor != nil {
+		fields[prefix+"price_minor"] = *variant.PriceMinor
+	}
+	return fields
+}
+
+func diffVariants(before, after *proto.ProductVariant) map[string]FieldChange {
+	return diffFields(variantFields(before), variantFields(after))
+}
+
+func (m VariantModel) Insert(variant *proto.ProductVariant, actor string) (*proto.ProductVariant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err = checkVariantOptions(ctx, tx, variant); err != nil {
+		return nil, err
+	}
+
+	product, err := eventState(ctx, tx, variant.ProductId)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := json.Marshal(variant.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO product_variants (product_id, sku, options, price_minor, quantity)
+			  VALUES ($1, $2, $3, $4, $5)
+			  RETURNING id, created_at, version`
+
+	args := []any{
+		variant.ProductId,
+		variant.Sku,
+		options,
+		nullablePrice(variant.PriceMinor),
+		variant.Quantity,
+	}
+
+	var createdAt time.Time
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&variant.Id, &createdAt, &variant.Version)
+	if err != nil {
+		return nil, variantWriteError(err)
+	}
+	variant.CreatedAt = timestamppb.New(createdAt)
+	variant.IsAvailable = variant.Quantity > 0
+
+	var movement *proto.StockMovement
+	if variant.Quantity != 0 {
+		movement = &proto.StockMovement{
+			ProductId: variant.ProductId,
+			VariantId: variant.Id,
+			Delta:     variant.Quantity,
+			Reason:    MovementReasonInitial,
+			Actor:     actor,
+			Balance:   variant.Quantity,
+		}
+		if err = insertMovement(ctx, tx, movement); err != nil {
+			return nil, err
+		}
+	}
+
+	err = touchProduct(ctx, tx, variant.ProductId, AuditActionAddVariant, actor, diffVariants(nil, variant))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = variantEvents(ctx, tx, product, movement, actor); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return variant, nil
+}
+
+// Update replaces the sku, options, price and quantity of a variant.
+func (m VariantModel) Update(variant *proto.ProductVariant, actor string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkVariantOptions(ctx, tx, variant); err != nil {
+		return err
+	}
+
+	product, err := eventState(ctx, tx, variant.ProductId)
+	if err != nil {
+		return err
+	}
+
+	before, err := scanVariant(tx.QueryRowContext(ctx, `
+		SELECT `+variantColumns+`
+		FROM product_variants
+		WHERE id = $1 AND product_id = $2
+		FOR UPDATE`, variant.Id, variant.ProductId))
+	if err != nil {
+		return err
+	}
+
+	options, err := json.Marshal(variant.Options)
+	if err != nil {
+		return err
+	}
+
+	// Like a product's, a variant's stock only changes through AdjustStock
+	// and reservations.
+	query := `UPDATE product_variants
+			  SET sku = $1, options = $2, price_minor = $3, version = version + 1
+			  WHERE id = $4
+			  RETURNING quantity, created_at, version`
+
+	args := []any{
+		variant.Sku,
+		options,
+		nullablePrice(variant.PriceMinor),
+		variant.Id,
+	}
+
+	var createdAt time.Time
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&variant.Quantity, &createdAt, &variant.Version)
+	if err != nil {
+		return variantWriteError(err)
+	}
+	variant.CreatedAt = timestamppb.New(createdAt)
+	variant.IsAvailable = variant.Quantity > 0
+
+	err = touchProduct(ctx, tx, variant.ProductId, AuditActionUpdateVariant, actor, diffVariants(before, variant))
+	if err != nil {
+		return err
+	}
+
+	if err = variantEvents(ctx, tx, product, nil, actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m VariantModel) Delete(productID, variantID int64, actor string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = lockProduct(ctx, tx, productID); err != nil {
+		return err
+	}
+
+	product, err := eventState(ctx, tx, productID)
+	if err != nil {
+		return err
+	}
+
+	query := `DELETE FROM product_variants
+			  WHERE id = $1 AND product_id = $2
+			  RETURNING ` + variantColumns
+
+	before, err := scanVariant(tx.QueryRowContext(ctx, query, variantID, productID))
+	if err != nil {
+		return err
+	}
+
+	err = touchProduct(ctx, tx, productID, AuditActionDeleteVariant, actor, diffVariants(before, nil))
+	if err != nil {
+		return err
+	}
+
+	if err = variantEvents(ctx, tx, product, nil, actor); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m VariantModel) GetForProduct(productID int64) ([]*proto.ProductVariant, error) {
+	variants, err := m.GetForProducts([]int64{productID})
+	if err != nil {
+		return nil, err
+	}
+	return variants[productID], nil
+}
+
+// GetForProducts loads the variants of several products at once, each list
+// ordered by id.
+func (m VariantModel) GetForProducts(productIDs []int64) (map[int64][]*proto.ProductVariant, error) {
+	variants := make(map[int64][]*proto.ProductVariant)
+	if len(productIDs) == 0 {
+		return variants, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + variantColumns + `
+			  FROM product_variants
+			  WHERE product_id = ANY($1)
+			  ORDER BY product_id, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		variant, err := scanVariant(rows)
+		if err != nil {
+			return nil, err
+		}
+		variants[variant.ProductId] = append(variants[variant.ProductId], variant)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return variants, nil
+}
+
+// adjustVariantQuantity is adjustQuantity for a variant's stock. The product
+// is locked first, in the same order as the other variant writes; like
+// adjustQuantity, it finds deleted products so their reservations can still
+// be released.
+func adjustVariantQuantity(ctx context.Context, q querier, productID, variantID int64, delta int32, action, reason, actor string) (*proto.StockMovement, error) {
+	before, err := lockedProduct(ctx, q, productID, true)
+	if err != nil {
+		return nil, err
+	}
+	if err = withVariants(ctx, q, before); err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE product_variants
+			  SET quantity = quantity + $3, version = version + 1
+			  WHERE id = $1 AND product_id = $2 AND quantity + $3 >= 0
+			  RETURNING quantity`
+
+	var quantity int32
+	err = q.QueryRowContext(ctx, query, variantID, productID, delta).Scan(&quantity)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		var exists bool
+		err = q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM product_variants WHERE id = $1 AND product_id = $2)`, variantID, productID).Scan(&exists)
+		switch {
+		case err != nil:
+			return nil, err
+		case !exists:
+			return nil, ErrRecordNotFound
+		default:
+			return nil, ErrInsufficientStock
+		}
+	}
+
+	changes := map[string]FieldChange{
+		fmt.Sprintf("variants.%d.quantity", variantID): {Old: quantity - delta, New: quantity},
+	}
+	if err = touchProduct(ctx, q, productID, action, actor, changes); err != nil {
+		return nil, err
+	}
+
+	movement := &proto.StockMovement{
+		ProductId: productID,
+		VariantId: variantID,
+		Delta:     delta,
+		Reason:    reason,
+		Actor:     actor,
+		Balance:   quantity,
+	}
+	if err = insertMovement(ctx, q, movement); err != nil {
+		return nil, err
+	}
+
+	after, err := eventState(ctx, q, productID)
+	if err != nil {
+		return nil, err
+	}
+	if err = stockChanged(ctx, q, movement, before, after, actor); err != nil {
+		return nil, err
+	}
+	return movement, nil
+}
+
+// checkVariantOptions locks the variant's product and checks the variant
+// against the product's current options, which may have changed since the
+// caller validated it.
+func checkVariantOptions(ctx context.Context, q querier, variant *proto.ProductVariant) error {
+	var js []byte
+	err := q.QueryRowContext(ctx, `SELECT options FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, variant.ProductId).Scan(&js)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	options, err := decodeOptions(js)
+	if err != nil {
+		return err
+	}
+	if len(options) == 0 || optionsMismatch(variant.Options, options) != "" {
+		return ErrVariantOptions
+	}
+	return nil
+}
+
+// checkProductVariants rejects a product update that would leave its variants
+// choosing options the product no longer has, or reinterpret their prices in
+// a different currency.
+func checkProductVariants(ctx context.Context, q querier, before, after *proto.Product) error {
+	rows, err := q.QueryContext(ctx, `SELECT `+variantColumns+` FROM product_variants WHERE product_id = $1`, after.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		variant, err := scanVariant(rows)
+		if err != nil {
+			return err
+		}
+		if optionsMismatch(variant.Options, after.Options) != "" {
+			return ErrOptionsInUse
+		}
+		if variant.PriceMinor != nil && before.Currency != after.Currency {
+			return ErrCurrencyInUse
+		}
+	}
+	return rows.Err()
+}
+
+// variantEvents publishes the change a variant write made to its product,
+// given the product's state from before the write, and the stock movement
+// if the write made one.
+func variantEvents(ctx context.Context, q querier, before *proto.Product, movement *proto.StockMovement, actor string) error {
+	after, err := eventState(ctx, q, before.Id)
+	if err != nil {
+		return err
+	}
+	if err = productUpdated(ctx, q, before, after, actor); err != nil {
+		return err
+	}
+	if movement != nil {
+		return stockChanged(ctx, q, movement, before, after, actor)
+	}
+	return nil
+}
+
+// touchProduct records a change to a product's variants: it recomputes the
+// product's availability, bumps its version and writes the audit entry.
+func touchProduct(ctx context.Context, q querier, productID int64, action, actor string, changes map[string]FieldChange) error {
+	query := `UPDATE products
+			  SET is_available = quantity > 0 OR ` + variantStockExpr + `, version = version + 1
+			  WHERE id = $1
+			  RETURNING version`
+
+	var version int32
+	err := q.QueryRowContext(ctx, query, productID).Scan(&version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	return insertAudit(ctx, q, productID, action, actor, version, changes)
+}
+
+// variantStockExpr is true when any variant of the product being updated has
+// stock. A product is available when it or one of its variants has stock.
+const variantStockExpr = `EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = products.id AND v.quantity > 0)`
+
+const variantColumns = `id, product_id, sku, options, price_minor, quantity, created_at, version`
+
+func scanVariant(row rowScanner) (*proto.ProductVariant, error) {
+	var variant proto.ProductVariant
+	var options []byte
+	var price sql.NullInt64
+	var createdAt time.Time
+	err := row.Scan(
+		&variant.Id,
+		&variant.ProductId,
+		&variant.Sku,
+		&options,
+		&price,
+		&variant.Quantity,
+		&createdAt,
+		&variant.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if err = json.Unmarshal(options, &variant.Options); err != nil {
+		return nil, err
+	}
+	if price.Valid {
+		variant.PriceMinor = &price.Int64
+	}
+	variant.IsAvailable = variant.Quantity > 0
+	variant.CreatedAt = timestamppb.New(createdAt)
+	return &variant, nil
+}
+
+func nullablePrice(price *int64) sql.NullInt64 {
+	if price == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *price, Valid: true}
+}
+
+// variantWriteError reports a taken SKU as ErrDuplicateSKU and a second
+// variant with the same options as ErrDuplicateVariant.
+func variantWriteError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+		if pqErr.Constraint == "product_variants_sku_key" {
+			return ErrDuplicateSKU
+		}
+		return ErrDuplicateVariant
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"testing"
+)
+
+func TestValidateOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []*proto.ProductOption
+		expected bool
+	}{
+		{"No options", nil, true},
+		{"Size and color", []*proto.ProductOption{
+			{Name: "size", Values: []string{"S", "M", "L"}},
+			{Name: "color", Values: []string{"red", "blue"}},
+		}, true},
+		{"Duplicate name", []*proto.ProductOption{
+			{Name: "size", Values: []string{"S"}},
+			{Name: "size", Values: []string{"M"}},
+		}, false},
+		{"No values", []*proto.ProductOption{{Name: "size"}}, false},
+		{"Repeated value", []*proto.ProductOption{{Name: "size", Values: []string{"S", "S"}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			if ValidateOptions(v, tt.options); v.Valid() != tt.expected {
+				t.Errorf("ValidateOptions() valid = %v, expected %v (%v)", v.Valid(), tt.expected, v.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateVariant(t *testing.T) {
+	options := []*proto.ProductOption{
+		{Name: "size", Values: []string{"S", "M", "L"}},
+		{Name: "color", Values: []string{"red", "blue"}},
+	}
+	negative := int64(-1)
+
+	tests := []struct {
+		name     string
+		variant  *proto.ProductVariant
+		options  []*proto.ProductOption
+		expected bool
+	}{
+		{"Valid", &proto.ProductVariant{Sku: "TS-RED-M", Options: map[string]string{"size": "M", "color": "red"}}, options, true},
+		{"Missing option", &proto.ProductVariant{Sku: "TS-M", Options: map[string]string{"size": "M"}}, options, false},
+		{"Unknown value", &proto.ProductVariant{Sku: "TS-XL", Options: map[string]string{"size": "XL", "color": "red"}}, options, false},
+		{"Extra option", &proto.ProductVariant{Sku: "TS", Options: map[string]string{"size": "M", "color": "red", "fit": "slim"}}, options, false},
+		{"Bad SKU", &proto.ProductVariant{Sku: "TS RED", Options: map[string]string{"size": "M", "color": "red"}}, options, false},
+		{"Negative price", &proto.ProductVariant{Sku: "TS", PriceMinor: &negative, Options: map[string]string{"size": "M", "color": "red"}}, options, false},
+		{"Product without options", &proto.ProductVariant{Sku: "TS"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			if ValidateVariant(v, tt.variant, tt.options); v.Valid() != tt.expected {
+				t.Errorf("ValidateVariant() valid = %v, expected %v (%v)", v.Valid(), tt.expected, v.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+// Package images validates uploaded product images and renders their
+// thumbnails.
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// AllowedTypes are the content types accepted for upload, keyed to the file
+// extension the original is stored with.
+var AllowedTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/webp": "webp",
+}
+
+// ThumbnailSizes maps each thumbnail name to the longest side it is scaled
+// to fit within. Images smaller than a size are not scaled up.
+var ThumbnailSizes = map[string]int{
+	"small":  160,
+	"medium": 480,
+	"large":  1024,
+}
+
+// MaxPixels bounds the decoded size of an upload, so that a small file that
+// declares huge dimensions cannot exhaust memory.
+const MaxPixels = 50_000_000
+
+var (
+	ErrUnsupportedType = errors.New("unsupported image type")
+	ErrTooLarge        = errors.New("image dimensions are too large")
+)
+
+type Thumbnail struct {
+	Data        []byte
+	ContentType string
+	Extension   string
+}
+
+type Image struct {
+	ContentType string
+	Extension   string
+	Width       int
+	Height      int
+	Thumbnails  map[string]Thumbnail
+}
+
+// Process checks that data is an image of an allowed type and renders its
+// thumbnails. The content type is sniffed from the data rather than trusted
+// from the client.
+func Process(data []byte) (*Image, error) {
+	contentType := http.DetectContentType(data)
+	extension, ok := AllowedTypes[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, contentType)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedType, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedType, err)
+	}
+
+	img := &Image{
+		ContentType: contentType,
+		Extension:   extension,
+		Width:       config.Width,
+		Height:      config.Height,
+		Thumbnails:  make(map[string]Thumbnail, len(ThumbnailSizes)),
+	}
+
+	for name, size := range ThumbnailSizes {
+		thumbnail, err := render(src, size, contentType == "image/png")
+		if err != nil {
+			return nil, err
+		}
+		img.Thumbnails[name] = thumbnail
+	}
+
+	return img, nil
+}
+
+// render scales src to fit within size and encodes it. PNG sources stay PNG
+// to keep their transparency; everything else becomes JPEG.
+func render(src image.Image, size int, keepPNG bool) (Thumbnail, error) {
+	width, height := Fit(src.Bounds().Dx(), src.Bounds().Dy(), size)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	var buf bytes.Buffer
+	if keepPNG {
+		if err := png.Encode(&buf, dst); err != nil {
+			return Thumbnail{}, err
+		}
+		return Thumbnail{Data: buf.Bytes(), ContentType: "image/png", Extension: "png"}, nil
+	}
+
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return Thumbnail{}, err
+	}
+	return Thumbnail{Data: buf.Bytes(), ContentType: "image/jpeg", Extension: "jpg"}, nil
+}
+
+// Fit scales width and height down, keeping their ratio, until neither
+// exceeds size.
+func Fit(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
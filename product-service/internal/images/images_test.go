@@ -0,0 +1,78 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		width, height, size  int
+		expectedW, expectedH int
+	}{
+		{2000, 1000, 160, 160, 80},
+		{1000, 2000, 160, 80, 160},
+		{100, 50, 160, 100, 50},
+		{5000, 1, 160, 160, 1},
+	}
+
+	for _, tt := range tests {
+		w, h := Fit(tt.width, tt.height, tt.size)
+		if w != tt.expectedW || h != tt.expectedH {
+			t.Errorf("Fit(%d, %d, %d) = %d, %d, expected %d, %d", tt.width, tt.height, tt.size, w, h, tt.expectedW, tt.expectedH)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 1200, 600))
+	for x := 0; x < 1200; x++ {
+		src.Set(x, x%600, color.RGBA{R: 255, A: 255})
+	}
+
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := Process(jpg.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.ContentType != "image/jpeg" || img.Width != 1200 || img.Height != 600 {
+		t.Errorf("Process() = %s %dx%d, expected image/jpeg 1200x600", img.ContentType, img.Width, img.Height)
+	}
+	if len(img.Thumbnails) != len(ThumbnailSizes) {
+		t.Fatalf("Process() rendered %d thumbnails, expected %d", len(img.Thumbnails), len(ThumbnailSizes))
+	}
+
+	small, _, err := image.DecodeConfig(bytes.NewReader(img.Thumbnails["small"].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.Width != 160 || small.Height != 80 {
+		t.Errorf("small thumbnail is %dx%d, expected 160x80", small.Width, small.Height)
+	}
+
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, src); err != nil {
+		t.Fatal(err)
+	}
+	img, err = Process(pngBuf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Thumbnails["small"].ContentType != "image/png" {
+		t.Errorf("PNG thumbnail has content type %s, expected image/png", img.Thumbnails["small"].ContentType)
+	}
+
+	_, err = Process([]byte("GIF89a not really"))
+	if !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Process(gif) = %v, expected ErrUnsupportedType", err)
+	}
+}
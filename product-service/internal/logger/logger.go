@@ -2,25 +2,54 @@ package logger
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/Skaifai/gophers-microservice/product-service/config"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
 	"time"
 )
 
+// ErrPublisherClosed is returned by publishes started after Close.
+var ErrPublisherClosed = errors.New("publisher is closed")
+
 type Publisher struct {
 	Conn    *amqp.Connection
 	Channel *amqp.Channel
+	// inFlight tracks publishes that have started, so Close can let them
+	// finish before tearing down the channel.
+	inFlight sync.WaitGroup
+	// mu guards Conn, Channel and closed. Conn and Channel are replaced when
+	// the connection to the broker is lost; once closed is set no publish
+	// starts and the connection is never dialled again.
+	mu     sync.Mutex
+	closed bool
 }
 
 func NewPublisher() (*Publisher, error) {
-	conn, err := amqp.Dial(config.GetEnvironmentVar("RMQ_DSN"))
+	conn, ch, err := dial()
 	if err != nil {
 		return nil, err
 	}
 
+	return &Publisher{
+		Conn:    conn,
+		Channel: ch,
+	}, nil
+}
+
+// dial connects to the broker and opens a channel in confirm mode, so that
+// Publish can tell when the broker has taken a message.
+func dial() (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(config.GetEnvironmentVar("RMQ_DSN"))
+	if err != nil {
+		return nil, nil, err
+	}
+
 	ch, err := conn.Channel()
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, nil, err
 	}
 
 	err = ch.ExchangeDeclare(
@@ -32,21 +61,130 @@ func NewPublisher() (*Publisher, error) {
 		false,
 		nil,
 	)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// Product events are routed by product.<event>.<category slug>, so
+	// consumers can bind to just the events or categories they need.
+	err = ch.ExchangeDeclare(
+		"products",
+		"topic",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// Cache invalidations go to every replica of the service.
+	err = ch.ExchangeDeclare(
+		"product-cache",
+		"fanout",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, ch, nil
+}
+
+// begin starts a publish, which must call p.inFlight.Done when it ends, and
+// returns the channel to publish on. Counting the publish under mu, where
+// Close sets closed, means Close never waits while a publish is being added.
+func (p *Publisher) begin() (*amqp.Channel, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrPublisherClosed
+	}
+	ch, err := p.channel()
 	if err != nil {
 		return nil, err
 	}
+	p.inFlight.Add(1)
+	return ch, nil
+}
 
-	return &Publisher{
-		Conn:    conn,
-		Channel: ch,
-	}, nil
+// channel returns the current channel, reconnecting first if the broker
+// closed it. The caller holds mu.
+func (p *Publisher) channel() (*amqp.Channel, error) {
+	if !p.Channel.IsClosed() {
+		return p.Channel, nil
+	}
+
+	if !p.Conn.IsClosed() {
+		p.Conn.Close()
+	}
+	conn, ch, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	p.Conn, p.Channel = conn, ch
+	return ch, nil
+}
+
+// Publish sends a persistent message and waits until the broker confirms it,
+// so that a nil error means the message will not be lost.
+func (p *Publisher) Publish(ctx context.Context, exchange, routingKey, contentType string, body []byte) error {
+	ch, err := p.begin()
+	if err != nil {
+		return err
+	}
+	defer p.inFlight.Done()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange,
+		routingKey,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  contentType,
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("message was rejected by the broker")
+	}
+	return nil
 }
 
 func (p *Publisher) SendLog(message string) error {
+	ch, err := p.begin()
+	if err != nil {
+		return err
+	}
+	defer p.inFlight.Done()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := p.Channel.PublishWithContext(ctx,
+	err = ch.PublishWithContext(ctx,
 		"logs",   // exchange
 		"logger", // routing key
 		false,    // mandatory
@@ -62,10 +200,39 @@ func (p *Publisher) SendLog(message string) error {
 	return nil
 }
 
-func (p *Publisher) Close() error {
-	err := p.Channel.Close()
-	if err != nil {
-		return err
+// Close stops new publishes, waits for in-flight ones to finish, or for ctx
+// to be done, and then closes the channel and the connection. Publishes still
+// running when ctx is done fail as the channel closes under them.
+func (p *Publisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("publisher not drained: %v", ctx.Err())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.Channel.IsClosed() {
+		if closeErr := p.Channel.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if !p.Conn.IsClosed() {
+		if closeErr := p.Conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
 	}
-	return p.Conn.Close()
+	return err
 }
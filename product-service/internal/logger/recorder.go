@@ -0,0 +1,78 @@
+package logger
+
+import (
+	"context"
+	"sync"
+)
+
+// EventPublisher is what the server and the outbox relay need from a
+// publisher. Publisher sends to RabbitMQ; Recorder keeps what it is given.
+type EventPublisher interface {
+	Publish(ctx context.Context, exchange, routingKey, contentType string, body []byte) error
+	SendLog(message string) error
+}
+
+var (
+	_ EventPublisher = (*Publisher)(nil)
+	_ EventPublisher = (*Recorder)(nil)
+)
+
+// Message is a message Recorder was asked to publish.
+type Message struct {
+	Exchange    string
+	RoutingKey  string
+	ContentType string
+	Body        []byte
+}
+
+// Recorder is an EventPublisher for tests. It records every message instead
+// of sending it, and fails with Err when that is set.
+type Recorder struct {
+	mu       sync.Mutex
+	messages []Message
+	logs     []string
+	Err      error
+}
+
+func (r *Recorder) Publish(ctx context.Context, exchange, routingKey, contentType string, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Err != nil {
+		return r.Err
+	}
+	r.messages = append(r.messages, Message{
+		Exchange:    exchange,
+		RoutingKey:  routingKey,
+		ContentType: contentType,
+		Body:        append([]byte(nil), body...),
+	})
+	return nil
+}
+
+func (r *Recorder) SendLog(message string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Err != nil {
+		return r.Err
+	}
+	r.logs = append(r.logs, message)
+	return nil
+}
+
+// Messages returns the messages published so far.
+func (r *Recorder) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Message(nil), r.messages...)
+}
+
+// Logs returns the log lines sent so far.
+func (r *Recorder) Logs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.logs...)
+}
@@ -0,0 +1,203 @@
+package outbox
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Product events are stored in the outbox as protobuf and, with
+// EncodingJSON, converted to JSON as they are published.
+const (
+	EncodingProtobuf = "protobuf"
+	EncodingJSON     = "json"
+)
+
+// Metrics are published under "outbox" in expvar. Published and failed count
+// publish attempts since start; a message that fails and is then published
+// counts in both, and one published again after a crash counts twice.
+var (
+	metrics          = expvar.NewMap("outbox")
+	publishedTotal   = new(expvar.Int)
+	failedTotal      = new(expvar.Int)
+	pendingMessages  = new(expvar.Int)
+	oldestPendingAge = new(expvar.Float)
+)
+
+func init() {
+	metrics.Set("published_total", publishedTotal)
+	metrics.Set("failed_total", failedTotal)
+	metrics.Set("pending", pendingMessages)
+	metrics.Set("oldest_pending_seconds", oldestPendingAge)
+}
+
+// Publisher sends a message and returns once the broker has taken it.
+type Publisher interface {
+	Publish(ctx context.Context, exchange, routingKey, contentType string, body []byte) error
+}
+
+// Store is the outbox table as the relay sees it. data.OutboxModel
+// implements it.
+type Store interface {
+	Claim(limit int, lease time.Duration) ([]*data.OutboxMessage, error)
+	Published(id int64) error
+	Failed(id int64, retryIn time.Duration, cause error) error
+	Release(ids []int64) error
+	Backlog() (int64, time.Duration, error)
+}
+
+const (
+	// claimLease is how long a claimed batch belongs to the relay. A relay
+	// that dies holding a claim delays those products by at most this long.
+	claimLease = time.Minute
+	// publishTimeout bounds one publish, so that a relay never starts a
+	// publish it cannot finish before its claim runs out.
+	publishTimeout = 5 * time.Second
+)
+
+// Relay moves messages from the outbox table to the broker. Any number of
+// relays may run against one database; each publishes the messages it has
+// claimed, and a product's messages are only ever claimed by one at a time.
+type Relay struct {
+	Outbox    Store
+	Publisher Publisher
+	// Interval is how long the relay sleeps once the outbox is drained.
+	Interval  time.Duration
+	BatchSize int
+	// Encoding is EncodingProtobuf or EncodingJSON.
+	Encoding string
+}
+
+// Run relays messages until ctx is done.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for ctx.Err() == nil {
+			claimed, err := r.relayBatch(ctx)
+			if err != nil {
+				log.Printf("failed to relay outbox: %v", err)
+				break
+			}
+			if claimed < r.BatchSize {
+				break
+			}
+		}
+
+		r.updateBacklog()
+	}
+}
+
+// relayBatch claims a batch of messages and publishes them in order, recording
+// each result as soon as it is known. Once a product's message fails, the
+// product's later messages in the batch are released untried so that they
+// stay behind it. It returns how many messages were claimed.
+//
+// If recording a result fails, relayBatch gives up on the rest of the batch
+// and leaves it claimed; the claims run out and the messages are relayed
+// again, in order, so at worst a message is published twice.
+func (r *Relay) relayBatch(ctx context.Context) (int, error) {
+	messages, err := r.Outbox.Claim(r.BatchSize, claimLease)
+	if err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(claimLease - publishTimeout)
+
+	var release []int64
+	blocked := make(map[int64]bool)
+	failed := 0
+	for _, message := range messages {
+		if blocked[message.AggregateID] || ctx.Err() != nil || time.Now().After(deadline) {
+			release = append(release, message.ID)
+			continue
+		}
+
+		if err := r.publish(message); err != nil {
+			failed++
+			failedTotal.Add(1)
+			blocked[message.AggregateID] = true
+			if err := r.Outbox.Failed(message.ID, Backoff(message.Attempts+1), err); err != nil {
+				return len(messages), err
+			}
+			continue
+		}
+
+		publishedTotal.Add(1)
+		if err := r.Outbox.Published(message.ID); err != nil {
+			return len(messages), err
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("failed to publish %d outbox messages, will retry", failed)
+	}
+	if err := r.Outbox.Release(release); err != nil {
+		return len(messages), err
+	}
+	return len(messages), nil
+}
+
+func (r *Relay) publish(message *data.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	contentType, body, err := r.encode(message)
+	if err != nil {
+		return err
+	}
+	return r.Publisher.Publish(ctx, message.Exchange, message.RoutingKey, contentType, body)
+}
+
+// encode returns the content type and body a message is published with.
+// Only product events are converted; other messages go out as stored.
+func (r *Relay) encode(message *data.OutboxMessage) (string, []byte, error) {
+	if r.Encoding != EncodingJSON || message.ContentType != data.EventContentType {
+		return message.ContentType, message.Payload, nil
+	}
+
+	event := new(proto.ProductEvent)
+	if err := protobuf.Unmarshal(message.Payload, event); err != nil {
+		return "", nil, err
+	}
+	body, err := protojson.Marshal(event)
+	if err != nil {
+		return "", nil, err
+	}
+	return "application/json", body, nil
+}
+
+func (r *Relay) updateBacklog() {
+	pending, age, err := r.Outbox.Backlog()
+	if err != nil {
+		log.Printf("failed to measure outbox backlog: %v", err)
+		return
+	}
+	pendingMessages.Set(pending)
+	oldestPendingAge.Set(age.Seconds())
+}
+
+// Backoff doubles the wait after each failed attempt, from one second up to
+// five minutes.
+func Backoff(attempts int32) time.Duration {
+	const maxBackoff = 5 * time.Minute
+	if attempts < 1 {
+		return time.Second
+	}
+	if attempts > 9 {
+		return maxBackoff
+	}
+	return time.Second << (attempts - 1)
+}
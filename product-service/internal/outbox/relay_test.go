@@ -0,0 +1,259 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int32
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{5, 16 * time.Second},
+		{9, 256 * time.Second},
+		{10, 5 * time.Minute},
+		{1000, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if backoff := Backoff(tt.attempts); backoff != tt.expected {
+			t.Errorf("Backoff(%d) = %v, expected %v", tt.attempts, backoff, tt.expected)
+		}
+	}
+}
+
+func TestRelayEncode(t *testing.T) {
+	event := &proto.ProductEvent{
+		SchemaVersion: data.EventSchemaVersion,
+		EventId:       "0b0e4f4c-6a47-4f57-9b1e-6c1a1d0d2b8e",
+		Event: &proto.ProductEvent_ProductDeleted{
+			ProductDeleted: &proto.ProductDeleted{Before: &proto.Product{Id: 5, Name: "Apple"}},
+		},
+	}
+	payload, err := protobuf.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := &data.OutboxMessage{ContentType: data.EventContentType, Payload: payload}
+
+	relay := &Relay{Encoding: EncodingProtobuf}
+	contentType, body, err := relay.encode(message)
+	if err != nil || contentType != data.EventContentType || !bytes.Equal(body, payload) {
+		t.Errorf("protobuf encoding changed the message: %q, %v", contentType, err)
+	}
+
+	relay.Encoding = EncodingJSON
+	contentType, body, err = relay.encode(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("content type is %q, expected application/json", contentType)
+	}
+	decoded := new(proto.ProductEvent)
+	if err = protojson.Unmarshal(body, decoded); err != nil {
+		t.Fatalf("body is not a JSON event: %v", err)
+	}
+	if !protobuf.Equal(decoded, event) {
+		t.Errorf("decoded event is %v, expected %v", decoded, event)
+	}
+
+	log := &data.OutboxMessage{ContentType: "text/plain", Payload: []byte("hello")}
+	contentType, body, err = relay.encode(log)
+	if err != nil || contentType != "text/plain" || string(body) != "hello" {
+		t.Errorf("log message was converted: %q %q %v", contentType, body, err)
+	}
+}
+
+// fakeStore keeps the outbox in memory and claims the way OutboxModel does.
+// Each message's payload is its ID.
+type fakeStore struct {
+	now      time.Time
+	rows     map[int64]*fakeRow
+	retries  []time.Duration
+	released int
+}
+
+type fakeRow struct {
+	message      *data.OutboxMessage
+	nextAttempt  time.Time
+	claimedUntil time.Time
+}
+
+func newFakeStore(aggregates ...int64) *fakeStore {
+	store := &fakeStore{now: time.Now(), rows: make(map[int64]*fakeRow)}
+	for i, aggregate := range aggregates {
+		id := int64(i + 1)
+		store.rows[id] = &fakeRow{message: &data.OutboxMessage{ID: id, AggregateID: aggregate, ContentType: "text/plain", Payload: []byte{byte(id)}}}
+	}
+	return store
+}
+
+func (s *fakeStore) Claim(limit int, lease time.Duration) ([]*data.OutboxMessage, error) {
+	var ids []int64
+	for id := range s.rows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var messages []*data.OutboxMessage
+	held := make(map[int64]bool)
+	for _, id := range ids {
+		row := s.rows[id]
+		aggregate := row.message.AggregateID
+		if row.nextAttempt.After(s.now) || row.claimedUntil.After(s.now) {
+			held[aggregate] = true
+		}
+		if held[aggregate] || len(messages) == limit {
+			continue
+		}
+		row.claimedUntil = s.now.Add(lease)
+		message := *row.message
+		messages = append(messages, &message)
+	}
+	return messages, nil
+}
+
+func (s *fakeStore) Published(id int64) error {
+	delete(s.rows, id)
+	return nil
+}
+
+func (s *fakeStore) Failed(id int64, retryIn time.Duration, cause error) error {
+	row := s.rows[id]
+	row.message.Attempts++
+	row.nextAttempt = s.now.Add(retryIn)
+	row.claimedUntil = time.Time{}
+	s.retries = append(s.retries, retryIn)
+	return nil
+}
+
+func (s *fakeStore) Release(ids []int64) error {
+	for _, id := range ids {
+		s.rows[id].claimedUntil = time.Time{}
+	}
+	s.released += len(ids)
+	return nil
+}
+
+func (s *fakeStore) Backlog() (int64, time.Duration, error) {
+	return int64(len(s.rows)), 0, nil
+}
+
+func TestRelayBatch(t *testing.T) {
+	// Messages 1, 3 and 5 are about product 10; 2 and 4 about product 20.
+	store := newFakeStore(10, 20, 10, 20, 10)
+	var published []int64
+	down := map[int64]bool{10: true}
+	relay := &Relay{Outbox: store, BatchSize: 10}
+	relay.Publisher = publisherFunc(func(ctx context.Context, exchange, routingKey, contentType string, body []byte) error {
+		row := store.rows[int64(body[0])]
+		if down[row.message.AggregateID] {
+			return errors.New("broker unavailable")
+		}
+		published = append(published, row.message.ID)
+		return nil
+	})
+
+	claimed, err := relay.relayBatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed != 5 {
+		t.Errorf("claimed %d messages, expected 5", claimed)
+	}
+	if !equalIDs(published, []int64{2, 4}) {
+		t.Errorf("published %v, expected [2 4]", published)
+	}
+	if store.released != 2 {
+		t.Errorf("released %d messages, expected product 10's later messages", store.released)
+	}
+	if len(store.retries) != 1 || store.retries[0] != Backoff(1) {
+		t.Errorf("retries are %v, expected one after %v", store.retries, Backoff(1))
+	}
+
+	// Product 10 is held back until its first message is due again.
+	claimed, err = relay.relayBatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed != 0 {
+		t.Errorf("claimed %d messages while product 10 waits for a retry", claimed)
+	}
+
+	// It fails again and waits longer.
+	store.now = store.now.Add(Backoff(1))
+	if _, err = relay.relayBatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.retries) != 2 || store.retries[1] != Backoff(2) {
+		t.Errorf("retries are %v, expected the second after %v", store.retries, Backoff(2))
+	}
+
+	// Once the broker is back, product 10's messages go out in order.
+	down[10] = false
+	store.now = store.now.Add(Backoff(2))
+	if _, err = relay.relayBatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !equalIDs(published, []int64{2, 4, 1, 3, 5}) {
+		t.Errorf("published %v, expected [2 4 1 3 5]", published)
+	}
+	if len(store.rows) != 0 {
+		t.Errorf("%d messages are left in the outbox", len(store.rows))
+	}
+}
+
+func TestRelayBatchStopsWhenCancelled(t *testing.T) {
+	store := newFakeStore(10, 20)
+	relay := &Relay{Outbox: store, BatchSize: 10}
+	relay.Publisher = publisherFunc(func(ctx context.Context, exchange, routingKey, contentType string, body []byte) error {
+		t.Error("published after the relay was cancelled")
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := relay.relayBatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if store.released != 2 {
+		t.Errorf("released %d messages, expected 2", store.released)
+	}
+
+	// The released messages can be claimed again straight away.
+	messages, _ := store.Claim(10, claimLease)
+	if len(messages) != 2 {
+		t.Errorf("claimed %d released messages, expected 2", len(messages))
+	}
+}
+
+type publisherFunc func(ctx context.Context, exchange, routingKey, contentType string, body []byte) error
+
+func (f publisherFunc) Publish(ctx context.Context, exchange, routingKey, contentType string, body []byte) error {
+	return f(ctx, exchange, routingKey, contentType, body)
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) AddCategory(ctx context.Context, req *proto.AddCategoryRequest) (*proto.AddCategoryResponse, error) {
+	category := req.GetCategory()
+	if category == nil {
+		return nil, failedValidationError(map[string]string{"category": "must be provided"})
+	}
+	if category.Slug == "" {
+		category.Slug = data.Slugify(category.Name)
+	}
+
+	v := validator.New()
+	if data.ValidateCategory(v, category); !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	category, err := s.Categories.Insert(category)
+	if err != nil {
+		return nil, categoryWriteError("add", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Category has been successfully created with id: %d", category.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.AddCategoryResponse{
+		Category: category,
+	}, nil
+}
+
+func (s *Server) ShowCategory(ctx context.Context, req *proto.ShowCategoryRequest) (*proto.ShowCategoryResponse, error) {
+	category, err := s.Categories.Get(req.GetId())
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Category not found: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to retrieve category: %v", err)
+	}
+
+	return &proto.ShowCategoryResponse{
+		Category: category,
+	}, nil
+}
+
+func (s *Server) ListCategories(ctx context.Context, req *proto.ListCategoriesRequest) (*proto.ListCategoriesResponse, error) {
+	categories, err := s.Categories.GetAll(req.GetRootId())
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Category not found: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to get categories: %v", err)
+	}
+
+	return &proto.ListCategoriesResponse{
+		Categories: categories,
+	}, nil
+}
+
+func (s *Server) UpdateCategory(ctx context.Context, req *proto.UpdateCategoryRequest) (*proto.UpdateCategoryResponse, error) {
+	category := req.GetCategory()
+	if category == nil {
+		return nil, failedValidationError(map[string]string{"category": "must be provided"})
+	}
+
+	v := validator.New()
+	if data.ValidateCategory(v, category); !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	err := s.Categories.Update(category)
+	if err != nil {
+		return nil, categoryWriteError("update", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Category has been successfully updated with id: %d", category.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.UpdateCategoryResponse{
+		Category: category,
+	}, nil
+}
+
+func (s *Server) DeleteCategory(ctx context.Context, req *proto.DeleteCategoryRequest) (*proto.DeleteCategoryResponse, error) {
+	err := s.Categories.Delete(req.GetId())
+	if err != nil {
+		return nil, categoryWriteError("delete", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Category has been successfully deleted with id: %d", req.GetId()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.DeleteCategoryResponse{
+		Message: fmt.Sprintf("Category has been successfully deleted with id: %d", req.GetId()),
+	}, nil
+}
+
+func categoryWriteError(operation string, err error) error {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return status.Errorf(codes.NotFound, "Category not found: %v", err)
+	case errors.Is(err, data.ErrDuplicateSlug):
+		return failedValidationError(map[string]string{"slug": "a category with this slug already exists"})
+	case errors.Is(err, data.ErrParentNotFound):
+		return failedValidationError(map[string]string{"parent_id": "does not exist"})
+	case errors.Is(err, data.ErrCategoryCycle):
+		return failedValidationError(map[string]string{"parent_id": "must not be the category itself or one of its subcategories"})
+	case errors.Is(err, data.ErrCategoryInUse):
+		return status.Errorf(codes.FailedPrecondition, "Failed to %s category: %v", operation, err)
+	default:
+		return status.Errorf(codes.Internal, "Failed to %s category: %v", operation, err)
+	}
+}
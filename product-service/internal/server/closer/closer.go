@@ -0,0 +1,55 @@
+package closer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// closer runs shutdown handlers in the order they were added.
+type closer struct {
+	mu       sync.Mutex
+	handlers []handler
+}
+
+func New() *closer {
+	return &closer{}
+}
+
+func (c *closer) Add(h handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.handlers = append(c.handlers, h)
+}
+
+// Close runs every handler in order, each one after the previous has
+// returned, and reports all of their errors. Handlers are given ctx and must
+// return promptly once it is done; the ones still to run when it expires are
+// run anyway, so that they can release what they hold without waiting.
+func (c *closer) Close(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	errs := make([]string, 0, len(c.handlers))
+	for _, h := range c.handlers {
+		if err := h(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("[!] %v", err))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, fmt.Sprintf("[!] shutdown cancelled: %v", err))
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf(
+			"shutdown finished with errors: \n%s",
+			strings.Join(errs, "\n"),
+		)
+	}
+
+	return nil
+}
+
+type handler func(ctx context.Context) error
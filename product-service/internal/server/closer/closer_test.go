@@ -0,0 +1,75 @@
+package closer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseRunsHandlersInOrder(t *testing.T) {
+	var order []int
+	c := New()
+	for i := 1; i <= 3; i++ {
+		i := i
+		c.Add(func(ctx context.Context) error {
+			order = append(order, i)
+			return nil
+		})
+	}
+
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned %v", err)
+	}
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Errorf("handlers ran in order %v, expected [1 2 3]", order)
+	}
+}
+
+func TestCloseReportsEveryError(t *testing.T) {
+	c := New()
+	c.Add(func(ctx context.Context) error { return errors.New("publisher failed") })
+	c.Add(func(ctx context.Context) error { return nil })
+	c.Add(func(ctx context.Context) error { return errors.New("db failed") })
+
+	err := c.Close(context.Background())
+	if err == nil {
+		t.Fatal("Close() returned no error")
+	}
+	for _, message := range []string{"publisher failed", "db failed"} {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("Close() error %q does not mention %q", err, message)
+		}
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	var ran []string
+	c := New()
+	c.Add(func(ctx context.Context) error {
+		<-ctx.Done()
+		ran = append(ran, "slow")
+		return ctx.Err()
+	})
+	c.Add(func(ctx context.Context) error {
+		if ctx.Err() == nil {
+			t.Error("handler after the timeout was given a live context")
+		}
+		ran = append(ran, "db")
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := c.Close(ctx)
+	if err == nil || !strings.Contains(err.Error(), "shutdown cancelled") {
+		t.Errorf("Close() returned %v, expected the shutdown to be cancelled", err)
+	}
+	// Every handler has returned by the time Close does, so nothing is left
+	// running against resources the caller goes on to tear down.
+	if len(ran) != 2 || ran[0] != "slow" || ran[1] != "db" {
+		t.Errorf("handlers that ran are %v, expected [slow db]", ran)
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/images"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log"
+	"time"
+)
+
+func (s *Server) UploadProductImage(ctx context.Context, req *proto.UploadProductImageRequest) (*proto.UploadProductImageResponse, error) {
+	if len(req.GetData()) == 0 {
+		return nil, failedValidationError(map[string]string{"image": "must be provided"})
+	}
+	if len(req.GetData()) > s.maxImageSize {
+		return nil, failedValidationError(map[string]string{"image": fmt.Sprintf("must not be larger than %d bytes", s.maxImageSize)})
+	}
+
+	processed, err := images.Process(req.GetData())
+	if err != nil {
+		switch {
+		case errors.Is(err, images.ErrUnsupportedType):
+			return nil, failedValidationError(map[string]string{"image": "must be a JPEG, PNG or WebP image"})
+		case errors.Is(err, images.ErrTooLarge):
+			return nil, failedValidationError(map[string]string{"image": "dimensions are too large"})
+		default:
+			return nil, status.Errorf(codes.Internal, "Failed to process image: %v", err)
+		}
+	}
+
+	prefix, err := imageKeyPrefix(req.GetProductId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to store image: %v", err)
+	}
+
+	image := &data.ProductImage{
+		ProductID:   req.GetProductId(),
+		Key:         prefix + "original." + processed.Extension,
+		Thumbnails:  make(map[string]string, len(processed.Thumbnails)),
+		ContentType: processed.ContentType,
+		Width:       int32(processed.Width),
+		Height:      int32(processed.Height),
+	}
+
+	uploaded := []string{}
+	err = s.Storage.Put(ctx, image.Key, req.GetData(), processed.ContentType)
+	if err == nil {
+		uploaded = append(uploaded, image.Key)
+		for name, thumbnail := range processed.Thumbnails {
+			key := prefix + name + "." + thumbnail.Extension
+			if err = s.Storage.Put(ctx, key, thumbnail.Data, thumbnail.ContentType); err != nil {
+				break
+			}
+			uploaded = append(uploaded, key)
+			image.Thumbnails[name] = key
+		}
+	}
+	if err != nil {
+		s.removeImageFiles(uploaded)
+		return nil, status.Errorf(codes.Internal, "Failed to store image: %v", err)
+	}
+
+	err = s.Images.Insert(image, req.GetPrimary())
+	if err != nil {
+		s.removeImageFiles(uploaded)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Product not found: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to add image: %v", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Image %d has been added to product with id: %d", image.ID, image.ProductID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.UploadProductImageResponse{
+		Image: s.imageProto(image),
+	}, nil
+}
+
+func (s *Server) UpdateProductImage(ctx context.Context, req *proto.UpdateProductImageRequest) (*proto.UpdateProductImageResponse, error) {
+	if req.GetPosition() < 0 {
+		return nil, failedValidationError(map[string]string{"position": "must not be negative"})
+	}
+
+	updated, err := s.Images.Update(req.GetProductId(), req.GetImageId(), req.GetPosition(), req.GetPrimary())
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Image not found: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to update image: %v", err)
+	}
+
+	return &proto.UpdateProductImageResponse{
+		Images: s.imageProtos(updated),
+	}, nil
+}
+
+func (s *Server) DeleteProductImage(ctx context.Context, req *proto.DeleteProductImageRequest) (*proto.DeleteProductImageResponse, error) {
+	image, err := s.Images.Delete(req.GetProductId(), req.GetImageId())
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Image not found: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to delete image: %v", err)
+	}
+	s.removeImageFiles(imageKeys(image))
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Image %d has been deleted from product with id: %d", image.ID, image.ProductID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.DeleteProductImageResponse{
+		Message: fmt.Sprintf("Image has been successfully deleted with id: %d", image.ID),
+	}, nil
+}
+
+// attachImages fills in the images of each product with one query.
+func (s *Server) attachImages(products []*proto.Product) error {
+	ids := make([]int64, 0, len(products))
+	for _, product := range products {
+		ids = append(ids, product.Id)
+	}
+
+	byProduct, err := s.Images.GetForProducts(ids)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to get product images: %v", err)
+	}
+	for _, product := range products {
+		product.Images = s.imageProtos(byProduct[product.Id])
+	}
+	return nil
+}
+
+func (s *Server) imageProto(image *data.ProductImage) *proto.ProductImage {
+	thumbnails := make(map[string]string, len(image.Thumbnails))
+	for name, key := range image.Thumbnails {
+		thumbnails[name] = s.Storage.URL(key)
+	}
+
+	return &proto.ProductImage{
+		Id:          image.ID,
+		ProductId:   image.ProductID,
+		Url:         s.Storage.URL(image.Key),
+		Thumbnails:  thumbnails,
+		ContentType: image.ContentType,
+		Width:       image.Width,
+		Height:      image.Height,
+		Position:    image.Position,
+		IsPrimary:   image.IsPrimary,
+		CreatedAt:   timestamppb.New(image.CreatedAt),
+	}
+}
+
+func (s *Server) imageProtos(images []*data.ProductImage) []*proto.ProductImage {
+	result := make([]*proto.ProductImage, 0, len(images))
+	for _, image := range images {
+		result = append(result, s.imageProto(image))
+	}
+	return result
+}
+
+// removeImageFiles deletes files whose database rows are gone, or were never
+// written. Failures only leave orphaned files behind, so they are logged
+// rather than returned.
+func (s *Server) removeImageFiles(keys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, key := range keys {
+		if err := s.Storage.Delete(ctx, key); err != nil {
+			log.Printf("failed to delete image file %s: %v", key, err)
+		}
+	}
+}
+
+func imageKeys(image *data.ProductImage) []string {
+	keys := []string{image.Key}
+	for _, key := range image.Thumbnails {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// imageKeyPrefix gives each upload its own directory, so a new upload never
+// overwrites the files of an image that is still referenced.
+func imageKeyPrefix(productID int64) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("products/%d/%s/", productID, hex.EncodeToString(b)), nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryInterceptors returns the interceptors every ProductService server runs,
+// outermost first. Logging wraps Recovery so that calls which panic are
+// logged with the Internal code they end with, and Recovery wraps the rest so
+// that a panic anywhere below it is caught.
+func UnaryInterceptors(readYourWritesWindow time.Duration) []grpc.UnaryServerInterceptor {
+	return []grpc.UnaryServerInterceptor{
+		LoggingInterceptor,
+		RecoveryInterceptor,
+		ReadYourWritesInterceptor(readYourWritesWindow),
+	}
+}
+
+// RecoveryInterceptor turns a panic inside a handler into an Internal error so
+// that a single bad request cannot take down the whole gRPC server.
+func RecoveryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic in %s: %v\n%s", info.FullMethod, r, debug.Stack())
+			err = status.Errorf(codes.Internal, "the server encountered a problem and could not process your request")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// LoggingInterceptor logs the method, resulting status code and duration of
+// every unary call.
+func LoggingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	log.Printf("method=%s code=%s duration=%s", info.FullMethod, status.Code(err), time.Since(start))
+	return resp, err
+}
+
+// readMethods are the ProductService calls that do not write.
+var readMethods = map[string]bool{
+	"ShowProduct":        true,
+	"ListProducts":       true,
+	"BatchGetProducts":   true,
+	"GetProductHistory":  true,
+	"ListStockMovements": true,
+	"ShowCategory":       true,
+	"ListCategories":     true,
+	"ShowReview":         true,
+	"ListReviews":        true,
+	"ShowPricingRule":    true,
+	"ListPricingRules":   true,
+	"PreviewPrices":      true,
+}
+
+// ReadYourWritesInterceptor gives callers read-your-writes consistency over
+// read replicas. A ProductService call that writes returns, whether or not it
+// succeeded, a token that sends the caller's reads to the primary for the
+// next window; calls that present it, or ask for the primary outright, skip
+// the replicas. The token is a wall-clock time, so window should also cover
+// the clock skew between the service's instances.
+func ReadYourWritesInterceptor(window time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if readsFromPrimary(ctx, time.Now()) {
+			ctx = data.WithPrimary(ctx)
+		}
+
+		method := strings.TrimPrefix(info.FullMethod, "/ProductService/")
+		if method != info.FullMethod && !readMethods[method] {
+			until := strconv.FormatInt(time.Now().Add(window).UnixMilli(), 10)
+			if err := grpc.SetHeader(ctx, metadata.Pairs(primaryUntilMetadataKey, until)); err != nil {
+				log.Printf("failed to return the read-your-writes token for %s: %v", info.FullMethod, err)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
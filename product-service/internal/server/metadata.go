@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The gateway verifies the caller's access token and sends the user's ID and
+// role under these keys. Calls without them are anonymous.
+const (
+	actorMetadataKey = "x-user-id"
+	roleMetadataKey  = "x-user-role"
+)
+
+// adminRole is the role of users who may moderate reviews and see or restore
+// deleted products.
+const adminRole = "ADMIN"
+
+// Reads go to the primary when a call carries readPrimaryMetadataKey set to
+// "true", for reads that must see the latest writes, or an unexpired
+// primaryUntilMetadataKey. Writes return the latter in their response
+// headers, as milliseconds since the Unix epoch, for the caller to send with
+// its next reads: the pin travels with the caller rather than staying with
+// the instance that handled the write.
+const (
+	readPrimaryMetadataKey  = "x-read-primary"
+	primaryUntilMetadataKey = "x-read-primary-until"
+)
+
+// actorFromContext returns the calling user's ID from the incoming metadata,
+// or an empty string when the call is not attributed to a user.
+func actorFromContext(ctx context.Context) string {
+	return incomingValue(ctx, actorMetadataKey)
+}
+
+// roleFromContext returns the calling user's role from the incoming metadata,
+// or an empty string when the call is not attributed to a user.
+func roleFromContext(ctx context.Context) string {
+	return incomingValue(ctx, roleMetadataKey)
+}
+
+// checkAdmin refuses calls that are not made for an admin. action completes
+// "Only an admin can ..." in the error.
+func checkAdmin(ctx context.Context, action string) error {
+	if actorFromContext(ctx) == "" {
+		return status.Errorf(codes.Unauthenticated, "Only a signed-in admin can %s", action)
+	}
+	if roleFromContext(ctx) != adminRole {
+		return status.Errorf(codes.PermissionDenied, "Only an admin can %s", action)
+	}
+	return nil
+}
+
+func incomingValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// readsFromPrimary reports whether the incoming metadata asks for the call's
+// reads to go to the primary at now.
+func readsFromPrimary(ctx context.Context, now time.Time) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	for _, value := range md.Get(readPrimaryMetadataKey) {
+		if value == "true" {
+			return true
+		}
+	}
+	for _, value := range md.Get(primaryUntilMetadataKey) {
+		until, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && now.Before(time.UnixMilli(until)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+func (s *Server) AddPricingRule(ctx context.Context, req *proto.AddPricingRuleRequest) (*proto.AddPricingRuleResponse, error) {
+	rule := req.GetRule()
+	if rule == nil {
+		return nil, failedValidationError(map[string]string{"rule": "must be provided"})
+	}
+	data.NormalizePricingRule(rule)
+
+	v := validator.New()
+	if data.ValidatePricingRule(v, rule); !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	rule, err := s.Pricing.Insert(rule)
+	if err != nil {
+		return nil, pricingRuleWriteError("add", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Pricing rule has been successfully created with id: %d", rule.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.AddPricingRuleResponse{
+		Rule: rule,
+	}, nil
+}
+
+func (s *Server) ShowPricingRule(ctx context.Context, req *proto.ShowPricingRuleRequest) (*proto.ShowPricingRuleResponse, error) {
+	rule, err := s.Pricing.Get(req.GetId())
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Pricing rule not found: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to retrieve pricing rule: %v", err)
+	}
+
+	return &proto.ShowPricingRuleResponse{
+		Rule: rule,
+	}, nil
+}
+
+func (s *Server) ListPricingRules(ctx context.Context, req *proto.ListPricingRulesRequest) (*proto.ListPricingRulesResponse, error) {
+	filters := req.GetFilters()
+	if filters == nil {
+		filters = &proto.Filters{}
+	}
+	filters.SortSafeList = data.PricingRuleSortSafeList
+
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	var activeAt *time.Time
+	if req.GetActiveAt() != nil {
+		at := req.GetActiveAt().AsTime()
+		activeAt = &at
+	}
+
+	rules, metadata, err := s.Pricing.GetAll(activeAt, filters)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to get pricing rules: %v", err)
+	}
+
+	return &proto.ListPricingRulesResponse{
+		Metadata: metadata,
+		Rules:    rules,
+	}, nil
+}
+
+func (s *Server) UpdatePricingRule(ctx context.Context, req *proto.UpdatePricingRuleRequest) (*proto.UpdatePricingRuleResponse, error) {
+	rule := req.GetRule()
+	if rule == nil {
+		return nil, failedValidationError(map[string]string{"rule": "must be provided"})
+	}
+	data.NormalizePricingRule(rule)
+
+	v := validator.New()
+	if data.ValidatePricingRule(v, rule); !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	err := s.Pricing.Update(rule)
+	if err != nil {
+		return nil, pricingRuleWriteError("update", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Pricing rule has been successfully updated with id: %d", rule.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.UpdatePricingRuleResponse{
+		Rule: rule,
+	}, nil
+}
+
+func (s *Server) DeletePricingRule(ctx context.Context, req *proto.DeletePricingRuleRequest) (*proto.DeletePricingRuleResponse, error) {
+	err := s.Pricing.Delete(req.GetId())
+	if err != nil {
+		return nil, pricingRuleWriteError("delete", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Pricing rule has been successfully deleted with id: %d", req.GetId()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.DeletePricingRuleResponse{
+		Message: fmt.Sprintf("Pricing rule has been successfully deleted with id: %d", req.GetId()),
+	}, nil
+}
+
+// PreviewPrices prices products as BatchGetProducts does, but with the rules
+// in effect at the requested time.
+func (s *Server) PreviewPrices(ctx context.Context, req *proto.PreviewPricesRequest) (*proto.PreviewPricesResponse, error) {
+	at := time.Now()
+	if req.GetAt() != nil {
+		at = req.GetAt().AsTime()
+	}
+
+	products, missingIDs, err := s.batchGetProducts(ctx, req.GetIds(), req.GetCurrency(), at)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.PreviewPricesResponse{
+		Products:   products,
+		MissingIds: missingIDs,
+	}, nil
+}
+
+// applyPricing sets the effective prices of products from the pricing rules
+// in effect at the given time. It must run before convertPrices, since fixed
+// discounts are in the currency products are stored with.
+func (s *Server) applyPricing(products []*proto.Product, at time.Time) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	rules, err := s.Pricing.Active(at)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to get pricing rules: %v", err)
+	}
+
+	var parents map[int64]int64
+	for _, rule := range rules {
+		if rule.Scope != data.PricingScopeCategory {
+			continue
+		}
+		categories, err := s.Categories.GetAll(0)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed to get categories: %v", err)
+		}
+		parents = make(map[int64]int64, len(categories))
+		for _, category := range categories {
+			parents[category.Id] = category.ParentId
+		}
+		break
+	}
+
+	data.ApplyPricing(products, rules, parents)
+	return nil
+}
+
+func pricingRuleWriteError(operation string, err error) error {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return status.Errorf(codes.NotFound, "Pricing rule not found: %v", err)
+	case errors.Is(err, data.ErrUnknownPricingTarget):
+		return failedValidationError(map[string]string{"target_id": "does not exist"})
+	default:
+		return status.Errorf(codes.Internal, "Failed to %s pricing rule: %v", operation, err)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+)
+
+func (s *Server) AddReview(ctx context.Context, req *proto.AddReviewRequest) (*proto.AddReviewResponse, error) {
+	review := req.GetReview()
+	if review == nil {
+		return nil, failedValidationError(map[string]string{"review": "must be provided"})
+	}
+
+	userID, err := reviewerFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	review.UserId = userID
+
+	v := validator.New()
+	if data.ValidateReview(v, review); !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	review, err = s.Reviews.Insert(review)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Product not found: %v", err)
+		}
+		return nil, reviewWriteError("add", err)
+	}
+
+	return &proto.AddReviewResponse{
+		Review: review,
+	}, nil
+}
+
+func (s *Server) ShowReview(ctx context.Context, req *proto.ShowReviewRequest) (*proto.ShowReviewResponse, error) {
+	review, err := s.Reviews.Get(req.GetProductId(), req.GetReviewId())
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Review not found: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to retrieve review: %v", err)
+	}
+
+	return &proto.ShowReviewResponse{
+		Review: review,
+	}, nil
+}
+
+func (s *Server) ListReviews(ctx context.Context, req *proto.ListReviewsRequest) (*proto.ListReviewsResponse, error) {
+	filters := req.GetFilters()
+	if filters == nil {
+		filters = &proto.Filters{}
+	}
+	filters.SortSafeList = data.ReviewSortSafeList
+
+	filter := data.ReviewFilter{
+		ProductID: req.GetProductId(),
+		Status:    req.GetStatus(),
+	}
+	if filter.Status == "" {
+		filter.Status = data.ReviewApproved
+	}
+
+	v := validator.New()
+	data.ValidateFilters(v, filters)
+	data.ValidateReviewStatus(v, filter.Status)
+	v.Check(filter.ProductID >= 0, "product_id", "must not be negative")
+	if !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	// Only moderators see reviews that have not been approved.
+	if filter.Status != data.ReviewApproved {
+		if err := checkModerator(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if filter.ProductID != 0 {
+		if _, err := s.Products.Get(ctx, filter.ProductID); err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return nil, status.Errorf(codes.NotFound, "Product not found: %v", err)
+			}
+			return nil, status.Errorf(codes.Internal, "Failed to retrieve product: %v", err)
+		}
+	}
+
+	reviews, metadata, err := s.Reviews.GetAll(filter, filters)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to get reviews: %v", err)
+	}
+
+	return &proto.ListReviewsResponse{
+		Metadata: metadata,
+		Reviews:  reviews,
+	}, nil
+}
+
+func (s *Server) UpdateReview(ctx context.Context, req *proto.UpdateReviewRequest) (*proto.UpdateReviewResponse, error) {
+	review := req.GetReview()
+	if review == nil {
+		return nil, failedValidationError(map[string]string{"review": "must be provided"})
+	}
+
+	v := validator.New()
+	if data.ValidateReview(v, review); !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	if err := s.checkReviewAuthor(ctx, review.ProductId, review.Id); err != nil {
+		return nil, err
+	}
+
+	err := s.Reviews.Update(review)
+	if err != nil {
+		return nil, reviewWriteError("update", err)
+	}
+
+	return &proto.UpdateReviewResponse{
+		Review: review,
+	}, nil
+}
+
+func (s *Server) DeleteReview(ctx context.Context, req *proto.DeleteReviewRequest) (*proto.DeleteReviewResponse, error) {
+	if err := s.checkReviewAuthor(ctx, req.GetProductId(), req.GetReviewId()); err != nil {
+		return nil, err
+	}
+
+	err := s.Reviews.Delete(req.GetProductId(), req.GetReviewId())
+	if err != nil {
+		return nil, reviewWriteError("delete", err)
+	}
+
+	return &proto.DeleteReviewResponse{
+		Message: fmt.Sprintf("Review has been successfully deleted with id: %d", req.GetReviewId()),
+	}, nil
+}
+
+func (s *Server) ModerateReview(ctx context.Context, req *proto.ModerateReviewRequest) (*proto.ModerateReviewResponse, error) {
+	if err := checkModerator(ctx); err != nil {
+		return nil, err
+	}
+
+	v := validator.New()
+	v.Check(validator.PermittedValue(req.GetStatus(), data.ReviewApproved, data.ReviewRejected), "status", "must be approved or rejected")
+	if !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	review, err := s.Reviews.Moderate(req.GetProductId(), req.GetReviewId(), req.GetStatus(), req.Verified)
+	if err != nil {
+		return nil, reviewWriteError("moderate", err)
+	}
+
+	return &proto.ModerateReviewResponse{
+		Review: review,
+	}, nil
+}
+
+// reviewerFromContext returns the ID of the user the gateway is calling for,
+// taken from the access token it verified. Reviews always belong to a user,
+// so calls without one are refused.
+func reviewerFromContext(ctx context.Context) (int64, error) {
+	userID, err := strconv.ParseInt(actorFromContext(ctx), 10, 64)
+	if err != nil || userID < 1 {
+		return 0, status.Errorf(codes.Unauthenticated, "Reviews can only be written by a signed-in user")
+	}
+	return userID, nil
+}
+
+// checkModerator makes sure the calling user is an admin.
+func checkModerator(ctx context.Context) error {
+	if _, err := reviewerFromContext(ctx); err != nil {
+		return err
+	}
+	if roleFromContext(ctx) != adminRole {
+		return status.Errorf(codes.PermissionDenied, "Reviews can only be moderated by an admin")
+	}
+	return nil
+}
+
+// checkReviewAuthor makes sure the calling user wrote the review.
+func (s *Server) checkReviewAuthor(ctx context.Context, productID, reviewID int64) error {
+	userID, err := reviewerFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	review, err := s.Reviews.Get(productID, reviewID)
+	if err != nil {
+		return reviewWriteError("retrieve", err)
+	}
+	if review.UserId != userID {
+		return status.Errorf(codes.PermissionDenied, "Only the author of a review can change it")
+	}
+	return nil
+}
+
+func reviewWriteError(operation string, err error) error {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return status.Errorf(codes.NotFound, "Review not found: %v", err)
+	case errors.Is(err, data.ErrDuplicateReview):
+		return status.Errorf(codes.AlreadyExists, "Failed to %s review: %v", operation, err)
+	default:
+		return status.Errorf(codes.Internal, "Failed to %s review: %v", operation, err)
+	}
+}
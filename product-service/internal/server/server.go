@@ -2,32 +2,57 @@ package server
 
 import (
 	"context"
-	"database/sql"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"github.com/Skaifai/gophers-microservice/product-service/config"
 	"github.com/Skaifai/gophers-microservice/product-service/internal/logger"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/storage"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
 
 	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/currency"
 	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+	"time"
 )
 
 type Server struct {
 	proto.UnimplementedProductServiceServer
 	data.Models
-	*logger.Publisher
+	Publisher logger.EventPublisher
+	storage.Storage
+	idempotencyWindow time.Duration
+	reservationTTL    time.Duration
+	deletedRetention  time.Duration
+	maxImageSize      int
+	maxBatchSize      int
 }
 
-func NewServer(db *sql.DB, publisher *logger.Publisher) *Server {
+func NewServer(models data.Models, publisher logger.EventPublisher, store storage.Storage, cfg *config.Config) *Server {
 	return &Server{
-		Models:    data.NewModels(db),
-		Publisher: publisher,
+		Models:            models,
+		Publisher:         publisher,
+		Storage:           store,
+		idempotencyWindow: cfg.IdempotencyWindow,
+		reservationTTL:    cfg.ReservationTTL,
+		deletedRetention:  cfg.DeletedRetention,
+		maxImageSize:      cfg.MaxImageSize,
+		maxBatchSize:      cfg.MaxBatchSize,
 	}
 }
 
 func (s *Server) ShowProduct(ctx context.Context, req *proto.ShowProductRequest) (*proto.ShowProductResponse, error) {
-	product, err := s.Products.Get(req.GetId())
+	get := s.Products.Get
+	if req.GetIncludeDeleted() {
+		if err := checkAdmin(ctx, "see deleted products"); err != nil {
+			return nil, err
+		}
+		get = s.Products.GetIncludingDeleted
+	}
+	product, err := get(ctx, req.GetId())
 	if err != nil {
 		if errors.Is(err, data.ErrRecordNotFound) {
 			return nil, status.Errorf(codes.NotFound, "Product not found: %v", err)
@@ -35,61 +60,276 @@ func (s *Server) ShowProduct(ctx context.Context, req *proto.ShowProductRequest)
 		return nil, status.Errorf(codes.Internal, "Failed to retrieve product: %v", err)
 	}
 
+	if err := s.attachVariants([]*proto.Product{product}); err != nil {
+		return nil, err
+	}
+	if err := s.applyPricing([]*proto.Product{product}, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := s.convertPrices(ctx, []*proto.Product{product}, req.GetCurrency()); err != nil {
+		return nil, err
+	}
+	if err := s.attachImages([]*proto.Product{product}); err != nil {
+		return nil, err
+	}
+
 	return &proto.ShowProductResponse{
 		Product: product,
 	}, nil
 }
 
 func (s *Server) ListProducts(ctx context.Context, req *proto.ListProductsRequest) (*proto.ListProductsResponse, error) {
-	products, metadata, err := s.Products.GetAll(req.GetName(), req.GetCategory(), req.GetFilters())
+	filters := req.GetFilters()
+	if filters == nil {
+		filters = &proto.Filters{}
+	}
+	filters.SortSafeList = data.ProductSortSafeList
+
+	filter := productFilter(req)
+
+	v := validator.New()
+	data.ValidateFilters(v, filters)
+	data.ValidateProductFilter(v, filter)
+	validateCurrency(v, req.GetCurrency())
+	if !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	if filter.IncludeDeleted {
+		if err := checkAdmin(ctx, "see deleted products"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fall back to similarity when the search words match nothing, so that
+	// typos still find something. The facets follow the same choice.
+	if filter.Search != "" {
+		exact, err := s.Products.HasMatches(ctx, filter)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to get products: %v", err)
+		}
+		filter.Fuzzy = !exact
+	}
+
+	products, metadata, err := s.Products.GetAll(ctx, filter, filters)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to get products: %v", err)
 	}
 
+	var facets *proto.Facets
+	if req.GetFacets() {
+		facets, err = s.Products.Facets(ctx, filter)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to count products: %v", err)
+		}
+	}
+
+	if err := s.attachVariants(products); err != nil {
+		return nil, err
+	}
+	if err := s.applyPricing(products, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := s.convertPrices(ctx, products, req.GetCurrency()); err != nil {
+		return nil, err
+	}
+	if err := s.attachImages(products); err != nil {
+		return nil, err
+	}
+
 	return &proto.ListProductsResponse{
 		Metadata: metadata,
 		Products: products,
+		Facets:   facets,
+		Fuzzy:    filter.Fuzzy,
 	}, nil
 }
 
+func (s *Server) BatchGetProducts(ctx context.Context, req *proto.BatchGetProductsRequest) (*proto.BatchGetProductsResponse, error) {
+	products, missingIDs, err := s.batchGetProducts(ctx, req.GetIds(), req.GetCurrency(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.BatchGetProductsResponse{
+		Products:   products,
+		MissingIds: missingIDs,
+	}, nil
+}
+
+// batchGetProducts looks up products by id, priced with the rules in effect
+// at the given time, and returns them in the order requested together with
+// the ids that have no product.
+func (s *Server) batchGetProducts(ctx context.Context, requested []int64, currency string, at time.Time) ([]*proto.Product, []int64, error) {
+	// Duplicates are dropped, keeping the order of first appearance.
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, id := range requested {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	v := validator.New()
+	v.Check(len(ids) > 0, "ids", "must be provided")
+	v.Check(len(ids) <= s.maxBatchSize, "ids", fmt.Sprintf("must not have more than %d entries", s.maxBatchSize))
+	for _, id := range ids {
+		v.Check(id > 0, "ids", "must be positive")
+	}
+	validateCurrency(v, currency)
+	if !v.Valid() {
+		return nil, nil, failedValidationError(v.Errors)
+	}
+
+	found, err := s.Products.GetMany(ctx, ids)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "Failed to get products: %v", err)
+	}
+
+	byID := make(map[int64]*proto.Product, len(found))
+	for _, product := range found {
+		byID[product.Id] = product
+	}
+
+	var products []*proto.Product
+	var missingIDs []int64
+	for _, id := range ids {
+		if product, ok := byID[id]; ok {
+			products = append(products, product)
+		} else {
+			missingIDs = append(missingIDs, id)
+		}
+	}
+
+	if err := s.attachVariants(products); err != nil {
+		return nil, nil, err
+	}
+	if err := s.applyPricing(products, at); err != nil {
+		return nil, nil, err
+	}
+	if err := s.convertPrices(ctx, products, currency); err != nil {
+		return nil, nil, err
+	}
+	if err := s.attachImages(products); err != nil {
+		return nil, nil, err
+	}
+
+	return products, missingIDs, nil
+}
+
+// productFilter collects the filters of a list request. Price bounds are in
+// the currency prices are listed in.
+func productFilter(req *proto.ListProductsRequest) data.ProductFilter {
+	filter := data.ProductFilter{
+		Name:           req.GetName(),
+		Category:       req.GetCategory(),
+		Search:         req.GetSearch(),
+		IncludeDeleted: req.GetIncludeDeleted(),
+		CategoryIDs:    req.GetCategoryIds(),
+		PriceMin:       req.PriceMin,
+		PriceMax:       req.PriceMax,
+		Currency:       req.GetCurrency(),
+		IsAvailable:    req.IsAvailable,
+	}
+	if req.GetCategoryId() != 0 {
+		filter.CategoryIDs = append([]int64{req.GetCategoryId()}, filter.CategoryIDs...)
+	}
+	if filter.Currency == "" {
+		filter.Currency = data.DefaultCurrency
+	}
+	if req.GetCreatedAfter() != nil {
+		createdAfter := req.GetCreatedAfter().AsTime()
+		filter.CreatedAfter = &createdAfter
+	}
+	if req.GetCreatedBefore() != nil {
+		createdBefore := req.GetCreatedBefore().AsTime()
+		filter.CreatedBefore = &createdBefore
+	}
+	return filter
+}
+
 func (s *Server) AddProduct(ctx context.Context, req *proto.AddProductRequest) (*proto.AddProductResponse, error) {
 	product := req.GetProduct()
-	data.SetStatus(product)
-	response, err := s.Products.Insert(product)
+	if req.GetIdempotencyKey() != "" {
+		return s.addProductIdempotent(ctx, req.GetIdempotencyKey(), product)
+	}
+
+	if err := s.normalizeProduct(product); err != nil {
+		return nil, err
+	}
+	response, err := s.Products.Insert(ctx, product, actorFromContext(ctx))
+	if err != nil {
+		return nil, productWriteError("add", err)
+	}
+	if err := s.applyPricing([]*proto.Product{response}, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &proto.AddProductResponse{
+		Product: response,
+	}, nil
+}
+
+func (s *Server) addProductIdempotent(ctx context.Context, key string, product *proto.Product) (*proto.AddProductResponse, error) {
+	// The fingerprint covers the product as the client sent it, before any
+	// server-side fields are filled in.
+	raw, err := protobuf.MarshalOptions{Deterministic: true}.Marshal(product)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to add product: %v", err)
 	}
+	fingerprint := sha256.Sum256(raw)
 
-	err = s.Publisher.SendLog(fmt.Sprintf("Product has been successfully created with id: %d", response.Id))
+	if err := s.normalizeProduct(product); err != nil {
+		return nil, err
+	}
+	response, replayed, err := s.Products.InsertIdempotent(ctx, product, actorFromContext(ctx), key, fingerprint[:], s.idempotencyWindow)
 	if err != nil {
+		if errors.Is(err, data.ErrIdempotencyKeyReused) {
+			return nil, failedValidationError(map[string]string{"idempotency_key": "was already used with a different request body"})
+		}
+		return nil, productWriteError("add", err)
+	}
+	if err := s.applyPricing([]*proto.Product{response}, time.Now()); err != nil {
 		return nil, err
 	}
 
 	return &proto.AddProductResponse{
-		Product: response,
+		Product:  response,
+		Replayed: replayed,
 	}, nil
 }
 
 func (s *Server) UpdateProduct(ctx context.Context, req *proto.UpdateProductRequest) (*proto.UpdateProductResponse, error) {
 	product := req.GetProduct()
-
-	err := s.Products.Update(product)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to update product: %v", err)
+	if err := s.normalizeProduct(product); err != nil {
+		return nil, err
 	}
 
-	err = s.Publisher.SendLog(fmt.Sprintf("Product has been successfully updated with id: %d", product.GetId()))
+	err := s.Products.Update(ctx, product, actorFromContext(ctx))
 	if err != nil {
+		return nil, productWriteError("update", err)
+	}
+	if err := s.attachVariants([]*proto.Product{product}); err != nil {
+		return nil, err
+	}
+	if err := s.applyPricing([]*proto.Product{product}, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := s.attachImages([]*proto.Product{product}); err != nil {
 		return nil, err
 	}
 
 	return &proto.UpdateProductResponse{
 		Message: fmt.Sprintf("Product has been successfully updated with id: %d", product.GetId()),
+		Product: product,
 	}, nil
 }
 
+// DeleteProduct only marks the product as deleted. Its images are kept until
+// PurgeDeletedProducts removes it for good.
 func (s *Server) DeleteProduct(ctx context.Context, req *proto.DeleteProductRequest) (*proto.DeleteProductResponse, error) {
-	err := s.Products.Delete(req.GetId())
+	err := s.Products.Delete(ctx, req.GetId(), actorFromContext(ctx))
 	if err != nil {
 		if errors.Is(err, data.ErrRecordNotFound) {
 			return nil, status.Errorf(codes.NotFound, "Product not found: %v", err)
@@ -97,12 +337,268 @@ func (s *Server) DeleteProduct(ctx context.Context, req *proto.DeleteProductRequ
 		return nil, status.Errorf(codes.Internal, "Failed to delete product: %v", err)
 	}
 
-	err = s.Publisher.SendLog(fmt.Sprintf("Product has been successfully deleted with id: %d", req.GetId()))
+	return &proto.DeleteProductResponse{
+		Message: fmt.Sprintf("Product has been successfully deleted with id: %d", req.GetId()),
+	}, nil
+}
+
+func (s *Server) RestoreProduct(ctx context.Context, req *proto.RestoreProductRequest) (*proto.RestoreProductResponse, error) {
+	if err := checkAdmin(ctx, "restore products"); err != nil {
+		return nil, err
+	}
+
+	err := s.Products.Restore(ctx, req.GetId(), actorFromContext(ctx))
 	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Errorf(codes.NotFound, "Product not found: %v", err)
+		case errors.Is(err, data.ErrNotDeleted):
+			return nil, status.Errorf(codes.FailedPrecondition, "Failed to restore product: %v", err)
+		default:
+			return nil, status.Errorf(codes.Internal, "Failed to restore product: %v", err)
+		}
+	}
+
+	product, err := s.Products.Get(data.WithPrimary(ctx), req.GetId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to retrieve product: %v", err)
+	}
+	if err := s.attachVariants([]*proto.Product{product}); err != nil {
+		return nil, err
+	}
+	if err := s.applyPricing([]*proto.Product{product}, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := s.attachImages([]*proto.Product{product}); err != nil {
 		return nil, err
 	}
 
-	return &proto.DeleteProductResponse{
-		Message: fmt.Sprintf("Product has been successfully deleted with id: %d", req.GetId()),
+	return &proto.RestoreProductResponse{Product: product}, nil
+}
+
+// PurgeDeletedProducts removes up to limit products that were deleted longer
+// than the retention period ago, together with their image files.
+func (s *Server) PurgeDeletedProducts(ctx context.Context, limit int) (int, error) {
+	purged, productImages, err := s.Products.PurgeDeleted(ctx, s.deletedRetention, limit)
+	if err != nil {
+		return 0, err
+	}
+	for _, image := range productImages {
+		s.removeImageFiles(imageKeys(image))
+	}
+	return purged, nil
+}
+
+func (s *Server) GetProductHistory(ctx context.Context, req *proto.GetProductHistoryRequest) (*proto.GetProductHistoryResponse, error) {
+	filters := req.GetFilters()
+	if filters == nil {
+		filters = &proto.Filters{}
+	}
+	if filters.Sort == "" {
+		filters.Sort = "-id"
+	}
+	filters.SortSafeList = data.AuditSortSafeList
+
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	entries, metadata, err := s.Audit.GetForProduct(ctx, req.GetId(), filters)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to get product history: %v", err)
+	}
+
+	return &proto.GetProductHistoryResponse{
+		Metadata: metadata,
+		Entries:  entries,
+	}, nil
+}
+
+func (s *Server) ReserveStock(ctx context.Context, req *proto.ReserveStockRequest) (*proto.ReserveStockResponse, error) {
+	v := validator.New()
+	v.Check(req.GetQuantity() > 0, "quantity", "must be greater than zero")
+	if !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	reservation, err := s.Products.Reserve(ctx, req.GetProductId(), req.GetVariantId(), req.GetQuantity(), s.reservationTTL, actorFromContext(ctx))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Errorf(codes.NotFound, "Product not found: %v", err)
+		case errors.Is(err, data.ErrInsufficientStock):
+			return nil, status.Errorf(codes.FailedPrecondition, "Not enough stock to reserve %d units", req.GetQuantity())
+		case errors.Is(err, data.ErrVariantRequired):
+			return nil, status.Errorf(codes.FailedPrecondition, "Product %d keeps its stock on variants; set variant_id to reserve one of them", req.GetProductId())
+		default:
+			return nil, status.Errorf(codes.Internal, "Failed to reserve stock: %v", err)
+		}
+	}
+
+	return &proto.ReserveStockResponse{
+		Reservation: reservation,
+	}, nil
+}
+
+func (s *Server) ReleaseReservation(ctx context.Context, req *proto.ReleaseReservationRequest) (*proto.ReleaseReservationResponse, error) {
+	reservation, err := s.Products.Release(ctx, req.GetId(), actorFromContext(ctx))
+	if err != nil {
+		return nil, reservationError("release", err)
+	}
+
+	return &proto.ReleaseReservationResponse{
+		Reservation: reservation,
 	}, nil
 }
+
+func (s *Server) CommitReservation(ctx context.Context, req *proto.CommitReservationRequest) (*proto.CommitReservationResponse, error) {
+	reservation, err := s.Products.Commit(ctx, req.GetId())
+	if err != nil {
+		return nil, reservationError("commit", err)
+	}
+
+	return &proto.CommitReservationResponse{
+		Reservation: reservation,
+	}, nil
+}
+
+func (s *Server) AdjustStock(ctx context.Context, req *proto.AdjustStockRequest) (*proto.AdjustStockResponse, error) {
+	v := validator.New()
+	v.Check(req.GetDelta() != 0, "delta", "must not be zero")
+	v.Check(req.GetReason() != "", "reason", "must be provided")
+	v.Check(len(req.GetReason()) <= 200, "reason", "must not be more than 200 bytes long")
+	if !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	movement, err := s.Products.AdjustStock(ctx, req.GetId(), req.GetVariantId(), req.GetDelta(), req.GetReason(), actorFromContext(ctx))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Errorf(codes.NotFound, "Product not found: %v", err)
+		case errors.Is(err, data.ErrInsufficientStock):
+			return nil, status.Errorf(codes.FailedPrecondition, "Stock cannot go below zero")
+		default:
+			return nil, status.Errorf(codes.Internal, "Failed to adjust stock: %v", err)
+		}
+	}
+
+	return &proto.AdjustStockResponse{
+		Movement: movement,
+	}, nil
+}
+
+func (s *Server) ListStockMovements(ctx context.Context, req *proto.ListStockMovementsRequest) (*proto.ListStockMovementsResponse, error) {
+	filters := req.GetFilters()
+	if filters == nil {
+		filters = &proto.Filters{}
+	}
+	if filters.Sort == "" {
+		filters.Sort = "-id"
+	}
+	filters.SortSafeList = data.MovementSortSafeList
+
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, failedValidationError(v.Errors)
+	}
+
+	movements, metadata, err := s.Movements.GetForProduct(ctx, req.GetId(), filters)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to get stock movements: %v", err)
+	}
+
+	return &proto.ListStockMovementsResponse{
+		Metadata:  metadata,
+		Movements: movements,
+	}, nil
+}
+
+func reservationError(operation string, err error) error {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return status.Errorf(codes.NotFound, "Reservation not found: %v", err)
+	case errors.Is(err, data.ErrReservationClosed):
+		return status.Errorf(codes.FailedPrecondition, "Failed to %s reservation: %v", operation, err)
+	default:
+		return status.Errorf(codes.Internal, "Failed to %s reservation: %v", operation, err)
+	}
+}
+
+// normalizeProduct resolves the price a client sent, including the deprecated
+// float field, into minor units and the category, including a legacy
+// category name, into a category ID, and rejects values that cannot be
+// stored.
+func (s *Server) normalizeProduct(product *proto.Product) error {
+	if product == nil {
+		return failedValidationError(map[string]string{"product": "must be provided"})
+	}
+	v := validator.New()
+	data.NormalizePrice(v, product)
+	data.ValidatePrice(v, product)
+	v.Check(product.Quantity >= 0, "quantity", "must not be negative")
+	v.Check(product.CategoryId > 0 || product.Category != "", "category_id", "must be provided")
+	data.ValidateOptions(v, product.Options)
+	if !v.Valid() {
+		return failedValidationError(v.Errors)
+	}
+
+	if product.CategoryId == 0 {
+		category, err := s.Categories.GetBySlug(data.Slugify(product.Category))
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return failedValidationError(map[string]string{"category": "does not exist"})
+			}
+			return status.Errorf(codes.Internal, "Failed to resolve category: %v", err)
+		}
+		product.CategoryId = category.Id
+		product.Category = category.Name
+	}
+	return nil
+}
+
+// productWriteError maps the errors Insert and Update share.
+func productWriteError(operation string, err error) error {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return status.Errorf(codes.NotFound, "Product not found: %v", err)
+	case errors.Is(err, data.ErrUnknownCategory):
+		return failedValidationError(map[string]string{"category_id": "does not exist"})
+	case errors.Is(err, data.ErrOptionsInUse):
+		return status.Errorf(codes.FailedPrecondition, "Options are still used by the product's variants")
+	case errors.Is(err, data.ErrCurrencyInUse):
+		return status.Errorf(codes.FailedPrecondition, "Variant prices must be cleared before the currency can change")
+	default:
+		return status.Errorf(codes.Internal, "Failed to %s product: %v", operation, err)
+	}
+}
+
+func validateCurrency(v *validator.Validator, code string) {
+	if code == "" {
+		return
+	}
+	_, known := currency.Exponent(code)
+	v.Check(known, "currency", "must be a supported ISO 4217 code")
+}
+
+// convertPrices lists products in the requested currency. An empty currency
+// leaves each product in the currency it was stored with.
+func (s *Server) convertPrices(ctx context.Context, products []*proto.Product, currency string) error {
+	if currency == "" || len(products) == 0 {
+		return nil
+	}
+
+	err := s.Currencies.Convert(ctx, products, currency)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUnknownCurrency):
+			return failedValidationError(map[string]string{"currency": "must be a supported ISO 4217 code"})
+		case errors.Is(err, data.ErrNoRate):
+			return failedValidationError(map[string]string{"currency": fmt.Sprintf("prices cannot be converted to %s", currency)})
+		default:
+			return status.Errorf(codes.Internal, "Failed to convert prices: %v", err)
+		}
+	}
+	return nil
+}
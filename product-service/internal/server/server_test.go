@@ -2,31 +2,95 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Skaifai/gophers-microservice/product-service/cmd/utils"
 	"github.com/Skaifai/gophers-microservice/product-service/config"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
 	"github.com/Skaifai/gophers-microservice/product-service/internal/logger"
 	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
-	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"log"
+	"net"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
-var server = func() *Server {
+// The tests call the server over an in-memory connection, so requests go
+// through the interceptors and the wire encoding as they do in production,
+// while the data lives in the memory models and published logs are recorded.
+var (
+	server    proto.ProductServiceClient
+	publisher = &logger.Recorder{}
+)
+
+func TestMain(m *testing.M) {
 	cfg := loadTestConfiguration()
-	db, err := utils.OpenDB(cfg)
+	store, err := utils.OpenStorage(cfg)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		log.Fatalf("failed to open storage: %v", err)
+	}
+	models := data.NewMemoryModels()
+	if err := seed(models); err != nil {
+		log.Fatalf("failed to seed models: %v", err)
 	}
-	publisher, err := logger.NewPublisher()
+
+	listener := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(UnaryInterceptors(time.Minute)...))
+	proto.RegisterProductServiceServer(srv, NewServer(models, publisher, store, cfg))
+	go srv.Serve(listener)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
 	if err != nil {
-		log.Fatalf("failed to create publisher: %v", err)
+		log.Fatalf("failed to dial server: %v", err)
 	}
-	return NewServer(db, publisher)
-}()
+	server = proto.NewProductServiceClient(conn)
+
+	code := m.Run()
+	conn.Close()
+	srv.Stop()
+	os.Exit(code)
+}
+
+// seed adds the categories and the first products the tests expect.
+func seed(models data.Models) error {
+	fruit, err := models.Categories.Insert(&proto.Category{Name: "Fruit", Slug: "fruit"})
+	if err != nil {
+		return err
+	}
+	berries, err := models.Categories.Insert(&proto.Category{Name: "Berries", Slug: "berries", ParentId: fruit.Id})
+	if err != nil {
+		return err
+	}
+
+	products := []*proto.Product{
+		{Name: "Banana", PriceMinor: 60000, Description: "Bananas from Ecuador", CategoryId: fruit.Id, Quantity: 10},
+		{Name: "Strawberry", PriceMinor: 150000, Description: "Sweet strawberries", CategoryId: berries.Id},
+		{Name: "Blueberry", PriceMinor: 220000, Description: "Wild blueberries from the north", CategoryId: berries.Id, Quantity: 4},
+		{Name: "Apple", PriceMinor: 85000, Description: "Apple from Almaty city", CategoryId: fruit.Id, Quantity: 5},
+	}
+	for _, product := range products {
+		product.Currency = data.DefaultCurrency
+		if _, err := models.Products.Insert(context.Background(), product, "seed"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 func TestServer_ShowProduct(t *testing.T) {
 	req := &proto.ShowProductRequest{
@@ -62,7 +126,36 @@ func TestServer_ListProducts(t *testing.T) {
 	}
 }
 
+func TestServer_BatchGetProducts(t *testing.T) {
+	res, err := server.BatchGetProducts(context.Background(), &proto.BatchGetProductsRequest{
+		Ids: []int64{4, 1 << 40, 4},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while getting products. %s", err.Error())
+	}
+	if len(res.GetProducts()) != 1 || res.GetProducts()[0].GetId() != 4 {
+		t.Errorf("products are %v, expected product 4 once", res.GetProducts())
+	}
+	if len(res.GetMissingIds()) != 1 || res.GetMissingIds()[0] != 1<<40 {
+		t.Errorf("missing ids are %v, expected [%d]", res.GetMissingIds(), int64(1<<40))
+	}
+
+	ids := make([]int64, 101)
+	for i := range ids {
+		ids[i] = int64(i + 1)
+	}
+	_, err = server.BatchGetProducts(context.Background(), &proto.BatchGetProductsRequest{Ids: ids})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("oversized batch returned %v, expected InvalidArgument", err)
+	}
+}
+
 func TestServer_UpdateProduct(t *testing.T) {
+	before, err := server.ShowProduct(context.Background(), &proto.ShowProductRequest{Id: 4})
+	if err != nil {
+		t.Fatalf("error acquired while showing product. %s", err.Error())
+	}
+
 	req := &proto.UpdateProductRequest{
 		Product: &proto.Product{
 			Id:          4,
@@ -81,28 +174,660 @@ func TestServer_UpdateProduct(t *testing.T) {
 	if res.GetMessage() != expected {
 		t.Errorf("error acquired while updating product. %s", err.Error())
 	}
+	// Stock only changes through AdjustStock and reservations.
+	if res.GetProduct().GetQuantity() != before.GetProduct().GetQuantity() {
+		t.Errorf("quantity after updating is %d, expected it to stay %d", res.GetProduct().GetQuantity(), before.GetProduct().GetQuantity())
+	}
+}
+
+func TestServer_ReserveStock(t *testing.T) {
+	res, err := server.ReserveStock(context.Background(), &proto.ReserveStockRequest{
+		ProductId: 4,
+		Quantity:  1,
+	})
+	if err != nil {
+		t.Fatalf("error acquired while reserving stock. %s", err.Error())
+	}
+	if res.GetReservation().GetStatus() != "pending" {
+		t.Errorf("reservation status is %q, expected pending", res.GetReservation().GetStatus())
+	}
+
+	released, err := server.ReleaseReservation(context.Background(), &proto.ReleaseReservationRequest{
+		Id: res.GetReservation().GetId(),
+	})
+	if err != nil {
+		t.Fatalf("error acquired while releasing reservation. %s", err.Error())
+	}
+	if released.GetReservation().GetStatus() != "released" {
+		t.Errorf("reservation status is %q, expected released", released.GetReservation().GetStatus())
+	}
+
+	_, err = server.CommitReservation(context.Background(), &proto.CommitReservationRequest{
+		Id: res.GetReservation().GetId(),
+	})
+	if err == nil {
+		t.Error("a released reservation must not be committed")
+	}
 }
 
-func getEnvironmentVar(key string) string {
-	godotenv.Load("..\\..\\.env")
-	return os.Getenv(key)
+func TestServer_AdjustStock(t *testing.T) {
+	res, err := server.AdjustStock(context.Background(), &proto.AdjustStockRequest{
+		Id:     4,
+		Delta:  2,
+		Reason: "restock",
+	})
+	if err != nil {
+		t.Fatalf("error acquired while adjusting stock. %s", err.Error())
+	}
+
+	product, err := server.ShowProduct(context.Background(), &proto.ShowProductRequest{Id: 4})
+	if err != nil {
+		t.Fatalf("error acquired while showing product. %s", err.Error())
+	}
+	if product.GetProduct().GetQuantity() != res.GetMovement().GetBalance() {
+		t.Errorf("quantity is %d, expected the movement balance %d", product.GetProduct().GetQuantity(), res.GetMovement().GetBalance())
+	}
+
+	movements, err := server.ListStockMovements(context.Background(), &proto.ListStockMovementsRequest{
+		Id:      4,
+		Filters: &proto.Filters{Page: 1, PageSize: 1},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while listing stock movements. %s", err.Error())
+	}
+	if len(movements.GetMovements()) != 1 || movements.GetMovements()[0].GetId() != res.GetMovement().GetId() {
+		t.Errorf("latest movement is %v, expected %v", movements.GetMovements(), res.GetMovement())
+	}
 }
 
 func loadTestConfiguration() *config.Config {
-	port, _ := strconv.Atoi(getEnvironmentVar("PORT"))
 	return &config.Config{
-		Port: port,
-		Env:  "development",
-		DB: struct {
-			DSN          string
-			MaxOpenConns int
-			MaxIdleConns int
-			MaxIdleTime  string
-		}{
-			DSN:          getEnvironmentVar("DB_DSN"),
-			MaxOpenConns: 25,
-			MaxIdleConns: 25,
-			MaxIdleTime:  "15m",
+		Env:               "development",
+		IdempotencyWindow: 24 * time.Hour,
+		ReservationTTL:    15 * time.Minute,
+		MaxImageSize:      5 << 20,
+		MaxBatchSize:      100,
+		Storage: config.Storage{
+			Backend: "local",
+			Root:    filepath.Join(os.TempDir(), "product-service-test-media"),
+			BaseURL: "http://localhost:7002/media",
+		},
+	}
+}
+
+func TestServer_AddProductVariant(t *testing.T) {
+	shown, err := server.ShowProduct(context.Background(), &proto.ShowProductRequest{Id: 4})
+	if err != nil {
+		t.Fatalf("error acquired while showing product. %s", err.Error())
+	}
+	product := shown.GetProduct()
+	product.Options = []*proto.ProductOption{{Name: "size", Values: []string{"S", "M"}}}
+	if _, err := server.UpdateProduct(context.Background(), &proto.UpdateProductRequest{Product: product}); err != nil {
+		t.Fatalf("error acquired while updating product. %s", err.Error())
+	}
+
+	res, err := server.AddProductVariant(context.Background(), &proto.AddProductVariantRequest{
+		Variant: &proto.ProductVariant{
+			ProductId: 4,
+			Sku:       fmt.Sprintf("TEST-%d", time.Now().UnixNano()),
+			Options:   map[string]string{"size": "M"},
+			Quantity:  3,
 		},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while adding variant. %s", err.Error())
+	}
+	defer server.DeleteProductVariant(context.Background(), &proto.DeleteProductVariantRequest{
+		ProductId: 4,
+		VariantId: res.GetVariant().GetId(),
+	})
+
+	shown, err = server.ShowProduct(context.Background(), &proto.ShowProductRequest{Id: 4})
+	if err != nil {
+		t.Fatalf("error acquired while showing product. %s", err.Error())
+	}
+	if !shown.GetProduct().GetIsAvailable() {
+		t.Errorf("product with a stocked variant is not available")
+	}
+	if len(shown.GetProduct().GetVariants()) == 0 {
+		t.Errorf("product has no variants, expected %v", res.GetVariant())
+	}
+
+	variant := res.GetVariant()
+	variant.Options = map[string]string{"size": "S"}
+	variant.Quantity = 100
+	updated, err := server.UpdateProductVariant(context.Background(), &proto.UpdateProductVariantRequest{Variant: variant})
+	if err != nil {
+		t.Fatalf("error acquired while updating variant. %s", err.Error())
+	}
+	if updated.GetVariant().GetQuantity() != 3 {
+		t.Errorf("variant quantity after updating is %d, expected it to stay 3", updated.GetVariant().GetQuantity())
+	}
+}
+
+func TestServer_SearchProducts(t *testing.T) {
+	res, err := server.ListProducts(context.Background(), &proto.ListProductsRequest{
+		Search:  "fro",
+		Filters: &proto.Filters{Page: 1, PageSize: 20, Sort: "relevance"},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while searching products. %s", err.Error())
+	}
+	if len(res.GetProducts()) != 3 {
+		t.Fatalf("search found %v, expected the three products described with \"from\"", res.GetProducts())
+	}
+	for _, product := range res.GetProducts() {
+		if !strings.Contains(product.GetSnippet(), "<mark>") {
+			t.Errorf("snippet %q has no highlighted word", product.GetSnippet())
+		}
+	}
+
+	res, err = server.ListProducts(context.Background(), &proto.ListProductsRequest{
+		Search:  "blueberyy",
+		Filters: &proto.Filters{Page: 1, PageSize: 20, Sort: "relevance"},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while searching products. %s", err.Error())
+	}
+	if !res.GetFuzzy() || len(res.GetProducts()) == 0 || res.GetProducts()[0].GetName() != "Blueberry" {
+		t.Errorf("misspelt search returned %v (fuzzy %t), expected Blueberry by similarity", res.GetProducts(), res.GetFuzzy())
+	}
+}
+
+func TestServer_ListProductsByCategory(t *testing.T) {
+	fruit, err := server.ListProducts(context.Background(), &proto.ListProductsRequest{
+		CategoryId: 1,
+		Facets:     true,
+		Filters:    &proto.Filters{Page: 2, PageSize: 2, Sort: "-price"},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while listing products. %s", err.Error())
+	}
+	if fruit.GetMetadata().GetTotalRecords() < 4 || fruit.GetMetadata().GetCurrentPage() != 2 {
+		t.Errorf("metadata is %v, expected page 2 of every fruit including the berries", fruit.GetMetadata())
+	}
+	products := fruit.GetProducts()
+	for i := 1; i < len(products); i++ {
+		if products[i].GetPriceMinor() > products[i-1].GetPriceMinor() {
+			t.Errorf("products are not sorted by descending price: %v", products)
+		}
+	}
+	if len(fruit.GetFacets().GetCategories()) != 2 {
+		t.Errorf("category facets are %v, expected Fruit and Berries", fruit.GetFacets().GetCategories())
+	}
+
+	berries, err := server.ListProducts(context.Background(), &proto.ListProductsRequest{
+		CategoryId: 2,
+		Filters:    &proto.Filters{Page: 1, PageSize: 20, Sort: "id"},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while listing products. %s", err.Error())
+	}
+	for _, product := range berries.GetProducts() {
+		if product.GetCategoryId() != 2 {
+			t.Errorf("berries list has %v", product)
+		}
+	}
+}
+
+func TestServer_DeleteAndRestoreProduct(t *testing.T) {
+	added, err := server.AddProduct(context.Background(), &proto.AddProductRequest{
+		Product: &proto.Product{Name: "Pear", PriceMinor: 90000, CategoryId: 1, Quantity: 2},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while adding product. %s", err.Error())
+	}
+	id := added.GetProduct().GetId()
+
+	if _, err = server.DeleteProduct(context.Background(), &proto.DeleteProductRequest{Id: id}); err != nil {
+		t.Fatalf("error acquired while deleting product. %s", err.Error())
+	}
+	_, err = server.ShowProduct(context.Background(), &proto.ShowProductRequest{Id: id})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("deleted product returned %v, expected NotFound", err)
+	}
+
+	_, err = server.ShowProduct(context.Background(), &proto.ShowProductRequest{Id: id, IncludeDeleted: true})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("anonymous include_deleted read returned %v, expected Unauthenticated", err)
+	}
+	asUser := metadata.AppendToOutgoingContext(context.Background(), "x-user-id", "7", "x-user-role", "USER")
+	_, err = server.RestoreProduct(asUser, &proto.RestoreProductRequest{Id: id})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("restoring as a user returned %v, expected PermissionDenied", err)
+	}
+
+	asAdmin := metadata.AppendToOutgoingContext(context.Background(), "x-user-id", "1", "x-user-role", "ADMIN")
+	if _, err = server.ShowProduct(asAdmin, &proto.ShowProductRequest{Id: id, IncludeDeleted: true}); err != nil {
+		t.Errorf("error acquired while showing a deleted product as an admin. %s", err.Error())
+	}
+	restored, err := server.RestoreProduct(asAdmin, &proto.RestoreProductRequest{Id: id})
+	if err != nil {
+		t.Fatalf("error acquired while restoring product. %s", err.Error())
+	}
+	if restored.GetProduct().GetDeletedAt() != nil {
+		t.Errorf("restored product still has deleted_at %v", restored.GetProduct().GetDeletedAt())
+	}
+	_, err = server.RestoreProduct(asAdmin, &proto.RestoreProductRequest{Id: id})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("restoring a product that is not deleted returned %v, expected FailedPrecondition", err)
+	}
+}
+
+func TestServer_ReserveStockBeyondStock(t *testing.T) {
+	_, err := server.ReserveStock(context.Background(), &proto.ReserveStockRequest{ProductId: 3, Quantity: 100})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("reserving more than the stock returned %v, expected FailedPrecondition", err)
+	}
+}
+
+func TestServer_ReserveVariantStock(t *testing.T) {
+	models := data.NewMemoryModels()
+	if err := seed(models); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(models, &logger.Recorder{}, nil, loadTestConfiguration())
+	ctx := context.Background()
+
+	shown, err := s.ShowProduct(ctx, &proto.ShowProductRequest{Id: 2})
+	if err != nil {
+		t.Fatalf("error acquired while showing product. %s", err.Error())
+	}
+	product := shown.GetProduct()
+	product.Options = []*proto.ProductOption{{Name: "size", Values: []string{"S", "M"}}}
+	if _, err = s.UpdateProduct(ctx, &proto.UpdateProductRequest{Product: product}); err != nil {
+		t.Fatalf("error acquired while updating product. %s", err.Error())
+	}
+	added, err := s.AddProductVariant(ctx, &proto.AddProductVariantRequest{
+		Variant: &proto.ProductVariant{ProductId: 2, Sku: "STRAWBERRY-M", Options: map[string]string{"size": "M"}, Quantity: 3},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while adding variant. %s", err.Error())
+	}
+	variantID := added.GetVariant().GetId()
+
+	_, err = s.ReserveStock(ctx, &proto.ReserveStockRequest{ProductId: 2, Quantity: 1})
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(status.Convert(err).Message(), "variant_id") {
+		t.Errorf("reserving a product whose stock is on its variants returned %v, expected FailedPrecondition naming variant_id", err)
+	}
+
+	reserved, err := s.ReserveStock(ctx, &proto.ReserveStockRequest{ProductId: 2, VariantId: variantID, Quantity: 2})
+	if err != nil {
+		t.Fatalf("error acquired while reserving variant stock. %s", err.Error())
+	}
+	if reserved.GetReservation().GetVariantId() != variantID {
+		t.Errorf("reservation has variant %d, expected %d", reserved.GetReservation().GetVariantId(), variantID)
+	}
+	variantQuantity := func() int32 {
+		shown, err := s.ShowProduct(ctx, &proto.ShowProductRequest{Id: 2})
+		if err != nil {
+			t.Fatalf("error acquired while showing product. %s", err.Error())
+		}
+		return shown.GetProduct().GetVariants()[0].GetQuantity()
+	}
+	if quantity := variantQuantity(); quantity != 1 {
+		t.Errorf("variant quantity after reserving is %d, expected 1", quantity)
+	}
+
+	_, err = s.ReserveStock(ctx, &proto.ReserveStockRequest{ProductId: 2, VariantId: variantID, Quantity: 2})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("reserving more than the variant's stock returned %v, expected FailedPrecondition", err)
+	}
+
+	if _, err = s.ReleaseReservation(ctx, &proto.ReleaseReservationRequest{Id: reserved.GetReservation().GetId()}); err != nil {
+		t.Fatalf("error acquired while releasing the reservation. %s", err.Error())
+	}
+	if quantity := variantQuantity(); quantity != 3 {
+		t.Errorf("variant quantity after releasing is %d, expected 3", quantity)
+	}
+}
+
+// TestServer_WritesWithoutBroker checks that stock and review writes do not
+// wait on the broker: their log lines go through the outbox, so a broker
+// that is down neither fails the call nor is sent anything.
+func TestServer_WritesWithoutBroker(t *testing.T) {
+	models := data.NewMemoryModels()
+	if err := seed(models); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &logger.Recorder{Err: errors.New("broker is down")}
+	s := NewServer(models, recorder, nil, loadTestConfiguration())
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-user-id", "7"))
+
+	reserved, err := s.ReserveStock(ctx, &proto.ReserveStockRequest{ProductId: 3, Quantity: 1})
+	if err != nil {
+		t.Fatalf("error acquired while reserving stock. %s", err.Error())
+	}
+	if _, err = s.ReleaseReservation(ctx, &proto.ReleaseReservationRequest{Id: reserved.GetReservation().GetId()}); err != nil {
+		t.Errorf("error acquired while releasing the reservation. %s", err.Error())
+	}
+	reserved, err = s.ReserveStock(ctx, &proto.ReserveStockRequest{ProductId: 3, Quantity: 1})
+	if err != nil {
+		t.Fatalf("error acquired while reserving stock. %s", err.Error())
+	}
+	if _, err = s.CommitReservation(ctx, &proto.CommitReservationRequest{Id: reserved.GetReservation().GetId()}); err != nil {
+		t.Errorf("error acquired while committing the reservation. %s", err.Error())
+	}
+	if _, err = s.AdjustStock(ctx, &proto.AdjustStockRequest{Id: 3, Delta: 5, Reason: "restock"}); err != nil {
+		t.Errorf("error acquired while adjusting stock. %s", err.Error())
+	}
+
+	review, err := s.AddReview(ctx, &proto.AddReviewRequest{Review: &proto.Review{ProductId: 3, Rating: 4}})
+	if err != nil {
+		t.Fatalf("error acquired while adding review. %s", err.Error())
+	}
+	if _, err = s.DeleteReview(ctx, &proto.DeleteReviewRequest{ProductId: 3, ReviewId: review.GetReview().GetId()}); err != nil {
+		t.Errorf("error acquired while deleting review. %s", err.Error())
+	}
+
+	if logs := recorder.Logs(); len(logs) != 0 {
+		t.Errorf("sent %q to the broker, expected nothing", logs)
+	}
+}
+
+func TestServer_Reviews(t *testing.T) {
+	asUser := func(id string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "x-user-id", id, "x-user-role", "USER")
+	}
+	asAdmin := metadata.AppendToOutgoingContext(context.Background(), "x-user-id", "1", "x-user-role", "ADMIN")
+
+	_, err := server.AddReview(context.Background(), &proto.AddReviewRequest{
+		Review: &proto.Review{ProductId: 2, Rating: 5},
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("anonymous review returned %v, expected Unauthenticated", err)
+	}
+
+	var ids []int64
+	for _, review := range []struct {
+		user   string
+		rating int32
+	}{{"7", 5}, {"8", 2}} {
+		res, err := server.AddReview(asUser(review.user), &proto.AddReviewRequest{
+			Review: &proto.Review{ProductId: 2, Rating: review.rating, Title: "Strawberries"},
+		})
+		if err != nil {
+			t.Fatalf("error acquired while adding review. %s", err.Error())
+		}
+		if res.GetReview().GetStatus() != data.ReviewPending {
+			t.Errorf("new review is %q, expected pending", res.GetReview().GetStatus())
+		}
+		ids = append(ids, res.GetReview().GetId())
+	}
+	_, err = server.AddReview(asUser("7"), &proto.AddReviewRequest{
+		Review: &proto.Review{ProductId: 2, Rating: 1},
+	})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("second review by the same user returned %v, expected AlreadyExists", err)
+	}
+
+	_, err = server.ModerateReview(asUser("7"), &proto.ModerateReviewRequest{ProductId: 2, ReviewId: ids[0], Status: data.ReviewApproved})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("moderating as a user returned %v, expected PermissionDenied", err)
+	}
+	_, err = server.ListReviews(context.Background(), &proto.ListReviewsRequest{ProductId: 2, Status: data.ReviewPending, Filters: &proto.Filters{Page: 1, PageSize: 10, Sort: "id"}})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("anonymous listing of pending reviews returned %v, expected Unauthenticated", err)
+	}
+	pending, err := server.ListReviews(asAdmin, &proto.ListReviewsRequest{ProductId: 2, Status: data.ReviewPending, Filters: &proto.Filters{Page: 1, PageSize: 10, Sort: "id"}})
+	if err != nil {
+		t.Fatalf("error acquired while listing pending reviews. %s", err.Error())
+	}
+	if len(pending.GetReviews()) != 2 {
+		t.Errorf("%d reviews are pending, expected 2", len(pending.GetReviews()))
+	}
+
+	for _, id := range ids {
+		_, err = server.ModerateReview(asAdmin, &proto.ModerateReviewRequest{ProductId: 2, ReviewId: id, Status: data.ReviewApproved})
+		if err != nil {
+			t.Fatalf("error acquired while moderating review. %s", err.Error())
+		}
+	}
+	product, err := server.ShowProduct(context.Background(), &proto.ShowProductRequest{Id: 2})
+	if err != nil {
+		t.Fatalf("error acquired while showing product. %s", err.Error())
+	}
+	if product.GetProduct().GetAverageRating() != 3.5 || product.GetProduct().GetReviewCount() != 2 {
+		t.Errorf("rating is %v from %d reviews, expected 3.5 from 2",
+			product.GetProduct().GetAverageRating(), product.GetProduct().GetReviewCount())
+	}
+
+	rated, err := server.ListProducts(context.Background(), &proto.ListProductsRequest{
+		Filters: &proto.Filters{Page: 1, PageSize: 1, Sort: "-rating"},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while listing products. %s", err.Error())
+	}
+	if len(rated.GetProducts()) != 1 || rated.GetProducts()[0].GetId() != 2 {
+		t.Errorf("best rated products are %v, expected product 2", rated.GetProducts())
+	}
+
+	_, err = server.UpdateReview(asUser("8"), &proto.UpdateReviewRequest{
+		Review: &proto.Review{Id: ids[0], ProductId: 2, Rating: 1},
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("changing another user's review returned %v, expected PermissionDenied", err)
+	}
+	_, err = server.DeleteReview(asUser("8"), &proto.DeleteReviewRequest{ProductId: 2, ReviewId: ids[1]})
+	if err != nil {
+		t.Fatalf("error acquired while deleting review. %s", err.Error())
+	}
+
+	reviews, err := server.ListReviews(context.Background(), &proto.ListReviewsRequest{
+		ProductId: 2,
+		Filters:   &proto.Filters{Page: 1, PageSize: 10, Sort: "-rating"},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while listing reviews. %s", err.Error())
+	}
+	if len(reviews.GetReviews()) != 1 || reviews.GetReviews()[0].GetId() != ids[0] {
+		t.Errorf("reviews are %v, expected only review %d", reviews.GetReviews(), ids[0])
+	}
+}
+
+func TestServer_PricingRules(t *testing.T) {
+	now := time.Now()
+	_, err := server.AddPricingRule(context.Background(), &proto.AddPricingRuleRequest{
+		Rule: &proto.PricingRule{Name: "Missing", Scope: data.PricingScopeCategory, TargetId: 99,
+			Kind: data.PricingKindPercent, PercentBps: 2000, StartsAt: timestamppb.New(now)},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("rule for a missing category returned %v, expected InvalidArgument", err)
+	}
+
+	// Fruit (1) covers Strawberry (2) through its Berries subcategory.
+	added, err := server.AddPricingRule(context.Background(), &proto.AddPricingRuleRequest{
+		Rule: &proto.PricingRule{Name: "Fruit weekend", Scope: data.PricingScopeCategory, TargetId: 1,
+			Kind: data.PricingKindPercent, PercentBps: 2000,
+			StartsAt: timestamppb.New(now.Add(-time.Hour)), EndsAt: timestamppb.New(now.Add(48 * time.Hour))},
+	})
+	if err != nil {
+		t.Fatalf("error acquired while adding pricing rule. %s", err.Error())
+	}
+	rule := added.GetRule()
+	defer server.DeletePricingRule(context.Background(), &proto.DeletePricingRuleRequest{Id: rule.GetId()})
+
+	shown, err := server.ShowProduct(context.Background(), &proto.ShowProductRequest{Id: 2})
+	if err != nil {
+		t.Fatalf("error acquired while showing product. %s", err.Error())
+	}
+	product := shown.GetProduct()
+	if product.GetEffectivePriceMinor() != product.GetPriceMinor()*8/10 || product.GetPricingRuleId() != rule.GetId() {
+		t.Errorf("effective price is %d from rule %d, expected %d from rule %d",
+			product.GetEffectivePriceMinor(), product.GetPricingRuleId(), product.GetPriceMinor()*8/10, rule.GetId())
+	}
+
+	preview, err := server.PreviewPrices(context.Background(), &proto.PreviewPricesRequest{
+		Ids: []int64{2, 404},
+		At:  timestamppb.New(now.Add(72 * time.Hour)),
+	})
+	if err != nil {
+		t.Fatalf("error acquired while previewing prices. %s", err.Error())
+	}
+	if len(preview.GetProducts()) != 1 || len(preview.GetMissingIds()) != 1 {
+		t.Fatalf("preview returned %d products and missing %v, expected 1 and [404]", len(preview.GetProducts()), preview.GetMissingIds())
+	}
+	if later := preview.GetProducts()[0]; later.GetEffectivePriceMinor() != later.GetPriceMinor() || later.GetPricingRuleId() != 0 {
+		t.Errorf("effective price after the rule ends is %d, expected the list price %d", later.GetEffectivePriceMinor(), later.GetPriceMinor())
+	}
+
+	active, err := server.ListPricingRules(context.Background(), &proto.ListPricingRulesRequest{
+		Filters:  &proto.Filters{Page: 1, PageSize: 10, Sort: "-priority"},
+		ActiveAt: timestamppb.New(now.Add(72 * time.Hour)),
+	})
+	if err != nil {
+		t.Fatalf("error acquired while listing pricing rules. %s", err.Error())
+	}
+	if len(active.GetRules()) != 0 {
+		t.Errorf("rules active after the sale are %v, expected none", active.GetRules())
+	}
+}
+
+func TestReadYourWritesInterceptor(t *testing.T) {
+	interceptor := ReadYourWritesInterceptor(time.Minute)
+
+	call := func(md metadata.MD) (primary bool) {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/ProductService/ShowProduct"}, func(ctx context.Context, req any) (any, error) {
+			primary = data.ReadsFromPrimary(ctx)
+			return nil, nil
+		})
+		return primary
+	}
+
+	if call(metadata.Pairs("x-user-id", "7")) {
+		t.Error("a read without a token was sent to the primary")
+	}
+	if !call(metadata.Pairs("x-read-primary", "true")) {
+		t.Error("a read that asked for the primary did not go to it")
+	}
+	past := fmt.Sprint(time.Now().Add(-time.Second).UnixMilli())
+	if call(metadata.Pairs("x-read-primary-until", past)) {
+		t.Error("a read with an expired token was sent to the primary")
+	}
+
+	// Writes return the token over the wire, wherever they were handled.
+	var header metadata.MD
+	_, err := server.AdjustStock(context.Background(), &proto.AdjustStockRequest{Id: 1, Delta: 1, Reason: "restock"}, grpc.Header(&header))
+	if err != nil {
+		t.Fatalf("error acquired while adjusting stock. %s", err.Error())
+	}
+	tokens := header.Get("x-read-primary-until")
+	if len(tokens) != 1 {
+		t.Fatalf("a write returned the tokens %v, expected one", tokens)
+	}
+	if !call(metadata.Pairs("x-read-primary-until", tokens[0])) {
+		t.Error("a read with the token a write returned did not go to the primary")
+	}
+
+	header = nil
+	if _, err = server.ShowProduct(context.Background(), &proto.ShowProductRequest{Id: 1}, grpc.Header(&header)); err != nil {
+		t.Fatalf("error acquired while showing product. %s", err.Error())
+	}
+	if len(header.Get("x-read-primary-until")) != 0 {
+		t.Error("a read returned a read-your-writes token")
+	}
+}
+
+func TestUnaryInterceptorsLogPanics(t *testing.T) {
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/ProductService/ShowProduct"}
+	handler := func(ctx context.Context, req any) (any, error) {
+		panic("boom")
+	}
+	// Chain the interceptors the way grpc.ChainUnaryInterceptor does, with
+	// the first one outermost.
+	interceptors := UnaryInterceptors(time.Minute)
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req any) (any, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+
+	if _, err := handler(context.Background(), nil); status.Code(err) != codes.Internal {
+		t.Errorf("a panicking call returned %v, expected Internal", err)
+	}
+	if !strings.Contains(logged.String(), "method=/ProductService/ShowProduct code=Internal") {
+		t.Errorf("a panicking call was not logged:\n%s", logged.String())
+	}
+}
+
+func TestServer_AddProductIdempotent(t *testing.T) {
+	asUser := func(id string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "x-user-id", id)
+	}
+	newRequest := func(name string) *proto.AddProductRequest {
+		return &proto.AddProductRequest{
+			Product: &proto.Product{Name: name, PriceMinor: 50000, Currency: data.DefaultCurrency,
+				Description: "Green pears", CategoryId: 1},
+			IdempotencyKey: "add-pear",
+		}
+	}
+
+	first, err := server.AddProduct(asUser("7"), newRequest("Pear"))
+	if err != nil {
+		t.Fatalf("error acquired while adding product. %s", err.Error())
+	}
+	if first.GetReplayed() {
+		t.Error("first request with the key was replayed")
+	}
+
+	retried, err := server.AddProduct(asUser("7"), newRequest("Pear"))
+	if err != nil {
+		t.Fatalf("error acquired while retrying product. %s", err.Error())
+	}
+	if !retried.GetReplayed() || retried.GetProduct().GetId() != first.GetProduct().GetId() {
+		t.Errorf("retry returned product %d (replayed %v), expected product %d replayed",
+			retried.GetProduct().GetId(), retried.GetReplayed(), first.GetProduct().GetId())
+	}
+
+	_, err = server.AddProduct(asUser("7"), newRequest("Quince"))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("reusing the key for another product returned %v, expected InvalidArgument", err)
+	}
+
+	other, err := server.AddProduct(asUser("8"), newRequest("Quince"))
+	if err != nil {
+		t.Fatalf("error acquired while adding product as another user. %s", err.Error())
+	}
+	if other.GetReplayed() || other.GetProduct().GetId() == first.GetProduct().GetId() {
+		t.Errorf("another user's key %q replayed product %d", "add-pear", other.GetProduct().GetId())
+	}
+}
+
+func TestServer_AddProductIdempotencyKeyExpires(t *testing.T) {
+	cfg := loadTestConfiguration()
+	cfg.IdempotencyWindow = time.Millisecond
+	models := data.NewMemoryModels()
+	if err := seed(models); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(models, &logger.Recorder{}, nil, cfg)
+
+	// The server is called directly, without the wire encoding, so each call
+	// gets a request of its own.
+	newRequest := func() *proto.AddProductRequest {
+		return &proto.AddProductRequest{
+			Product: &proto.Product{Name: "Pear", PriceMinor: 50000, Currency: data.DefaultCurrency,
+				Description: "Green pears", CategoryId: 1},
+			IdempotencyKey: "add-pear",
+		}
+	}
+	first, err := s.AddProduct(context.Background(), newRequest())
+	if err != nil {
+		t.Fatalf("error acquired while adding product. %s", err.Error())
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	again, err := s.AddProduct(context.Background(), newRequest())
+	if err != nil {
+		t.Fatalf("error acquired while adding product after the key expired. %s", err.Error())
+	}
+	if again.GetReplayed() || again.GetProduct().GetId() == first.GetProduct().GetId() {
+		t.Errorf("expired key replayed product %d", again.GetProduct().GetId())
 	}
 }
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/data"
+	"github.com/Skaifai/gophers-microservice/product-service/internal/validator"
+	"github.com/Skaifai/gophers-microservice/product-service/pkg/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) AddProductVariant(ctx context.Context, req *proto.AddProductVariantRequest) (*proto.AddProductVariantResponse, error) {
+	variant := req.GetVariant()
+	if err := s.validateVariant(ctx, variant); err != nil {
+		return nil, err
+	}
+
+	variant, err := s.Variants.Insert(variant, actorFromContext(ctx))
+	if err != nil {
+		return nil, variantWriteError("add", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Variant %s has been added to product with id: %d", variant.Sku, variant.ProductId))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.AddProductVariantResponse{
+		Variant: variant,
+	}, nil
+}
+
+func (s *Server) UpdateProductVariant(ctx context.Context, req *proto.UpdateProductVariantRequest) (*proto.UpdateProductVariantResponse, error) {
+	variant := req.GetVariant()
+	if err := s.validateVariant(ctx, variant); err != nil {
+		return nil, err
+	}
+
+	err := s.Variants.Update(variant, actorFromContext(ctx))
+	if err != nil {
+		return nil, variantWriteError("update", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Variant %s of product with id %d has been updated", variant.Sku, variant.ProductId))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.UpdateProductVariantResponse{
+		Variant: variant,
+	}, nil
+}
+
+func (s *Server) DeleteProductVariant(ctx context.Context, req *proto.DeleteProductVariantRequest) (*proto.DeleteProductVariantResponse, error) {
+	err := s.Variants.Delete(req.GetProductId(), req.GetVariantId(), actorFromContext(ctx))
+	if err != nil {
+		return nil, variantWriteError("delete", err)
+	}
+
+	err = s.Publisher.SendLog(fmt.Sprintf("Variant %d has been deleted from product with id: %d", req.GetVariantId(), req.GetProductId()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.DeleteProductVariantResponse{
+		Message: fmt.Sprintf("Variant has been successfully deleted with id: %d", req.GetVariantId()),
+	}, nil
+}
+
+// validateVariant checks a variant against the current options of its
+// product. The data layer checks the options again under a lock, in case the
+// product changes in between. The product is read from the primary, so that
+// a replica lagging behind a change of options cannot reject the variant.
+func (s *Server) validateVariant(ctx context.Context, variant *proto.ProductVariant) error {
+	if variant == nil {
+		return failedValidationError(map[string]string{"variant": "must be provided"})
+	}
+
+	product, err := s.Products.Get(data.WithPrimary(ctx), variant.ProductId)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return status.Errorf(codes.NotFound, "Product not found: %v", err)
+		}
+		return status.Errorf(codes.Internal, "Failed to retrieve product: %v", err)
+	}
+
+	v := validator.New()
+	if data.ValidateVariant(v, variant, product.Options); !v.Valid() {
+		return failedValidationError(v.Errors)
+	}
+	return nil
+}
+
+// attachVariants fills in the variants of each product with one query.
+func (s *Server) attachVariants(products []*proto.Product) error {
+	ids := make([]int64, 0, len(products))
+	for _, product := range products {
+		ids = append(ids, product.Id)
+	}
+
+	byProduct, err := s.Variants.GetForProducts(ids)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to get product variants: %v", err)
+	}
+	for _, product := range products {
+		product.Variants = byProduct[product.Id]
+	}
+	return nil
+}
+
+func variantWriteError(operation string, err error) error {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return status.Errorf(codes.NotFound, "Variant not found: %v", err)
+	case errors.Is(err, data.ErrDuplicateSKU):
+		return failedValidationError(map[string]string{"sku": "is already used by another variant"})
+	case errors.Is(err, data.ErrDuplicateVariant):
+		return failedValidationError(map[string]string{"options": "are already used by another variant of the product"})
+	case errors.Is(err, data.ErrVariantOptions):
+		return status.Errorf(codes.FailedPrecondition, "The product's options changed; retry with its current options")
+	default:
+		return status.Errorf(codes.Internal, "Failed to %s variant: %v", operation, err)
+	}
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Options describes a bucket on an S3-compatible service.
+type S3Options struct {
+	// Endpoint is the service URL, e.g. https://s3.eu-central-1.amazonaws.com
+	// or http://minio:9000.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses objects as Endpoint/Bucket/key, which most
+	// self-hosted S3-compatible services expect, instead of using the bucket
+	// as a subdomain.
+	PathStyle bool
+	// PublicURL is where objects are served from, such as a CDN. It defaults
+	// to the object's own URL.
+	PublicURL string
+}
+
+// S3 keeps objects in a bucket of any S3-compatible service.
+type S3 struct {
+	bucket    string
+	pathStyle bool
+	publicURL string
+	endpoint  *url.URL
+	client    *minio.Client
+}
+
+// NewS3 returns an S3 store for the bucket. No request is made until the
+// first object is stored.
+func NewS3(opts S3Options) (*S3, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", opts.Endpoint)
+	}
+
+	lookup := minio.BucketLookupDNS
+	if opts.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure:       endpoint.Scheme == "https",
+		Region:       opts.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{
+		bucket:    opts.Bucket,
+		pathStyle: opts.PathStyle,
+		publicURL: opts.PublicURL,
+		endpoint:  endpoint,
+		client:    client,
+	}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	return err
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+
+	err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+	// S3 itself answers 204 for a missing key, but not every compatible
+	// service does; a missing object is already deleted.
+	if resp := minio.ToErrorResponse(err); resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *S3) URL(key string) string {
+	if s.publicURL != "" {
+		return joinURL(s.publicURL, key)
+	}
+	if s.pathStyle {
+		return fmt.Sprintf("%s://%s/%s/%s", s.endpoint.Scheme, s.endpoint.Host, s.bucket, key)
+	}
+	return fmt.Sprintf("%s://%s.%s/%s", s.endpoint.Scheme, s.bucket, s.endpoint.Host, key)
+}
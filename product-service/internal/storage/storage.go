@@ -0,0 +1,34 @@
+// Package storage keeps product media in a pluggable backend: a directory on
+// the local filesystem or an S3-compatible bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+)
+
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// Storage stores objects under slash-separated keys and reports the public
+// URL each one is served from.
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Delete removes an object. Deleting a key that does not exist is not an
+	// error.
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+// validKey rejects keys that are absolute or could escape the storage root.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "..") {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+func joinURL(base, key string) string {
+	return strings.TrimSuffix(base, "/") + "/" + key
+}
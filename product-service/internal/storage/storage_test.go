@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	local := Local{Root: t.TempDir(), BaseURL: "http://localhost:7002/media/"}
+	ctx := context.Background()
+
+	err := local.Put(ctx, "products/1/image.jpg", []byte("jpeg"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(local.Root, "products", "1", "image.jpg"))
+	if err != nil || string(data) != "jpeg" {
+		t.Fatalf("stored object = %q, %v", data, err)
+	}
+
+	if url := local.URL("products/1/image.jpg"); url != "http://localhost:7002/media/products/1/image.jpg" {
+		t.Errorf("URL() = %q", url)
+	}
+
+	if err = local.Delete(ctx, "products/1/image.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err = local.Delete(ctx, "products/1/image.jpg"); err != nil {
+		t.Errorf("deleting a missing object returned %v", err)
+	}
+
+	for _, key := range []string{"", "/etc/passwd", "../outside", "products/../../outside"} {
+		if err := local.Put(ctx, key, nil, "image/jpeg"); err != ErrInvalidKey {
+			t.Errorf("Put(%q) = %v, expected ErrInvalidKey", key, err)
+		}
+	}
+}
+
+func TestS3(t *testing.T) {
+	type request struct {
+		method, path, contentType string
+	}
+	var requests []request
+	var stored string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, request{r.Method, r.URL.Path, r.Header.Get("Content-Type")})
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			stored = string(body)
+			w.Header().Set("ETag", `"etag"`)
+			w.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			// Some S3-compatible services report a missing object.
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	s3, err := NewS3(S3Options{
+		Endpoint:  srv.URL,
+		Region:    "us-east-1",
+		Bucket:    "media",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err = s3.Put(ctx, "products/1/a.jpg", []byte("jpeg"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s3.Delete(ctx, "products/1/a.jpg"); err != nil {
+		t.Errorf("deleting a missing object returned %v", err)
+	}
+
+	expected := []request{
+		{http.MethodPut, "/media/products/1/a.jpg", "image/jpeg"},
+		{http.MethodDelete, "/media/products/1/a.jpg", ""},
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("requests = %+v, expected %+v", requests, expected)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Errorf("request %d = %+v, expected %+v", i, requests[i], expected[i])
+		}
+	}
+
+	// Over plain HTTP the payload is sent in signed chunks.
+	if !strings.Contains(stored, "\njpeg\r\n") {
+		t.Errorf("stored object = %q", stored)
+	}
+
+	if err := s3.Put(ctx, "../outside", nil, "image/jpeg"); err != ErrInvalidKey {
+		t.Errorf("Put(../outside) = %v, expected ErrInvalidKey", err)
+	}
+}
+
+func TestS3URL(t *testing.T) {
+	tests := []struct {
+		options  S3Options
+		expected string
+	}{
+		{S3Options{Endpoint: "https://s3.amazonaws.com", Bucket: "media"}, "https://media.s3.amazonaws.com/products/1/a.jpg"},
+		{S3Options{Endpoint: "http://minio:9000", Bucket: "media", PathStyle: true}, "http://minio:9000/media/products/1/a.jpg"},
+		{S3Options{Endpoint: "http://minio:9000", Bucket: "media", PublicURL: "https://cdn.example.com"}, "https://cdn.example.com/products/1/a.jpg"},
+	}
+
+	for _, tt := range tests {
+		s3, err := NewS3(tt.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url := s3.URL("products/1/a.jpg"); url != tt.expected {
+			t.Errorf("URL() = %q, expected %q", url, tt.expected)
+		}
+	}
+}
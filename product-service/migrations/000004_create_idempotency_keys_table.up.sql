@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key text PRIMARY KEY,
+    -- sha256 of the request the key was first used with
+    fingerprint bytea not null,
+    -- serialized response, NULL until the original request has committed
+    response bytea,
+    created_at timestamp(0) with time zone not null default NOW(),
+    expires_at timestamp(0) with time zone not null
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
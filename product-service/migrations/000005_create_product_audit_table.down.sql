@@ -0,0 +1 @@
+DROP TABLE IF EXISTS product_audit;
\ No newline at end of file
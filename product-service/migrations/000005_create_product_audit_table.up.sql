@@ -0,0 +1,13 @@
+-- product_id deliberately has no foreign key so that history survives the
+-- product being deleted.
+CREATE TABLE IF NOT EXISTS product_audit (
+    id bigserial PRIMARY KEY,
+    product_id bigint not null,
+    action varchar(10) not null,
+    actor text not null default '',
+    version integer not null,
+    changes jsonb not null,
+    changed_at timestamp(0) with time zone not null default NOW()
+);
+
+CREATE INDEX IF NOT EXISTS product_audit_product_id_idx ON product_audit (product_id, id);
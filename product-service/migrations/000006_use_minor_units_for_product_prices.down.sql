@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS currency_rates;
+
+-- The float price has no currency, so each amount is converted with its own
+-- currency's minor-unit digits (see pkg/currency) and the currency is lost.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS price float8;
+UPDATE products SET price = price_minor / power(10, CASE currency
+    WHEN 'JPY' THEN 0
+    WHEN 'KRW' THEN 0
+    WHEN 'KWD' THEN 3
+    ELSE 2
+END);
+ALTER TABLE products ALTER COLUMN price SET NOT NULL;
+
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_price_minor_check;
+ALTER TABLE products DROP COLUMN IF EXISTS price_minor;
+ALTER TABLE products DROP COLUMN IF EXISTS currency;
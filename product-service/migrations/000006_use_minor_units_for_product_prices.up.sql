@@ -0,0 +1,19 @@
+ALTER TABLE products ADD COLUMN IF NOT EXISTS price_minor bigint;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS currency char(3) not null default 'KZT';
+
+-- Existing prices were entered in tenge, which has two minor digits.
+UPDATE products SET price_minor = round(price::numeric * 100);
+
+ALTER TABLE products ALTER COLUMN price_minor SET NOT NULL;
+ALTER TABLE products ADD CONSTRAINT products_price_minor_check CHECK (price_minor >= 0);
+ALTER TABLE products DROP COLUMN price;
+
+-- rate converts one unit of base into quote; the inverse pair is derived
+-- when only one direction is stored.
+CREATE TABLE IF NOT EXISTS currency_rates (
+    base char(3) not null,
+    quote char(3) not null,
+    rate numeric(20, 10) not null CHECK (rate > 0),
+    updated_at timestamp(0) with time zone not null default NOW(),
+    PRIMARY KEY (base, quote)
+);
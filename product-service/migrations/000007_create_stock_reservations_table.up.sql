@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    id bigserial PRIMARY KEY,
+    product_id bigint not null REFERENCES products ON DELETE CASCADE,
+    quantity integer not null CHECK (quantity > 0),
+    status text not null default 'pending',
+    created_at timestamp(0) with time zone not null default NOW(),
+    expires_at timestamp(0) with time zone not null
+);
+
+-- The sweeper only ever looks for pending reservations past their expiry.
+CREATE INDEX IF NOT EXISTS stock_reservations_pending_expires_at_idx
+    ON stock_reservations (expires_at) WHERE status = 'pending';
@@ -0,0 +1,14 @@
+-- Like product_audit, product_id has no foreign key so that the ledger
+-- survives the product being deleted.
+CREATE TABLE IF NOT EXISTS stock_movements (
+    id bigserial PRIMARY KEY,
+    product_id bigint not null,
+    delta integer not null,
+    reason text not null,
+    actor text not null default '',
+    -- quantity on hand after this movement
+    balance integer not null,
+    created_at timestamp(0) with time zone not null default NOW()
+);
+
+CREATE INDEX IF NOT EXISTS stock_movements_product_id_idx ON stock_movements (product_id, id);
@@ -0,0 +1,12 @@
+ALTER TABLE products ADD COLUMN IF NOT EXISTS category varchar(20);
+
+UPDATE products p
+SET category = left(c.name, 20)
+FROM categories c
+WHERE c.id = p.category_id;
+
+ALTER TABLE products ALTER COLUMN category SET NOT NULL;
+CREATE INDEX IF NOT EXISTS products_category_idx ON products USING GIN (to_tsvector('simple', category));
+
+ALTER TABLE products DROP COLUMN category_id;
+DROP TABLE IF EXISTS categories;
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id bigserial PRIMARY KEY,
+    parent_id bigint REFERENCES categories ON DELETE RESTRICT CHECK (parent_id <> id),
+    name varchar(50) not null,
+    slug text not null UNIQUE,
+    sort_order integer not null default 0,
+    created_at timestamp(0) with time zone not null default NOW(),
+    version integer not null default 1
+);
+
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories (parent_id, sort_order);
+
+-- Existing free-text categories that only differ in case, spacing or
+-- punctuation share a slug and become one category, named after the most
+-- common spelling. Variants such as "Fruit" and "Fruits" still need to be
+-- merged by hand.
+CREATE FUNCTION pg_temp.slugify(value text) RETURNS text AS $$
+    SELECT coalesce(nullif(trim(both '-' from regexp_replace(lower(trim(value)), '[^[:alnum:]]+', '-', 'g')), ''), 'uncategorized')
+$$ LANGUAGE SQL IMMUTABLE;
+
+INSERT INTO categories (name, slug)
+SELECT mode() WITHIN GROUP (ORDER BY trim(category)), pg_temp.slugify(category)
+FROM products
+GROUP BY pg_temp.slugify(category)
+ON CONFLICT (slug) DO NOTHING;
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS category_id bigint REFERENCES categories ON DELETE RESTRICT;
+
+UPDATE products p
+SET category_id = c.id
+FROM categories c
+WHERE c.slug = pg_temp.slugify(p.category);
+
+ALTER TABLE products ALTER COLUMN category_id SET NOT NULL;
+CREATE INDEX IF NOT EXISTS products_category_id_idx ON products (category_id);
+
+DROP INDEX IF EXISTS products_category_idx;
+ALTER TABLE products DROP COLUMN category;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS product_images (
+    id bigserial PRIMARY KEY,
+    product_id bigint not null REFERENCES products ON DELETE CASCADE,
+    -- storage key of the original upload; thumbnails maps size names to keys
+    storage_key text not null,
+    thumbnails jsonb not null default '{}',
+    content_type text not null,
+    width integer not null,
+    height integer not null,
+    position integer not null,
+    is_primary boolean not null default false,
+    created_at timestamp(0) with time zone not null default NOW()
+);
+
+CREATE INDEX IF NOT EXISTS product_images_product_id_idx ON product_images (product_id, position);
+CREATE UNIQUE INDEX IF NOT EXISTS product_images_primary_idx ON product_images (product_id) WHERE is_primary;
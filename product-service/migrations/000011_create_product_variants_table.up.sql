@@ -0,0 +1,22 @@
+-- options is the product's option schema: a list of {"name": ..., "values": [...]}
+-- that every variant of the product picks one value from.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS options jsonb not null default '[]';
+
+CREATE TABLE IF NOT EXISTS product_variants (
+    id bigserial PRIMARY KEY,
+    product_id bigint not null REFERENCES products ON DELETE CASCADE,
+    sku varchar(64) not null UNIQUE,
+    -- option name -> chosen value
+    options jsonb not null,
+    -- overrides the product's price when set; always in the product's currency
+    price_minor bigint CHECK (price_minor >= 0),
+    quantity integer not null default 0 CHECK (quantity >= 0),
+    created_at timestamp(0) with time zone not null default NOW(),
+    version integer not null default 1,
+    UNIQUE (product_id, options)
+);
+
+-- Movements of a variant's stock carry its ID; product-level movements leave
+-- it null. Like product_id it has no foreign key, so the ledger outlives the
+-- variant.
+ALTER TABLE stock_movements ADD COLUMN IF NOT EXISTS variant_id bigint;
@@ -0,0 +1,3 @@
+DELETE FROM products WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS products_deleted_at_idx;
+ALTER TABLE products DROP COLUMN IF EXISTS deleted_at;
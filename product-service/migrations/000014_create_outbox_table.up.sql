@@ -0,0 +1,16 @@
+-- Messages are written here in the same transaction as the change they
+-- describe, and deleted once the relay has published them.
+CREATE TABLE IF NOT EXISTS outbox (
+    id bigserial PRIMARY KEY,
+    aggregate_id bigint not null,
+    exchange text not null,
+    routing_key text not null,
+    content_type text not null,
+    payload bytea not null,
+    created_at timestamp with time zone not null default NOW(),
+    attempts integer not null default 0,
+    next_attempt_at timestamp with time zone not null default NOW(),
+    last_error text not null default ''
+);
+
+CREATE INDEX IF NOT EXISTS outbox_aggregate_id_idx ON outbox (aggregate_id, id);
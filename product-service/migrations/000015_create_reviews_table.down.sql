@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS products_average_rating_idx;
+ALTER TABLE products DROP COLUMN IF EXISTS average_rating;
+ALTER TABLE products DROP COLUMN IF EXISTS review_count;
+ALTER TABLE products DROP COLUMN IF EXISTS rating_sum;
+DROP TABLE IF EXISTS reviews;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS reviews (
+    id bigserial PRIMARY KEY,
+    product_id bigint not null REFERENCES products ON DELETE CASCADE,
+    user_id bigint not null,
+    rating smallint not null CHECK (rating BETWEEN 1 AND 5),
+    title varchar(100) not null default '',
+    body text not null default '',
+    verified boolean not null default false,
+    status text not null default 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+    created_at timestamp(0) with time zone not null default NOW(),
+    updated_at timestamp(0) with time zone not null default NOW(),
+    version integer not null default 1,
+    UNIQUE (product_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_status_idx ON reviews (status, product_id, id);
+
+-- The sum and count of the ratings of approved reviews, kept up to date in
+-- the transactions that change reviews.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS rating_sum bigint not null default 0;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS review_count integer not null default 0;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS average_rating double precision GENERATED ALWAYS AS (
+    CASE WHEN review_count = 0 THEN 0 ELSE rating_sum::double precision / review_count END
+) STORED;
+
+CREATE INDEX IF NOT EXISTS products_average_rating_idx ON products (average_rating);
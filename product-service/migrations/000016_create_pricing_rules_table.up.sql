@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS pricing_rules (
+    id bigserial PRIMARY KEY,
+    name text not null,
+    scope text not null CHECK (scope IN ('product', 'category', 'catalog')),
+    product_id bigint REFERENCES products ON DELETE CASCADE,
+    category_id bigint REFERENCES categories ON DELETE CASCADE,
+    kind text not null CHECK (kind IN ('percent', 'fixed')),
+    percent_bps integer not null default 0,
+    amount_minor bigint not null default 0,
+    currency char(3) not null default '',
+    starts_at timestamp(0) with time zone not null,
+    ends_at timestamp(0) with time zone,
+    priority integer not null default 0,
+    created_at timestamp(0) with time zone not null default NOW(),
+    version integer not null default 1,
+    CHECK ((scope = 'product') = (product_id IS NOT NULL)),
+    CHECK ((scope = 'category') = (category_id IS NOT NULL)),
+    CHECK (kind <> 'percent' OR percent_bps BETWEEN 1 AND 10000),
+    CHECK (kind <> 'fixed' OR (amount_minor > 0 AND currency <> '')),
+    CHECK (ends_at IS NULL OR ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS pricing_rules_starts_at_idx ON pricing_rules (starts_at, ends_at);
@@ -0,0 +1,3 @@
+-- A relay claims messages for a while before publishing them outside any
+-- transaction; claims that run out are taken up by the next relay.
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS claimed_until timestamp with time zone;
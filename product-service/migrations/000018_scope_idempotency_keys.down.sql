@@ -0,0 +1,6 @@
+-- Keys only live for the idempotency window, so scoped keys that would clash
+-- once unscoped are dropped rather than merged.
+DELETE FROM idempotency_keys WHERE scope <> '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key);
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS scope;
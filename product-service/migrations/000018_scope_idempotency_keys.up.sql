@@ -0,0 +1,6 @@
+-- Keys are chosen by clients, so each client gets its own: two users sending
+-- the same key no longer see each other's products. The scope is the ID of the
+-- user the gateway authenticated, or empty for anonymous calls.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS scope text NOT NULL DEFAULT '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (scope, key);
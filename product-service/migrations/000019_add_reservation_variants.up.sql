@@ -0,0 +1,3 @@
+-- Products whose stock lives on their variants are reserved per variant. A
+-- deleted variant takes its stock with it, so its reservations go too.
+ALTER TABLE stock_reservations ADD COLUMN IF NOT EXISTS variant_id bigint REFERENCES product_variants ON DELETE CASCADE;
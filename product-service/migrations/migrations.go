@@ -0,0 +1,8 @@
+// Package migrations holds the service's schema migrations so the binary can
+// apply them itself.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// TestMigrationsPair checks that every embedded migration can be rolled back.
+func TestMigrationsPair(t *testing.T) {
+	source, err := iofs.New(FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	version, err := source.First()
+	for ; err == nil; version, err = source.Next(version) {
+		up, _, upErr := source.ReadUp(version)
+		if upErr != nil {
+			t.Errorf("version %d has no up migration: %v", version, upErr)
+		} else {
+			up.Close()
+		}
+		down, _, downErr := source.ReadDown(version)
+		if downErr != nil {
+			t.Errorf("version %d has no down migration: %v", version, downErr)
+		} else {
+			down.Close()
+		}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+}
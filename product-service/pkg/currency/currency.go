@@ -0,0 +1,29 @@
+// Package currency lists the currencies product-service supports. It is
+// exported so that the gateway, which converts between decimal amounts and
+// minor units, uses the same table.
+package currency
+
+// Default is used for products created without a currency, matching the
+// column default.
+const Default = "KZT"
+
+// exponents maps the supported ISO 4217 codes to the number of minor-unit
+// digits they use.
+var exponents = map[string]int{
+	"KZT": 2,
+	"RUB": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CNY": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+}
+
+// Exponent reports how many minor-unit digits code uses, and whether code is
+// supported at all.
+func Exponent(code string) (int, bool) {
+	exponent, ok := exponents[code]
+	return exponent, ok
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	cfg "github.com/Skaifai/gophers-microservice/user-service/config"
@@ -19,13 +22,31 @@ import (
 	user_storage "github.com/Skaifai/gophers-microservice/user-service/internal/app/storage/user/user"
 	"github.com/Skaifai/gophers-microservice/user-service/internal/lib/clients/psql"
 	jwtcodec "github.com/Skaifai/gophers-microservice/user-service/internal/lib/codec/jwt"
+	"github.com/Skaifai/gophers-microservice/user-service/internal/lib/e"
 	"github.com/Skaifai/gophers-microservice/user-service/internal/lib/mailer"
+	"github.com/Skaifai/gophers-microservice/user-service/internal/server/closer"
+	"github.com/Skaifai/gophers-microservice/user-service/internal/server/interceptors"
 	"github.com/Skaifai/gophers-microservice/user-service/pkg/proto"
 	"github.com/golang-jwt/jwt/v5"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	if cfg.DB.AUTO_MIGRATE {
+		if err := autoMigrate(cfg.DB.DSN); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 	db, err := psql.Connect(
@@ -39,7 +60,6 @@ func main() {
 	if err != nil {
 		log.Fatalf("can't connect to db: %v", err)
 	}
-	defer db.Close()
 
 	user_domain_storage := domain.NewPSQL(db)
 	user_auth_storage := auth.NewPSQL(db)
@@ -58,15 +78,75 @@ func main() {
 	usvc := user_service.New(user_domain_storage, user_auth_storage, user_profile_storage, user_globar_storage, mailService, token_service)
 	uhandler := user_handler.New(usvc)
 
-	srv := grpc.NewServer()
+	// Logging is outermost so that calls Recovery turns into Internal errors
+	// are logged too.
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		interceptors.Logging,
+		interceptors.Recovery,
+	))
+	healthServer := health.NewServer()
 	proto.RegisterUserServiceServer(srv, uhandler)
+	healthpb.RegisterHealthServer(srv, healthServer)
 	listen, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.SERVER.PORT))
 	if err != nil {
-		log.Fatalf("")
+		log.Fatalf("can't listen: %v", err)
 	}
 
+	// handlers run in order: stop taking traffic, let in-flight RPCs
+	// finish, then close the db they were using
+	c := closer.New()
+	c.Add(func(ctx context.Context) error {
+		healthServer.Shutdown()
+		return nil
+	})
+	c.Add(func(ctx context.Context) error {
+		return gracefulStop(ctx, srv, cfg.SERVER.GRACEFUL_STOP_TIMEOUT)
+	})
+	c.Add(func(ctx context.Context) error {
+		return e.WrapIfErr("can't close db", db.Close())
+	})
+
+	shutdownErr := make(chan error)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+		log.Printf("caught signal %s, shutting down\n", s)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.SERVER.SHUTDOWN_TIMEOUT)
+		defer cancel()
+
+		shutdownErr <- c.Close(ctx)
+	}()
+
 	log.Printf("Server started at:%d\n", cfg.SERVER.PORT)
 	if err = srv.Serve(listen); err != nil {
 		log.Fatalf("oops: %v", err)
 	}
+
+	if err = <-shutdownErr; err != nil {
+		log.Fatalf("%v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// gracefulStop waits up to timeout for in-flight RPCs and then cancels
+// whatever is still running.
+func gracefulStop(ctx context.Context, srv *grpc.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		return e.Wrap("in-flight RPCs cancelled", ctx.Err())
+	}
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+
+	cfg "github.com/Skaifai/gophers-microservice/user-service/config"
+	"github.com/Skaifai/gophers-microservice/user-service/internal/lib/e"
+	"github.com/Skaifai/gophers-microservice/user-service/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// migrationsTable keeps the user-service schema version apart from the
+// product-service one, which lives in the same database.
+const migrationsTable = "user_service_schema_migrations"
+
+var errMigrateUsage = errors.New("usage: migrate up | down | version | force VERSION")
+
+// runMigrate handles `migrate up`, `migrate down` and `migrate version`
+// against cfg.DB.DSN. The schema is small enough to step through one
+// migration at a time, so down only ever undoes the latest one; force marks
+// a dirty schema as clean once it has been repaired by hand.
+func runMigrate(args []string) (err error) {
+	defer func() { err = e.WrapIfErr("migrate", err) }()
+
+	var run func(m *migrate.Migrate) error
+	switch {
+	case len(args) == 1 && args[0] == "up":
+		run = (*migrate.Migrate).Up
+	case len(args) == 1 && args[0] == "down":
+		run = func(m *migrate.Migrate) error { return m.Steps(-1) }
+	case len(args) == 1 && args[0] == "version":
+		run = func(*migrate.Migrate) error { return nil }
+	case len(args) == 2 && args[0] == "force":
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return errMigrateUsage
+		}
+		run = func(m *migrate.Migrate) error { return m.Force(version) }
+	default:
+		return errMigrateUsage
+	}
+
+	m, err := openMigrations(cfg.DB.DSN)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err = run(m); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return printVersion(m)
+}
+
+// autoMigrate applies every pending migration before the server starts. The
+// driver holds an advisory lock while it migrates, so replicas started
+// together wait for each other and apply each migration once.
+func autoMigrate(dsn string) (err error) {
+	defer func() { err = e.WrapIfErr("can't migrate", err) }()
+
+	m, err := openMigrations(dsn)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return printVersion(m)
+}
+
+// openMigrations opens the embedded migrations on a connection pool of their
+// own, so closing them leaves the server's pool alone.
+func openMigrations(dsn string) (*migrate.Migrate, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, e.Wrap("can't open db", err)
+	}
+
+	driver, err := pgx.WithInstance(db, &pgx.Config{MigrationsTable: migrationsTable})
+	if err != nil {
+		db.Close()
+		return nil, e.Wrap("can't create driver", err)
+	}
+
+	source, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		driver.Close()
+		return nil, e.Wrap("can't read migrations", err)
+	}
+
+	m, err := migrate.NewWithInstance("iofs", source, "pgx", driver)
+	if err != nil {
+		driver.Close()
+		return nil, e.Wrap("can't create migrate", err)
+	}
+	return m, nil
+}
+
+// printVersion logs where the schema stands. A dirty schema is reported
+// rather than returned as an error, since force is how it gets fixed.
+func printVersion(m *migrate.Migrate) error {
+	version, dirty, err := m.Version()
+	switch {
+	case errors.Is(err, migrate.ErrNilVersion):
+		log.Println("schema: no migrations applied")
+	case err != nil:
+		return e.Wrap("can't read schema version", err)
+	case dirty:
+		log.Printf("schema: version %d, dirty (repair it, then run migrate force %d)\n", version, version)
+	default:
+		log.Printf("schema: version %d\n", version)
+	}
+	return nil
+}
@@ -40,14 +40,18 @@ func New(storage storage, access_codec codec, refresh_codec codec, refresh_expir
 	}
 }
 
+// TokenClaims are the claims of access and refresh tokens. Role is only set
+// on access tokens, which the gateway trusts to decide what a user may do.
 type TokenClaims struct {
 	UserID string `json:"user_id"`
+	Role   string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func (svc *service) GenerateAccess(userID string, loginTime time.Time) (string, error) {
+func (svc *service) GenerateAccess(userID string, role string, loginTime time.Time) (string, error) {
 	claims := &TokenClaims{
 		UserID: userID,
+		Role:   role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(svc.access_expiry)),
 			IssuedAt:  jwt.NewNumericDate(loginTime),
@@ -20,7 +20,7 @@ var (
 )
 
 type token_service interface {
-	GenerateAccess(userID string, loginTime time.Time) (string, error)
+	GenerateAccess(userID string, role string, loginTime time.Time) (string, error)
 	DecodeAccess(tokenString string) (*auth_tokens.TokenClaims, error)
 	GenerateRefresh(userID string, loginTime time.Time) (string, error)
 	DecodeRefresh(tokenString string) (*auth_tokens.TokenClaims, error)
@@ -246,7 +246,14 @@ func (svc *userService) Refresh(ctx context.Context, refreshToken string, userAg
 		return "", err
 	}
 
-	accessToken, err = svc.token_service.GenerateAccess(claims.UserID, claims.IssuedAt.Time)
+	// The role is looked up again so that a changed role takes effect on the
+	// next refresh rather than when the user next signs in.
+	a, err := svc.auth.GetAuth(ctx, claims.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	accessToken, err = svc.token_service.GenerateAccess(claims.UserID, a.Role, claims.IssuedAt.Time)
 	if err != nil {
 		return "", err
 	}
@@ -284,7 +291,7 @@ func (svc *userService) Login(ctx context.Context, key, userAgent, password stri
 
 	loginTime := time.Now()
 
-	accessToken, err = svc.token_service.GenerateAccess(u.ID, loginTime)
+	accessToken, err = svc.token_service.GenerateAccess(u.ID, a.Role, loginTime)
 	if err != nil {
 		return "", "", fmt.Errorf("unexpected error: %v\n", err)
 	}
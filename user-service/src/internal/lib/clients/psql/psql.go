@@ -46,10 +46,20 @@ func Connect(ctx context.Context, dsn string, maxIdleConns, maxOpenConns int, ma
 	return Db, nil
 }
 
-func (db *DB) Close() (err error) {
-	defer func() { err = db.client.Close() }()
-	defer func() { err = db.conn.Close() }()
-	return err
+// Close releases the dedicated connection before closing the pool it was
+// taken from.
+func (db *DB) Close() error {
+	connErr := db.conn.Close()
+	clientErr := db.client.Close()
+
+	if connErr != nil {
+		return fmt.Errorf("can't close connection: %v", connErr)
+	}
+	if clientErr != nil {
+		return fmt.Errorf("can't close db: %v", clientErr)
+	}
+
+	return nil
 }
 
 func (db *DB) Conn() *sqlx.Conn {